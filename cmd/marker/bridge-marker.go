@@ -1,28 +1,101 @@
 package main
 
 import (
+	"context"
 	goflag "flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/Acedus/bridge-marker-dp/pkg/config"
+	"github.com/Acedus/bridge-marker-dp/pkg/labeler"
+	"github.com/Acedus/bridge-marker-dp/pkg/metrics"
+	"github.com/Acedus/bridge-marker-dp/pkg/nad"
+	"github.com/Acedus/bridge-marker-dp/pkg/notify"
 	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"github.com/Acedus/bridge-marker-dp/pkg/podresources"
 	flag "github.com/spf13/pflag"
 	"kubevirt.io/client-go/log"
 )
 
-const (
-	// The Linux kernel has a default hardcoded parameter BR_PORT_BITS = 10.
-	// This means that the maximum number of ports allowed on a bridge is 1024 (2^10 = 1024).
-	maxDevices = 1024
-)
-
-var defaultBackoffTime = []time.Duration{1 * time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second}
+// defaultShutdownTimeout stays below the default terminationGracePeriodSeconds of 30s.
+const defaultShutdownTimeout = 25 * time.Second
 
 type bridgeMarkerApp struct {
-	startedPluginMutex sync.Mutex
-	maxDevices         int
-	backoff            []time.Duration
-	stop               chan struct{}
+	startedPluginMutex  sync.Mutex
+	maxDevices          int
+	resourceNamespace   string
+	socketPrefix        string
+	registrationMode    string
+	pluginsRegistryDir  string
+	devicePluginDir     string
+	kubeletSocket       string
+	socketMode          string
+	socketOwner         string
+	restartBackoff      string
+	loopStallThreshold  time.Duration
+	bridgeVariants      []string
+	maxDevicesPerBridge []string
+	bridgeMaxDevices    map[string]int
+	bridges             []string
+	configFile          string
+	nadDiscovery        bool
+	nadNamespace        string
+	// filterLock guards the inputs of the bridge filter that change while running
+	filterLock            sync.Mutex
+	nadBridges            []string
+	activeConfig          *config.Config
+	bridgeIncludeRegex    string
+	bridgeExcludeRegex    string
+	exposeAllBridges      bool
+	filterMatch           string
+	requireUplink         bool
+	includeEnslaved       bool
+	enableOVSBridges      bool
+	enableBonds           bool
+	bondMaxDevices        int
+	bondMinActiveSlaves   int
+	enableVLANs           bool
+	bridgeVLANs           bool
+	bridgeVLANMaxDevices  int
+	netns                 string
+	fastRestart           bool
+	shutdownTimeout       time.Duration
+	dryRun                bool
+	output                string
+	probeAddr             string
+	metricsAddr           string
+	grpcMetrics           bool
+	podResourcesSocket    string
+	allocationInterval    time.Duration
+	pprofAddr             string
+	allocationEnvs        bool
+	allocationAnnotations bool
+	healthHistorySize     int
+	healthMode            string
+	healthCheckMode       string
+	linkPollInterval      time.Duration
+	requireUpPort         bool
+	portCapacity          bool
+	numaTopology          bool
+	preStartCheck         bool
+	healthDebounce        time.Duration
+	debounceUnhealthy     bool
+	nodeName              string
+	nodeLabels            bool
+	notifyURL             string
+	notifyExec            string
+	discoveryTimeout      time.Duration
+	resyncPeriod          time.Duration
+	drainGracePeriod      time.Duration
+	deregistrationTimeout time.Duration
+	gracefulStopTimeout   time.Duration
+	maxConcurrentStarts   int
 }
 
 func (app *bridgeMarkerApp) InitFlags() {
@@ -31,37 +104,585 @@ func (app *bridgeMarkerApp) InitFlags() {
 
 func (app *bridgeMarkerApp) AddFlags() {
 	app.InitFlags()
-	flag.IntVar(&app.maxDevices, "max-devices", maxDevices,
-		"The maximum number of connected devices to the bridge")
+	flag.IntVar(&app.maxDevices, "max-devices", plugin.MaxBridgePorts,
+		"The maximum number of connected devices to the bridge, reduced to the port limit of the bridge")
+	flag.StringVar(&app.resourceNamespace, "resource-namespace", plugin.DeviceNamespace,
+		"The domain bridge resources are advertised under, e.g. net.example.com for net.example.com/br0")
+	flag.StringVar(&app.socketPrefix, "socket-prefix", plugin.DefaultSocketPrefix,
+		"Prefix of the device plugin socket file names, e.g. to run several markers side by side")
+	flag.StringVar(&app.registrationMode, "registration-mode", string(plugin.RegistrationModeLegacy),
+		"How device plugins register with kubelet: legacy (through kubelet.sock), pluginwatcher (through the plugins registry) or auto (pluginwatcher, falling back to legacy)")
+	flag.StringVar(&app.pluginsRegistryDir, "plugins-registry-dir", plugin.PluginsRegistryPath,
+		"The directory kubelet's plugin watcher discovers plugin sockets in, used by the pluginwatcher and auto registration modes")
+	flag.StringVar(&app.devicePluginDir, "device-plugin-dir", plugin.DefaultDevicePluginDir,
+		"The directory kubelet expects device plugin sockets in, e.g. for distributions with a non-standard kubelet root")
+	flag.StringVar(&app.kubeletSocket, "kubelet-socket", "",
+		"The kubelet registration socket, defaults to kubelet.sock in the device plugin directory")
+	flag.StringVar(&app.socketMode, "socket-mode", fmt.Sprintf("%#o", plugin.DefaultSocketMode),
+		"The octal permissions of the device plugin sockets")
+	flag.StringVar(&app.socketOwner, "socket-owner", "",
+		"Change the owner of the device plugin sockets to <uid>:<gid>, either may be left empty to keep it")
+	flag.DurationVar(&app.loopStallThreshold, "loop-stall-threshold", plugin.DefaultLoopStallThreshold,
+		"Event loop iteration gap after which a stall warning with a goroutine dump is logged, 0 disables it")
+	flag.StringSliceVar(&app.maxDevicesPerBridge, "max-devices-per-bridge", nil,
+		"Device counts of single bridges overriding --max-devices, e.g. br-storage=512,br-mgmt=4, bridges may appear later")
+	flag.StringSliceVar(&app.bridgeVariants, "bridge-variants", nil,
+		"Additional named sub-resources per bridge with their own device count, e.g. br0/trunk=16")
+	flag.StringVar(&app.configFile, "config", "",
+		"YAML configuration file with default and per-bridge settings, changes are applied without a restart")
+	flag.BoolVar(&app.nadDiscovery, "nad-discovery", false,
+		"Expose exactly the bridges referenced by NetworkAttachmentDefinitions using the bridge CNI plugin, missing ones as unhealthy")
+	flag.StringVar(&app.nadNamespace, "nad-namespace", "",
+		"The namespace whose NetworkAttachmentDefinitions are watched, all namespaces when empty")
+	flag.StringSliceVar(&app.bridges, "bridges", nil,
+		"Expose exactly these bridges without discovering others, missing ones are exposed as unhealthy until they are created")
+	flag.StringVar(&app.bridgeIncludeRegex, "bridge-include-regex", "",
+		"Only expose bridges whose name matches the regular expression, e.g. ^br-tenant-")
+	flag.StringVar(&app.bridgeExcludeRegex, "bridge-exclude-regex", "",
+		"Don't expose bridges whose name matches the regular expression, takes precedence over the include regex")
+	flag.BoolVar(&app.requireUplink, "require-uplink", false,
+		"Only expose bridges with a physical device among their ports, bridges appear once an uplink is attached")
+	flag.BoolVar(&app.includeEnslaved, "include-enslaved-bridges", false,
+		"Also expose bridges enslaved to another interface, e.g. to a bond or another bridge")
+	flag.BoolVar(&app.exposeAllBridges, "expose-all-bridges", false,
+		"Also expose well-known infrastructure bridges, e.g. docker0, cni0 and virbr0, which are excluded by default")
+	flag.StringVar(&app.filterMatch, "filter-match", string(plugin.FilterMatchPrimaryOnly),
+		"Which names of a bridge the regexes and bridge settings are matched against: primary-only, its kernel name, or any, also its alternative names, "+
+			"hiding a bridge when any of its names is hidden")
+	flag.BoolVar(&app.enableOVSBridges, "enable-ovs-bridges", false,
+		"Also expose Open vSwitch bridges, use the exclude regex to keep e.g. br-int from being exposed")
+	flag.BoolVar(&app.enableBonds, "enable-bonds", false,
+		"Also expose bond interfaces, as "+plugin.BondNamespace+"/<bond>")
+	flag.IntVar(&app.bondMaxDevices, "bond-max-devices", plugin.DefaultBondMaxDevices,
+		"The number of devices advertised per bond")
+	flag.IntVar(&app.bondMinActiveSlaves, "bond-min-active-slaves", 0,
+		"Consider a bond unhealthy unless at least this many of its slaves are up, 0 only checks the bond itself")
+	flag.BoolVar(&app.enableVLANs, "enable-vlans", false,
+		"Also expose VLAN sub-interfaces, e.g. eth0.100 as eth0-100")
+	flag.BoolVar(&app.bridgeVLANs, "bridge-vlans", false,
+		"Also expose every VLAN trunked on the uplinks of VLAN-filtering bridges, e.g. VLAN 100 of br0 as br0.vlan100")
+	flag.IntVar(&app.bridgeVLANMaxDevices, "bridge-vlan-max-devices", 0,
+		"The number of devices advertised per bridge VLAN, 0 uses the port slots the bridge has left")
+	flag.StringVar(&app.netns, "netns", "",
+		"Monitor the bridges of this network namespace, a path to a netns file or a name in "+plugin.NetnsRunDir+", instead of the marker's own")
+	flag.DurationVar(&app.shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout,
+		"How long the plugins get to drain and deregister on SIGTERM or SIGINT before the marker exits anyway, keep it below the pod's terminationGracePeriodSeconds")
+	flag.BoolVar(&app.dryRun, "dry-run", false,
+		"Print the bridges that would be exposed, their resources, device counts and initial health, and exit without registering anything")
+	flag.StringVar(&app.output, "output", outputTable,
+		"The output format of --dry-run, "+outputTable+" or "+outputJSON)
+	flag.StringVar(&app.probeAddr, "probe-addr", "",
+		"Address serving the /healthz liveness and /readyz readiness probes, e.g. :8081, disabled when empty")
+	flag.StringVar(&app.metricsAddr, "metrics-addr", "",
+		"Address serving Prometheus metrics on /metrics, e.g. :8080, it may equal --probe-addr, disabled when empty")
+	flag.BoolVar(&app.grpcMetrics, "grpc-metrics", false,
+		"Export the count, status codes and latency of the RPCs kubelet sends to the plugins, requires --metrics-addr")
+	flag.DurationVar(&app.allocationInterval, "allocation-poll-interval", 0,
+		"How often allocated devices are counted through the kubelet PodResources API for the bridge_marker_devices_allocated metric, e.g. 1m, disabled when 0, requires --metrics-addr")
+	flag.StringVar(&app.podResourcesSocket, "pod-resources-socket", podresources.DefaultSocket,
+		"The kubelet PodResources socket allocated devices are counted through")
+	flag.StringVar(&app.pprofAddr, "pprof-addr", "",
+		"Loopback address serving net/http/pprof, e.g. localhost:6060, disabled when empty")
+	flag.BoolVar(&app.fastRestart, "fast-restart", false,
+		"Keep sockets and registrations on shutdown and reclaim leftover sockets on startup, so quick restarts go unnoticed by kubelet")
+	flag.BoolVar(&app.allocationEnvs, "allocation-envs", false,
+		"Set environment variables naming the granted bridge and device IDs in containers")
+	flag.BoolVar(&app.allocationAnnotations, "allocation-annotations", false,
+		"Annotate allocations with the bridge's MTU, MAC address and ifindex")
+	flag.StringVar(&app.healthMode, "health-mode", string(plugin.HealthModeOperUp),
+		"What makes a bridge healthy: oper-up (operationally up), admin-up (administratively up) or exists")
+	flag.StringVar(&app.healthCheckMode, "health-check-mode", string(plugin.LinkWatchAuto),
+		"How health checks and discovery follow link changes: subscribe (netlink link updates), poll (list the links every --poll-interval) or auto (subscribe, falling back to polling)")
+	flag.DurationVar(&app.linkPollInterval, "poll-interval", plugin.DefaultLinkPollInterval,
+		"How often links are listed when they are polled")
+	flag.BoolVar(&app.requireUpPort, "require-up-port", false,
+		"Consider a bridge unhealthy unless at least one of its ports is up")
+	flag.BoolVar(&app.portCapacity, "port-capacity", false,
+		"Reduce the advertised devices by the ports a bridge already has, e.g. taps created outside Kubernetes")
+	flag.BoolVar(&app.numaTopology, "numa-topology", false,
+		"Report the NUMA nodes of a bridge's physical uplinks as device topology")
+	flag.BoolVar(&app.preStartCheck, "pre-start-check", false,
+		"Fail containers whose bridge is gone or unhealthy when they start")
+	flag.DurationVar(&app.healthDebounce, "health-debounce", 0,
+		"How long a bridge health change must be stable before kubelet is updated, 0 updates it right away")
+	flag.BoolVar(&app.debounceUnhealthy, "health-debounce-unhealthy", false,
+		"Debounce changes to unhealthy as well, by default only recoveries are debounced")
+	flag.IntVar(&app.healthHistorySize, "health-history-size", plugin.DefaultHealthHistorySize,
+		"The number of health transitions kept in memory per bridge")
+	flag.StringVar(&app.nodeName, "node-name", os.Getenv("NODE_NAME"),
+		"The name of the node, defaults to the NODE_NAME environment variable or the hostname")
+	flag.BoolVar(&app.nodeLabels, "node-labels", false,
+		"Label the node with <resource namespace>/<bridge>=true for every healthy bridge, like the original bridge-marker, requires the node name and an in-cluster service account")
+	flag.StringVar(&app.notifyURL, "notify-url", "",
+		"URL to POST a JSON payload to whenever a bridge resource changes health")
+	flag.StringVar(&app.notifyExec, "notify-exec", "",
+		"Command to run with a JSON payload on stdin whenever a bridge resource changes health")
+	flag.DurationVar(&app.discoveryTimeout, "discovery-timeout", plugin.DefaultDiscoveryTimeout,
+		"Deadline for a bridge discovery pass, bridges found until then are exposed")
+	flag.DurationVar(&app.drainGracePeriod, "drain-grace-period", plugin.DefaultDrainGracePeriod,
+		"How long devices are reported unhealthy on shutdown before the device plugins stop, 0 disables draining")
+	flag.DurationVar(&app.deregistrationTimeout, "deregistration-timeout", plugin.DefaultDeregistrationTimeout,
+		"How long a stopping device plugin waits for kubelet to receive its empty device list")
+	flag.DurationVar(&app.gracefulStopTimeout, "graceful-stop-timeout", plugin.DefaultGracefulStopTimeout,
+		"How long in-flight requests, e.g. allocations, may take when a device plugin stops")
+	flag.IntVar(&app.maxConcurrentStarts, "max-concurrent-starts", plugin.DefaultMaxConcurrentStarts,
+		"The maximum number of device plugins registering with kubelet at once, 0 is unbounded")
+	flag.StringVar(&app.restartBackoff, "restart-backoff",
+		fmt.Sprintf("%v/%v", plugin.DefaultBackoff.Base, plugin.DefaultBackoff.Cap),
+		"Waits before restarting a failed device plugin or retrying its registration, either a comma separated list, e.g. 1s,2s,5s,10s, or exponential as <base>/<max>")
+	flag.DurationVar(&app.resyncPeriod, "resync-period", plugin.DefaultResyncPeriod,
+		"Interval of full bridge resyncs that recover from missed netlink events, 0 disables them")
 }
 
-func (app *bridgeMarkerApp) Run() {
+func (app *bridgeMarkerApp) Run(ctx context.Context) {
 	logger := log.DefaultLogger()
-	bridgeDevices, err := plugin.GetBridgeDevicePlugins(app.maxDevices)
+	pluginOptions := []plugin.PluginOption{
+		plugin.WithLoopStallThreshold(app.loopStallThreshold),
+		plugin.WithHealthHistorySize(app.healthHistorySize),
+		plugin.WithHealthDebounce(app.healthDebounce, app.debounceUnhealthy),
+		plugin.WithDeregistrationTimeout(app.deregistrationTimeout),
+		plugin.WithGracefulStopTimeout(app.gracefulStopTimeout),
+	}
+	controllerOptions := []plugin.ControllerOption{
+		plugin.WithControllerLoopStallThreshold(app.loopStallThreshold),
+		plugin.WithDiscoveryTimeout(app.discoveryTimeout),
+		plugin.WithResyncPeriod(app.resyncPeriod),
+		plugin.WithDrainGracePeriod(app.drainGracePeriod),
+		plugin.WithMaxConcurrentStarts(app.maxConcurrentStarts),
+	}
+	if app.allocationEnvs {
+		pluginOptions = append(pluginOptions, plugin.WithAllocationEnvs())
+	}
+	if app.allocationAnnotations {
+		pluginOptions = append(pluginOptions, plugin.WithAllocationAnnotations())
+	}
+	if app.requireUpPort {
+		pluginOptions = append(pluginOptions, plugin.WithRequireUpPort())
+	}
+	if app.portCapacity {
+		pluginOptions = append(pluginOptions, plugin.WithPortCapacity())
+	}
+	if app.numaTopology {
+		pluginOptions = append(pluginOptions, plugin.WithNUMATopology())
+	}
+	if app.preStartCheck {
+		pluginOptions = append(pluginOptions, plugin.WithPreStartCheck())
+	}
+	if app.grpcMetrics {
+		if app.metricsAddr == "" {
+			err := fmt.Errorf("--grpc-metrics requires --metrics-addr")
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+		pluginOptions = append(pluginOptions, plugin.WithServerMetrics(plugin.NewServerMetrics(metrics.Default)))
+	}
+	if app.fastRestart {
+		pluginOptions = append(pluginOptions, plugin.WithFastRestart())
+		controllerOptions = append(controllerOptions, plugin.WithKeepRegistrationOnShutdown())
+	}
+
+	if notifier := app.newNotifier(); notifier != nil {
+		go notifier.Run(ctx.Done())
+		pluginOptions = append(pluginOptions, plugin.WithHealthNotifier(notifier))
+	}
+
+	variants, err := parseBridgeVariants(app.bridgeVariants)
+	if err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+
+	if app.bridgeMaxDevices, err = parseMaxDevicesPerBridge(app.maxDevicesPerBridge); err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+
+	if app.configFile != "" {
+		if app.activeConfig, err = config.Load(app.configFile); err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+	}
+	bridgeFilter, err := app.newBridgeFilter()
+	if err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+	if app.pprofAddr != "" {
+		if app.pprofAddr, err = pprofAddr(app.pprofAddr); err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+	}
+	if len(app.bridges) > 0 && app.nadDiscovery {
+		err := fmt.Errorf("--bridges can't be combined with --nad-discovery")
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+	if len(app.bridges) > 0 || app.nadDiscovery {
+		controllerOptions = append(controllerOptions, plugin.WithDynamicDiscovery(false))
+	}
+	if app.dryRun {
+		if err := validateOutput(app.output); err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+		if app.nadDiscovery {
+			err := fmt.Errorf("--dry-run can't be combined with --nad-discovery")
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+	}
+	if app.allocationInterval < 0 || (app.allocationInterval > 0 && app.metricsAddr == "") {
+		err := fmt.Errorf("--allocation-poll-interval must not be negative and requires --metrics-addr")
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+	nodeName, nodeNameErr := resolveNodeName(app.nodeName, os.Hostname)
+	if app.nodeLabels && nodeNameErr != nil {
+		err := fmt.Errorf("--node-labels requires the node name: %v", nodeNameErr)
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+	app.nodeName = nodeName
+	var nadWatcher *nad.Watcher
+	if app.nadDiscovery {
+		if nadWatcher, err = nad.NewInClusterWatcher(app.nadNamespace); err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+	}
+
+	if err := plugin.ValidateResourceNamespace(app.resourceNamespace); err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+	pluginOptions = append(pluginOptions, plugin.WithResourceNamespace(app.resourceNamespace))
+
+	if err := plugin.ValidateSocketPrefix(app.socketPrefix); err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+	pluginOptions = append(pluginOptions, plugin.WithSocketPrefix(app.socketPrefix))
+
+	if !app.dryRun {
+		if err := plugin.EnsureDevicePluginDir(app.devicePluginDir); err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+	}
+	pluginOptions = append(pluginOptions, plugin.WithDevicePluginDir(app.devicePluginDir))
+	if app.kubeletSocket != "" {
+		pluginOptions = append(pluginOptions, plugin.WithKubeletSocket(app.kubeletSocket))
+	}
+
+	socketMode, err := parseSocketMode(app.socketMode)
+	if err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+	pluginOptions = append(pluginOptions, plugin.WithSocketMode(socketMode))
+	if app.socketOwner != "" {
+		uid, gid, err := parseSocketOwner(app.socketOwner)
+		if err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+		pluginOptions = append(pluginOptions, plugin.WithSocketOwner(uid, gid))
+	}
+
+	registrationMode, err := plugin.ParseRegistrationMode(app.registrationMode)
+	if err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+	pluginOptions = append(pluginOptions, plugin.WithRegistrationMode(registrationMode), plugin.WithPluginsRegistryDir(app.pluginsRegistryDir))
+
+	healthMode, err := plugin.ParseHealthMode(app.healthMode)
 	if err != nil {
 		logger.Errorf("bridge-marker couldn't start: %v", err)
 		panic(err)
 	}
+	pluginOptions = append(pluginOptions, plugin.WithHealthMode(healthMode))
+
+	backoff, err := parseBackoff(app.restartBackoff)
+	if err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+	pluginOptions = append(pluginOptions, plugin.WithRegistrationBackoff(backoff))
+
+	linkWatchMode, err := plugin.ParseLinkWatchMode(app.healthCheckMode)
+	if err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+	if err := plugin.SetLinkWatchMode(linkWatchMode, app.linkPollInterval); err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+
+	if app.netns != "" {
+		if err := plugin.SetNetworkNamespace(app.netns); err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+	}
+
+	var bridgeDevices []plugin.Device
+	if bridgeFilter.Bridges != nil {
+		bridgeDevices, err = plugin.GetListedBridgeDevicePlugins(app.maxDevices, variants, bridgeFilter, pluginOptions...)
+	} else {
+		discoveryCtx, cancel := context.WithTimeout(ctx, app.discoveryTimeout)
+		bridgeDevices, err = plugin.GetBridgeDevicePlugins(discoveryCtx, app.maxDevices, variants, bridgeFilter, pluginOptions...)
+		cancel()
+	}
+	if err != nil {
+		logger.Errorf("bridge-marker couldn't start: %v", err)
+		panic(err)
+	}
+
+	if app.dryRun {
+		if err := printDryRun(os.Stdout, bridgeDevices, app.output); err != nil {
+			logger.Errorf("bridge-marker couldn't print the dry run: %v", err)
+			panic(err)
+		}
+		return
+	}
 
 	if len(bridgeDevices) == 0 {
-		logger.Warning("no bridge devices found on node.")
+		if len(app.bridges) > 0 || app.nadDiscovery {
+			logger.Warning("no bridge devices found on node.")
+		} else {
+			logger.Warning("no bridge devices found on node, bridges created later are exposed as they appear.")
+		}
+	}
+
+	controllerOptions = append(controllerOptions,
+		plugin.WithPluginOptions(pluginOptions...),
+		plugin.WithBridgeVariants(variants),
+		plugin.WithBackoff(backoff),
+		plugin.WithBridgeFilter(bridgeFilter),
+	)
+	bridgeDeviceController := plugin.NewBridgeDeviceController(bridgeDevices, app.maxDevices, controllerOptions...)
+	go refreshOnSignal(ctx, bridgeDeviceController)
+	go dumpStatusOnSignal(ctx, bridgeDeviceController)
+	if nadWatcher != nil {
+		go nadWatcher.Run(ctx, func(bridges []string) {
+			logger.Infof("NetworkAttachmentDefinitions reference bridges %v", bridges)
+			err := app.updateBridgeFilter(bridgeDeviceController, func() { app.nadBridges = bridges })
+			if err != nil {
+				logger.Reason(err).Error("could not apply the bridges of the NetworkAttachmentDefinitions")
+			}
+		})
+	}
+	if app.nodeLabels {
+		nodeLabeler, err := labeler.NewInClusterLabeler(app.nodeName, app.resourceNamespace, bridgeDeviceController.Status)
+		if err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+		go func() {
+			// Labels of bridges without a plugin are removed, so wait until the plugins run
+			select {
+			case <-bridgeDeviceController.PluginsStarted():
+				nodeLabeler.Run(ctx)
+			case <-ctx.Done():
+			}
+		}()
+	}
+	if app.allocationInterval > 0 {
+		poller, err := podresources.NewPoller(app.podResourcesSocket, app.resourceNamespace, app.allocationInterval, bridgeDeviceController.Status)
+		if err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+		go poller.Run(ctx)
+	}
+	if app.activeConfig != nil {
+		err := config.Watch(ctx, app.configFile, app.activeConfig, func(changed *config.Config) error {
+			return app.updateBridgeFilter(bridgeDeviceController, func() { app.activeConfig = changed })
+		})
+		if err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+	}
+
+	muxes := map[string]*http.ServeMux{}
+	if app.probeAddr != "" {
+		registerProbes(serveMux(muxes, app.probeAddr), bridgeDeviceController)
+	}
+	if app.metricsAddr != "" {
+		serveMux(muxes, app.metricsAddr).Handle("/metrics", metrics.Default)
+	}
+	for addr, mux := range muxes {
+		stopServer, err := startHTTPServer(addr, mux)
+		if err != nil {
+			logger.Errorf("bridge-marker couldn't start: %v", err)
+			panic(err)
+		}
+		defer stopServer()
 	}
 
-	bridgeDeviceController := plugin.NewBridgeDeviceController(bridgeDevices, app.maxDevices)
+	if app.pprofAddr != "" {
+		// Profiling is started after the plugins, so it never delays their registration
+		pprofCtx, stopPprof := context.WithCancel(ctx)
+		pprofStopped := make(chan struct{})
+		defer func() {
+			stopPprof()
+			<-pprofStopped
+		}()
+		go func() {
+			defer close(pprofStopped)
+			select {
+			case <-bridgeDeviceController.PluginsStarted():
+			case <-pprofCtx.Done():
+				return
+			}
+			stopServer, err := startHTTPServer(app.pprofAddr, newPprofMux())
+			if err != nil {
+				logger.Reason(err).Error("could not serve pprof")
+				return
+			}
+			<-pprofCtx.Done()
+			stopServer()
+		}()
+	}
+
+	if err := bridgeDeviceController.Run(ctx); err != nil {
+		logger.Reason(err).Error("bridge-marker device plugin controller failed")
+	}
+}
+
+// updateBridgeFilter applies a change of the configuration file or of the NADs to the controller.
+// Changes are applied one at a time and a change resulting in an invalid filter is reverted.
+func (app *bridgeMarkerApp) updateBridgeFilter(controller *plugin.BridgeDeviceController, change func()) error {
+	app.filterLock.Lock()
+	defer app.filterLock.Unlock()
+	activeConfig, nadBridges := app.activeConfig, app.nadBridges
+	change()
+	filter, err := app.newBridgeFilter()
+	if err != nil {
+		app.activeConfig, app.nadBridges = activeConfig, nadBridges
+		return err
+	}
+	return controller.SetBridgeFilter(filter)
+}
+
+// newBridgeFilter builds the bridge filter from the flags, the active configuration file and
+// the bridges of the NADs. After startup it must be called with filterLock held.
+func (app *bridgeMarkerApp) newBridgeFilter() (*plugin.BridgeFilter, error) {
+	bridgeFilter, err := plugin.NewBridgeFilter(app.bridgeIncludeRegex, app.bridgeExcludeRegex, !app.exposeAllBridges)
+	if err != nil {
+		return nil, err
+	}
+	if bridgeFilter.MatchPolicy, err = plugin.ParseFilterMatchPolicy(app.filterMatch); err != nil {
+		return nil, err
+	}
+	if len(app.bridges) > 0 {
+		if err := bridgeFilter.SetBridges(app.bridges); err != nil {
+			return nil, err
+		}
+	}
+	if app.nadDiscovery {
+		if err := bridgeFilter.SetBridges(app.nadBridges); err != nil {
+			return nil, err
+		}
+	}
+	bridgeFilter.Settings = make(map[string]plugin.BridgeSettings, len(app.bridgeMaxDevices))
+	for name, maxDevices := range app.bridgeMaxDevices {
+		bridgeFilter.Settings[name] = plugin.BridgeSettings{MaxDevices: maxDevices}
+	}
+	bridgeFilter.OVSBridges = app.enableOVSBridges
+	bridgeFilter.VLANs = app.enableVLANs
+	bridgeFilter.RequireUplink = app.requireUplink
+	bridgeFilter.IncludeEnslaved = app.includeEnslaved
+	if app.bridgeVLANs {
+		bridgeFilter.BridgeVLANs = &plugin.BridgeVLANConfig{MaxDevices: app.bridgeVLANMaxDevices}
+	}
+	if app.enableBonds {
+		bridgeFilter.Bonds = &plugin.BondConfig{MaxDevices: app.bondMaxDevices, MinActiveSlaves: app.bondMinActiveSlaves}
+	}
+	if app.activeConfig != nil {
+		if err := app.activeConfig.Apply(bridgeFilter); err != nil {
+			return nil, err
+		}
+	}
+	return bridgeFilter, nil
+}
+
+// refreshOnSignal reconciles the device plugins with the node's bridges on every SIGHUP.
+func refreshOnSignal(ctx context.Context, controller plugin.BridgeDeviceControllerInterface) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			log.DefaultLogger().Info("received SIGHUP, refreshing bridge devices")
+			if err := controller.RefreshDevices(); err != nil {
+				log.DefaultLogger().Reason(err).Error("refreshing bridge devices failed")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (app *bridgeMarkerApp) newNotifier() *notify.Notifier {
+	var senders []notify.Sender
+	if app.notifyURL != "" {
+		senders = append(senders, &notify.HTTPSender{URL: app.notifyURL})
+	}
+	if command := strings.Fields(app.notifyExec); len(command) > 0 {
+		senders = append(senders, &notify.ExecSender{Command: command})
+	}
+	if len(senders) == 0 {
+		return nil
+	}
+
+	return notify.NewNotifier(app.nodeName, senders)
+}
+
+// shutdownOnSignal cancels the marker on the first SIGTERM or SIGINT, so the plugins are drained
+// and deregistered. A second signal, or a shutdown outlasting the timeout, exits immediately.
+func shutdownOnSignal(cancel context.CancelFunc, timeout time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
-	go bridgeDeviceController.Run(app.stop)
+	sig := <-signals
+	log.DefaultLogger().Infof("received %v, shutting down", sig)
+	cancel()
 
-	<-app.stop
+	select {
+	case sig = <-signals:
+		log.DefaultLogger().Warningf("received %v again, exiting immediately", sig)
+	case <-time.After(timeout):
+		log.DefaultLogger().Warningf("shutdown didn't finish within %v, exiting", timeout)
+	}
+	os.Exit(1)
 }
 
 func main() {
-	app := &bridgeMarkerApp{
-		stop:    make(chan struct{}),
-		backoff: defaultBackoffTime,
+	if len(os.Args) > 1 && os.Args[1] == "resources" {
+		if err := runResources(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "bridge-marker resources: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
+
+	app := &bridgeMarkerApp{}
 	app.AddFlags()
 
 	flag.Parse()
 
-	app.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go shutdownOnSignal(cancel, app.shutdownTimeout)
+	// Run returns once the controller has drained and stopped every plugin
+	app.Run(ctx)
+	log.DefaultLogger().Info("bridge-marker shut down")
 }
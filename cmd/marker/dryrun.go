@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// dryRunEntry describes a plugin the marker would start.
+type dryRunEntry struct {
+	Bridge   string `json:"bridge"`
+	Resource string `json:"resource"`
+	Devices  int    `json:"devices"`
+	Health   string `json:"health"`
+	Socket   string `json:"socket"`
+}
+
+func validateOutput(output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("unknown output format %q, expected %s or %s", output, outputTable, outputJSON)
+	}
+	return nil
+}
+
+// printDryRun prints the plugins that would be started with their initial health, without starting them.
+func printDryRun(w io.Writer, devices []plugin.Device, output string) error {
+	entries := make([]dryRunEntry, 0, len(devices))
+	for _, dev := range devices {
+		entry := dryRunEntry{Bridge: dev.GetDeviceName(), Resource: dev.GetResourceName(), Socket: dev.GetSocketPath()}
+		_, entry.Devices = dev.HealthSummary()
+		reason, err := dev.CurrentHealth()
+		if err != nil {
+			entry.Health = fmt.Sprintf("unknown: %v", err)
+		} else {
+			entry.Health = string(reason)
+		}
+		entries = append(entries, entry)
+	}
+
+	if output == outputJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "BRIDGE\tRESOURCE\tDEVICES\tHEALTH\tSOCKET")
+	for _, entry := range entries {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\n", entry.Bridge, entry.Resource, entry.Devices, entry.Health, entry.Socket)
+	}
+	return table.Flush()
+}
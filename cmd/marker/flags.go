@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+)
+
+// parseBridgeVariants parses entries of the form <bridge>/<variant>=<max devices>.
+func parseBridgeVariants(entries []string) (map[string][]plugin.BridgeVariant, error) {
+	variants := map[string][]plugin.BridgeVariant{}
+	for _, entry := range entries {
+		spec, count, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid bridge variant %q, expected <bridge>/<variant>=<max devices>", entry)
+		}
+		bridge, name, found := strings.Cut(spec, "/")
+		if !found || bridge == "" || name == "" {
+			return nil, fmt.Errorf("invalid bridge variant %q, expected <bridge>/<variant>=<max devices>", entry)
+		}
+		maxDevices, err := strconv.Atoi(count)
+		if err != nil || maxDevices <= 0 {
+			return nil, fmt.Errorf("invalid device count in bridge variant %q", entry)
+		}
+		for _, existing := range variants[bridge] {
+			if existing.Name == name {
+				return nil, fmt.Errorf("duplicate bridge variant %q", spec)
+			}
+		}
+		variants[bridge] = append(variants[bridge], plugin.BridgeVariant{Name: name, MaxDevices: maxDevices})
+	}
+	return variants, nil
+}
+
+// parseMaxDevicesPerBridge parses device count overrides of single bridges, e.g. br-storage=512.
+func parseMaxDevicesPerBridge(entries []string) (map[string]int, error) {
+	ret := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		bridge, count, found := strings.Cut(entry, "=")
+		if !found || bridge == "" {
+			return nil, fmt.Errorf("invalid device count override %q, expected <bridge>=<max devices>", entry)
+		}
+		maxDevices, err := strconv.Atoi(count)
+		if err != nil || maxDevices <= 0 {
+			return nil, fmt.Errorf("invalid device count in override %q", entry)
+		}
+		if _, exists := ret[bridge]; exists {
+			return nil, fmt.Errorf("duplicate device count override for bridge %s", bridge)
+		}
+		ret[bridge] = maxDevices
+	}
+	return ret, nil
+}
+
+// parseBackoff parses either a comma separated list of waits, e.g. 1s,2s,5s,10s,
+// or an exponential backoff in the form <base>/<max>, e.g. 1s/30s.
+func parseBackoff(spec string) (plugin.Backoff, error) {
+	backoff := plugin.Backoff{Jitter: plugin.DefaultBackoff.Jitter}
+	if base, limit, found := strings.Cut(spec, "/"); found {
+		var err error
+		if backoff.Base, err = time.ParseDuration(base); err != nil {
+			return backoff, fmt.Errorf("invalid backoff base in %q: %v", spec, err)
+		}
+		if backoff.Cap, err = time.ParseDuration(limit); err != nil {
+			return backoff, fmt.Errorf("invalid backoff max in %q: %v", spec, err)
+		}
+	} else {
+		for _, step := range strings.Split(spec, ",") {
+			wait, err := time.ParseDuration(strings.TrimSpace(step))
+			if err != nil {
+				return backoff, fmt.Errorf("invalid backoff step in %q: %v", spec, err)
+			}
+			backoff.Steps = append(backoff.Steps, wait)
+		}
+	}
+	if err := backoff.Validate(); err != nil {
+		return backoff, fmt.Errorf("invalid backoff %q: %v", spec, err)
+	}
+	return backoff, nil
+}
+
+// parseSocketMode parses octal file permissions, e.g. 0660.
+func parseSocketMode(spec string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(spec, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q, expected octal permissions, e.g. 0660", spec)
+	}
+	return os.FileMode(mode), nil
+}
+
+// parseSocketOwner parses <uid>:<gid>, an empty id is returned as -1.
+func parseSocketOwner(spec string) (uid, gid int, err error) {
+	user, group, found := strings.Cut(spec, ":")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid socket owner %q, expected <uid>:<gid>", spec)
+	}
+	ids := []int{-1, -1}
+	for i, id := range []string{user, group} {
+		if id == "" {
+			continue
+		}
+		if ids[i], err = strconv.Atoi(id); err != nil || ids[i] < 0 {
+			return 0, 0, fmt.Errorf("invalid id %q in socket owner %q", id, spec)
+		}
+	}
+	return ids[0], ids[1], nil
+}
+
+// resolveNodeName returns the node name given by --node-name or NODE_NAME, or else the hostname,
+// which is what kubelet names the node by default.
+func resolveNodeName(name string, hostname func() (string, error)) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+	name, err := hostname()
+	if err != nil {
+		return "", fmt.Errorf("no node name is set and the hostname is unknown: %v", err)
+	}
+	if name == "" {
+		return "", fmt.Errorf("no node name is set and the hostname is empty")
+	}
+	return name, nil
+}
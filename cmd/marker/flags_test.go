@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+)
+
+func TestParseBridgeVariants(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []string
+		expected map[string][]plugin.BridgeVariant
+		wantErr  bool
+	}{
+		{
+			name:     "none",
+			expected: map[string][]plugin.BridgeVariant{},
+		},
+		{
+			name:    "variants of several bridges",
+			entries: []string{"br0/trunk=10", "br0/access=20", "br1/trunk=5"},
+			expected: map[string][]plugin.BridgeVariant{
+				"br0": {{Name: "trunk", MaxDevices: 10}, {Name: "access", MaxDevices: 20}},
+				"br1": {{Name: "trunk", MaxDevices: 5}},
+			},
+		},
+		{name: "missing count", entries: []string{"br0/trunk"}, wantErr: true},
+		{name: "missing variant", entries: []string{"br0=10"}, wantErr: true},
+		{name: "empty bridge", entries: []string{"/trunk=10"}, wantErr: true},
+		{name: "empty variant", entries: []string{"br0/=10"}, wantErr: true},
+		{name: "invalid count", entries: []string{"br0/trunk=many"}, wantErr: true},
+		{name: "zero count", entries: []string{"br0/trunk=0"}, wantErr: true},
+		{name: "duplicate", entries: []string{"br0/trunk=10", "br0/trunk=20"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variants, err := parseBridgeVariants(tt.entries)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", variants)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(variants, tt.expected) {
+				t.Errorf("got %v, expected %v", variants, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseSocketMode(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected os.FileMode
+		wantErr  bool
+	}{
+		{spec: "0600", expected: 0600},
+		{spec: "660", expected: 0660},
+		{spec: "0", expected: 0},
+		{spec: "0777", expected: 0777},
+		{spec: "01777", wantErr: true},
+		{spec: "0689", wantErr: true},
+		{spec: "rw-------", wantErr: true},
+		{spec: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		mode, err := parseSocketMode(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q got error %v, expected an error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if mode != tt.expected {
+			t.Errorf("%q got mode %o, expected %o", tt.spec, mode, tt.expected)
+		}
+	}
+}
+
+func TestParseSocketOwner(t *testing.T) {
+	tests := []struct {
+		spec     string
+		uid, gid int
+		wantErr  bool
+	}{
+		{spec: "107:107", uid: 107, gid: 107},
+		{spec: "0:1000", uid: 0, gid: 1000},
+		{spec: ":1000", uid: -1, gid: 1000},
+		{spec: "107:", uid: 107, gid: -1},
+		{spec: "107", wantErr: true},
+		{spec: "qemu:kvm", wantErr: true},
+		{spec: "-1:107", wantErr: true},
+	}
+	for _, tt := range tests {
+		uid, gid, err := parseSocketOwner(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q got error %v, expected an error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if uid != tt.uid || gid != tt.gid {
+			t.Errorf("%q got owner %d:%d, expected %d:%d", tt.spec, uid, gid, tt.uid, tt.gid)
+		}
+	}
+}
+
+func TestResolveNodeName(t *testing.T) {
+	tests := []struct {
+		name        string
+		nodeName    string
+		hostname    string
+		hostnameErr error
+		expected    string
+		wantErr     bool
+	}{
+		{name: "node name given", nodeName: "node01", hostname: "node01.example.com", expected: "node01"},
+		{name: "node name given without a hostname", nodeName: "node01", hostnameErr: errors.New("no hostname"), expected: "node01"},
+		{name: "hostname as a fallback", hostname: "node02", expected: "node02"},
+		{name: "unknown hostname", hostnameErr: errors.New("no hostname"), wantErr: true},
+		{name: "empty hostname", wantErr: true},
+	}
+	for _, tt := range tests {
+		hostname := func() (string, error) { return tt.hostname, tt.hostnameErr }
+		nodeName, err := resolveNodeName(tt.nodeName, hostname)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, expected an error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if nodeName != tt.expected {
+			t.Errorf("%s: got node name %q, expected %q", tt.name, nodeName, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"kubevirt.io/client-go/log"
+)
+
+// httpShutdownTimeout bounds how long in-flight requests delay the shutdown of the HTTP listener.
+const httpShutdownTimeout = 5 * time.Second
+
+// probeController is the part of the controller the probes report on.
+type probeController interface {
+	Initialized() bool
+	FailedPlugins() []string
+	Subscribed() bool
+	Stalled() bool
+	LinkWatchDegraded() bool
+}
+
+// registerProbes serves /healthz, failing when the link update subscription is lost or an event
+// loop stalled and noting when link updates are polled instead, and /readyz, failing until every
+// started plugin is registered with kubelet and naming the plugins that can't register at all.
+func registerProbes(mux *http.ServeMux, controller probeController) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		switch {
+		case !controller.Subscribed():
+			http.Error(w, "not subscribed to link updates", http.StatusServiceUnavailable)
+		case controller.Stalled():
+			http.Error(w, "event loop stalled", http.StatusServiceUnavailable)
+		case controller.LinkWatchDegraded():
+			// Polling still follows the links, only later, so it doesn't fail the probe
+			fmt.Fprintln(w, "ok, degraded: link updates are polled, the netlink subscription isn't permitted")
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if failed := controller.FailedPlugins(); len(failed) > 0 {
+			http.Error(w, "device plugins failed for good: "+strings.Join(failed, ", "), http.StatusServiceUnavailable)
+			return
+		}
+		if !controller.Initialized() {
+			http.Error(w, "device plugins not registered", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// serveMux returns the mux served on addr, endpoints sharing an address share a listener.
+func serveMux(muxes map[string]*http.ServeMux, addr string) *http.ServeMux {
+	if _, exists := muxes[addr]; !exists {
+		muxes[addr] = http.NewServeMux()
+	}
+	return muxes[addr]
+}
+
+// startHTTPServer listens on addr right away, so a taken address fails the startup, and
+// serves handler in the background. The returned function shuts the server down.
+func startHTTPServer(addr string, handler http.Handler) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %v", addr, err)
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.DefaultLogger().Reason(err).Errorf("HTTP server on %s failed", addr)
+		}
+	}()
+	log.DefaultLogger().Infof("serving HTTP on %s", listener.Addr())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.DefaultLogger().Reason(err).Warningf("HTTP server on %s didn't shut down cleanly", addr)
+		}
+	}, nil
+}
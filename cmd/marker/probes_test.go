@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeProbeController reports a fixed state.
+type fakeProbeController struct {
+	initialized bool
+	failed      []string
+	subscribed  bool
+	stalled     bool
+	degraded    bool
+}
+
+func (c *fakeProbeController) Initialized() bool       { return c.initialized }
+func (c *fakeProbeController) FailedPlugins() []string { return c.failed }
+func (c *fakeProbeController) Subscribed() bool        { return c.subscribed }
+func (c *fakeProbeController) Stalled() bool           { return c.stalled }
+func (c *fakeProbeController) LinkWatchDegraded() bool { return c.degraded }
+
+func TestProbes(t *testing.T) {
+	healthy := fakeProbeController{initialized: true, subscribed: true}
+	tests := []struct {
+		name       string
+		controller fakeProbeController
+		path       string
+		code       int
+		body       string
+	}{
+		{name: "healthy", controller: healthy, path: "/healthz", code: http.StatusOK, body: "ok"},
+		{
+			name:       "unsubscribed",
+			controller: fakeProbeController{initialized: true},
+			path:       "/healthz",
+			code:       http.StatusServiceUnavailable,
+			body:       "not subscribed",
+		},
+		{
+			name:       "stalled",
+			controller: fakeProbeController{initialized: true, subscribed: true, stalled: true},
+			path:       "/healthz",
+			code:       http.StatusServiceUnavailable,
+			body:       "stalled",
+		},
+		{
+			name:       "polling links",
+			controller: fakeProbeController{initialized: true, subscribed: true, degraded: true},
+			path:       "/healthz",
+			code:       http.StatusOK,
+			body:       "link updates are polled",
+		},
+		{name: "ready", controller: healthy, path: "/readyz", code: http.StatusOK, body: "ok"},
+		{
+			name:       "not registered",
+			controller: fakeProbeController{subscribed: true},
+			path:       "/readyz",
+			code:       http.StatusServiceUnavailable,
+			body:       "not registered",
+		},
+		{
+			name:       "failed plugins",
+			controller: fakeProbeController{initialized: true, subscribed: true, failed: []string{"br0"}},
+			path:       "/readyz",
+			code:       http.StatusServiceUnavailable,
+			body:       "failed for good: br0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			registerProbes(mux, &tt.controller)
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if recorder.Code != tt.code || !strings.Contains(recorder.Body.String(), tt.body) {
+				t.Errorf("got %d %q, expected %d with %q", recorder.Code, recorder.Body.String(), tt.code, tt.body)
+			}
+		})
+	}
+}
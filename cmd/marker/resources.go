@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"github.com/Acedus/bridge-marker-dp/pkg/podresources"
+	flag "github.com/spf13/pflag"
+)
+
+// resourceAllocation is an allocation of bridge devices as printed by the resources subcommand.
+type resourceAllocation struct {
+	Namespace string   `json:"namespace"`
+	Pod       string   `json:"pod"`
+	Container string   `json:"container"`
+	Bridge    string   `json:"bridge"`
+	DeviceIDs []string `json:"deviceIDs"`
+}
+
+// runResources lists the pods consuming bridge resources on this node.
+func runResources(args []string) error {
+	flags := flag.NewFlagSet("resources", flag.ContinueOnError)
+	socket := flags.String("pod-resources-socket", podresources.DefaultSocket,
+		"The kubelet PodResources socket")
+	resourceNamespace := flags.String("resource-namespace", plugin.DeviceNamespace,
+		"The domain bridge resources are advertised under")
+	bridge := flags.String("bridge", "",
+		"Only list allocations of this bridge resource, e.g. br0")
+	output := flags.String("output", outputTable,
+		"The output format, "+outputTable+" or "+outputJSON)
+	timeout := flags.Duration("timeout", 10*time.Second,
+		"Deadline for listing the pod resources")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+
+	client, err := podresources.NewClient(*socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	allocations, err := client.List(ctx, *resourceNamespace)
+	if err != nil {
+		return err
+	}
+
+	var ret []resourceAllocation
+	for _, allocation := range allocations {
+		name := strings.TrimPrefix(allocation.ResourceName, *resourceNamespace+"/")
+		if *bridge != "" && name != *bridge {
+			continue
+		}
+		ret = append(ret, resourceAllocation{
+			Namespace: allocation.Namespace,
+			Pod:       allocation.Pod,
+			Container: allocation.Container,
+			Bridge:    name,
+			DeviceIDs: allocation.DeviceIDs,
+		})
+	}
+	return printResources(os.Stdout, ret, *output)
+}
+
+func printResources(w io.Writer, allocations []resourceAllocation, output string) error {
+	if output == outputJSON {
+		if allocations == nil {
+			allocations = []resourceAllocation{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(allocations)
+	}
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NAMESPACE\tPOD\tCONTAINER\tBRIDGE\tDEVICES")
+	for _, allocation := range allocations {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", allocation.Namespace, allocation.Pod, allocation.Container,
+			allocation.Bridge, strings.Join(allocation.DeviceIDs, ","))
+	}
+	return table.Flush()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"kubevirt.io/client-go/log"
+)
+
+// statusController is the part of the controller the status dump reports on.
+type statusController interface {
+	Status() []plugin.DeviceStatus
+}
+
+// dumpStatusOnSignal logs the status of every plugin on every SIGUSR1, e.g. for a post-incident
+// review of the time the bridges spent in each health reason.
+func dumpStatusOnSignal(ctx context.Context, controller statusController) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+
+	for {
+		select {
+		case <-usr1:
+			var b strings.Builder
+			writeStatusDump(&b, controller.Status())
+			log.DefaultLogger().Infof("received SIGUSR1, device plugin status:\n%s", b.String())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeStatusDump writes a plugin per line, followed by the time spent per health reason and
+// the latest health transitions of its bridge.
+func writeStatusDump(w io.Writer, statuses []plugin.DeviceStatus) {
+	if len(statuses) == 0 {
+		fmt.Fprintln(w, "no device plugins are running")
+		return
+	}
+	for _, status := range statuses {
+		fmt.Fprintf(w, "%s (bridge %s): initialized %t, %d of %d devices healthy, %d restarts\n",
+			status.ResourceName, status.BridgeName, status.Initialized, status.HealthyDevices, status.TotalDevices, status.Restarts)
+		if status.LastError != "" {
+			fmt.Fprintf(w, "  last error: %s\n", status.LastError)
+		}
+		reasons := make([]plugin.HealthReason, 0, len(status.HealthReasons))
+		for reason := range status.HealthReasons {
+			reasons = append(reasons, reason)
+		}
+		sort.Slice(reasons, func(i, j int) bool { return reasons[i] < reasons[j] })
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "  %s for %v\n", reason, status.HealthReasons[reason].Round(time.Second))
+		}
+		for _, transition := range status.HealthHistory {
+			fmt.Fprintf(w, "  %s became %s\n", transition.Time.UTC().Format(time.RFC3339), transition.Reason)
+		}
+	}
+}
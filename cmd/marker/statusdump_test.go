@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+)
+
+func TestWriteStatusDump(t *testing.T) {
+	at := time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		statuses []plugin.DeviceStatus
+		expected string
+	}{
+		{
+			name:     "no plugins",
+			expected: "no device plugins are running\n",
+		},
+		{
+			name: "health reasons and transitions",
+			statuses: []plugin.DeviceStatus{{
+				BridgeName:     "br0",
+				ResourceName:   "bridge.network.kubevirt.io/br0",
+				Initialized:    true,
+				HealthyDevices: 0,
+				TotalDevices:   3,
+				Restarts:       1,
+				LastError:      "kubelet restarted",
+				HealthReasons: map[plugin.HealthReason]time.Duration{
+					plugin.HealthReasonUp:        time.Hour,
+					plugin.HealthReasonNoCarrier: 14*time.Minute + 300*time.Millisecond,
+					plugin.HealthReasonMissing:   2 * time.Minute,
+				},
+				HealthHistory: []plugin.HealthTransition{
+					{Time: at, Reason: plugin.HealthReasonNoCarrier},
+					{Time: at.Add(14 * time.Minute), Reason: plugin.HealthReasonMissing},
+				},
+			}},
+			expected: "bridge.network.kubevirt.io/br0 (bridge br0): initialized true, 0 of 3 devices healthy, 1 restarts\n" +
+				"  last error: kubelet restarted\n" +
+				"  Missing for 2m0s\n" +
+				"  NoCarrier for 14m0s\n" +
+				"  Up for 1h0m0s\n" +
+				"  2024-01-01T22:00:00Z became NoCarrier\n" +
+				"  2024-01-01T22:14:00Z became Missing\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			writeStatusDump(&b, tt.statuses)
+			if b.String() != tt.expected {
+				t.Errorf("got dump\n%s\nexpected\n%s", b.String(), tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+)
+
+// Config is the configuration file of the marker, e.g.
+//
+//	defaults:
+//	  maxDevices: 1000
+//	  healthMode: oper-up
+//	exclude: "^br-int$"
+//	bridges:
+//	  br-storage:
+//	    maxDevices: 512
+//	    resourceName: storage
+//	    minUpPorts: 1
+//	  br-mgmt:
+//	    healthMode: exists
+//	  br-test:
+//	    expose: false
+//
+// Settings left out keep the values of the command line flags.
+type Config struct {
+	// Defaults apply to every bridge without its own settings
+	Defaults BridgeConfig `yaml:"defaults"`
+	// Include and Exclude replace the bridge include and exclude regexes when set
+	Include string `yaml:"include"`
+	Exclude string `yaml:"exclude"`
+	// ExposeListedOnly exposes exactly the bridges listed below, like the --bridges flag
+	ExposeListedOnly bool `yaml:"exposeListedOnly"`
+	// Bridges are the settings of single bridges by name
+	Bridges map[string]BridgeConfig `yaml:"bridges"`
+}
+
+// BridgeConfig are the settings of a bridge, zero values keep the defaults.
+type BridgeConfig struct {
+	MaxDevices int    `yaml:"maxDevices"`
+	HealthMode string `yaml:"healthMode"`
+	// MinUpPorts is the number of ports that have to be up, on top of the health mode
+	MinUpPorts   int    `yaml:"minUpPorts"`
+	ResourceName string `yaml:"resourceName"`
+	// Expose exposes the bridge, true, or hides it, false, regardless of the regexes
+	Expose *bool `yaml:"expose"`
+}
+
+// Load reads and validates the configuration file, unknown fields are rejected.
+func Load(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the configuration file: %v", err)
+	}
+	return Parse(raw)
+}
+
+// Parse parses and validates a configuration.
+func Parse(raw []byte) (*Config, error) {
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(raw, config); err != nil {
+		return nil, fmt.Errorf("could not parse the configuration: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the whole configuration, so that it is either applied entirely or not at all.
+func (c *Config) Validate() error {
+	if err := c.Defaults.validate(); err != nil {
+		return fmt.Errorf("invalid defaults: %v", err)
+	}
+	if err := validateHealth(c.Defaults.settings()); err != nil {
+		return fmt.Errorf("invalid defaults: %v", err)
+	}
+	if c.Defaults.ResourceName != "" {
+		return fmt.Errorf("invalid defaults: a resource name can only be set per bridge")
+	}
+	if c.Defaults.Expose != nil {
+		return fmt.Errorf("invalid defaults: expose can only be set per bridge")
+	}
+	for field, expr := range map[string]string{"include": c.Include, "exclude": c.Exclude} {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("invalid %s regex %q: %v", field, expr, err)
+		}
+	}
+	if c.ExposeListedOnly && (c.Include != "" || c.Exclude != "") {
+		return fmt.Errorf("exposeListedOnly can't be combined with the include and exclude regexes")
+	}
+
+	resourceNames := map[string]string{}
+	for _, name := range c.bridgeNames() {
+		bridge := c.Bridges[name]
+		if name == "" {
+			return fmt.Errorf("a bridge has an empty name")
+		}
+		if err := bridge.validate(); err != nil {
+			return fmt.Errorf("invalid settings of bridge %s: %v", name, err)
+		}
+		if err := validateHealth(bridge.settings().Merge(c.Defaults.settings())); err != nil {
+			return fmt.Errorf("invalid settings of bridge %s: %v", name, err)
+		}
+		if bridge.ResourceName == "" {
+			continue
+		}
+		if other, exists := resourceNames[bridge.ResourceName]; exists {
+			return fmt.Errorf("bridges %s and %s have the same resource name %s", other, name, bridge.ResourceName)
+		}
+		resourceNames[bridge.ResourceName] = name
+	}
+	return nil
+}
+
+func (b BridgeConfig) validate() error {
+	if b.MaxDevices < 0 {
+		return fmt.Errorf("maxDevices must not be negative")
+	}
+	if b.MinUpPorts < 0 {
+		return fmt.Errorf("minUpPorts must not be negative")
+	}
+	if b.HealthMode != "" {
+		if _, err := plugin.ParseHealthMode(b.HealthMode); err != nil {
+			return err
+		}
+	}
+	if b.ResourceName != "" {
+		if err := plugin.ValidateResourceName(b.ResourceName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateHealth rejects health settings that contradict each other once merged with the defaults.
+func validateHealth(s plugin.BridgeSettings) error {
+	if s.HealthMode == plugin.HealthModeExists && s.MinUpPorts > 0 {
+		return fmt.Errorf("minUpPorts can't be required by the %s health mode, which ignores the state of the bridge", plugin.HealthModeExists)
+	}
+	return nil
+}
+
+func (b BridgeConfig) settings() plugin.BridgeSettings {
+	// The health mode was validated
+	return plugin.BridgeSettings{
+		MaxDevices:   b.MaxDevices,
+		HealthMode:   plugin.HealthMode(b.HealthMode),
+		MinUpPorts:   b.MinUpPorts,
+		ResourceName: b.ResourceName,
+	}
+}
+
+// bridgeNames returns the names of the configured bridges in order.
+func (c *Config) bridgeNames() []string {
+	names := make([]string, 0, len(c.Bridges))
+	for name := range c.Bridges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply sets the bridge selection and settings of the configuration on a filter built from
+// the command line flags, settings of single bridges take precedence over the flags.
+func (c *Config) Apply(filter *plugin.BridgeFilter) error {
+	if c.Include != "" {
+		filter.Include = regexp.MustCompile(c.Include)
+	}
+	if c.Exclude != "" {
+		filter.Exclude = regexp.MustCompile(c.Exclude)
+	}
+	filter.Defaults = c.Defaults.settings()
+	if filter.Settings == nil {
+		filter.Settings = make(map[string]plugin.BridgeSettings, len(c.Bridges))
+	}
+	filter.Overrides = map[string]bool{}
+	for name, bridge := range c.Bridges {
+		filter.Settings[name] = bridge.settings().Merge(filter.Settings[name])
+		if bridge.Expose != nil {
+			filter.Overrides[name] = *bridge.Expose
+		}
+	}
+	if !c.ExposeListedOnly {
+		return nil
+	}
+	if filter.Bridges != nil {
+		return fmt.Errorf("exposeListedOnly can't be combined with the --bridges flag")
+	}
+	return filter.SetBridges(c.bridgeNames())
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+)
+
+func TestApplyHealthSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected map[string]plugin.BridgeSettings
+	}{
+		{
+			name: "bridges override the default health mode",
+			raw: `
+defaults:
+  healthMode: admin-up
+bridges:
+  br-mgmt:
+    healthMode: exists
+  br-storage:
+    minUpPorts: 2
+`,
+			expected: map[string]plugin.BridgeSettings{
+				"br-mgmt":    {HealthMode: plugin.HealthModeExists},
+				"br-storage": {MinUpPorts: 2},
+			},
+		},
+		{
+			name: "bridges combine a health mode with ports",
+			raw: `
+bridges:
+  br-storage:
+    healthMode: oper-up
+    minUpPorts: 1
+`,
+			expected: map[string]plugin.BridgeSettings{
+				"br-storage": {HealthMode: plugin.HealthModeOperUp, MinUpPorts: 1},
+			},
+		},
+		{
+			name: "flag settings are kept",
+			raw: `
+bridges:
+  br0:
+    healthMode: exists
+`,
+			expected: map[string]plugin.BridgeSettings{
+				"br0": {MaxDevices: 10, HealthMode: plugin.HealthModeExists},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := Parse([]byte(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter, err := plugin.NewBridgeFilter("", "", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter.Settings = map[string]plugin.BridgeSettings{"br0": {MaxDevices: 10}}
+			if err := config.Apply(filter); err != nil {
+				t.Fatal(err)
+			}
+			for name, expected := range tt.expected {
+				if settings := filter.Settings[name]; !reflect.DeepEqual(settings, expected) {
+					t.Errorf("bridge %s has settings %+v, expected %+v", name, settings, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRejectsContradictoryHealth(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name: "ports required of a bridge that only has to exist",
+			raw: `
+bridges:
+  br-mgmt:
+    healthMode: exists
+    minUpPorts: 1
+`,
+			expected: "invalid settings of bridge br-mgmt",
+		},
+		{
+			name: "ports required by default of a bridge that only has to exist",
+			raw: `
+defaults:
+  minUpPorts: 1
+bridges:
+  br-mgmt:
+    healthMode: exists
+`,
+			expected: "invalid settings of bridge br-mgmt",
+		},
+		{
+			name: "defaults contradicting themselves",
+			raw: `
+defaults:
+  healthMode: exists
+  minUpPorts: 1
+`,
+			expected: "invalid defaults",
+		},
+		{
+			name: "negative port count",
+			raw: `
+bridges:
+  br0:
+    minUpPorts: -1
+`,
+			expected: "minUpPorts must not be negative",
+		},
+		{
+			name: "unknown health mode",
+			raw: `
+bridges:
+  br0:
+    healthMode: carrier
+`,
+			expected: "unknown health mode",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.raw))
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("got error %v, expected %q", err, tt.expected)
+			}
+		})
+	}
+}
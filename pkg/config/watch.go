@@ -0,0 +1,63 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"kubevirt.io/client-go/log"
+)
+
+// reloadDelay coalesces the events of a single change of the file, e.g. a truncate and a write.
+const reloadDelay = 200 * time.Millisecond
+
+// Watch reloads the configuration file when it changes, until ctx is done, and hands every valid
+// new configuration to apply. Invalid configurations are logged and skipped, so the last good one
+// stays active. The directory of the file is watched, so files replaced by a rename, like the
+// ones of mounted ConfigMaps, are followed. active is the configuration loaded at startup.
+func Watch(ctx context.Context, path string, active *Config, apply func(*Config) error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not create a watcher for the configuration file: %v", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("could not watch the directory of the configuration file: %v", err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		logger := log.DefaultLogger()
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-watcher.Events:
+				reload = time.After(reloadDelay)
+			case err := <-watcher.Errors:
+				logger.Reason(err).Warning("error watching the configuration file")
+			case <-reload:
+				reload = nil
+				config, err := Load(path)
+				if err != nil {
+					logger.Reason(err).Error("rejected the configuration file, keeping the last good configuration")
+					continue
+				}
+				if reflect.DeepEqual(config, active) {
+					continue
+				}
+				if err := apply(config); err != nil {
+					logger.Reason(err).Error("could not apply the changed configuration file, keeping the last good configuration")
+					continue
+				}
+				active = config
+				logger.Infof("applied the changed configuration file %s", path)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,228 @@
+// Package labeler maintains node labels for the bridges exposed on the node, like the original
+// bridge-marker did, for tooling that selects nodes by label rather than by resource.
+package labeler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/kube"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"kubevirt.io/client-go/log"
+)
+
+const (
+	// labelValue is the value of the label of every exposed bridge
+	labelValue = "true"
+
+	// DefaultSyncInterval is the minimum interval between label patches, changes in between are coalesced.
+	DefaultSyncInterval = 5 * time.Second
+	// resyncPeriod is the interval the labels are read back from the node, to undo changes by others
+	resyncPeriod = 5 * time.Minute
+	// requestTimeout bounds a single request to the API server
+	requestTimeout = 30 * time.Second
+	// maxRetryDelay caps the backoff of failed patches
+	maxRetryDelay = 2 * time.Minute
+)
+
+// Labeler labels the node with <resource namespace>/<bridge>=true for every healthy bridge.
+type Labeler struct {
+	client   *kube.Client
+	nodeName string
+	prefix   string
+	// status returns the plugins of the controller
+	status       func() []plugin.DeviceStatus
+	syncInterval time.Duration
+
+	// applied are the bridge labels on the node as far as known
+	applied map[string]bool
+}
+
+// NewInClusterLabeler creates a labeler using the service account of the pod, status is usually
+// the Status method of the controller.
+func NewInClusterLabeler(nodeName, resourceNamespace string, status func() []plugin.DeviceStatus) (*Labeler, error) {
+	if nodeName == "" {
+		return nil, fmt.Errorf("labeling the node requires its name")
+	}
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return &Labeler{
+		client:       client,
+		nodeName:     nodeName,
+		prefix:       resourceNamespace + "/",
+		status:       status,
+		syncInterval: DefaultSyncInterval,
+	}, nil
+}
+
+// Run keeps the labels of the node in sync with the healthy bridges until ctx is done. Labels
+// are left in place on shutdown, so restarts don't make them flap.
+func (l *Labeler) Run(ctx context.Context) {
+	logger := log.DefaultLogger()
+	ticker := time.NewTicker(l.syncInterval)
+	defer ticker.Stop()
+	failures := 0
+	var lastRead time.Time
+	var retryAt time.Time
+
+	for {
+		now := time.Now()
+		if now.After(retryAt) {
+			err := l.sync(ctx, l.applied == nil || now.Sub(lastRead) >= resyncPeriod, &lastRead)
+			if err != nil {
+				failures++
+				delay := min(l.syncInterval<<min(failures, 10), maxRetryDelay)
+				retryAt = now.Add(delay)
+				logger.Reason(err).Warningf("could not label node %s, retrying in %v", l.nodeName, delay)
+			} else {
+				failures = 0
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sync patches the labels that differ from the healthy bridges, reading them from the node first if needed.
+func (l *Labeler) sync(ctx context.Context, read bool, lastRead *time.Time) error {
+	if read {
+		applied, err := l.readLabels(ctx)
+		if err != nil {
+			return err
+		}
+		l.applied = applied
+		*lastRead = time.Now()
+	}
+
+	wanted, pending := l.wantedLabels()
+	applied := map[string]bool{}
+	patch := map[string]interface{}{}
+	for key := range wanted {
+		applied[key] = true
+		if !l.applied[key] {
+			patch[key] = labelValue
+		}
+	}
+	for key := range l.applied {
+		if pending[key] {
+			applied[key] = true
+		} else if !wanted[key] {
+			// null removes the label in a merge patch
+			patch[key] = nil
+		}
+	}
+	if len(patch) == 0 {
+		return nil
+	}
+	if err := l.patchLabels(ctx, patch); err != nil {
+		return err
+	}
+	l.applied = applied
+	log.DefaultLogger().Infof("labeled node %s with bridges %v", l.nodeName, sortedBridges(applied, l.prefix))
+	return nil
+}
+
+// wantedLabels returns the label keys of the bridges with a healthy plugin, and those of bridges
+// whose plugins aren't registered yet. The labels of the latter are left as they are, so a
+// restart doesn't remove and re-add them.
+func (l *Labeler) wantedLabels() (wanted, pending map[string]bool) {
+	wanted, pending = map[string]bool{}, map[string]bool{}
+	for _, status := range l.status() {
+		key := l.prefix + status.BridgeName
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			log.DefaultLogger().V(4).Infof("bridge %s can't be a label: %s", status.BridgeName, strings.Join(errs, ", "))
+			continue
+		}
+		switch {
+		case status.Healthy:
+			wanted[key] = true
+		case !status.Initialized:
+			pending[key] = true
+		}
+	}
+	return wanted, pending
+}
+
+// readLabels returns the bridge labels currently on the node.
+func (l *Labeler) readLabels(ctx context.Context) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := l.client.Do(ctx, http.MethodGet, l.nodePath(), nil, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not get node %s: %v", l.nodeName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not get node %s: %s", l.nodeName, responseError(resp))
+	}
+	node := struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&node); err != nil {
+		return nil, fmt.Errorf("could not decode node %s: %v", l.nodeName, err)
+	}
+	ret := map[string]bool{}
+	for key, value := range node.Metadata.Labels {
+		if strings.HasPrefix(key, l.prefix) && value == labelValue {
+			ret[key] = true
+		}
+	}
+	return ret, nil
+}
+
+// patchLabels sends a JSON merge patch of the labels. It carries no resource version, so
+// concurrent changes of the node by others never conflict with it.
+func (l *Labeler) patchLabels(ctx context.Context, labels map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := l.client.Do(ctx, http.MethodPatch, l.nodePath(), nil, "application/merge-patch+json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not patch node %s: %v", l.nodeName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not patch node %s: %s", l.nodeName, responseError(resp))
+	}
+	return nil
+}
+
+func (l *Labeler) nodePath() string {
+	return "/api/v1/nodes/" + url.PathEscape(l.nodeName)
+}
+
+// responseError is the status of a failed response with the start of its body.
+func responseError(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return strings.TrimSpace(fmt.Sprintf("%s %s", resp.Status, body))
+}
+
+func sortedBridges(labels map[string]bool, prefix string) []string {
+	ret := make([]string, 0, len(labels))
+	for key := range labels {
+		ret = append(ret, strings.TrimPrefix(key, prefix))
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,52 @@
+package labeler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+)
+
+func TestWantedLabels(t *testing.T) {
+	tests := []struct {
+		name            string
+		status          []plugin.DeviceStatus
+		wanted, pending []string
+	}{
+		{
+			name: "healthy bridges are labeled",
+			status: []plugin.DeviceStatus{
+				{BridgeName: "br0", Initialized: true, Healthy: true},
+				{BridgeName: "br1", Initialized: true},
+			},
+			wanted: []string{"bridge.network.kubevirt.io/br0"},
+		},
+		{
+			name:    "unregistered bridges keep their labels",
+			status:  []plugin.DeviceStatus{{BridgeName: "br0"}},
+			pending: []string{"bridge.network.kubevirt.io/br0"},
+		},
+		{
+			name:   "bridges that can't be labels are skipped",
+			status: []plugin.DeviceStatus{{BridgeName: "br 0", Initialized: true, Healthy: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Labeler{prefix: "bridge.network.kubevirt.io/", status: func() []plugin.DeviceStatus { return tt.status }}
+			wanted, pending := l.wantedLabels()
+			if keys := sortedBridges(wanted, ""); !reflect.DeepEqual(keys, append([]string{}, tt.wanted...)) {
+				t.Errorf("wanted labels %v, expected %v", keys, tt.wanted)
+			}
+			if keys := sortedBridges(pending, ""); !reflect.DeepEqual(keys, append([]string{}, tt.pending...)) {
+				t.Errorf("pending labels %v, expected %v", keys, tt.pending)
+			}
+		})
+	}
+}
+
+func TestNewInClusterLabelerRequiresNodeName(t *testing.T) {
+	if _, err := NewInClusterLabeler("", "bridge.network.kubevirt.io", nil); err == nil {
+		t.Error("a labeler was created without a node name")
+	}
+}
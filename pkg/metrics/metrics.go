@@ -0,0 +1,289 @@
+// Package metrics is a minimal registry of labeled metrics served in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the registry the marker's metrics are registered with.
+var Default = NewRegistry()
+
+// DefaultBuckets are the upper bounds of histogram buckets in seconds suited to RPC latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metric families and serves them on scrapes.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*vec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*vec{}}
+}
+
+// vec is a metric family, its series are keyed by their label values.
+type vec struct {
+	lock       sync.Mutex
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	// buckets are the sorted upper bounds of a histogram's buckets
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// bucketCounts and count are the observations of a histogram, value is their sum
+	bucketCounts []uint64
+	count        uint64
+}
+
+// GaugeVec is a family of gauges partitioned by labels.
+type GaugeVec struct {
+	vec *vec
+}
+
+// NewGaugeVec registers a gauge family, it panics if the name is already registered.
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{vec: r.register(name, help, "gauge", labelNames)}
+}
+
+// CounterVec is a family of counters partitioned by labels.
+type CounterVec struct {
+	vec *vec
+}
+
+// NewCounterVec registers a counter family, it panics if the name is already registered.
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{vec: r.register(name, help, "counter", labelNames)}
+}
+
+// HistogramVec is a family of histograms partitioned by labels.
+type HistogramVec struct {
+	vec *vec
+}
+
+// NewHistogramVec registers a histogram family with the given bucket upper bounds, it panics
+// if the name is already registered or the buckets aren't increasing.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("buckets of histogram %s aren't sorted", name))
+	}
+	v := r.register(name, help, "histogram", labelNames)
+	v.buckets = append([]float64{}, buckets...)
+	return &HistogramVec{vec: v}
+}
+
+func (r *Registry) register(name, help, kind string, labelNames []string) *vec {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.families[name]; exists {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	v := &vec{name: name, help: help, kind: kind, labelNames: labelNames, series: map[string]*series{}}
+	r.families[name] = v
+	return v
+}
+
+// Set sets the gauge with the given label values, in the order of the label names.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.vec.update(labelValues, func(s *series) { s.value = value })
+}
+
+// Delete removes the gauge with the given label values.
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.vec.delete(labelValues)
+}
+
+// DeleteMatching removes every gauge whose label has the given value.
+func (g *GaugeVec) DeleteMatching(label, value string) {
+	g.vec.deleteMatching(label, value)
+}
+
+// Inc increments the counter with the given label values, in the order of the label names.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds the value to the counter with the given label values, it panics on negative values.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.vec.name))
+	}
+	c.vec.update(labelValues, func(s *series) { s.value += value })
+}
+
+// Value returns the counter with the given label values, 0 if it wasn't added to yet.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	value, _ := c.vec.value(labelValues)
+	return value
+}
+
+// Value returns the gauge with the given label values and whether it is set.
+func (g *GaugeVec) Value(labelValues ...string) (float64, bool) {
+	return g.vec.value(labelValues)
+}
+
+// Observe adds an observation to the histogram with the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.vec.update(labelValues, func(s *series) {
+		if s.bucketCounts == nil {
+			s.bucketCounts = make([]uint64, len(h.vec.buckets))
+		}
+		for i, bound := range h.vec.buckets {
+			if value <= bound {
+				s.bucketCounts[i]++
+			}
+		}
+		s.count++
+		s.value += value
+	})
+}
+
+func (v *vec) update(labelValues []string, update func(*series)) {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := seriesKey(labelValues)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	s, exists := v.series[key]
+	if !exists {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		v.series[key] = s
+	}
+	update(s)
+}
+
+func (v *vec) value(labelValues []string) (float64, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if s, exists := v.series[seriesKey(labelValues)]; exists {
+		return s.value, true
+	}
+	return 0, false
+}
+
+func (v *vec) delete(labelValues []string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.series, seriesKey(labelValues))
+}
+
+func (v *vec) deleteMatching(label, value string) {
+	index := -1
+	for i, name := range v.labelNames {
+		if name == label {
+			index = i
+		}
+	}
+	if index < 0 {
+		return
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for key, s := range v.series {
+		if s.labelValues[index] == value {
+			delete(v.series, key)
+		}
+	}
+}
+
+// seriesKey joins the label values with a separator that can't appear in them unescaped.
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// Write writes all metrics in the Prometheus text exposition format, ordered by name and labels.
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	families := make([]*vec, 0, len(r.families))
+	for _, v := range r.families {
+		families = append(families, v)
+	}
+	r.lock.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, v := range families {
+		v.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (v *vec) write(b *strings.Builder) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", v.name, v.kind)
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := v.series[key]
+		if v.kind != "histogram" {
+			writeSample(b, v.name, v.labelNames, s.labelValues, s.value)
+			continue
+		}
+		// Buckets are cumulative and labeled with their upper bound
+		labelNames := append(append([]string{}, v.labelNames...), "le")
+		for i, bound := range v.buckets {
+			labelValues := append(append([]string{}, s.labelValues...), formatFloat(bound))
+			writeSample(b, v.name+"_bucket", labelNames, labelValues, float64(s.bucketCounts[i]))
+		}
+		labelValues := append(append([]string{}, s.labelValues...), "+Inf")
+		writeSample(b, v.name+"_bucket", labelNames, labelValues, float64(s.count))
+		writeSample(b, v.name+"_sum", v.labelNames, s.labelValues, s.value)
+		writeSample(b, v.name+"_count", v.labelNames, s.labelValues, float64(s.count))
+	}
+}
+
+func writeSample(b *strings.Builder, name string, labelNames, labelValues []string, value float64) {
+	b.WriteString(name)
+	if len(labelNames) > 0 {
+		b.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", labelName, escapeLabelValue(labelValues[i]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(b, " %s\n", formatFloat(value))
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	up := r.NewGaugeVec("bridge_up", "Whether the bridge is up.", "bridge")
+	restarts := r.NewCounterVec("restarts_total", "Plugin restarts,\nby reason.", "bridge", "reason")
+	latency := r.NewHistogramVec("latency_seconds", "RPC latency.", []float64{.1, 1}, "method")
+
+	up.Set(1, "br0")
+	up.Set(0, `br"1`)
+	restarts.Inc("br0", "error")
+	restarts.Add(2, "br0", "error")
+	latency.Observe(.05, "Allocate")
+	latency.Observe(.5, "Allocate")
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP bridge_up Whether the bridge is up.
+# TYPE bridge_up gauge
+bridge_up{bridge="br\"1"} 0
+bridge_up{bridge="br0"} 1
+# HELP latency_seconds RPC latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="Allocate",le="0.1"} 1
+latency_seconds_bucket{method="Allocate",le="1"} 2
+latency_seconds_bucket{method="Allocate",le="+Inf"} 2
+latency_seconds_sum{method="Allocate"} 0.55
+latency_seconds_count{method="Allocate"} 2
+# HELP restarts_total Plugin restarts,\nby reason.
+# TYPE restarts_total counter
+restarts_total{bridge="br0",reason="error"} 3
+`
+	if b.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", b.String(), expected)
+	}
+}
+
+func TestCounterValue(t *testing.T) {
+	r := NewRegistry()
+	events := r.NewCounterVec("events_total", "Link events.", "type")
+	events.Inc("new")
+	events.Inc("new")
+	events.Inc("del")
+
+	tests := []struct {
+		eventType string
+		expected  float64
+	}{
+		{eventType: "new", expected: 2},
+		{eventType: "del", expected: 1},
+		{eventType: "update", expected: 0},
+	}
+	for _, tt := range tests {
+		if value := events.Value(tt.eventType); value != tt.expected {
+			t.Errorf("counter of %s events is %v, expected %v", tt.eventType, value, tt.expected)
+		}
+	}
+}
+
+func TestCounterRejectsDecrease(t *testing.T) {
+	r := NewRegistry()
+	events := r.NewCounterVec("events_total", "Link events.", "type")
+	defer func() {
+		if recover() == nil {
+			t.Error("a counter was decreased")
+		}
+	}()
+	events.Add(-1, "new")
+}
+
+func TestGaugeValue(t *testing.T) {
+	r := NewRegistry()
+	up := r.NewGaugeVec("bridge_up", "Whether the bridge is up.", "bridge")
+	up.Set(1, "br0")
+	up.Set(0, "br1")
+	up.Set(1, "br2")
+	up.Delete("br2")
+
+	tests := []struct {
+		bridge   string
+		expected float64
+		set      bool
+	}{
+		{bridge: "br0", expected: 1, set: true},
+		{bridge: "br1", expected: 0, set: true},
+		{bridge: "br2"},
+		{bridge: "br3"},
+	}
+	for _, tt := range tests {
+		if value, set := up.Value(tt.bridge); value != tt.expected || set != tt.set {
+			t.Errorf("%s: got %v (set %t), expected %v (set %t)", tt.bridge, value, set, tt.expected, tt.set)
+		}
+	}
+}
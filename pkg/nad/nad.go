@@ -0,0 +1,68 @@
+package nad
+
+import (
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// bridgePluginType is the type of the bridge CNI plugin
+	bridgePluginType = "bridge"
+	// defaultBridgeName is the bridge the bridge CNI plugin uses when the config names none
+	defaultBridgeName = "cni0"
+)
+
+// NetworkAttachmentDefinition is the part of a Multus NetworkAttachmentDefinition the marker reads.
+type NetworkAttachmentDefinition struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              NetworkAttachmentDefinitionSpec `json:"spec"`
+}
+
+type NetworkAttachmentDefinitionSpec struct {
+	// Config is the CNI configuration, a single plugin config or a plugin list
+	Config string `json:"config"`
+}
+
+type NetworkAttachmentDefinitionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NetworkAttachmentDefinition `json:"items"`
+}
+
+// cniPluginConfig is the part of a CNI plugin config naming the bridge.
+type cniPluginConfig struct {
+	Type   string `json:"type"`
+	Bridge string `json:"bridge"`
+}
+
+// cniConfig is either a single plugin config or a plugin list.
+type cniConfig struct {
+	cniPluginConfig
+	Plugins []cniPluginConfig `json:"plugins"`
+}
+
+// BridgeName returns the bridge a CNI configuration attaches to through the bridge CNI plugin,
+// false if it doesn't use the bridge plugin. An empty config has no CNI config of its own,
+// e.g. when Multus reads it from a file on the node, and is skipped as well.
+func BridgeName(config string) (string, bool, error) {
+	if config == "" {
+		return "", false, nil
+	}
+	parsed := cniConfig{}
+	if err := json.Unmarshal([]byte(config), &parsed); err != nil {
+		return "", false, fmt.Errorf("invalid CNI config: %v", err)
+	}
+	for _, plugin := range append([]cniPluginConfig{parsed.cniPluginConfig}, parsed.Plugins...) {
+		if plugin.Type != bridgePluginType {
+			continue
+		}
+		if plugin.Bridge == "" {
+			return defaultBridgeName, true, nil
+		}
+		return plugin.Bridge, true, nil
+	}
+	return "", false, nil
+}
@@ -0,0 +1,209 @@
+package nad
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/kube"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"kubevirt.io/client-go/log"
+)
+
+const (
+	nadResourcePath = "/apis/k8s.cni.cncf.io/v1"
+	nadResource     = "network-attachment-definitions"
+
+	// listTimeout bounds a list request
+	listTimeout = 30 * time.Second
+	// watchTimeout makes the API server end a watch, which is then resumed from the last resource version
+	watchTimeout = 5 * time.Minute
+	// retryDelay is the wait before listing again after a failed list or watch
+	retryDelay = 5 * time.Second
+)
+
+// errExpired is returned when the watched resource version is too old and a new list is needed.
+var errExpired = errors.New("the resource version expired")
+
+// Watcher lists and watches NetworkAttachmentDefinitions and tracks the bridges they attach to.
+type Watcher struct {
+	client *kube.Client
+	// Namespace restricts the watch to a namespace, empty watches all namespaces
+	Namespace string
+
+	// bridges maps the namespace/name of every NAD using the bridge plugin to its bridge
+	bridges map[string]string
+	// reported is the last set of bridges handed to the callback
+	reported []string
+}
+
+// NewInClusterWatcher creates a watcher using the service account of the pod.
+func NewInClusterWatcher(namespace string) (*Watcher, error) {
+	client, err := kube.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{
+		client:    client,
+		Namespace: namespace,
+		bridges:   map[string]string{},
+	}, nil
+}
+
+// Run lists and watches the NADs until ctx is done, onChange is called with the sorted names of
+// the referenced bridges whenever they change, starting with the first successful list.
+func (w *Watcher) Run(ctx context.Context, onChange func(bridges []string)) {
+	logger := log.DefaultLogger()
+	for {
+		resourceVersion, err := w.list(ctx)
+		if err == nil {
+			w.report(onChange)
+			for err == nil {
+				resourceVersion, err = w.watch(ctx, resourceVersion, onChange)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errExpired) {
+			logger.V(4).Info("NetworkAttachmentDefinition watch expired, listing again")
+			continue
+		}
+		logger.Reason(err).Warningf("could not watch NetworkAttachmentDefinitions, retrying in %v", retryDelay)
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// list replaces the tracked NADs with the current ones and returns the list's resource version.
+func (w *Watcher) list(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, listTimeout)
+	defer cancel()
+	resp, err := w.get(ctx, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	list := NetworkAttachmentDefinitionList{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("could not decode the NetworkAttachmentDefinition list: %v", err)
+	}
+	w.bridges = map[string]string{}
+	for i := range list.Items {
+		w.track(watch.Added, &list.Items[i])
+	}
+	return list.ResourceVersion, nil
+}
+
+// watch follows the changes since the resource version until the watch ends, it returns the
+// last seen resource version.
+func (w *Watcher) watch(ctx context.Context, resourceVersion string, onChange func([]string)) (string, error) {
+	resp, err := w.get(ctx, url.Values{
+		"watch":           {"true"},
+		"resourceVersion": {resourceVersion},
+		"timeoutSeconds":  {fmt.Sprint(int(watchTimeout.Seconds()))},
+	})
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := struct {
+			Type   watch.EventType `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}{}
+		if err := decoder.Decode(&event); err != nil {
+			if ctx.Err() != nil {
+				return resourceVersion, ctx.Err()
+			}
+			// The server ended the watch, it is resumed from the last resource version
+			return resourceVersion, nil
+		}
+		if event.Type == watch.Error {
+			status := metav1.Status{}
+			if err := json.Unmarshal(event.Object, &status); err == nil && status.Code == http.StatusGone {
+				return resourceVersion, errExpired
+			}
+			return resourceVersion, fmt.Errorf("watch error: %s", event.Object)
+		}
+		nad := NetworkAttachmentDefinition{}
+		if err := json.Unmarshal(event.Object, &nad); err != nil {
+			return resourceVersion, fmt.Errorf("could not decode a NetworkAttachmentDefinition: %v", err)
+		}
+		resourceVersion = nad.ResourceVersion
+		if event.Type == watch.Bookmark {
+			continue
+		}
+		w.track(event.Type, &nad)
+		w.report(onChange)
+	}
+}
+
+func (w *Watcher) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	path := nadResourcePath + "/" + nadResource
+	if w.Namespace != "" {
+		path = nadResourcePath + "/namespaces/" + url.PathEscape(w.Namespace) + "/" + nadResource
+	}
+	resp, err := w.client.Do(ctx, http.MethodGet, path, query, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// track records the bridge of an added or modified NAD and forgets a deleted one.
+func (w *Watcher) track(eventType watch.EventType, nad *NetworkAttachmentDefinition) {
+	key := nad.Namespace + "/" + nad.Name
+	if eventType == watch.Deleted {
+		delete(w.bridges, key)
+		return
+	}
+	bridge, ok, err := BridgeName(nad.Spec.Config)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Warningf("ignoring NetworkAttachmentDefinition %s", key)
+	}
+	if !ok {
+		delete(w.bridges, key)
+		return
+	}
+	w.bridges[key] = bridge
+}
+
+// report hands the referenced bridges to the callback if they changed.
+func (w *Watcher) report(onChange func([]string)) {
+	unique := map[string]bool{}
+	for _, bridge := range w.bridges {
+		unique[bridge] = true
+	}
+	bridges := make([]string, 0, len(unique))
+	for bridge := range unique {
+		bridges = append(bridges, bridge)
+	}
+	sort.Strings(bridges)
+	if w.reported != nil && slices.Equal(bridges, w.reported) {
+		return
+	}
+	w.reported = bridges
+	onChange(bridges)
+}
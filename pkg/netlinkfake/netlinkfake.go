@@ -0,0 +1,335 @@
+// Package netlinkfake is an in-memory link source for tests of the plugins and the controller,
+// it needs no privileges. Tests add, remove and flap links and subscribers see the updates.
+package netlinkfake
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// subscriberBuffer bounds the updates queued for a subscriber that isn't receiving.
+const subscriberBuffer = 1024
+
+var (
+	_ plugin.LinkSource    = &Links{}
+	_ plugin.AltNameLister = &Links{}
+)
+
+// Links implements plugin.LinkSource and plugin.AltNameLister.
+type Links struct {
+	lock        sync.Mutex
+	links       map[int]netlink.Link
+	vlans       map[int32][]*nl.BridgeVlanInfo
+	altNames    map[int][]string
+	nextIndex   int
+	subscribers map[*subscriber]bool
+	// SubscribeErr fails the following subscriptions, e.g. to test the polling fallback
+	SubscribeErr error
+}
+
+type subscriber struct {
+	queue chan netlink.LinkUpdate
+}
+
+func New() *Links {
+	return &Links{
+		links:       map[int]netlink.Link{},
+		vlans:       map[int32][]*nl.BridgeVlanInfo{},
+		altNames:    map[int][]string{},
+		nextIndex:   1,
+		subscribers: map[*subscriber]bool{},
+	}
+}
+
+// AddBridge creates a Linux bridge that is up and returns its ifindex.
+func (l *Links) AddBridge(name string) int {
+	return l.AddLink(&netlink.Bridge{LinkAttrs: upAttrs(name)})
+}
+
+// AddDevice creates a physical device that is up and returns its ifindex.
+func (l *Links) AddDevice(name string) int {
+	return l.AddLink(&netlink.Device{LinkAttrs: upAttrs(name)})
+}
+
+// AddLink adds the link with the next free ifindex and returns it, the link must not be modified afterwards.
+func (l *Links) AddLink(link netlink.Link) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	attrs := link.Attrs()
+	if existing := l.byName(attrs.Name); existing != nil {
+		panic(fmt.Sprintf("link %s already exists", attrs.Name))
+	}
+	attrs.Index = l.nextIndex
+	l.nextIndex++
+	l.links[attrs.Index] = link
+	update := newUpdate(link, unix.RTM_NEWLINK)
+	// Like the kernel, creations are told apart from changes by a full change mask
+	update.Change = 0xffffffff
+	l.send(update)
+	return attrs.Index
+}
+
+// RemoveLink deletes the link, ports enslaved to it are released.
+func (l *Links) RemoveLink(name string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	link := l.mustGet(name)
+	index := link.Attrs().Index
+	delete(l.links, index)
+	delete(l.vlans, int32(index))
+	delete(l.altNames, index)
+	l.notify(link, unix.RTM_DELLINK)
+	for _, port := range l.sorted() {
+		if port.Attrs().MasterIndex == index {
+			l.update(port, func(attrs *netlink.LinkAttrs) { attrs.MasterIndex = 0 })
+		}
+	}
+}
+
+// SetUp sets the link administratively and operationally up or down, flapping it.
+func (l *Links) SetUp(name string, up bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.update(l.mustGet(name), func(attrs *netlink.LinkAttrs) {
+		if up {
+			attrs.Flags |= net.FlagUp
+			attrs.OperState = netlink.OperUp
+		} else {
+			attrs.Flags &^= net.FlagUp
+			attrs.OperState = netlink.OperDown
+		}
+	})
+}
+
+// SetOperState sets the operational state of the link only, e.g. a bridge without carrier.
+func (l *Links) SetOperState(name string, state netlink.LinkOperState) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.update(l.mustGet(name), func(attrs *netlink.LinkAttrs) { attrs.OperState = state })
+}
+
+// SetMaster enslaves the link to the master, an empty master releases it.
+func (l *Links) SetMaster(name, master string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	index := 0
+	if master != "" {
+		index = l.mustGet(master).Attrs().Index
+	}
+	l.update(l.mustGet(name), func(attrs *netlink.LinkAttrs) { attrs.MasterIndex = index })
+}
+
+// Rename renames the link, keeping its ifindex.
+func (l *Links) Rename(name, newName string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.update(l.mustGet(name), func(attrs *netlink.LinkAttrs) { attrs.Name = newName })
+}
+
+// SetAltNames replaces the alternative names of the link and sends a link update.
+func (l *Links) SetAltNames(name string, altNames ...string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	link := l.mustGet(name)
+	l.altNames[link.Attrs().Index] = altNames
+	l.notify(link, unix.RTM_NEWLINK)
+}
+
+// SetBridgeVLANs sets the VLANs of a bridge port, pvid is its untagged VLAN, 0 for none.
+func (l *Links) SetBridgeVLANs(port string, pvid uint16, vids ...uint16) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	link := l.mustGet(port)
+	var infos []*nl.BridgeVlanInfo
+	if pvid != 0 {
+		infos = append(infos, &nl.BridgeVlanInfo{Vid: pvid, Flags: nl.BRIDGE_VLAN_INFO_PVID | nl.BRIDGE_VLAN_INFO_UNTAGGED})
+	}
+	for _, vid := range vids {
+		infos = append(infos, &nl.BridgeVlanInfo{Vid: vid})
+	}
+	l.vlans[int32(link.Attrs().Index)] = infos
+	update := newUpdate(link, unix.RTM_NEWLINK)
+	update.Family = unix.AF_BRIDGE
+	l.send(update)
+}
+
+func (l *Links) LinkList() ([]netlink.Link, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ret := make([]netlink.Link, 0, len(l.links))
+	for _, link := range l.sorted() {
+		ret = append(ret, copyLink(link))
+	}
+	return ret, nil
+}
+
+func (l *Links) LinkByName(name string) (netlink.Link, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if link := l.byName(name); link != nil {
+		return copyLink(link), nil
+	}
+	return nil, fmt.Errorf("link %s: %w", name, plugin.ErrLinkNotFound)
+}
+
+func (l *Links) LinkByIndex(index int) (netlink.Link, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if link, exists := l.links[index]; exists {
+		return copyLink(link), nil
+	}
+	return nil, fmt.Errorf("link %d: %w", index, plugin.ErrLinkNotFound)
+}
+
+func (l *Links) LinkAltNames(index int) ([]string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, exists := l.links[index]; !exists {
+		return nil, fmt.Errorf("link %d: %w", index, plugin.ErrLinkNotFound)
+	}
+	return append([]string{}, l.altNames[index]...), nil
+}
+
+func (l *Links) BridgeVlanList() (map[int32][]*nl.BridgeVlanInfo, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ret := make(map[int32][]*nl.BridgeVlanInfo, len(l.vlans))
+	for index, infos := range l.vlans {
+		ret[index] = append([]*nl.BridgeVlanInfo{}, infos...)
+	}
+	return ret, nil
+}
+
+// Subscribe delivers the updates of all later changes until stop is closed, then closes updates.
+func (l *Links) Subscribe(updates chan<- netlink.LinkUpdate, stop <-chan struct{}) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.SubscribeErr != nil {
+		return l.SubscribeErr
+	}
+	sub := &subscriber{queue: make(chan netlink.LinkUpdate, subscriberBuffer)}
+	l.subscribers[sub] = true
+	go func() {
+		defer close(updates)
+		defer func() {
+			l.lock.Lock()
+			delete(l.subscribers, sub)
+			l.lock.Unlock()
+		}()
+		for {
+			select {
+			case update := <-sub.queue:
+				select {
+				case updates <- update:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Subscribers returns the number of subscriptions that weren't stopped yet.
+func (l *Links) Subscribers() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.subscribers)
+}
+
+// update changes a copy of the link, so links handed out before stay as they were.
+func (l *Links) update(link netlink.Link, change func(*netlink.LinkAttrs)) {
+	changed := copyLink(link)
+	change(changed.Attrs())
+	l.links[changed.Attrs().Index] = changed
+	l.notify(changed, unix.RTM_NEWLINK)
+}
+
+func (l *Links) notify(link netlink.Link, msgType uint16) {
+	l.send(newUpdate(link, msgType))
+}
+
+func (l *Links) send(update netlink.LinkUpdate) {
+	for sub := range l.subscribers {
+		select {
+		case sub.queue <- update:
+		default:
+			panic("netlinkfake: a subscriber stopped receiving updates")
+		}
+	}
+}
+
+func (l *Links) byName(name string) netlink.Link {
+	for _, link := range l.links {
+		if link.Attrs().Name == name {
+			return link
+		}
+	}
+	return nil
+}
+
+func (l *Links) mustGet(name string) netlink.Link {
+	link := l.byName(name)
+	if link == nil {
+		panic(fmt.Sprintf("link %s doesn't exist", name))
+	}
+	return link
+}
+
+func (l *Links) sorted() []netlink.Link {
+	ret := make([]netlink.Link, 0, len(l.links))
+	for _, link := range l.links {
+		ret = append(ret, link)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Attrs().Index < ret[j].Attrs().Index })
+	return ret
+}
+
+func upAttrs(name string) netlink.LinkAttrs {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	attrs.Flags = net.FlagUp
+	attrs.OperState = netlink.OperUp
+	return attrs
+}
+
+func newUpdate(link netlink.Link, msgType uint16) netlink.LinkUpdate {
+	update := netlink.LinkUpdate{Link: copyLink(link)}
+	update.Header.Type = msgType
+	update.Index = int32(link.Attrs().Index)
+	return update
+}
+
+// copyLink copies the attributes of the link kinds the marker distinguishes.
+func copyLink(link netlink.Link) netlink.Link {
+	switch l := link.(type) {
+	case *netlink.Bridge:
+		c := *l
+		return &c
+	case *netlink.Device:
+		c := *l
+		return &c
+	case *netlink.Vlan:
+		c := *l
+		return &c
+	case *netlink.Bond:
+		c := *l
+		return &c
+	case *netlink.Veth:
+		c := *l
+		return &c
+	case *netlink.GenericLink:
+		c := *l
+		return &c
+	}
+	panic(fmt.Sprintf("netlinkfake: unsupported link type %T", link))
+}
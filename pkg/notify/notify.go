@@ -0,0 +1,290 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"kubevirt.io/client-go/log"
+)
+
+// PayloadVersion identifies the schema of Payload, it is bumped on incompatible changes.
+const PayloadVersion = "v1"
+
+const (
+	DefaultRateLimit        = 5 * time.Second
+	DefaultRetries          = 3
+	DefaultRetryDelay       = 1 * time.Second
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 1 * time.Minute
+
+	queueSize   = 256
+	sendTimeout = 5 * time.Second
+)
+
+// Payload is the JSON document delivered for a health change of a bridge resource:
+//
+//	{
+//	  "version": "v1",
+//	  "node": "node01",
+//	  "bridge": "br0",
+//	  "resource": "bridge.network.kubevirt.io/br0",
+//	  "oldHealth": "Healthy",
+//	  "newHealth": "Unhealthy",
+//	  "reason": "NoCarrier",
+//	  "timestamp": "2024-08-01T10:00:00Z"
+//	}
+//
+// Changes of the same resource within the rate limit are coalesced, in which case
+// oldHealth is the health of the last delivered notification.
+type Payload struct {
+	Version   string    `json:"version"`
+	Node      string    `json:"node"`
+	Bridge    string    `json:"bridge"`
+	Resource  string    `json:"resource"`
+	OldHealth string    `json:"oldHealth"`
+	NewHealth string    `json:"newHealth"`
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Sender delivers an encoded payload to a single destination.
+type Sender interface {
+	Name() string
+	Send(ctx context.Context, body []byte) error
+}
+
+type Option func(*Notifier)
+
+// WithRateLimit sets the minimum interval between notifications for the same resource.
+func WithRateLimit(interval time.Duration) Option {
+	return func(n *Notifier) {
+		n.rateLimit = interval
+	}
+}
+
+// WithRetries sets how often a failed delivery is attempted before the payload is dropped.
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(n *Notifier) {
+		n.retries = retries
+		n.retryDelay = delay
+	}
+}
+
+// WithCircuitBreaker stops delivering to a sender for cooldown after threshold consecutive failed deliveries.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(n *Notifier) {
+		n.breakerThreshold = threshold
+		n.breakerCooldown = cooldown
+	}
+}
+
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// senderWorker delivers the payloads of one sender in order, so a slow or failing destination
+// delays neither the Run loop nor the other senders.
+type senderWorker struct {
+	sender Sender
+	queue  chan delivery
+	// breaker is only used by the worker's goroutine
+	breaker breaker
+}
+
+type delivery struct {
+	resource string
+	body     []byte
+}
+
+// Notifier delivers health changes asynchronously to its senders.
+// Deliveries are retried and dropped once retries are exhausted, so a failing
+// destination never blocks the plugins.
+type Notifier struct {
+	node             string
+	workers          []*senderWorker
+	queue            chan plugin.HealthChange
+	rateLimit        time.Duration
+	retries          int
+	retryDelay       time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	// the delivery state below is only used by the Run goroutine
+	pending    map[string]Payload
+	lastSent   map[string]time.Time
+	lastHealth map[string]string
+}
+
+func NewNotifier(node string, senders []Sender, opts ...Option) *Notifier {
+	n := &Notifier{
+		node:             node,
+		queue:            make(chan plugin.HealthChange, queueSize),
+		rateLimit:        DefaultRateLimit,
+		retries:          DefaultRetries,
+		retryDelay:       DefaultRetryDelay,
+		breakerThreshold: DefaultBreakerThreshold,
+		breakerCooldown:  DefaultBreakerCooldown,
+		pending:          map[string]Payload{},
+		lastSent:         map[string]time.Time{},
+		lastHealth:       map[string]string{},
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	for _, sender := range senders {
+		n.workers = append(n.workers, &senderWorker{sender: sender, queue: make(chan delivery, queueSize)})
+	}
+	return n
+}
+
+// NotifyHealthChange queues the change for delivery, it is dropped if the queue is full.
+func (n *Notifier) NotifyHealthChange(change plugin.HealthChange) {
+	select {
+	case n.queue <- change:
+	default:
+		log.DefaultLogger().Warningf("notification queue is full, dropping health change of %s", change.Resource)
+	}
+}
+
+// Run delivers queued notifications until stop is closed. Every sender is served by its own
+// goroutine, Run itself never waits for a delivery.
+func (n *Notifier) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, w := range n.workers {
+		wg.Add(1)
+		go func(w *senderWorker) {
+			defer wg.Done()
+			n.work(w, stop)
+		}(w)
+	}
+
+	tick := n.rateLimit
+	if tick <= 0 || tick > time.Second {
+		tick = time.Second
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case change := <-n.queue:
+			n.enqueue(change)
+		case <-ticker.C:
+		}
+		n.flush()
+	}
+}
+
+func (n *Notifier) enqueue(change plugin.HealthChange) {
+	payload := Payload{
+		Version:   PayloadVersion,
+		Node:      n.node,
+		Bridge:    change.Bridge,
+		Resource:  change.Resource,
+		OldHealth: change.OldHealth,
+		NewHealth: change.NewHealth,
+		Reason:    string(change.Reason),
+		Timestamp: change.Time.UTC(),
+	}
+	if pending, exists := n.pending[change.Resource]; exists {
+		payload.OldHealth = pending.OldHealth
+	} else if last, exists := n.lastHealth[change.Resource]; exists {
+		payload.OldHealth = last
+	}
+	n.pending[change.Resource] = payload
+}
+
+func (n *Notifier) flush() {
+	now := time.Now()
+	for resource, payload := range n.pending {
+		if now.Sub(n.lastSent[resource]) < n.rateLimit {
+			continue
+		}
+		delete(n.pending, resource)
+		if payload.OldHealth == payload.NewHealth {
+			// The resource flapped back within the rate limit
+			continue
+		}
+		n.lastSent[resource] = now
+		n.lastHealth[resource] = payload.NewHealth
+		n.deliver(payload)
+	}
+}
+
+// deliver hands the payload to the workers of all senders, it is dropped for senders whose
+// queue is full.
+func (n *Notifier) deliver(payload Payload) {
+	logger := log.DefaultLogger()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Reason(err).Errorf("could not encode notification for %s", payload.Resource)
+		return
+	}
+
+	for _, w := range n.workers {
+		select {
+		case w.queue <- delivery{resource: payload.Resource, body: body}:
+		default:
+			logger.Warningf("notification queue of %s is full, dropping notification for %s", w.sender.Name(), payload.Resource)
+		}
+	}
+}
+
+// work delivers the payloads queued for the sender until stop is closed.
+func (n *Notifier) work(w *senderWorker, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case d := <-w.queue:
+			n.deliverTo(w, d, stop)
+		}
+	}
+}
+
+func (n *Notifier) deliverTo(w *senderWorker, d delivery, stop <-chan struct{}) {
+	logger := log.DefaultLogger()
+	b := &w.breaker
+	if time.Now().Before(b.openUntil) {
+		logger.V(4).Infof("circuit to %s is open, dropping notification for %s", w.sender.Name(), d.resource)
+		return
+	}
+
+	if err := n.send(w.sender, d.body, stop); err != nil {
+		b.failures++
+		logger.Reason(err).Warningf("dropping notification for %s to %s", d.resource, w.sender.Name())
+		if n.breakerThreshold > 0 && b.failures >= n.breakerThreshold {
+			b.openUntil = time.Now().Add(n.breakerCooldown)
+			logger.Warningf("%s failed %d times in a row, pausing notifications to it for %v", w.sender.Name(), b.failures, n.breakerCooldown)
+		}
+		return
+	}
+	b.failures = 0
+}
+
+func (n *Notifier) send(sender Sender, body []byte, stop <-chan struct{}) error {
+	var err error
+	for attempt := 0; attempt <= n.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-stop:
+				return err
+			case <-time.After(n.retryDelay):
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err = sender.Send(ctx, body)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,247 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const testTimeout = 10 * time.Second
+
+var changeTime = time.Date(2024, 8, 1, 10, 0, 0, 0, time.UTC)
+
+func healthChange(bridge, oldHealth, newHealth string, reason plugin.HealthReason) plugin.HealthChange {
+	return plugin.HealthChange{
+		Bridge:    bridge,
+		Resource:  plugin.DeviceNamespace + "/" + bridge,
+		OldHealth: oldHealth,
+		NewHealth: newHealth,
+		Reason:    reason,
+		Time:      changeTime,
+	}
+}
+
+// runNotifier runs the notifier until the test ends.
+func runNotifier(t *testing.T, n *Notifier) {
+	t.Helper()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.Run(stop)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+}
+
+// receive waits for the next payload sent to payloads.
+func receive(t *testing.T, payloads <-chan []byte) Payload {
+	t.Helper()
+	select {
+	case body := <-payloads:
+		var payload Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatalf("invalid payload %s: %v", body, err)
+		}
+		return payload
+	case <-time.After(testTimeout):
+		t.Fatal("no notification was delivered")
+		return Payload{}
+	}
+}
+
+func TestHTTPSenderPostsPayload(t *testing.T) {
+	payloads := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got a %s request of %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		payloads <- body
+	}))
+	defer server.Close()
+
+	n := NewNotifier("node01", []Sender{&HTTPSender{URL: server.URL}}, WithRateLimit(0))
+	runNotifier(t, n)
+	n.NotifyHealthChange(healthChange("br0", pluginapi.Healthy, pluginapi.Unhealthy, plugin.HealthReasonNoCarrier))
+
+	expected := Payload{
+		Version:   PayloadVersion,
+		Node:      "node01",
+		Bridge:    "br0",
+		Resource:  plugin.DeviceNamespace + "/br0",
+		OldHealth: pluginapi.Healthy,
+		NewHealth: pluginapi.Unhealthy,
+		Reason:    string(plugin.HealthReasonNoCarrier),
+		Timestamp: changeTime,
+	}
+	if payload := receive(t, payloads); !reflect.DeepEqual(payload, expected) {
+		t.Errorf("got payload %+v, expected %+v", payload, expected)
+	}
+}
+
+func TestHTTPSenderFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	sender := &HTTPSender{URL: server.URL}
+	if err := sender.Send(context.Background(), []byte("{}")); err == nil {
+		t.Error("a 503 response was taken as a delivery")
+	}
+}
+
+func TestExecSenderPassesPayloadOnStdin(t *testing.T) {
+	payloads := make(chan []byte, 10)
+	sender := &ExecSender{
+		Command: []string{"/usr/local/bin/notify", "--quiet"},
+		Runner: func(ctx context.Context, command []string, stdin []byte) error {
+			if !reflect.DeepEqual(command, []string{"/usr/local/bin/notify", "--quiet"}) {
+				t.Errorf("ran %v", command)
+			}
+			payloads <- stdin
+			return nil
+		},
+	}
+	n := NewNotifier("node01", []Sender{sender}, WithRateLimit(0))
+	runNotifier(t, n)
+	n.NotifyHealthChange(healthChange("br0", pluginapi.Unhealthy, pluginapi.Healthy, plugin.HealthReasonUp))
+
+	if payload := receive(t, payloads); payload.Bridge != "br0" || payload.NewHealth != pluginapi.Healthy {
+		t.Errorf("got payload %+v", payload)
+	}
+}
+
+// fakeSender records the payloads sent to it, failing with err and blocking while block is open.
+type fakeSender struct {
+	name     string
+	payloads chan []byte
+	block    chan struct{}
+	err      error
+
+	lock  sync.Mutex
+	calls int
+}
+
+func newFakeSender(name string) *fakeSender {
+	return &fakeSender{name: name, payloads: make(chan []byte, 100)}
+}
+
+func (s *fakeSender) Name() string {
+	return s.name
+}
+
+func (s *fakeSender) Send(ctx context.Context, body []byte) error {
+	s.lock.Lock()
+	s.calls++
+	s.lock.Unlock()
+	if s.block != nil {
+		select {
+		case <-s.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if s.err != nil {
+		return s.err
+	}
+	s.payloads <- body
+	return nil
+}
+
+func (s *fakeSender) sendCalls() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls
+}
+
+func TestSlowSenderDoesNotDelayOthers(t *testing.T) {
+	slow := newFakeSender("slow")
+	slow.block = make(chan struct{})
+	defer close(slow.block)
+	fast := newFakeSender("fast")
+	n := NewNotifier("node01", []Sender{slow, fast}, WithRateLimit(0))
+	runNotifier(t, n)
+
+	n.NotifyHealthChange(healthChange("br0", pluginapi.Healthy, pluginapi.Unhealthy, plugin.HealthReasonDown))
+	n.NotifyHealthChange(healthChange("br1", pluginapi.Healthy, pluginapi.Unhealthy, plugin.HealthReasonDown))
+	bridges := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		bridges[receive(t, fast.payloads).Bridge] = true
+	}
+	if !bridges["br0"] || !bridges["br1"] {
+		t.Errorf("the fast sender got notifications of %v, expected br0 and br1", bridges)
+	}
+}
+
+func TestFlushCoalescesChangesWithinRateLimit(t *testing.T) {
+	sender := newFakeSender("sender")
+	n := NewNotifier("node01", []Sender{sender}, WithRateLimit(time.Hour))
+	queued := func() []delivery {
+		var ret []delivery
+		for {
+			select {
+			case d := <-n.workers[0].queue:
+				ret = append(ret, d)
+			default:
+				return ret
+			}
+		}
+	}
+
+	n.enqueue(healthChange("br0", pluginapi.Healthy, pluginapi.Unhealthy, plugin.HealthReasonDown))
+	n.flush()
+	if deliveries := queued(); len(deliveries) != 1 {
+		t.Fatalf("%d notifications were delivered, expected the first change", len(deliveries))
+	}
+
+	// Within the rate limit changes are held back, and flapping back to the delivered health
+	// isn't delivered at all
+	n.enqueue(healthChange("br0", pluginapi.Unhealthy, pluginapi.Healthy, plugin.HealthReasonUp))
+	n.enqueue(healthChange("br0", pluginapi.Healthy, pluginapi.Unhealthy, plugin.HealthReasonDown))
+	n.flush()
+	if deliveries := queued(); len(deliveries) != 0 {
+		t.Fatalf("%d notifications were delivered within the rate limit", len(deliveries))
+	}
+	n.lastSent[plugin.DeviceNamespace+"/br0"] = time.Time{}
+	n.flush()
+	if deliveries := queued(); len(deliveries) != 0 {
+		t.Errorf("a flap back to the delivered health was delivered: %s", deliveries[0].body)
+	}
+}
+
+func TestDeliveryRetriesThenOpensCircuit(t *testing.T) {
+	sender := newFakeSender("failing")
+	sender.err = errors.New("connection refused")
+	n := NewNotifier("node01", []Sender{sender}, WithRetries(1, 0), WithCircuitBreaker(2, time.Hour))
+	w := n.workers[0]
+	stop := make(chan struct{})
+
+	for _, bridge := range []string{"br0", "br1", "br2"} {
+		n.deliverTo(w, delivery{resource: bridge, body: []byte("{}")}, stop)
+	}
+	// Two deliveries of two attempts each, the third is dropped by the open circuit
+	if calls := sender.sendCalls(); calls != 4 {
+		t.Errorf("the sender was called %d times, expected 4", calls)
+	}
+
+	sender.err = nil
+	w.breaker.openUntil = time.Time{}
+	n.deliverTo(w, delivery{resource: "br0", body: []byte("{}")}, stop)
+	if w.breaker.failures != 0 {
+		t.Errorf("a delivery didn't reset the %d failures", w.breaker.failures)
+	}
+}
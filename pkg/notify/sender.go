@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+)
+
+// HTTPSender POSTs payloads as JSON to a URL.
+type HTTPSender struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *HTTPSender) Name() string {
+	return s.URL
+}
+
+func (s *HTTPSender) Send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
+
+// CommandRunner runs a command with the given stdin, it exists so tests can fake execution.
+type CommandRunner func(ctx context.Context, command []string, stdin []byte) error
+
+func runCommand(ctx context.Context, command []string, stdin []byte) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// ExecSender runs a command with the payload on stdin.
+type ExecSender struct {
+	Command []string
+	Runner  CommandRunner
+}
+
+func (s *ExecSender) Name() string {
+	return fmt.Sprintf("exec %s", s.Command[0])
+}
+
+func (s *ExecSender) Send(ctx context.Context, body []byte) error {
+	runner := s.Runner
+	if runner == nil {
+		runner = runCommand
+	}
+	return runner(ctx, s.Command, body)
+}
@@ -0,0 +1,282 @@
+package plugin_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func allocateRequest(containers ...[]string) *pluginapi.AllocateRequest {
+	req := &pluginapi.AllocateRequest{}
+	for _, ids := range containers {
+		req.ContainerRequests = append(req.ContainerRequests, &pluginapi.ContainerAllocateRequest{DevicesIDs: ids})
+	}
+	return req
+}
+
+// deviceIDs names the devices of the bridge in each container, e.g. [[0 1] [2]].
+func deviceIDs(bridge string, containers [][]int) [][]string {
+	ret := make([][]string, 0, len(containers))
+	for _, numbers := range containers {
+		var ids []string
+		for _, number := range numbers {
+			ids = append(ids, fmt.Sprintf("%s%d", bridge, number))
+		}
+		ret = append(ret, ids)
+	}
+	return ret
+}
+
+func TestAllocateRespondsPerContainer(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	h.Links.AddBridge("br1")
+	h.StartPlugin(ctx, newPlugin(t, h, "br0", 4))
+	h.StartPlugin(ctx, newPlugin(t, h, "br1", 4, plugin.WithAllocationEnvs()))
+	plain := dial(ctx, t, h, resourceName("br0"))
+	withEnvs := dial(ctx, t, h, resourceName("br1"))
+
+	tests := []struct {
+		name       string
+		containers [][]int
+	}{
+		{name: "one container", containers: [][]int{{0}}},
+		{name: "two containers", containers: [][]int{{0}, {1}}},
+		{name: "three containers", containers: [][]int{{0, 1}, {2}, {3}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := plain.Allocate(ctx, allocateRequest(deviceIDs("br0", test.containers)...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.ContainerResponses) != len(test.containers) {
+				t.Errorf("got %d container responses, want %d", len(resp.ContainerResponses), len(test.containers))
+			}
+
+			// The envs tell the responses apart, they must be in the order of the requests
+			containers := deviceIDs("br1", test.containers)
+			resp, err = withEnvs.Allocate(ctx, allocateRequest(containers...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.ContainerResponses) != len(containers) {
+				t.Fatalf("got %d container responses with envs, want %d", len(resp.ContainerResponses), len(containers))
+			}
+			for i, container := range resp.ContainerResponses {
+				got := container.Envs["BRIDGE_NETWORK_KUBEVIRT_IO_BR1_DEVICE_IDS"]
+				if want := strings.Join(containers[i], ","); got != want {
+					t.Errorf("container %d got devices %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocateValidatesDeviceIDs(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	h.StartPlugin(ctx, newPlugin(t, h, "br0", 3))
+	client := dial(ctx, t, h, resourceName("br0"))
+
+	tests := []struct {
+		name       string
+		containers [][]string
+		want       codes.Code
+	}{
+		{name: "valid", containers: [][]string{{"br00", "br01"}}, want: codes.OK},
+		{name: "valid across containers", containers: [][]string{{"br00"}, {"br02"}}, want: codes.OK},
+		{name: "unknown", containers: [][]string{{"br00", "br07"}}, want: codes.InvalidArgument},
+		{name: "of another bridge", containers: [][]string{{"br10"}}, want: codes.InvalidArgument},
+		{name: "duplicate", containers: [][]string{{"br01", "br01"}}, want: codes.InvalidArgument},
+		{name: "duplicate across containers", containers: [][]string{{"br01"}, {"br01"}}, want: codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := client.Allocate(ctx, allocateRequest(test.containers...))
+			if code := status.Code(err); code != test.want {
+				t.Errorf("got %v (%v), want %v", code, err, test.want)
+			}
+		})
+	}
+}
+
+func TestAllocateWhileShuttingDown(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3)
+	run := h.StartPlugin(ctx, dev)
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+	if err := run.Stop(); err != nil {
+		t.Fatalf("the plugin failed: %v", err)
+	}
+
+	// A call that raced the shutdown still reaches the stopped plugin
+	_, err := dev.Allocate(ctx, allocateRequest([]string{"br00"}))
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("got %v (%v), want %v", code, err, codes.Unavailable)
+	}
+}
+
+func TestAllocateReportsDuplicateDeviceIDs(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 4)
+	h.StartPlugin(ctx, dev)
+	client := dial(ctx, t, h, resourceName("br0"))
+	sample := `bridge_marker_duplicate_allocations_total{bridge="br0",resource="` + resourceName("br0") + `"}`
+	before := metricValue(t, sample)
+
+	tests := []struct {
+		name       string
+		containers [][]string
+		duplicates string
+	}{
+		{name: "within a container", containers: [][]string{{"br00", "br01", "br00"}}, duplicates: "br00"},
+		{name: "across containers", containers: [][]string{{"br00", "br01"}, {"br02"}, {"br01", "br02"}}, duplicates: "br01, br02"},
+	}
+	for i, test := range tests {
+		_, err := client.Allocate(ctx, allocateRequest(test.containers...))
+		if code := status.Code(err); code != codes.InvalidArgument {
+			t.Fatalf("%s: got %v (%v), want %v", test.name, code, err, codes.InvalidArgument)
+		}
+		if msg := status.Convert(err).Message(); !strings.Contains(msg, test.duplicates) || !strings.Contains(msg, "kubelet_internal_checkpoint") {
+			t.Errorf("%s: the error %q doesn't name %s and the checkpoint", test.name, msg, test.duplicates)
+		}
+		if count := dev.DuplicateAllocations(); count != uint64(i+1) {
+			t.Errorf("%s: %d duplicate allocations were counted, want %d", test.name, count, i+1)
+		}
+		if exported := metricValue(t, sample) - before; exported != float64(i+1) {
+			t.Errorf("%s: %v duplicate allocations were exported, want %d", test.name, exported, i+1)
+		}
+	}
+}
+
+func TestGetPreferredAllocation(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	h.StartPlugin(ctx, newPlugin(t, h, "br0", 12))
+	client := dial(ctx, t, h, resourceName("br0"))
+
+	options, err := client.GetDevicePluginOptions(ctx, &pluginapi.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !options.GetPreferredAllocationAvailable {
+		t.Error("the preferred allocation isn't advertised")
+	}
+
+	tests := []struct {
+		name        string
+		available   []string
+		mustInclude []string
+		size        int32
+		expected    []string
+	}{
+		{
+			name:      "lowest numbered devices, not the lowest names",
+			available: []string{"br010", "br02", "br03", "br011"},
+			size:      2,
+			expected:  []string{"br02", "br03"},
+		},
+		{
+			name:        "required devices come first",
+			available:   []string{"br01", "br02", "br03", "br05"},
+			mustInclude: []string{"br05"},
+			size:        3,
+			expected:    []string{"br05", "br01", "br02"},
+		},
+		{
+			name:        "required devices are not repeated",
+			available:   []string{"br01", "br02", "br03"},
+			mustInclude: []string{"br02", "br02"},
+			size:        2,
+			expected:    []string{"br02", "br01"},
+		},
+		{
+			name:        "required devices are clamped to the size",
+			available:   []string{"br01", "br02", "br03"},
+			mustInclude: []string{"br03", "br02"},
+			size:        1,
+			expected:    []string{"br03"},
+		},
+		{
+			name:      "larger than the available devices",
+			available: []string{"br04", "br01"},
+			size:      5,
+			expected:  []string{"br01", "br04"},
+		},
+		{
+			name:      "unknown devices are skipped",
+			available: []string{"eth01", "br07"},
+			size:      2,
+			expected:  []string{"br07"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.GetPreferredAllocation(ctx, &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+					AvailableDeviceIDs:   test.available,
+					MustIncludeDeviceIDs: test.mustInclude,
+					AllocationSize:       test.size,
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.ContainerResponses) != 1 {
+				t.Fatalf("got %d container responses, want 1", len(resp.ContainerResponses))
+			}
+			if got := resp.ContainerResponses[0].DeviceIDs; !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("got devices %v, want %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestAllocateEnvsNameTheBridge(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	h.Links.AddBridge("br-storage")
+	h.StartPlugin(ctx, newPlugin(t, h, "br0", 4))
+	h.StartPlugin(ctx, newPlugin(t, h, "br-storage", 8, plugin.WithAllocationEnvs()))
+
+	resp, err := dial(ctx, t, h, resourceName("br0")).Allocate(ctx, allocateRequest([]string{"br00"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envs := resp.ContainerResponses[0].Envs; len(envs) != 0 {
+		t.Errorf("got envs %v without opting in", envs)
+	}
+
+	resp, err = dial(ctx, t, h, resourceName("br-storage")).Allocate(ctx, allocateRequest([]string{"br-storage3", "br-storage7"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"BRIDGE_NETWORK_KUBEVIRT_IO_BR_STORAGE":            "br-storage",
+		"BRIDGE_NETWORK_KUBEVIRT_IO_BR_STORAGE_DEVICE_IDS": "br-storage3,br-storage7",
+	}
+	if envs := resp.ContainerResponses[0].Envs; !reflect.DeepEqual(envs, expected) {
+		t.Errorf("got envs %v, want %v", envs, expected)
+	}
+}
@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"kubevirt.io/client-go/log"
+)
+
+// AltNameLister is implemented by link sources that know the alternative names of links, as
+// given by ip link property add dev <link> altname <name>.
+type AltNameLister interface {
+	LinkAltNames(index int) ([]string, error)
+}
+
+// linkNames returns the kernel name of the link followed by its alternative names, if the
+// source knows them.
+func linkNames(link netlink.Link, lister LinkLister) []string {
+	names := []string{link.Attrs().Name}
+	altNameLister, ok := lister.(AltNameLister)
+	if !ok {
+		return names
+	}
+	altNames, err := altNameLister.LinkAltNames(link.Attrs().Index)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Warningf("could not look up the alternative names of %s, matching its name only", names[0])
+		return names
+	}
+	return append(names, altNames...)
+}
+
+// LinkAltNames looks the alternative names of the link up in the monitored network namespace,
+// the netlink library doesn't parse them.
+func (netlinkSource) LinkAltNames(index int) ([]string, error) {
+	netnsLock.RLock()
+	sock, err := nl.GetNetlinkSocketAt(netnsHandle, netns.None(), unix.NETLINK_ROUTE)
+	netnsLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer sock.Close()
+	if err := sock.SetReceiveTimeout(&nl.SocketTimeoutTv); err != nil {
+		return nil, err
+	}
+
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	req.Sockets = map[int]*nl.SocketHandle{unix.NETLINK_ROUTE: {Socket: sock}}
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("no link with index %d", index)
+	}
+	return parseAltNames(msgs[0])
+}
+
+// parseAltNames returns the alternative names in the property list of an RTM_NEWLINK message.
+func parseAltNames(msg []byte) ([]string, error) {
+	if len(msg) < unix.SizeofIfInfomsg {
+		return nil, fmt.Errorf("link message of %d bytes is too short", len(msg))
+	}
+	attrs, err := nl.ParseRouteAttr(msg[unix.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, attr := range attrs {
+		if attr.Attr.Type&nl.NLA_TYPE_MASK != unix.IFLA_PROP_LIST {
+			continue
+		}
+		props, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, prop := range props {
+			if prop.Attr.Type&nl.NLA_TYPE_MASK == unix.IFLA_ALT_IFNAME {
+				names = append(names, strings.TrimRight(string(prop.Value), "\x00"))
+			}
+		}
+	}
+	return names, nil
+}
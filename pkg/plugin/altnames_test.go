@@ -0,0 +1,34 @@
+package plugin
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseAltNames(t *testing.T) {
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC).Serialize()
+	msg = append(msg, nl.NewRtAttr(unix.IFLA_IFNAME, nl.ZeroTerminated("br0")).Serialize()...)
+	props := nl.NewRtAttr(unix.IFLA_PROP_LIST|unix.NLA_F_NESTED, nil)
+	props.AddRtAttr(unix.IFLA_ALT_IFNAME, nl.ZeroTerminated("uplink-net"))
+	props.AddRtAttr(unix.IFLA_ALT_IFNAME, nl.ZeroTerminated("enp0s31f6-br"))
+	msg = append(msg, props.Serialize()...)
+
+	names, err := parseAltNames(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"uplink-net", "enp0s31f6-br"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %v, expected %v", names, expected)
+	}
+
+	names, err = parseAltNames(nl.NewIfInfomsg(unix.AF_UNSPEC).Serialize())
+	if err != nil || len(names) != 0 {
+		t.Errorf("a link without alternative names has %v, %v", names, err)
+	}
+	if _, err := parseAltNames([]byte{1, 2}); err == nil {
+		t.Error("a truncated message was parsed")
+	}
+}
@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// DefaultBackoff is the backoff used to restart device plugins.
+var DefaultBackoff = Backoff{
+	Base:   1 * time.Second,
+	Cap:    30 * time.Second,
+	Jitter: 0.2,
+}
+
+// Backoff is an exponential backoff, the wait after the n-th consecutive failure is
+// min(Cap, Base*2^n), randomly spread by ±Jitter so that many plugins failing at the
+// same time, e.g. after a kubelet restart, don't retry in lockstep.
+// When Steps is set the n-th wait is taken from it instead, repeating the last step.
+type Backoff struct {
+	Base  time.Duration
+	Cap   time.Duration
+	Steps []time.Duration
+	// Jitter is the fraction of the wait it is randomly spread by, e.g. 0.2 for ±20%
+	Jitter float64
+}
+
+// Duration returns the wait after the given number of consecutive failures.
+func (b Backoff) Duration(failures int) time.Duration {
+	var wait time.Duration
+	if len(b.Steps) > 0 {
+		wait = b.Steps[min(failures, len(b.Steps)-1)]
+	} else {
+		wait = b.Base
+		for i := 0; i < failures && wait < b.Cap; i++ {
+			wait *= 2
+		}
+		if b.Cap > 0 && wait > b.Cap {
+			wait = b.Cap
+		}
+	}
+	if b.Jitter > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * b.Jitter * float64(wait))
+	}
+	return wait
+}
+
+// Validate checks that the waits are positive and don't decrease.
+func (b Backoff) Validate() error {
+	if b.Jitter < 0 || b.Jitter >= 1 {
+		return fmt.Errorf("backoff jitter %v must be in [0, 1)", b.Jitter)
+	}
+	if len(b.Steps) > 0 {
+		for i, step := range b.Steps {
+			if step <= 0 {
+				return fmt.Errorf("backoff step %v must be positive", step)
+			}
+			if i > 0 && step < b.Steps[i-1] {
+				return fmt.Errorf("backoff steps must be ascending, %v follows %v", step, b.Steps[i-1])
+			}
+		}
+		return nil
+	}
+	if b.Base <= 0 {
+		return fmt.Errorf("backoff base %v must be positive", b.Base)
+	}
+	if b.Cap < b.Base {
+		return fmt.Errorf("backoff cap %v must not be below the base %v", b.Cap, b.Base)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package plugin
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// BondNamespace is the resource namespace bond interfaces are advertised under.
+	BondNamespace = "bond.network.kubevirt.io"
+	// DefaultBondMaxDevices matches the default device count of bridges.
+	DefaultBondMaxDevices = MaxBridgePorts
+)
+
+// BondConfig configures the plugins of bond interfaces, e.g. for VMs attached through macvtap.
+type BondConfig struct {
+	// MaxDevices is the device count of every bond, bonds have no port limit
+	MaxDevices int
+	// MinActiveSlaves makes a bond unhealthy unless at least as many of its slaves are up, 0 disables it
+	MinActiveSlaves int
+}
+
+func isBond(link netlink.Link) bool {
+	_, ok := link.(*netlink.Bond)
+	return ok
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"kubevirt.io/client-go/log"
+)
+
+// BridgeVLANConfig configures the per-VLAN resources of VLAN-filtering bridges, e.g.
+// bridge.network.kubevirt.io/br0.vlan100 for VLAN 100 trunked on the uplink of br0.
+type BridgeVLANConfig struct {
+	// MaxDevices is the device count of every VLAN, 0 uses the port slots the bridge has left
+	// when the VLAN appears
+	MaxDevices int
+}
+
+// bridgeVLANResourceName is the resource name of a VLAN of a bridge.
+func bridgeVLANResourceName(bridgeName string, vid uint16) string {
+	return fmt.Sprintf("%s.vlan%d", bridgeName, vid)
+}
+
+// trunkVLANs returns the sorted VLANs tagged on the uplinks of a VLAN-filtering bridge, uplinks
+// being the ports backed by a physical device. The PVID of a port is its untagged native VLAN
+// and isn't exposed. Bridges without VLAN filtering have no trunk VLANs.
+func trunkVLANs(ctx context.Context, lister LinkLister, bridge netlink.Link) ([]uint16, int, error) {
+	br, ok := bridge.(*netlink.Bridge)
+	if !ok || br.VlanFiltering == nil || !*br.VlanFiltering {
+		return nil, 0, nil
+	}
+	links, err := listLinks(ctx, lister)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not list links: %v", err)
+	}
+	vlanTable, err := lister.BridgeVlanList()
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not list the bridge VLANs: %v", err)
+	}
+
+	byIndex := make(map[int]netlink.Link, len(links))
+	for _, link := range links {
+		byIndex[link.Attrs().Index] = link
+	}
+	ports := 0
+	vids := map[uint16]bool{}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.MasterIndex != br.Index {
+			continue
+		}
+		ports++
+		if physicalDevice(link, byIndex) == nil {
+			continue
+		}
+		for _, info := range vlanTable[int32(attrs.Index)] {
+			if info.Flags&nl.BRIDGE_VLAN_INFO_PVID == 0 {
+				vids[info.Vid] = true
+			}
+		}
+	}
+
+	ret := make([]uint16, 0, len(vids))
+	for vid := range vids {
+		ret = append(ret, vid)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, ports, nil
+}
+
+// newBridgeVLANPlugins creates a plugin per VLAN trunked on the uplinks of the bridge.
+func newBridgeVLANPlugins(bridge netlink.Link, config *BridgeVLANConfig, opts []PluginOption) ([]Device, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDiscoveryTimeout)
+	defer cancel()
+	vids, ports, err := trunkVLANs(ctx, linkSourceOf(opts), bridge)
+	if err != nil {
+		return nil, err
+	}
+	maxDevices := config.MaxDevices
+	if maxDevices == 0 {
+		maxDevices = max(MaxBridgePorts-ports, 0)
+	}
+
+	bridgeName := bridge.Attrs().Name
+	ret := make([]Device, 0, len(vids))
+	for _, vid := range vids {
+		vlanOpts := append(append([]PluginOption{}, opts...), WithBridgeVLAN(vid))
+		dev, err := NewBridgeDevicePlugin(bridgeName, clampMaxDevices(bridgeName, maxDevices), vlanOpts...)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, dev)
+	}
+	if len(ret) > 0 {
+		log.DefaultLogger().V(4).Infof("bridge %s trunks VLANs %v on its uplinks", bridgeName, vids)
+	}
+	return ret, nil
+}
+
+// bridgeVLANOf returns the VLAN a plugin is exposing, 0 if it exposes a whole link.
+func bridgeVLANOf(dev Device) uint16 {
+	if vlan, ok := dev.(interface{ GetBridgeVLAN() uint16 }); ok {
+		return vlan.GetBridgeVLAN()
+	}
+	return 0
+}
@@ -2,8 +2,13 @@ package plugin
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc"
@@ -14,19 +19,174 @@ import (
 
 const (
 	scheme = "unix"
+
+	// DefaultSocketPrefix is the socket file name prefix used unless configured otherwise
+	DefaultSocketPrefix = "kubevirt-"
+	socketSuffix        = ".sock"
+	// maxSocketPathLength is the portable unix socket path limit (sun_path), longer endpoints are hash-shortened.
+	maxSocketPathLength = 104
+	endpointHashLength  = 8
+
+	// maxResourceNameLength is the limit of the name part of an extended resource name.
+	maxResourceNameLength = 63
 )
 
+// DefaultDevicePluginDir is where kubelet expects device plugin sockets unless configured otherwise.
+const DefaultDevicePluginDir = pluginapi.DevicePluginPath
+
+// kubeletCheckpointFile is where kubelet checkpoints device allocations in the device plugin directory.
+const kubeletCheckpointFile = "kubelet_internal_checkpoint"
+
+// reservedEndpoints are file names kubelet owns in the device plugin directory.
+var reservedEndpoints = map[string]bool{
+	filepath.Base(pluginapi.KubeletSocket): true,
+	kubeletCheckpointFile:                  true,
+}
+
+// InvalidEndpointError is returned when a plugin's socket endpoint can't be registered with kubelet.
+type InvalidEndpointError struct {
+	Endpoint string
+	Reason   string
+}
+
+func (e *InvalidEndpointError) Error() string {
+	return fmt.Sprintf("invalid device plugin endpoint %q: %s", e.Endpoint, e.Reason)
+}
+
 type deviceHealth struct {
 	DevId  string
 	Health string
 }
 
+// SocketPath returns the plugin socket path for the given device name.
+// Endpoints that would exceed the socket path limit are deterministically shortened with a hash of the name.
 func SocketPath(deviceName string) string {
-	return filepath.Join(pluginapi.DevicePluginPath, fmt.Sprintf("kubevirt-%s.sock", deviceName))
+	return prefixedSocketPath(DefaultDevicePluginDir, DefaultSocketPrefix, deviceName)
+}
+
+func prefixedSocketPath(dir, prefix, deviceName string) string {
+	return filepath.Join(dir, endpointName(dir, prefix, deviceName))
+}
+
+func endpointName(dir, prefix, deviceName string) string {
+	endpoint := prefix + deviceName + socketSuffix
+	maxLength := maxEndpointLength(dir)
+	if len(endpoint) <= maxLength {
+		return endpoint
+	}
+
+	hash := shortHash(deviceName)
+	keep := maxLength - len(prefix) - len(socketSuffix) - len(hash) - 1
+	if keep < 0 {
+		keep = 0
+	}
+	return fmt.Sprintf("%s%s-%s%s", prefix, deviceName[:keep], hash, socketSuffix)
+}
+
+// shortHash deterministically identifies a name in shortened or sanitized names.
+func shortHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:endpointHashLength]
+}
+
+// sanitizeResourceName turns an interface name into a valid extended resource name part: lower case
+// alphanumerics, '-', '_' and '.', starting and ending with an alphanumeric, at most 63 characters.
+// Names that had to be changed get a hash of the original name appended, so distinct interfaces
+// never end up with the same resource. It reports whether the name was changed.
+func sanitizeResourceName(name string) (string, bool) {
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, name)
+	isAlphanumeric := func(r rune) bool {
+		return (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+	}
+	sanitized = strings.TrimFunc(sanitized, func(r rune) bool { return !isAlphanumeric(r) })
+	if sanitized == name && len(name) <= maxResourceNameLength {
+		return name, false
+	}
+
+	hash := shortHash(name)
+	keep := maxResourceNameLength - len(hash) - 1
+	if len(sanitized) > keep {
+		sanitized = strings.TrimRightFunc(sanitized[:keep], func(r rune) bool { return !isAlphanumeric(r) })
+	}
+	if sanitized == "" {
+		return hash, true
+	}
+	return sanitized + "-" + hash, true
+}
+
+// ValidateResourceName checks that the name is valid as the name part of an extended resource name.
+func ValidateResourceName(name string) error {
+	if _, changed := sanitizeResourceName(name); changed {
+		return fmt.Errorf("resource name %q must be at most %d lower case alphanumeric characters, '-', '_' or '.', starting and ending with an alphanumeric character",
+			name, maxResourceNameLength)
+	}
+	return nil
+}
+
+// ValidateResourceNamespace checks that the namespace is a DNS-1123 subdomain outside of the
+// kubernetes.io domains, which are reserved for native resources.
+func ValidateResourceNamespace(namespace string) error {
+	if namespace == "" || len(namespace) > 253 {
+		return fmt.Errorf("resource namespace %q must have 1 to 253 characters", namespace)
+	}
+	for _, label := range strings.Split(namespace, ".") {
+		if !dns1123Label.MatchString(label) {
+			return fmt.Errorf("resource namespace %q must be a DNS-1123 subdomain, e.g. net.example.com", namespace)
+		}
+	}
+	if namespace == "kubernetes.io" || strings.HasSuffix(namespace, ".kubernetes.io") {
+		return fmt.Errorf("resource namespace %q is reserved for native resources", namespace)
+	}
+	return nil
+}
+
+var dns1123Label = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+func maxEndpointLength(dir string) int {
+	return maxSocketPathLength - len(filepath.Clean(dir)) - 1
+}
+
+// EnsureDevicePluginDir creates the device plugin directory if it doesn't exist yet.
+func EnsureDevicePluginDir(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("device plugin directory %s doesn't exist and can't be created: %v", dir, err)
+	}
+	return checkSocketDir(dir)
+}
+
+// ValidateSocketPrefix checks that the prefix keeps sockets inside the device plugin directory.
+func ValidateSocketPrefix(prefix string) error {
+	if strings.ContainsRune(prefix, filepath.Separator) || strings.HasPrefix(prefix, ".") {
+		return fmt.Errorf("socket prefix %q must not contain %q or start with a dot", prefix, filepath.Separator)
+	}
+	return nil
+}
+
+// ValidateSocketPath checks that the endpoint kubelet is told about is usable, before any socket is created.
+func ValidateSocketPath(socketPath string) error {
+	endpoint := filepath.Base(socketPath)
+	switch {
+	case reservedEndpoints[endpoint]:
+		return &InvalidEndpointError{Endpoint: endpoint, Reason: "name is reserved by kubelet"}
+	case !strings.HasSuffix(endpoint, socketSuffix) || endpoint == socketSuffix:
+		return &InvalidEndpointError{Endpoint: endpoint, Reason: fmt.Sprintf("name must end with %q", socketSuffix)}
+	case len(socketPath) > maxSocketPathLength:
+		return &InvalidEndpointError{Endpoint: endpoint, Reason: fmt.Sprintf("socket path exceeds %d characters", maxSocketPathLength)}
+	}
+	return nil
 }
 
-func waitForGRPCServer(socketPath string, timeout time.Duration) error {
-	conn, err := gRPCConnect(socketPath, timeout)
+func waitForGRPCServer(ctx context.Context, socketPath string, timeout time.Duration) error {
+	conn, err := gRPCConnect(ctx, socketPath, timeout)
 	if err != nil {
 		return err
 	}
@@ -34,7 +194,8 @@ func waitForGRPCServer(socketPath string, timeout time.Duration) error {
 	return nil
 }
 
-func gRPCConnect(socketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
+// gRPCConnect dials the unix socket and waits until the connection is ready, the timeout or ctx expire.
+func gRPCConnect(ctx context.Context, socketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
 	grpcPath := fmt.Sprintf("%s://%s", scheme, socketPath)
 	conn, err := grpc.NewClient(grpcPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
 
@@ -42,7 +203,7 @@ func gRPCConnect(socketPath string, timeout time.Duration) (*grpc.ClientConn, er
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 
 	defer cancel()
 
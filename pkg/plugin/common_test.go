@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSocketPathShortensLongEndpoints(t *testing.T) {
+	if path := SocketPath("br0"); path != filepath.Join(DefaultDevicePluginDir, "kubevirt-br0.sock") {
+		t.Errorf("the socket path of br0 is %s", path)
+	}
+
+	long := strings.Repeat("a", 200)
+	path := SocketPath(long)
+	if len(path) > maxSocketPathLength {
+		t.Errorf("the socket path %s exceeds %d characters", path, maxSocketPathLength)
+	}
+	if err := ValidateSocketPath(path); err != nil {
+		t.Errorf("the shortened socket path is invalid: %v", err)
+	}
+	if SocketPath(long) != path {
+		t.Error("shortening the socket path isn't deterministic")
+	}
+	// Names sharing the kept prefix still get distinct sockets
+	if other := SocketPath(long + "b"); other == path {
+		t.Errorf("%s is the socket path of two names", path)
+	}
+}
+
+func TestValidateSocketPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		invalid bool
+	}{
+		{name: "plugin socket", path: "/var/lib/kubelet/device-plugins/kubevirt-br0.sock"},
+		{name: "kubelet socket", path: "/var/lib/kubelet/device-plugins/kubelet.sock", invalid: true},
+		{name: "kubelet checkpoint", path: "/var/lib/kubelet/device-plugins/kubelet_internal_checkpoint", invalid: true},
+		{name: "missing suffix", path: "/var/lib/kubelet/device-plugins/kubevirt-br0", invalid: true},
+		{name: "only the suffix", path: "/var/lib/kubelet/device-plugins/.sock", invalid: true},
+		{name: "too long", path: "/var/lib/kubelet/device-plugins/" + strings.Repeat("a", 100) + ".sock", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSocketPath(tt.path)
+			if !tt.invalid {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			var invalid *InvalidEndpointError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("expected an InvalidEndpointError, got %v", err)
+			}
+			if invalid.Endpoint != filepath.Base(tt.path) {
+				t.Errorf("the error names endpoint %q, expected %q", invalid.Endpoint, filepath.Base(tt.path))
+			}
+		})
+	}
+}
+
+func TestValidateSocketPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		invalid bool
+	}{
+		{prefix: DefaultSocketPrefix},
+		{prefix: "marker-"},
+		{prefix: ""},
+		{prefix: "../", invalid: true},
+		{prefix: "sub/marker-", invalid: true},
+		{prefix: ".hidden-", invalid: true},
+	}
+	for _, tt := range tests {
+		if err := ValidateSocketPrefix(tt.prefix); (err != nil) != tt.invalid {
+			t.Errorf("prefix %q got error %v, expected invalid %v", tt.prefix, err, tt.invalid)
+		}
+	}
+}
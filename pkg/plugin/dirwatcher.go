@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"kubevirt.io/client-go/log"
+)
+
+// socketWatcher is the watcher shared by all plugins of the process, so hundreds of plugins
+// don't take an inotify instance each for the same directories.
+var socketWatcher = &dirWatcher{dirs: map[string]int{}, watches: map[*fileWatch]bool{}}
+
+// dirWatcher shares one fsnotify watcher between the watches of single files, each watch is only
+// notified about its own file.
+type dirWatcher struct {
+	lock    sync.Mutex
+	watcher *fsnotify.Watcher
+	// dirs counts the watches of every watched directory
+	dirs    map[string]int
+	watches map[*fileWatch]bool
+}
+
+// fileWatch is notified when an operation happens to a file.
+type fileWatch struct {
+	watcher *dirWatcher
+	path    string
+	op      fsnotify.Op
+	events  chan fsnotify.Event
+}
+
+// watch notifies about op happening to the file at path, until the watch is closed.
+func (w *dirWatcher) watch(path string, op fsnotify.Op) (*fileWatch, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.watcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create fsnotify watcher: %v", err)
+		}
+		w.watcher = watcher
+		go w.dispatch(watcher)
+	}
+	dir := filepath.Dir(path)
+	if w.dirs[dir] == 0 {
+		if err := w.watcher.Add(dir); err != nil {
+			w.closeIfUnused()
+			return nil, fmt.Errorf("failed to watch directory %s: %v", dir, err)
+		}
+	}
+	w.dirs[dir]++
+	fw := &fileWatch{watcher: w, path: path, op: op, events: make(chan fsnotify.Event, 1)}
+	w.watches[fw] = true
+	return fw, nil
+}
+
+// Events delivers the first matching event, later ones are dropped until it is received.
+func (fw *fileWatch) Events() <-chan fsnotify.Event {
+	return fw.events
+}
+
+// Close stops the watch, the shared watcher is closed with the last one.
+func (fw *fileWatch) Close() {
+	w := fw.watcher
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.watches[fw] {
+		return
+	}
+	delete(w.watches, fw)
+	dir := filepath.Dir(fw.path)
+	w.dirs[dir]--
+	if w.dirs[dir] == 0 {
+		delete(w.dirs, dir)
+		if err := w.watcher.Remove(dir); err != nil {
+			log.DefaultLogger().V(4).Infof("could not stop watching directory %s: %v", dir, err)
+		}
+	}
+	w.closeIfUnused()
+}
+
+// closeIfUnused closes the watcher once nothing is watched, it is called with the lock held.
+func (w *dirWatcher) closeIfUnused() {
+	if len(w.watches) > 0 || w.watcher == nil {
+		return
+	}
+	w.watcher.Close()
+	w.watcher = nil
+}
+
+func (w *dirWatcher) dispatch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			w.lock.Lock()
+			for fw := range w.watches {
+				if event.Name != fw.path || event.Op&fw.op == 0 {
+					continue
+				}
+				select {
+				case fw.events <- event:
+				default:
+				}
+			}
+			w.lock.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.DefaultLogger().Errorf("Error watching socket file: %v", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestDirWatcherNotifiesOwnFileOnly(t *testing.T) {
+	dir := t.TempDir()
+	w := &dirWatcher{dirs: map[string]int{}, watches: map[*fileWatch]bool{}}
+	paths := map[string]string{}
+	watches := map[string]*fileWatch{}
+	for _, bridge := range []string{"br0", "br1"} {
+		paths[bridge] = filepath.Join(dir, bridge+".sock")
+		if err := os.WriteFile(paths[bridge], nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		fw, err := w.watch(paths[bridge], fsnotify.Remove)
+		if err != nil {
+			t.Fatal(err)
+		}
+		watches[bridge] = fw
+	}
+	if len(w.dirs) != 1 || w.dirs[dir] != 2 {
+		t.Errorf("watching directories %v, expected %s once for both files", w.dirs, dir)
+	}
+
+	if err := os.Remove(paths["br0"]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-watches["br0"].Events():
+		if event.Name != paths["br0"] {
+			t.Errorf("br0 was notified about %s", event.Name)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("br0 wasn't notified about the removal of its socket")
+	}
+	// Writes don't match the operation and the other file is untouched
+	if err := os.WriteFile(paths["br1"], []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-watches["br1"].Events():
+		t.Errorf("br1 was notified about %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	watches["br0"].Close()
+	watches["br0"].Close()
+	if w.dirs[dir] != 1 || w.watcher == nil {
+		t.Errorf("closing br0 twice left %d watches of the directory", w.dirs[dir])
+	}
+	watches["br1"].Close()
+	if len(w.dirs) != 0 || w.watcher != nil {
+		t.Error("the watcher is still open without watches")
+	}
+}
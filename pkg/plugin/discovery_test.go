@@ -0,0 +1,231 @@
+package plugin_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/netlinkfake"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin/pluginfakes"
+	"github.com/vishvananda/netlink"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestGetBridgeDevicePlugins(t *testing.T) {
+	links := netlinkfake.New()
+	links.AddBridge("br0")
+	links.AddBridge("br1")
+	links.AddBridge("docker0")
+	links.AddDevice("eth0")
+	links.AddBridge("br-nested")
+	links.SetMaster("br-nested", "br0")
+
+	defaults, err := plugin.NewBridgeFilter("", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	include, err := plugin.NewBridgeFilter("^br1$", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		filter *plugin.BridgeFilter
+		want   []string
+	}{
+		{name: "no filter", filter: nil, want: []string{"br0", "br1", "docker0"}},
+		{name: "default exclusions", filter: defaults, want: []string{"br0", "br1"}},
+		{name: "include regex", filter: include, want: []string{"br1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			devs, err := plugin.GetBridgeDevicePlugins(context.Background(), 3, nil, test.filter,
+				plugin.WithLinkSource(links), plugin.WithDevicePluginDir(t.TempDir()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, dev := range devs {
+				got = append(got, dev.GetDeviceName())
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("discovered %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// blockedLinks doesn't answer LinkList until released, like netlink on a node with a huge
+// number of links.
+type blockedLinks struct {
+	*netlinkfake.Links
+	release chan struct{}
+}
+
+func (l *blockedLinks) LinkList() ([]netlink.Link, error) {
+	<-l.release
+	return l.Links.LinkList()
+}
+
+func TestGetBridgeDevicePluginsGivesUpAtDeadline(t *testing.T) {
+	links := &blockedLinks{Links: netlinkfake.New(), release: make(chan struct{})}
+	defer close(links.release)
+	links.AddBridge("br0")
+
+	truncations := plugin.DiscoveryTruncations()
+	exported := metricValue(t, "bridge_marker_discovery_truncations_total")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	devs, err := plugin.GetBridgeDevicePlugins(ctx, 3, nil, nil,
+		plugin.WithLinkSource(links), plugin.WithDevicePluginDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("a truncated discovery failed: %v", err)
+	}
+	if len(devs) != 0 {
+		t.Errorf("discovered %d plugins without a link listing", len(devs))
+	}
+	if plugin.DiscoveryTruncations() <= truncations {
+		t.Error("the truncated discovery wasn't counted")
+	}
+	if metricValue(t, "bridge_marker_discovery_truncations_total") <= exported {
+		t.Error("the truncated discovery wasn't exported")
+	}
+}
+
+// watchPlugin starts a plugin for the bridge and watches its devices like kubelet.
+func watchPlugin(ctx context.Context, t *testing.T, h *pluginfakes.Harness, bridge string, opts ...plugin.PluginOption) *pluginfakes.DeviceStream {
+	t.Helper()
+	h.StartPlugin(ctx, newPlugin(t, h, bridge, 3, opts...))
+	return watch(ctx, t, h, resourceName(bridge))
+}
+
+func waitForHealth(ctx context.Context, t *testing.T, stream *pluginfakes.DeviceStream, health string) {
+	t.Helper()
+	if _, err := stream.WaitFor(ctx, pluginfakes.AllHealth(health)); err != nil {
+		t.Fatalf("devices didn't become %s: %v", health, err)
+	}
+}
+
+func TestPluginHealthFollowsBridge(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	stream := watchPlugin(ctx, t, h, "br0")
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+
+	h.Links.SetUp("br0", false)
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+	h.Links.SetUp("br0", true)
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+}
+
+func TestPluginHealthChangesBeforeKubeletWatches(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3)
+	h.StartPlugin(ctx, dev)
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+
+	// Nobody watches the devices yet, the health check must keep up with the bridge anyway
+	h.Links.SetUp("br0", false)
+	h.Links.SetUp("br0", true)
+	h.Links.SetUp("br0", false)
+	eventually(ctx, t, "br0 stayed healthy", func() bool { return !dev.Healthy() })
+
+	stream := watch(ctx, t, h, resourceName("br0"))
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+	h.Links.SetUp("br0", true)
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+}
+
+func TestPluginBridgeDeletedAndRecreated(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	stream := watchPlugin(ctx, t, h, "br0")
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+
+	h.Links.RemoveLink("br0")
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+	// The new bridge has another ifindex
+	h.Links.AddBridge("br0")
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+	// and is followed from then on
+	h.Links.SetUp("br0", false)
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+}
+
+func TestPluginBridgeRecreatedRightAway(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3)
+	h.StartPlugin(ctx, dev)
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+	eventually(ctx, t, "br0 didn't become healthy", dev.Healthy)
+
+	// Both updates are queued before the plugin handles the deletion, so the bridge is back
+	// by the time it looks it up
+	h.Links.RemoveLink("br0")
+	h.Links.AddBridge("br0")
+	h.Links.SetUp("br0", false)
+	eventually(ctx, t, "the recreated br0 going down wasn't seen", func() bool { return !dev.Healthy() })
+	h.Links.SetUp("br0", true)
+	eventually(ctx, t, "the plugin isn't following the recreated br0", dev.Healthy)
+}
+
+func TestControllerStopsPluginOfDeletedBridge(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	c := runController(t, h, []plugin.Device{newPlugin(t, h, "br0", 3)})
+	stream, err := dial(ctx, t, h, resourceName("br0")).Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+
+	h.Links.RemoveLink("br0")
+	// The stopped plugin deregisters its devices with an empty list
+	if _, err := stream.WaitFor(ctx, pluginfakes.Empty); err != nil {
+		t.Fatal(err)
+	}
+	eventually(ctx, t, "the plugin of br0 wasn't stopped", func() bool {
+		return len(c.Status()) == 0
+	})
+}
+
+func TestPluginsShareLinkSubscription(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	var streams []*pluginfakes.DeviceStream
+	for _, bridge := range []string{"br0", "br1", "br2"} {
+		h.Links.AddBridge(bridge)
+		streams = append(streams, watchPlugin(ctx, t, h, bridge))
+	}
+	for _, stream := range streams {
+		waitForHealth(ctx, t, stream, pluginapi.Healthy)
+	}
+	if subscribers := h.Links.Subscribers(); subscribers != 1 {
+		t.Errorf("%d subscriptions to link updates for three plugins, expected a shared one", subscribers)
+	}
+
+	// Each plugin still only follows its own bridge
+	h.Links.SetUp("br1", false)
+	waitForHealth(ctx, t, streams[1], pluginapi.Unhealthy)
+	for _, i := range []int{0, 2} {
+		if devices := streams[i].Lists(); !pluginfakes.AllHealth(pluginapi.Healthy)(devices[len(devices)-1]) {
+			t.Errorf("br%d went unhealthy with br1", i)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"kubevirt.io/client-go/log"
+)
+
+// DefaultExcludedBridges matches bridges created by container runtimes, CNIs and libvirt,
+// which are not meant to be attached to by VMs.
+var DefaultExcludedBridges = regexp.MustCompile(
+	`^(docker[0-9]+|cni[0-9]+|cbr0|virbr[0-9]+|lxcbr[0-9]+|lxdbr[0-9]+|podman[0-9]+|kube-bridge|br-[0-9a-f]{12})$`)
+
+// FilterMatchPolicy is which names of a link the bridge filter is evaluated against.
+type FilterMatchPolicy string
+
+const (
+	// FilterMatchPrimaryOnly evaluates the filter against the kernel name of a link only.
+	FilterMatchPrimaryOnly FilterMatchPolicy = "primary-only"
+	// FilterMatchAny evaluates the filter against the kernel name and the alternative names of a
+	// link: it is hidden when any of its names is, and included when any of them is.
+	FilterMatchAny FilterMatchPolicy = "any"
+)
+
+// ParseFilterMatchPolicy validates the name of a filter match policy.
+func ParseFilterMatchPolicy(name string) (FilterMatchPolicy, error) {
+	switch policy := FilterMatchPolicy(name); policy {
+	case FilterMatchPrimaryOnly, FilterMatchAny:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown filter match policy %q, expected %s or %s", name, FilterMatchPrimaryOnly, FilterMatchAny)
+}
+
+// BridgeFilter selects the bridges that are exposed by name, exclusion takes precedence over inclusion.
+type BridgeFilter struct {
+	// Bridges, when set, are exactly the exposed bridges, they are exposed whether or not they
+	// exist so their capacity appears as soon as they are created
+	Bridges map[string]bool
+	// Overrides expose single bridges, true, or hide them, false, regardless of the regexes
+	Overrides map[string]bool
+	// Defaults and Settings are the plugin settings of all bridges and of single bridges
+	Defaults BridgeSettings
+	Settings map[string]BridgeSettings
+	// Include, when set, is matched by every exposed bridge
+	Include *regexp.Regexp
+	// Exclude, when set, is matched by no exposed bridge
+	Exclude *regexp.Regexp
+	// ExcludeDefaults also excludes the bridges matching DefaultExcludedBridges
+	ExcludeDefaults bool
+	// MatchPolicy is which names of a link the regexes and Overrides are evaluated against, the
+	// kernel name only unless it is FilterMatchAny. Bridges and Settings always use the kernel name.
+	MatchPolicy FilterMatchPolicy
+	// OVSBridges also exposes Open vSwitch bridges, not just Linux bridges
+	OVSBridges bool
+	// Bonds, when set, also exposes bond interfaces with the given configuration
+	Bonds *BondConfig
+	// VLANs also exposes VLAN sub-interfaces
+	VLANs bool
+	// BridgeVLANs, when set, also exposes every VLAN trunked on the uplinks of VLAN-filtering bridges
+	BridgeVLANs *BridgeVLANConfig
+	// IncludeEnslaved also exposes links enslaved to another interface, e.g. a bridge in a bond
+	// or in another bridge, which aren't usable as attachment points themselves
+	IncludeEnslaved bool
+	// RequireUplink only exposes Linux bridges with a physical device among their ports, directly,
+	// through a bond or below a stacked device like a VLAN sub-interface
+	RequireUplink bool
+
+	// logged are the bridges whose exclusion was logged
+	logged sync.Map
+}
+
+// NewBridgeFilter compiles the include and exclude expressions, empty ones are not applied.
+func NewBridgeFilter(include, exclude string, excludeDefaults bool) (*BridgeFilter, error) {
+	filter := &BridgeFilter{ExcludeDefaults: excludeDefaults}
+	var err error
+	if include != "" {
+		if filter.Include, err = regexp.Compile(include); err != nil {
+			return nil, fmt.Errorf("invalid bridge include regex %q: %v", include, err)
+		}
+	}
+	if exclude != "" {
+		if filter.Exclude, err = regexp.Compile(exclude); err != nil {
+			return nil, fmt.Errorf("invalid bridge exclude regex %q: %v", exclude, err)
+		}
+	}
+	return filter, nil
+}
+
+// SetBridges restricts the filter to exactly the named bridges, which can't be combined with
+// the regexes.
+func (f *BridgeFilter) SetBridges(names []string) error {
+	if f.Include != nil || f.Exclude != nil {
+		return fmt.Errorf("a bridge list can't be combined with the bridge include and exclude regexes")
+	}
+	f.Bridges = make(map[string]bool, len(names))
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("the bridge list contains an empty name")
+		}
+		f.Bridges[name] = true
+	}
+	return nil
+}
+
+// settings returns the effective plugin settings of the bridge.
+func (f *BridgeFilter) settings(bridgeName string) BridgeSettings {
+	if f == nil {
+		return BridgeSettings{}
+	}
+	return f.Settings[bridgeName].Merge(f.Defaults)
+}
+
+// listed reports whether the bridge is in the bridge list, listed bridges are kept when they are missing.
+func (f *BridgeFilter) listed(bridgeName string) bool {
+	return f != nil && f.Bridges[bridgeName]
+}
+
+// listedBridges returns the bridge list, nil when the filter doesn't restrict the bridges to one.
+func (f *BridgeFilter) listedBridges() map[string]bool {
+	if f == nil {
+		return nil
+	}
+	return f.Bridges
+}
+
+// Matches reports whether the bridge is exposed by its name, a nil filter exposes every bridge.
+func (f *BridgeFilter) Matches(bridgeName string) bool {
+	return f.matches([]string{bridgeName})
+}
+
+// MatchesLink reports whether the link is exposed, by its kernel name or, with FilterMatchAny,
+// by all its names as known to lister.
+func (f *BridgeFilter) MatchesLink(link netlink.Link, lister LinkLister) bool {
+	if f == nil || f.MatchPolicy != FilterMatchAny {
+		return f.Matches(link.Attrs().Name)
+	}
+	return f.matches(linkNames(link, lister))
+}
+
+// matches evaluates the filter against the names of a bridge, its kernel name first.
+func (f *BridgeFilter) matches(names []string) bool {
+	if f == nil {
+		return true
+	}
+	reason := f.exclusionReason(names)
+	if reason == "" {
+		return true
+	}
+	if _, logged := f.logged.LoadOrStore(names[0], true); !logged {
+		log.DefaultLogger().Infof("bridge %s is not exposed, %s", names[0], reason)
+	}
+	return false
+}
+
+// isBridge reports whether the link is a bridge, or another kind of link enabled by the filter,
+// that can be exposed. A nil filter only accepts Linux bridges.
+func (f *BridgeFilter) isBridge(link netlink.Link) bool {
+	if _, ok := link.(*netlink.Bridge); ok {
+		return true
+	}
+	if f == nil {
+		return false
+	}
+	return (f.OVSBridges && isOVSBridge(link)) || (f.Bonds != nil && isBond(link)) || (f.VLANs && isVLAN(link))
+}
+
+// enslaved reports whether the link is enslaved to another interface and not exposed because of
+// it. OVS bridges are always enslaved to the datapath and not considered enslaved. A nil filter
+// doesn't expose enslaved links either.
+func (f *BridgeFilter) enslaved(link netlink.Link) bool {
+	if link.Attrs().MasterIndex == 0 || isOVSBridge(link) || (f != nil && f.IncludeEnslaved) {
+		return false
+	}
+	log.DefaultLogger().V(4).Infof("bridge %s is not exposed while it is enslaved to another interface", link.Attrs().Name)
+	return true
+}
+
+// bridgeVLANs returns the configuration of the exposed bridge VLANs, nil when they aren't exposed.
+func (f *BridgeFilter) bridgeVLANs() *BridgeVLANConfig {
+	if f == nil {
+		return nil
+	}
+	return f.BridgeVLANs
+}
+
+// requiresUplink reports whether bridges need a physical uplink, a nil filter doesn't require one.
+func (f *BridgeFilter) requiresUplink() bool {
+	return f != nil && f.RequireUplink
+}
+
+// missingUplink reports whether the filter requires a physical uplink the bridge doesn't have.
+// links are the links of the node, nil lists them through lister.
+func (f *BridgeFilter) missingUplink(link netlink.Link, links []netlink.Link, lister LinkLister) bool {
+	if f == nil || !f.RequireUplink {
+		return false
+	}
+	// Ports of other kinds of links aren't enslaved to them, e.g. OVS ports to ovs-system
+	if _, ok := link.(*netlink.Bridge); !ok {
+		return false
+	}
+	name := link.Attrs().Name
+	if links == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultDiscoveryTimeout)
+		defer cancel()
+		var err error
+		if links, err = listLinks(ctx, lister); err != nil {
+			log.DefaultLogger().Reason(err).Warningf("could not list links to find the uplink of bridge %s, exposing it", name)
+			return false
+		}
+	}
+	if hasPhysicalUplink(links, link.Attrs().Index) {
+		return false
+	}
+	log.DefaultLogger().V(4).Infof("bridge %s is not exposed until a physical uplink is attached to it", name)
+	return true
+}
+
+// exclusionReason explains why the bridge with the given names, its kernel name first, is not
+// exposed, naming the alternative name that decided it. It is empty for exposed bridges.
+func (f *BridgeFilter) exclusionReason(names []string) string {
+	bridgeName := names[0]
+	if f.Bridges != nil {
+		if !f.Bridges[bridgeName] {
+			return "it isn't in the bridge list"
+		}
+		return ""
+	}
+	subject := func(name string) string {
+		if name == bridgeName {
+			return "it"
+		}
+		return "its alternative name " + name
+	}
+	exposed := false
+	for _, name := range names {
+		if expose, exists := f.Overrides[name]; exists {
+			if !expose {
+				return fmt.Sprintf("%s is hidden by its bridge settings", subject(name))
+			}
+			exposed = true
+		}
+	}
+	if exposed {
+		return ""
+	}
+	for _, name := range names {
+		switch {
+		case f.Exclude != nil && f.Exclude.MatchString(name):
+			return fmt.Sprintf("%s matches the exclude regex %s", subject(name), f.Exclude)
+		case f.ExcludeDefaults && DefaultExcludedBridges.MatchString(name):
+			return fmt.Sprintf("%s is a well-known infrastructure bridge, use --expose-all-bridges to expose it", subject(name))
+		}
+	}
+	if f.Include != nil && !slices.ContainsFunc(names, f.Include.MatchString) {
+		if len(names) > 1 {
+			return fmt.Sprintf("none of its names match the include regex %s", f.Include)
+		}
+		return fmt.Sprintf("it doesn't match the include regex %s", f.Include)
+	}
+	return ""
+}
@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// altNameStub knows the alternative names of every link.
+type altNameStub struct {
+	stubLister
+	altNames []string
+}
+
+func (l *altNameStub) LinkAltNames(index int) ([]string, error) {
+	return l.altNames, nil
+}
+
+func TestBridgeFilterMatchesAltNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		include   string
+		exclude   string
+		overrides map[string]bool
+		// exposed by policy primary-only and any
+		primaryOnly bool
+		any         bool
+	}{
+		{name: "no regexes", primaryOnly: true, any: true},
+		{name: "primary name included", include: "^br0$", primaryOnly: true, any: true},
+		{name: "alternative name included", include: "^uplink-net$", primaryOnly: false, any: true},
+		{name: "no name included", include: "^br1$", primaryOnly: false, any: false},
+		{name: "primary name excluded", exclude: "^br0$", primaryOnly: false, any: false},
+		{name: "alternative name excluded", exclude: "^uplink-net$", primaryOnly: true, any: false},
+		{name: "included by primary and excluded by alternative name", include: "^br0$", exclude: "^uplink", primaryOnly: true, any: false},
+		{name: "alternative name hidden", overrides: map[string]bool{"uplink-net": false}, primaryOnly: true, any: false},
+		{name: "alternative name exposed", exclude: "^br", overrides: map[string]bool{"uplink-net": true}, primaryOnly: false, any: true},
+	}
+	lister := &altNameStub{altNames: []string{"uplink-net"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, policy := range []FilterMatchPolicy{FilterMatchPrimaryOnly, FilterMatchAny} {
+				filter, err := NewBridgeFilter(tt.include, tt.exclude, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				filter.Overrides, filter.MatchPolicy = tt.overrides, policy
+				expected := tt.primaryOnly
+				if policy == FilterMatchAny {
+					expected = tt.any
+				}
+				if exposed := filter.MatchesLink(testBridge(1, "br0"), lister); exposed != expected {
+					t.Errorf("with policy %s the bridge is exposed: %v, expected %v", policy, exposed, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestBridgeFilterDefaultExclusionOfAltName(t *testing.T) {
+	filter, err := NewBridgeFilter("", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter.MatchPolicy = FilterMatchAny
+	lister := &altNameStub{altNames: []string{"docker0"}}
+	if filter.MatchesLink(testBridge(1, "br0"), lister) {
+		t.Error("a bridge whose alternative name is a default exclusion is exposed")
+	}
+	if reason := filter.exclusionReason([]string{"br0", "docker0"}); !strings.Contains(reason, "docker0") {
+		t.Errorf("the exclusion reason %q doesn't name the matching alternative name", reason)
+	}
+}
+
+func TestBridgeFilterWithoutAltNameLister(t *testing.T) {
+	filter, err := NewBridgeFilter("", "^uplink-net$", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter.MatchPolicy = FilterMatchAny
+	// Sources that don't know alternative names match the kernel name only
+	var lister LinkLister = &stubLister{links: []netlink.Link{testBridge(1, "br0")}}
+	if !filter.MatchesLink(testBridge(1, "br0"), lister) {
+		t.Error("the bridge is hidden by a name it doesn't have")
+	}
+}
+
+func TestParseFilterMatchPolicy(t *testing.T) {
+	for _, name := range []string{"any", "primary-only"} {
+		if policy, err := ParseFilterMatchPolicy(name); err != nil || string(policy) != name {
+			t.Errorf("parsing %q returned %q, %v", name, policy, err)
+		}
+	}
+	if _, err := ParseFilterMatchPolicy("all"); err == nil {
+		t.Error("an unknown policy was accepted")
+	}
+}
+
+func TestBridgeFilterSetBridges(t *testing.T) {
+	tests := []struct {
+		name       string
+		include    string
+		exclude    string
+		bridges    []string
+		wantErr    bool
+		matches    []string
+		notMatches []string
+	}{
+		{
+			name:       "only listed bridges",
+			bridges:    []string{"br-storage", "br-vm"},
+			matches:    []string{"br-storage", "br-vm"},
+			notMatches: []string{"br0", "br-storage2"},
+		},
+		{
+			name:    "listed bridges override the default exclusions",
+			bridges: []string{"virbr0"},
+			matches: []string{"virbr0"},
+		},
+		{name: "combined with an include regex", include: "^br-", bridges: []string{"br-vm"}, wantErr: true},
+		{name: "combined with an exclude regex", exclude: "^br-int$", bridges: []string{"br-vm"}, wantErr: true},
+		{name: "empty name", bridges: []string{"br-vm", ""}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewBridgeFilter(tt.include, tt.exclude, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = filter.SetBridges(tt.bridges)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected an error %v", err, tt.wantErr)
+			}
+			for _, name := range tt.matches {
+				if !filter.Matches(name) {
+					t.Errorf("listed bridge %s doesn't match", name)
+				}
+			}
+			for _, name := range tt.notMatches {
+				if filter.Matches(name) {
+					t.Errorf("bridge %s matches without being listed", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package plugin
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// ServerMetrics records the RPCs served by device plugins, e.g. to see how long Allocate takes
+// from the plugin's side. Create one per registry and share it between the plugins.
+type ServerMetrics struct {
+	started  *metrics.CounterVec
+	handled  *metrics.CounterVec
+	duration *metrics.HistogramVec
+}
+
+// NewServerMetrics registers the RPC metrics with the registry, e.g. metrics.Default.
+func NewServerMetrics(registry *metrics.Registry) *ServerMetrics {
+	return &ServerMetrics{
+		started: registry.NewCounterVec("bridge_marker_grpc_server_started_total",
+			"The number of RPCs started by kubelet, for ListAndWatch the number of streams established.",
+			"resource", "method"),
+		handled: registry.NewCounterVec("bridge_marker_grpc_server_handled_total",
+			"The number of RPCs completed, by their status code.", "resource", "method", "code"),
+		duration: registry.NewHistogramVec("bridge_marker_grpc_server_handling_seconds",
+			"How long unary RPCs, e.g. Allocate, took to handle.", metrics.DefaultBuckets, "resource", "method"),
+	}
+}
+
+func (m *ServerMetrics) unaryInterceptor(resourceName string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		method := path.Base(info.FullMethod)
+		m.started.Inc(resourceName, method)
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.duration.Observe(time.Since(start).Seconds(), resourceName, method)
+		m.handled.Inc(resourceName, method, status.Code(err).String())
+		return resp, err
+	}
+}
+
+// streamInterceptor doesn't observe the duration, streams last as long as kubelet watches.
+func (m *ServerMetrics) streamInterceptor(resourceName string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		method := path.Base(info.FullMethod)
+		m.started.Inc(resourceName, method)
+		err := handler(srv, ss)
+		m.handled.Inc(resourceName, method, status.Code(err).String())
+		return err
+	}
+}
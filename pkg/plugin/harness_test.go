@@ -0,0 +1,159 @@
+package plugin_test
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/metrics"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin/pluginfakes"
+)
+
+// testTimeout bounds every wait of a test, nothing should take close to it.
+const testTimeout = 30 * time.Second
+
+func newHarness(t *testing.T) *pluginfakes.Harness {
+	t.Helper()
+	h, err := pluginfakes.NewHarness(t.TempDir())
+	if err != nil {
+		t.Fatalf("could not start the harness: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := h.Close(); err != nil {
+			t.Errorf("plugins failed: %v", err)
+		}
+	})
+	return h
+}
+
+func testContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// newPlugin creates a plugin for the bridge with the harness' options.
+func newPlugin(t *testing.T, h *pluginfakes.Harness, bridge string, maxDevices int, opts ...plugin.PluginOption) *plugin.BridgeDevicePlugin {
+	t.Helper()
+	dev, err := h.NewPlugin(bridge, maxDevices, opts...)
+	if err != nil {
+		t.Fatalf("could not create the plugin of %s: %v", bridge, err)
+	}
+	return dev
+}
+
+// testController is a controller run by a test until it ends.
+type testController struct {
+	*plugin.BridgeDeviceController
+	run func()
+}
+
+// runController runs a controller of the permanent plugins until the test ends, it doesn't
+// drain on shutdown unless opts ask for it.
+func runController(t *testing.T, h *pluginfakes.Harness, permanent []plugin.Device, opts ...plugin.ControllerOption) *plugin.BridgeDeviceController {
+	t.Helper()
+	c := runControllerLater(t, h, permanent, opts...)
+	c.run()
+	return c.BridgeDeviceController
+}
+
+// runControllerLater creates the controller like runController, it runs once run is called.
+func runControllerLater(t *testing.T, h *pluginfakes.Harness, permanent []plugin.Device, opts ...plugin.ControllerOption) *testController {
+	t.Helper()
+	opts = append(append(h.ControllerOptions(), plugin.WithDrainGracePeriod(0)), opts...)
+	c := &testController{BridgeDeviceController: plugin.NewBridgeDeviceController(permanent, 3, opts...)}
+	ctx, cancel := context.WithCancel(context.Background())
+	var done chan struct{}
+	c.run = func() {
+		done = make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := c.Run(ctx); err != nil {
+				t.Errorf("the controller failed: %v", err)
+			}
+		}()
+	}
+	t.Cleanup(func() {
+		cancel()
+		if done != nil {
+			<-done
+		}
+	})
+	return c
+}
+
+// waitForRegistration waits until the resource registered with the fake kubelet.
+func waitForRegistration(ctx context.Context, t *testing.T, h *pluginfakes.Harness, resourceName string) {
+	t.Helper()
+	if _, err := h.Kubelet.WaitForRegistration(ctx, resourceName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dial connects to the registered resource like kubelet does.
+func dial(ctx context.Context, t *testing.T, h *pluginfakes.Harness, resourceName string) *pluginfakes.PluginClient {
+	t.Helper()
+	client, err := h.Dial(ctx, resourceName)
+	if err != nil {
+		t.Fatalf("could not dial %s: %v", resourceName, err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// watch streams the device lists of the registered resource like kubelet does.
+func watch(ctx context.Context, t *testing.T, h *pluginfakes.Harness, resourceName string) *pluginfakes.DeviceStream {
+	t.Helper()
+	stream, err := dial(ctx, t, h, resourceName).Watch(ctx)
+	if err != nil {
+		t.Fatalf("could not watch %s: %v", resourceName, err)
+	}
+	return stream
+}
+
+// stopBeforeClients stops the plugin before the clients dialed so far are closed. A plugin with a
+// fake clock has to deregister through a ListAndWatch stream, the clock never times it out.
+func stopBeforeClients(t *testing.T, run *pluginfakes.PluginRun) {
+	t.Helper()
+	t.Cleanup(func() {
+		if err := run.Stop(); err != nil {
+			t.Errorf("the plugin failed: %v", err)
+		}
+	})
+}
+
+// eventually polls the condition until it holds or the test times out.
+func eventually(ctx context.Context, t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for !condition() {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%s: %v", what, ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// metricValue scrapes the marker's metrics and returns the value of the sample, e.g.
+// `bridge_marker_netlink_events_total{type="new"}`, 0 if it isn't there.
+func metricValue(t *testing.T, sample string) float64 {
+	t.Helper()
+	var b strings.Builder
+	if err := metrics.Default.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if value, found := strings.CutPrefix(line, sample+" "); found {
+			ret, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("invalid sample %q: %v", line, err)
+			}
+			return ret
+		}
+	}
+	return 0
+}
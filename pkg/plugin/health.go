@@ -0,0 +1,396 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// DefaultHealthHistorySize is the number of health transitions kept per plugin.
+const DefaultHealthHistorySize = 32
+
+// HealthReason explains the health reported for a bridge.
+type HealthReason string
+
+const (
+	HealthReasonUp        HealthReason = "Up"
+	HealthReasonDown      HealthReason = "Down"
+	HealthReasonNoCarrier HealthReason = "NoCarrier"
+	HealthReasonMissing   HealthReason = "Missing"
+	// HealthReasonNoPortUp means fewer ports, or bond slaves, are up than required
+	HealthReasonNoPortUp HealthReason = "NoPortUp"
+)
+
+// Health returns the device plugin health corresponding to the reason.
+func (r HealthReason) Health() string {
+	if r == HealthReasonUp {
+		return pluginapi.Healthy
+	}
+	return pluginapi.Unhealthy
+}
+
+// HealthMode is the criterion for a bridge to be healthy.
+type HealthMode string
+
+const (
+	// HealthModeOperUp requires the bridge to be operationally up.
+	HealthModeOperUp HealthMode = "oper-up"
+	// HealthModeAdminUp requires the bridge to be administratively up, e.g. a bridge without ports is healthy.
+	HealthModeAdminUp HealthMode = "admin-up"
+	// HealthModeExists only requires the bridge to exist.
+	HealthModeExists HealthMode = "exists"
+)
+
+// ParseHealthMode validates the name of a health mode.
+func ParseHealthMode(name string) (HealthMode, error) {
+	switch mode := HealthMode(name); mode {
+	case HealthModeOperUp, HealthModeAdminUp, HealthModeExists:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown health mode %q, expected one of %s, %s or %s", name, HealthModeOperUp, HealthModeAdminUp, HealthModeExists)
+}
+
+// linkHealthReason derives the health reason of an existing link according to the mode.
+func linkHealthReason(link netlink.Link, mode HealthMode) HealthReason {
+	attrs := link.Attrs()
+	switch mode {
+	case HealthModeExists:
+		return HealthReasonUp
+	case HealthModeAdminUp:
+		if attrs.Flags&net.FlagUp != 0 {
+			return HealthReasonUp
+		}
+		return HealthReasonDown
+	}
+
+	// The internal interfaces of OVS bridges report an unknown operational state when up
+	if isOVSBridge(link) && portUp(attrs) {
+		return HealthReasonUp
+	}
+	switch attrs.OperState {
+	case netlink.OperUp:
+		return HealthReasonUp
+	case netlink.OperLowerLayerDown:
+		return HealthReasonNoCarrier
+	default:
+		return HealthReasonDown
+	}
+}
+
+// HealthChange describes a change of the health a plugin reports for its devices.
+type HealthChange struct {
+	Bridge    string
+	Resource  string
+	OldHealth string
+	NewHealth string
+	Reason    HealthReason
+	Time      time.Time
+}
+
+// HealthNotifier is informed about health changes, it must not block the caller.
+type HealthNotifier interface {
+	NotifyHealthChange(change HealthChange)
+}
+
+// HealthTransition is a change of the health reason of a bridge.
+type HealthTransition struct {
+	Time   time.Time
+	Reason HealthReason
+}
+
+// healthAccounting accumulates the time spent in each health reason and keeps
+// a bounded history of the latest transitions.
+type healthAccounting struct {
+	lock    sync.Mutex
+	current HealthReason
+	since   time.Time
+	totals  map[HealthReason]time.Duration
+	// exported is the time per reason already added to the metrics
+	exported    map[HealthReason]time.Duration
+	history     []HealthTransition
+	historySize int
+}
+
+func newHealthAccounting(historySize int) *healthAccounting {
+	return &healthAccounting{
+		totals:      map[HealthReason]time.Duration{},
+		exported:    map[HealthReason]time.Duration{},
+		historySize: historySize,
+	}
+}
+
+// record switches to the given reason, repeated reasons are not transitions.
+func (a *healthAccounting) record(reason HealthReason, now time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if reason == a.current {
+		return
+	}
+	a.accumulate(now)
+	a.current = reason
+	a.since = now
+
+	if a.historySize <= 0 {
+		return
+	}
+	if len(a.history) == a.historySize {
+		a.history = append(a.history[:0], a.history[1:]...)
+	}
+	a.history = append(a.history, HealthTransition{Time: now, Reason: reason})
+}
+
+// stop ends the current reason, e.g. because the health check is no longer running.
+func (a *healthAccounting) stop(now time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.accumulate(now)
+	a.current = ""
+}
+
+func (a *healthAccounting) accumulate(now time.Time) {
+	if a.current != "" {
+		a.totals[a.current] += now.Sub(a.since)
+	}
+}
+
+// durations returns the total time spent per reason, including the ongoing one.
+func (a *healthAccounting) durations(now time.Time) map[HealthReason]time.Duration {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.durationsLocked(now)
+}
+
+func (a *healthAccounting) durationsLocked(now time.Time) map[HealthReason]time.Duration {
+	ret := make(map[HealthReason]time.Duration, len(a.totals)+1)
+	for reason, total := range a.totals {
+		ret[reason] = total
+	}
+	if a.current != "" {
+		ret[a.current] += now.Sub(a.since)
+	}
+	return ret
+}
+
+// unexported returns the time per reason spent since the previous call, including the
+// ongoing reason, so a counter can be kept in step with the totals.
+func (a *healthAccounting) unexported(now time.Time) map[HealthReason]time.Duration {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ret := map[HealthReason]time.Duration{}
+	for reason, total := range a.durationsLocked(now) {
+		if delta := total - a.exported[reason]; delta > 0 {
+			ret[reason] = delta
+			a.exported[reason] = total
+		}
+	}
+	return ret
+}
+
+func (a *healthAccounting) transitions() []HealthTransition {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]HealthTransition{}, a.history...)
+}
+
+// deviceHealthState is the authoritative health of every device of a plugin. Updates never
+// block, every ListAndWatch stream is notified through its own subscription and always sends
+// the latest state.
+type deviceHealthState struct {
+	lock   sync.Mutex
+	ids    []string
+	health map[string]string
+	// subscribers are notified of every change, each through its own channel
+	subscribers map[chan struct{}]bool
+
+	// portCapacity reserves one unallocated device per bridge port not accounted for
+	// by an allocation, so the advertised capacity matches the free port slots
+	portCapacity bool
+	ports        int
+	allocated    map[string]bool
+
+	// topology is the NUMA placement shared by all devices, nil if unknown
+	topology *pluginapi.TopologyInfo
+}
+
+func newDeviceHealthState(devs []*pluginapi.Device) *deviceHealthState {
+	s := &deviceHealthState{
+		health:      make(map[string]string, len(devs)),
+		subscribers: map[chan struct{}]bool{},
+		allocated:   map[string]bool{},
+	}
+	for _, dev := range devs {
+		s.ids = append(s.ids, dev.ID)
+		s.health[dev.ID] = dev.Health
+	}
+	return s
+}
+
+// apply updates the device named by the update, or all devices when it names none.
+// Updates of unknown devices are ignored.
+func (s *deviceHealthState) apply(update deviceHealth) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	changed := false
+	for id, health := range s.health {
+		if (update.DevId == "" || update.DevId == id) && health != update.Health {
+			s.health[id] = update.Health
+			changed = true
+		}
+	}
+	if changed {
+		s.notify()
+	}
+}
+
+// subscribe returns a channel that is notified of the changes from now on, pending
+// notifications are coalesced. The returned function ends the subscription.
+func (s *deviceHealthState) subscribe() (<-chan struct{}, func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	changed := make(chan struct{}, 1)
+	s.subscribers[changed] = true
+	return changed, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		delete(s.subscribers, changed)
+	}
+}
+
+// notify flags a change to every subscriber, it must be called with the lock held.
+func (s *deviceHealthState) notify() {
+	for changed := range s.subscribers {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *deviceHealthState) counts() (healthy, total int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	reserved := s.reserved()
+	for id, health := range s.health {
+		if health == pluginapi.Healthy && !reserved[id] {
+			healthy++
+		}
+	}
+	return healthy, len(s.health)
+}
+
+// anyHealthy reports whether any device is healthy, ignoring reservations.
+func (s *deviceHealthState) anyHealthy() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, health := range s.health {
+		if health == pluginapi.Healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// setTopology sets the NUMA placement of the devices.
+func (s *deviceHealthState) setTopology(topology *pluginapi.TopologyInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if topology.String() != s.topology.String() {
+		s.topology = topology
+		s.notify()
+	}
+}
+
+// setPorts sets the number of ports of the bridge.
+func (s *deviceHealthState) setPorts(ports int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ports != ports {
+		s.ports = ports
+		s.notify()
+	}
+}
+
+// markAllocated records devices handed out by Allocate.
+func (s *deviceHealthState) markAllocated(ids []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, id := range ids {
+		s.allocated[id] = true
+	}
+	s.notify()
+}
+
+// markAvailable records devices kubelet considers free again.
+func (s *deviceHealthState) markAvailable(ids []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, id := range ids {
+		delete(s.allocated, id)
+	}
+	s.notify()
+}
+
+// reserved returns the devices taken out of the capacity for ports without an allocation,
+// the highest unallocated ones are picked. It must be called with the lock held.
+func (s *deviceHealthState) reserved() map[string]bool {
+	if !s.portCapacity {
+		return nil
+	}
+	surplus := s.ports - len(s.allocated)
+	reserved := map[string]bool{}
+	for i := len(s.ids) - 1; i >= 0 && len(reserved) < surplus; i-- {
+		if id := s.ids[i]; !s.allocated[id] {
+			reserved[id] = true
+		}
+	}
+	return reserved
+}
+
+// sameDevices reports whether the device lists would be sent identically to kubelet.
+func sameDevices(a, b []*pluginapi.Device) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].Health != b[i].Health {
+			return false
+		}
+		if a[i].Topology != b[i].Topology && a[i].Topology.String() != b[i].Topology.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// unhealthy returns the IDs of the devices that are unhealthy.
+func (s *deviceHealthState) unhealthy(ids []string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var ret []string
+	for _, id := range ids {
+		if s.health[id] == pluginapi.Unhealthy {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// devices returns a copy of the devices in their original order.
+func (s *deviceHealthState) devices() []*pluginapi.Device {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	reserved := s.reserved()
+	ret := make([]*pluginapi.Device, 0, len(s.ids))
+	for _, id := range s.ids {
+		health := s.health[id]
+		if reserved[id] {
+			health = pluginapi.Unhealthy
+		}
+		ret = append(ret, &pluginapi.Device{ID: id, Health: health, Topology: s.topology})
+	}
+	return ret
+}
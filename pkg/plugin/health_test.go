@@ -0,0 +1,259 @@
+package plugin
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestHealthAccounting(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	a := newHealthAccounting(2)
+	a.record(HealthReasonUp, at(0))
+	a.record(HealthReasonNoCarrier, at(10))
+	// Repeated reasons neither restart the clock nor add transitions
+	a.record(HealthReasonNoCarrier, at(12))
+	a.record(HealthReasonUp, at(15))
+
+	expected := map[HealthReason]time.Duration{
+		HealthReasonUp:        15 * time.Second,
+		HealthReasonNoCarrier: 5 * time.Second,
+	}
+	if durations := a.durations(at(20)); !reflect.DeepEqual(durations, expected) {
+		t.Errorf("got durations %v, expected %v", durations, expected)
+	}
+
+	// The history keeps the latest transitions only
+	history := a.transitions()
+	expectedHistory := []HealthTransition{
+		{Time: at(10), Reason: HealthReasonNoCarrier},
+		{Time: at(15), Reason: HealthReasonUp},
+	}
+	if !reflect.DeepEqual(history, expectedHistory) {
+		t.Errorf("got history %v, expected %v", history, expectedHistory)
+	}
+
+	// Time after the health check stopped isn't attributed to any reason
+	a.stop(at(20))
+	if durations := a.durations(at(60)); !reflect.DeepEqual(durations, expected) {
+		t.Errorf("got durations %v after stopping, expected %v", durations, expected)
+	}
+}
+
+func TestHealthAccountingUnexported(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	a := newHealthAccounting(DefaultHealthHistorySize)
+	a.record(HealthReasonUp, at(0))
+	steps := []struct {
+		name     string
+		record   HealthReason
+		at       int
+		expected map[HealthReason]time.Duration
+	}{
+		{
+			name:     "the ongoing reason",
+			at:       5,
+			expected: map[HealthReason]time.Duration{HealthReasonUp: 5 * time.Second},
+		},
+		{
+			name:     "nothing elapsed",
+			at:       5,
+			expected: map[HealthReason]time.Duration{},
+		},
+		{
+			name:     "the rest of a finished reason",
+			record:   HealthReasonNoCarrier,
+			at:       8,
+			expected: map[HealthReason]time.Duration{HealthReasonUp: 3 * time.Second},
+		},
+		{
+			name:   "several reasons",
+			record: HealthReasonUp,
+			at:     20,
+			expected: map[HealthReason]time.Duration{
+				HealthReasonNoCarrier: 12 * time.Second,
+			},
+		},
+		{
+			name:     "after the transition",
+			at:       21,
+			expected: map[HealthReason]time.Duration{HealthReasonUp: time.Second},
+		},
+	}
+	// The steps build on each other, so they don't run as subtests
+	for _, step := range steps {
+		if step.record != "" {
+			a.record(step.record, at(step.at))
+		}
+		if delta := a.unexported(at(step.at)); !reflect.DeepEqual(delta, step.expected) {
+			t.Errorf("%s: got %v, expected %v", step.name, delta, step.expected)
+		}
+	}
+}
+
+func TestDeviceHealthStateAppliesUpdates(t *testing.T) {
+	healthOf := func(s *deviceHealthState) []string {
+		var ret []string
+		for _, dev := range s.devices() {
+			ret = append(ret, dev.Health)
+		}
+		return ret
+	}
+	changed := func(notified <-chan struct{}) bool {
+		select {
+		case <-notified:
+			return true
+		default:
+			return false
+		}
+	}
+
+	s := newDeviceHealthState([]*pluginapi.Device{
+		{ID: "br00", Health: pluginapi.Healthy},
+		{ID: "br01", Health: pluginapi.Healthy},
+		{ID: "br02", Health: pluginapi.Healthy},
+	})
+	notified, unsubscribe := s.subscribe()
+	defer unsubscribe()
+	tests := []struct {
+		name     string
+		update   deviceHealth
+		expected []string
+		changed  bool
+	}{
+		{
+			name:     "a single device",
+			update:   deviceHealth{DevId: "br01", Health: pluginapi.Unhealthy},
+			expected: []string{pluginapi.Healthy, pluginapi.Unhealthy, pluginapi.Healthy},
+			changed:  true,
+		},
+		{
+			name:     "all devices",
+			update:   deviceHealth{Health: pluginapi.Unhealthy},
+			expected: []string{pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Unhealthy},
+			changed:  true,
+		},
+		{
+			name:     "a single device after all devices",
+			update:   deviceHealth{DevId: "br02", Health: pluginapi.Healthy},
+			expected: []string{pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Healthy},
+			changed:  true,
+		},
+		{
+			name:     "an unchanged device",
+			update:   deviceHealth{DevId: "br02", Health: pluginapi.Healthy},
+			expected: []string{pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Healthy},
+		},
+		{
+			name:     "an unknown device",
+			update:   deviceHealth{DevId: "br07", Health: pluginapi.Healthy},
+			expected: []string{pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Healthy},
+		},
+		{
+			name:     "all devices, some already unhealthy",
+			update:   deviceHealth{Health: pluginapi.Unhealthy},
+			expected: []string{pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Unhealthy},
+			changed:  true,
+		},
+		{
+			name:     "all devices again",
+			update:   deviceHealth{Health: pluginapi.Unhealthy},
+			expected: []string{pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Unhealthy},
+		},
+		{
+			name:     "a single device back",
+			update:   deviceHealth{DevId: "br02", Health: pluginapi.Healthy},
+			expected: []string{pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Healthy},
+			changed:  true,
+		},
+	}
+	// The updates build on each other, so they don't run as subtests
+	for _, tt := range tests {
+		s.apply(tt.update)
+		if health := healthOf(s); !reflect.DeepEqual(health, tt.expected) {
+			t.Errorf("%s: got health %v, expected %v", tt.name, health, tt.expected)
+		}
+		if c := changed(notified); c != tt.changed {
+			t.Errorf("%s: notified a change %v, expected %v", tt.name, c, tt.changed)
+		}
+	}
+	if healthy, total := s.counts(); healthy != 1 || total != 3 {
+		t.Errorf("counted %d of %d devices healthy, expected 1 of 3", healthy, total)
+	}
+}
+
+func TestDeviceHealthStateNotifiesEverySubscriber(t *testing.T) {
+	s := newDeviceHealthState([]*pluginapi.Device{{ID: "br00", Health: pluginapi.Healthy}})
+	first, unsubscribeFirst := s.subscribe()
+	second, unsubscribeSecond := s.subscribe()
+	defer unsubscribeSecond()
+	notified := func(changed <-chan struct{}) bool {
+		select {
+		case <-changed:
+			return true
+		default:
+			return false
+		}
+	}
+
+	s.apply(deviceHealth{Health: pluginapi.Unhealthy})
+	if !notified(first) || !notified(second) {
+		t.Fatal("not every subscriber was notified of the change")
+	}
+
+	unsubscribeFirst()
+	s.apply(deviceHealth{Health: pluginapi.Healthy})
+	if notified(first) {
+		t.Error("a subscriber was notified after unsubscribing")
+	}
+	if !notified(second) {
+		t.Error("the remaining subscriber wasn't notified of the change")
+	}
+}
+
+func TestSameDevices(t *testing.T) {
+	numa := func(ids ...int64) *pluginapi.TopologyInfo {
+		topology := &pluginapi.TopologyInfo{}
+		for _, id := range ids {
+			topology.Nodes = append(topology.Nodes, &pluginapi.NUMANode{ID: id})
+		}
+		return topology
+	}
+	devices := func(health string, topology *pluginapi.TopologyInfo) []*pluginapi.Device {
+		return []*pluginapi.Device{
+			{ID: "br00", Health: pluginapi.Healthy, Topology: topology},
+			{ID: "br01", Health: health, Topology: topology},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		a, b     []*pluginapi.Device
+		expected bool
+	}{
+		{name: "identical lists", a: devices(pluginapi.Healthy, nil), b: devices(pluginapi.Healthy, nil), expected: true},
+		{name: "equal topologies", a: devices(pluginapi.Healthy, numa(0)), b: devices(pluginapi.Healthy, numa(0)), expected: true},
+		{name: "health differs", a: devices(pluginapi.Healthy, nil), b: devices(pluginapi.Unhealthy, nil)},
+		{name: "topology differs", a: devices(pluginapi.Healthy, numa(0)), b: devices(pluginapi.Healthy, numa(1))},
+		{name: "topology added", a: devices(pluginapi.Healthy, nil), b: devices(pluginapi.Healthy, numa(0))},
+		{name: "device added", a: devices(pluginapi.Healthy, nil)[:1], b: devices(pluginapi.Healthy, nil)},
+		{
+			name: "devices renamed",
+			a:    devices(pluginapi.Healthy, nil),
+			b:    []*pluginapi.Device{{ID: "br00", Health: pluginapi.Healthy}, {ID: "br02", Health: pluginapi.Healthy}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := sameDevices(tt.a, tt.b); same != tt.expected {
+				t.Errorf("the lists are the same: %v, expected %v", same, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"kubevirt.io/client-go/log"
+)
+
+const (
+	// rpcLogVerbosity logs every RPC with its duration and status code
+	rpcLogVerbosity = 4
+	// rpcDumpVerbosity additionally dumps requests, responses and stream messages
+	rpcDumpVerbosity = 6
+	// maxRPCDumpSize caps a single dumped message
+	maxRPCDumpSize = 4096
+	// streamDumpInterval rate limits the dumps of stream messages, e.g. device lists during flaps
+	streamDumpInterval = 5 * time.Second
+)
+
+// logUnary logs unary RPCs, e.g. Allocate, and dumps their messages at a high verbosity.
+func (dpi *BridgeDevicePlugin) logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	logger := log.DefaultLogger()
+	if logger.Verbosity(rpcDumpVerbosity) {
+		logger.V(rpcDumpVerbosity).Infof("%s %s request: %s", dpi.resourceName, info.FullMethod, dumpMessage(req))
+	}
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logger.V(rpcLogVerbosity).Infof("%s %s took %v, code %s", dpi.resourceName, info.FullMethod, time.Since(start), status.Code(err))
+	if err == nil && logger.Verbosity(rpcDumpVerbosity) {
+		logger.V(rpcDumpVerbosity).Infof("%s %s response: %s", dpi.resourceName, info.FullMethod, dumpMessage(resp))
+	}
+	return resp, err
+}
+
+// logStream logs streaming RPCs, i.e. ListAndWatch, and dumps the sent messages at a high verbosity.
+func (dpi *BridgeDevicePlugin) logStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	logger := log.DefaultLogger()
+	logger.V(rpcLogVerbosity).Infof("%s %s stream opened", dpi.resourceName, info.FullMethod)
+	start := time.Now()
+	err := handler(srv, &loggedStream{ServerStream: ss, resourceName: dpi.resourceName, method: info.FullMethod})
+	logger.V(rpcLogVerbosity).Infof("%s %s stream closed after %v, code %s", dpi.resourceName, info.FullMethod, time.Since(start), status.Code(err))
+	return err
+}
+
+// loggedStream dumps sent messages, at most one per streamDumpInterval.
+type loggedStream struct {
+	grpc.ServerStream
+	resourceName string
+	method       string
+	lastDump     time.Time
+	skipped      int
+}
+
+func (s *loggedStream) SendMsg(m interface{}) error {
+	logger := log.DefaultLogger()
+	if logger.Verbosity(rpcDumpVerbosity) {
+		if time.Since(s.lastDump) < streamDumpInterval {
+			s.skipped++
+		} else {
+			logger.V(rpcDumpVerbosity).Infof("%s %s sent (%d not dumped since the last one): %s", s.resourceName, s.method, s.skipped, dumpMessage(m))
+			s.lastDump = time.Now()
+			s.skipped = 0
+		}
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// dumpMessage formats a message, cut to maxRPCDumpSize.
+func dumpMessage(m interface{}) string {
+	dump := fmt.Sprintf("%v", m)
+	if len(dump) > maxRPCDumpSize {
+		return fmt.Sprintf("%s... (%d bytes cut)", dump[:maxRPCDumpSize], len(dump)-maxRPCDumpSize)
+	}
+	return dump
+}
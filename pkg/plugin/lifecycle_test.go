@@ -0,0 +1,97 @@
+package plugin_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestPluginLifecycle(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	run := h.StartPlugin(ctx, newPlugin(t, h, "br0", 3))
+	client := dial(ctx, t, h, resourceName("br0"))
+	stream, err := client.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+
+	h.Links.SetUp("br0", false)
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+	h.Links.SetUp("br0", true)
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+
+	if _, err := client.AllocateDevices(ctx, "br00"); err != nil {
+		t.Fatalf("allocation failed: %v", err)
+	}
+
+	if err := h.RestartKubelet(ctx, resourceName("br0")); err != nil {
+		t.Fatal(err)
+	}
+	if run.Restarts() != 1 {
+		t.Errorf("the plugin restarted %d times, want 1", run.Restarts())
+	}
+	// kubelet connects to the new socket after the restart
+	stream, err = dial(ctx, t, h, resourceName("br0")).Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+}
+
+func TestControllerReregistersAfterKubeletRestart(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	c := runController(t, h, []plugin.Device{newPlugin(t, h, "br0", 3)})
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+	eventually(ctx, t, "the controller didn't initialize", c.Initialized)
+
+	if err := h.RestartKubelet(ctx, resourceName("br0")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(ctx, t, "the controller didn't initialize again", c.Initialized)
+	if restarts := c.Status()[0].Restarts; restarts != 1 {
+		t.Errorf("the plugin restarted %d times, want 1", restarts)
+	}
+}
+
+func TestPluginFastRestartKeepsRegistration(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	first := newPlugin(t, h, "br0", 3, plugin.WithFastRestart())
+	run := h.StartPlugin(ctx, first)
+	stream := watch(ctx, t, h, resourceName("br0"))
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+
+	// A live socket belongs to a running marker and must not be taken over
+	if err := newPlugin(t, h, "br0", 3, plugin.WithFastRestart()).Start(ctx); err == nil {
+		t.Fatal("a second plugin took over the socket of a running one")
+	}
+
+	first.KeepRegistration()
+	if err := run.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(first.GetSocketPath()); err != nil {
+		t.Errorf("the socket wasn't left behind: %v", err)
+	}
+	<-stream.Done()
+	lists := stream.Lists()
+	if devices := lists[len(lists)-1]; len(devices) == 0 {
+		t.Error("the plugin deregistered its devices")
+	}
+
+	h.StartPlugin(ctx, newPlugin(t, h, "br0", 3, plugin.WithFastRestart()))
+	if _, err := h.Kubelet.WaitForRegistrations(ctx, resourceName("br0"), 2); err != nil {
+		t.Fatalf("the restarted plugin didn't reclaim the socket: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultMaxConcurrentStarts bounds how many plugins set up their socket and register with kubelet at once.
+const DefaultMaxConcurrentStarts = 10
+
+type startLimiterKey struct{}
+
+// withStartLimiter makes plugins started with the returned context take one of slots
+// while they set up their socket and register, so many bridges don't hammer kubelet at once.
+func withStartLimiter(ctx context.Context, slots int) context.Context {
+	if slots <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, startLimiterKey{}, make(chan struct{}, slots))
+}
+
+// acquireStartSlot waits for a start slot of the context's limiter, if any. The returned
+// release func may be called more than once.
+func acquireStartSlot(ctx context.Context) (release func(), err error) {
+	slots, ok := ctx.Value(startLimiterKey{}).(chan struct{})
+	if !ok {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-slots })
+	}, nil
+}
@@ -0,0 +1,263 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"kubevirt.io/client-go/log"
+)
+
+// linkSnapshotTTL is how long a listing of the links answers lookups, kept current by the
+// updates received since. Plugins starting at once share a single listing this way.
+const linkSnapshotTTL = 5 * time.Second
+
+// LinkMonitor shares a single link subscription of a source between all its subscribers, e.g.
+// the plugins and the scanner of a controller, instead of a netlink socket each. While it is
+// subscribed, lookups are answered from a recent listing and the updates since.
+type LinkMonitor struct {
+	LinkSource
+
+	clock    Clock
+	lock     sync.Mutex
+	upstream *linkUpstream
+}
+
+// linkUpstream is a subscription of the source and the subscribers it fans out to.
+type linkUpstream struct {
+	stop        chan struct{}
+	generation  uint64
+	subscribers map[chan<- netlink.LinkUpdate]bool
+	// links is the snapshot listed at listedAt with the updates applied, nil until listed
+	links    map[int]netlink.Link
+	listedAt time.Time
+	// listing is set while the links are listed without the lock, the updates received
+	// meanwhile are kept in pending to be applied to the new listing
+	listing bool
+	pending []netlink.LinkUpdate
+}
+
+// NewLinkMonitor creates a monitor of the source, it subscribes once the first subscriber does.
+func NewLinkMonitor(source LinkSource) *LinkMonitor {
+	return NewLinkMonitorWithClock(source, defaultClock)
+}
+
+// NewLinkMonitorWithClock creates a monitor of the source whose listings expire on the clock.
+func NewLinkMonitorWithClock(source LinkSource, clock Clock) *LinkMonitor {
+	return &LinkMonitor{LinkSource: source, clock: clock}
+}
+
+// Subscribe delivers all link updates to updates until stop is closed, then closes updates. A
+// subscriber that falls behind has updates closed early, like a subscription that lost updates,
+// and is expected to subscribe again and resync.
+func (m *LinkMonitor) Subscribe(updates chan<- netlink.LinkUpdate, stop <-chan struct{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// A replaced network namespace needs a subscription in the new one
+	if m.upstream != nil && m.upstream.generation != currentNetnsGeneration() {
+		m.closeUpstream(m.upstream)
+	}
+	if m.upstream == nil {
+		if err := m.subscribeUpstream(); err != nil {
+			return err
+		}
+	}
+	upstream := m.upstream
+	upstream.subscribers[updates] = true
+
+	go func() {
+		<-stop
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if !upstream.subscribers[updates] {
+			return
+		}
+		delete(upstream.subscribers, updates)
+		close(updates)
+		if len(upstream.subscribers) == 0 && m.upstream == upstream {
+			m.closeUpstream(upstream)
+		}
+	}()
+	return nil
+}
+
+// subscribeUpstream subscribes to the source, it is called with the lock held.
+func (m *LinkMonitor) subscribeUpstream() error {
+	upstream := &linkUpstream{
+		stop:        make(chan struct{}),
+		generation:  currentNetnsGeneration(),
+		subscribers: map[chan<- netlink.LinkUpdate]bool{},
+	}
+	updates := make(chan netlink.LinkUpdate, linkUpdateBuffer)
+	if err := m.LinkSource.Subscribe(updates, upstream.stop); err != nil {
+		return err
+	}
+	m.upstream = upstream
+	go m.fanOut(upstream, updates)
+	return nil
+}
+
+func (m *LinkMonitor) fanOut(upstream *linkUpstream, updates <-chan netlink.LinkUpdate) {
+	for {
+		var update netlink.LinkUpdate
+		var ok bool
+		select {
+		case update, ok = <-updates:
+		case <-upstream.stop:
+		}
+		m.lock.Lock()
+		if !ok {
+			// The subscription ended, the subscribers resubscribe and get a new one
+			if m.upstream == upstream {
+				m.closeUpstream(upstream)
+			}
+			m.lock.Unlock()
+			return
+		}
+		upstream.apply(update)
+		for subscriber := range upstream.subscribers {
+			select {
+			case subscriber <- update:
+			default:
+				log.DefaultLogger().Warning("a link update subscriber fell behind, it has to resync")
+				delete(upstream.subscribers, subscriber)
+				close(subscriber)
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+// closeUpstream ends the subscription and closes the updates of its subscribers, it is called
+// with the lock held.
+func (m *LinkMonitor) closeUpstream(upstream *linkUpstream) {
+	if m.upstream == upstream {
+		m.upstream = nil
+	}
+	select {
+	case <-upstream.stop:
+	default:
+		close(upstream.stop)
+	}
+	for subscriber := range upstream.subscribers {
+		close(subscriber)
+	}
+	upstream.subscribers = map[chan<- netlink.LinkUpdate]bool{}
+}
+
+// apply keeps the snapshot current, bridge port updates don't change the links themselves.
+func (u *linkUpstream) apply(update netlink.LinkUpdate) {
+	if update.Family == unix.AF_BRIDGE {
+		return
+	}
+	if u.listing {
+		u.pending = append(u.pending, update)
+	}
+	if u.links == nil {
+		return
+	}
+	switch update.Header.Type {
+	case unix.RTM_NEWLINK:
+		u.links[update.Attrs().Index] = update.Link
+	case unix.RTM_DELLINK:
+		delete(u.links, update.Attrs().Index)
+	}
+}
+
+// snapshot returns the current links while subscribed, listing them again once the listing
+// expired. It returns nil when lookups have to go to the source. It is called with the lock
+// held and releases it while listing, so updates and other lookups don't wait for the source.
+func (m *LinkMonitor) snapshot() map[int]netlink.Link {
+	upstream := m.upstream
+	if upstream == nil {
+		return nil
+	}
+	if upstream.links != nil && m.clock.Now().Sub(upstream.listedAt) <= linkSnapshotTTL {
+		return upstream.links
+	}
+	if upstream.listing {
+		// Another lookup lists the links, the expired listing is still kept current meanwhile
+		return upstream.links
+	}
+
+	upstream.listing = true
+	listedAt := m.clock.Now()
+	m.lock.Unlock()
+	links, err := m.LinkSource.LinkList()
+	m.lock.Lock()
+	pending := upstream.pending
+	upstream.listing, upstream.pending = false, nil
+	if err != nil {
+		log.DefaultLogger().Reason(err).V(4).Info("could not list the links, looking them up one by one")
+		upstream.links = nil
+		return nil
+	}
+	if m.upstream != upstream {
+		// The subscription ended while listing, nothing keeps the listing current
+		return nil
+	}
+	upstream.links = make(map[int]netlink.Link, len(links))
+	for _, link := range links {
+		upstream.links[link.Attrs().Index] = link
+	}
+	for _, update := range pending {
+		upstream.apply(update)
+	}
+	upstream.listedAt = listedAt
+	return upstream.links
+}
+
+func (m *LinkMonitor) LinkList() ([]netlink.Link, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	links := m.snapshot()
+	if links == nil {
+		return m.LinkSource.LinkList()
+	}
+	ret := make([]netlink.Link, 0, len(links))
+	for _, link := range links {
+		ret = append(ret, link)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Attrs().Index < ret[j].Attrs().Index })
+	return ret, nil
+}
+
+func (m *LinkMonitor) LinkByName(name string) (netlink.Link, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	links := m.snapshot()
+	if links == nil {
+		return m.LinkSource.LinkByName(name)
+	}
+	for _, link := range links {
+		if link.Attrs().Name == name {
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("link %s: %w", name, ErrLinkNotFound)
+}
+
+func (m *LinkMonitor) LinkByIndex(index int) (netlink.Link, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	links := m.snapshot()
+	if links == nil {
+		return m.LinkSource.LinkByIndex(index)
+	}
+	if link, exists := links[index]; exists {
+		return link, nil
+	}
+	return nil, fmt.Errorf("link %d: %w", index, ErrLinkNotFound)
+}
+
+// LinkAltNames looks the alternative names up in the source, they aren't kept in the snapshot.
+func (m *LinkMonitor) LinkAltNames(index int) ([]string, error) {
+	altNameLister, ok := m.LinkSource.(AltNameLister)
+	if !ok {
+		return nil, nil
+	}
+	return altNameLister.LinkAltNames(index)
+}
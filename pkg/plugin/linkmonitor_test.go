@@ -0,0 +1,116 @@
+package plugin_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/netlinkfake"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin/pluginfakes"
+	"github.com/vishvananda/netlink"
+)
+
+// slowLinks counts the listings of the links, and holds them back until released when block
+// is set, answering with the links as they were when the listing started.
+type slowLinks struct {
+	*netlinkfake.Links
+	listings atomic.Int32
+	block    bool
+	listing  chan struct{}
+	release  chan struct{}
+}
+
+func (l *slowLinks) LinkList() ([]netlink.Link, error) {
+	l.listings.Add(1)
+	links, err := l.Links.LinkList()
+	if l.block {
+		l.listing <- struct{}{}
+		<-l.release
+	}
+	return links, err
+}
+
+// subscribeMonitor subscribes to the monitor for the duration of the test.
+func subscribeMonitor(t *testing.T, m *plugin.LinkMonitor) <-chan netlink.LinkUpdate {
+	t.Helper()
+	updates := make(chan netlink.LinkUpdate, 16)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	if err := m.Subscribe(updates, stop); err != nil {
+		t.Fatal(err)
+	}
+	return updates
+}
+
+func TestLinkMonitorExpiresListingsOnItsClock(t *testing.T) {
+	links := &slowLinks{Links: netlinkfake.New()}
+	links.AddBridge("br0")
+	clock := pluginfakes.NewClock(time.Now())
+	m := plugin.NewLinkMonitorWithClock(links, clock)
+	subscribeMonitor(t, m)
+
+	for i := 0; i < 3; i++ {
+		if _, err := m.LinkByName("br0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if listings := links.listings.Load(); listings != 1 {
+		t.Errorf("listed the links %d times for lookups within the listing's lifetime", listings)
+	}
+
+	clock.Step(time.Minute)
+	if _, err := m.LinkByName("br0"); err != nil {
+		t.Fatal(err)
+	}
+	if listings := links.listings.Load(); listings != 2 {
+		t.Errorf("listed the links %d times, expected the expired listing to be replaced", listings)
+	}
+}
+
+func TestLinkMonitorListsWithoutLock(t *testing.T) {
+	links := &slowLinks{
+		Links:   netlinkfake.New(),
+		block:   true,
+		listing: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	index := links.AddBridge("br0")
+	m := plugin.NewLinkMonitorWithClock(links, pluginfakes.NewClock(time.Now()))
+	updates := subscribeMonitor(t, m)
+
+	listed := make(chan error)
+	go func() {
+		_, err := m.LinkByName("br0")
+		listed <- err
+	}()
+	<-links.listing
+
+	// Updates and other lookups go on while the links are listed
+	links.SetUp("br0", false)
+	select {
+	case <-updates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the update wasn't delivered while the links were listed")
+	}
+	if _, err := m.LinkByIndex(index); err != nil {
+		t.Fatalf("a lookup during the listing failed: %v", err)
+	}
+
+	close(links.release)
+	if err := <-listed; err != nil {
+		t.Fatal(err)
+	}
+	// The listing predates the update, which must not be lost
+	link, err := m.LinkByName("br0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		t.Error("the listing dropped the update received while listing")
+	}
+	if listings := links.listings.Load(); listings != 1 {
+		t.Errorf("listed the links %d times, expected a single listing", listings)
+	}
+}
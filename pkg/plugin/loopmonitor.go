@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"kubevirt.io/client-go/log"
+)
+
+const (
+	// DefaultLoopStallThreshold is the iteration gap above which an event loop is considered stalled.
+	DefaultLoopStallThreshold = 5 * time.Second
+	// loopHeartbeatInterval makes idle event loops iterate regularly so that a stall is distinguishable from idleness.
+	loopHeartbeatInterval = 1 * time.Second
+	loopLatencySamples    = 128
+	maxStackDumpSize      = 8 << 20
+)
+
+// LoopLatencyStats summarizes the observed gaps between iterations of an event loop.
+type LoopLatencyStats struct {
+	Max time.Duration
+	P50 time.Duration
+	P99 time.Duration
+}
+
+// loopMonitor tracks the time between consecutive iterations of an event loop.
+// Recording an iteration costs a timestamp compare, stats are only computed on demand and
+// exported at most once per heartbeat interval.
+type loopMonitor struct {
+	name string
+	// label identifies the loop in the metrics
+	label     string
+	threshold time.Duration
+	lock      sync.Mutex
+	last      time.Time
+	max       time.Duration
+	samples   [loopLatencySamples]time.Duration
+	next      int
+	count     int
+	exported  time.Time
+}
+
+func newLoopMonitor(name string, threshold time.Duration) *loopMonitor {
+	return &loopMonitor{
+		name:      name,
+		label:     name,
+		threshold: threshold,
+	}
+}
+
+// Beat records an iteration of the monitored loop and warns if the gap since the previous one exceeds the threshold.
+func (m *loopMonitor) Beat() {
+	now := time.Now()
+
+	m.lock.Lock()
+	var gap time.Duration
+	if !m.last.IsZero() {
+		gap = now.Sub(m.last)
+		if gap > m.max {
+			m.max = gap
+		}
+		m.samples[m.next] = gap
+		m.next = (m.next + 1) % loopLatencySamples
+		if m.count < loopLatencySamples {
+			m.count++
+		}
+	}
+	m.last = now
+	export := now.Sub(m.exported) >= loopHeartbeatInterval
+	if export {
+		m.exported = now
+	}
+	m.lock.Unlock()
+
+	if export {
+		recordLoopLatencyMetrics(m.label, m.Stats())
+	}
+	if m.threshold > 0 && gap > m.threshold {
+		log.DefaultLogger().Warningf("%s event loop stalled for %v (threshold %v), goroutine dump:\n%s",
+			m.name, gap, m.threshold, goroutineDump())
+	}
+}
+
+// Reset forgets the last iteration, so an exited loop is not reported as stalled, and removes
+// its metrics until it iterates again.
+func (m *loopMonitor) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.last = time.Time{}
+	m.exported = time.Time{}
+	deleteLoopLatencyMetrics(m.label)
+}
+
+// Stalled reports whether the running loop has not iterated for longer than the threshold.
+func (m *loopMonitor) Stalled() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.threshold <= 0 || m.last.IsZero() {
+		return false
+	}
+	return time.Since(m.last) > m.threshold
+}
+
+func (m *loopMonitor) Stats() LoopLatencyStats {
+	m.lock.Lock()
+	samples := make([]time.Duration, m.count)
+	copy(samples, m.samples[:m.count])
+	stats := LoopLatencyStats{Max: m.max}
+	m.lock.Unlock()
+
+	if len(samples) == 0 {
+		return stats
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	stats.P50 = samples[(len(samples)-1)*50/100]
+	stats.P99 = samples[(len(samples)-1)*99/100]
+	return stats
+}
+
+func goroutineDump() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStackDumpSize {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
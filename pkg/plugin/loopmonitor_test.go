@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoopMonitorReportsStall(t *testing.T) {
+	m := newLoopMonitor("test", time.Second)
+	if m.Stalled() {
+		t.Fatal("a loop that never iterated is stalled")
+	}
+
+	m.Beat()
+	if m.Stalled() {
+		t.Fatal("a loop that just iterated is stalled")
+	}
+
+	// Pretend the handler of the last iteration took a minute
+	m.last = time.Now().Add(-time.Minute)
+	if !m.Stalled() {
+		t.Fatal("a loop that didn't iterate for a minute is not stalled")
+	}
+	m.Beat()
+	if m.Stalled() {
+		t.Fatal("a loop that iterated again is still stalled")
+	}
+	if stats := m.Stats(); stats.Max < time.Minute {
+		t.Errorf("the maximum gap is %v, expected at least a minute", stats.Max)
+	}
+
+	m.last = time.Now().Add(-time.Minute)
+	m.Reset()
+	if m.Stalled() {
+		t.Error("an exited loop is stalled")
+	}
+}
+
+func TestLoopMonitorWithoutThresholdNeverStalls(t *testing.T) {
+	m := newLoopMonitor("test", 0)
+	m.Beat()
+	m.last = time.Now().Add(-time.Hour)
+	if m.Stalled() {
+		t.Error("a loop without a threshold is stalled")
+	}
+}
+
+func TestLoopMonitorStats(t *testing.T) {
+	m := newLoopMonitor("test", 0)
+	if stats := m.Stats(); stats != (LoopLatencyStats{}) {
+		t.Errorf("a loop that never iterated has stats %+v", stats)
+	}
+
+	// Gaps of 1ms to 100ms, with the oldest ones pushed out of the samples by later ones
+	for i := 1; i <= loopLatencySamples+100; i++ {
+		gap := time.Duration(i%100+1) * time.Millisecond
+		m.last = time.Now().Add(-gap)
+		m.Beat()
+	}
+	stats := m.Stats()
+	if stats.Max < 100*time.Millisecond || stats.Max > time.Second {
+		t.Errorf("the maximum gap is %v, expected about 100ms", stats.Max)
+	}
+	if stats.P50 > stats.P99 || stats.P99 > stats.Max {
+		t.Errorf("the percentiles are out of order: %+v", stats)
+	}
+	if stats.P99 < 90*time.Millisecond {
+		t.Errorf("the 99th percentile is %v, expected at least 90ms", stats.P99)
+	}
+}
+
+func TestLoopMonitorExportsLatency(t *testing.T) {
+	m := newLoopMonitor("exported", 0)
+	m.Beat()
+	// The previous export is a heartbeat interval ago, so the next iteration exports
+	m.last = time.Now().Add(-50 * time.Millisecond)
+	m.exported = time.Now().Add(-loopHeartbeatInterval)
+	m.Beat()
+
+	stats := m.Stats()
+	if longest, set := loopLatencyMaxMetric.Value("exported"); !set || longest != stats.Max.Seconds() {
+		t.Errorf("exported a maximum of %v (set %t), expected %v", longest, set, stats.Max.Seconds())
+	}
+	for quantile, expected := range map[string]time.Duration{"0.5": stats.P50, "0.99": stats.P99} {
+		if value, set := loopLatencyMetric.Value("exported", quantile); !set || value != expected.Seconds() {
+			t.Errorf("exported quantile %s as %v (set %t), expected %v", quantile, value, set, expected.Seconds())
+		}
+	}
+
+	// Iterations within the heartbeat interval leave the exported stats alone
+	m.last = time.Now().Add(-time.Second)
+	m.Beat()
+	if longest, _ := loopLatencyMaxMetric.Value("exported"); longest != stats.Max.Seconds() {
+		t.Errorf("the maximum was exported again as %v right after the previous export", longest)
+	}
+
+	m.Reset()
+	if _, set := loopLatencyMaxMetric.Value("exported"); set {
+		t.Error("the latency of an exited loop is still exported")
+	}
+}
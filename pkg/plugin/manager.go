@@ -1,8 +1,14 @@
 package plugin
 
 import (
-	"math"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vishvananda/netlink"
@@ -11,153 +17,638 @@ import (
 	"kubevirt.io/client-go/log"
 )
 
-var defaultBackoffTime = []time.Duration{1 * time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second}
+// ErrUnknownDevice is returned when a bridge named by the caller has no plugin or doesn't exist.
+var ErrUnknownDevice = errors.New("unknown device")
+
+const (
+	// kubeletRestartTimeout bounds how long a plugin waits for a restarted kubelet before falling back to the backoff.
+	kubeletRestartTimeout = 30 * time.Second
+	// kubeletBounceWindow is how long a registration must last for a following kubelet restart
+	// to be re-registered right away
+	kubeletBounceWindow = 10 * time.Second
+
+	// deviceStopTimeout bounds how long stopping a device plugin waits for it to shut down.
+	deviceStopTimeout = 10 * time.Second
+
+	// maxSubscribeAttempts is how often the scanner tries to subscribe to link updates before giving up.
+	maxSubscribeAttempts = 10
+
+	// DefaultDiscoveryTimeout bounds a discovery pass over the node's links.
+	DefaultDiscoveryTimeout = 30 * time.Second
+	// DefaultDrainGracePeriod is how long devices are reported unhealthy on shutdown before the plugins stop.
+	DefaultDrainGracePeriod = 5 * time.Second
+	// DefaultResyncPeriod is the interval of full bridge resyncs that recover from missed link updates.
+	DefaultResyncPeriod = 5 * time.Minute
+)
 
 type controlledDevice struct {
 	devicePlugin Device
-	started      bool
-	stopChan     chan struct{}
-	backoff      []time.Duration
+	backoff      Backoff
+	clock        Clock
+
+	// lock guards the run state below against concurrent Start and Stop calls
+	lock    sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	exited  chan struct{}
+
+	// statusLock guards the accounting below, which is updated by the run loop
+	statusLock  sync.Mutex
+	startedAt   time.Time
+	restarts    int
+	lastAttempt time.Time
+	lastError   error
+	failed      bool
+}
+
+// DeviceStatus describes a device plugin run by the controller.
+type DeviceStatus struct {
+	BridgeName     string
+	ResourceName   string
+	SocketPath     string
+	Initialized    bool
+	Healthy        bool
+	HealthyDevices int
+	TotalDevices   int
+	// StartedSince is when the controller started the plugin, restarts don't reset it
+	StartedSince time.Time
+	// Restarts is the number of times the plugin was started again after it exited
+	Restarts    int
+	LastAttempt time.Time
+	// LastError is the error of the latest failed start, empty if it never failed
+	LastError string
+	// Failed is set when the plugin stopped for good, e.g. because kubelet doesn't support its
+	// API version
+	Failed bool
+	// HealthReasons is the time the bridge spent in each health reason and HealthHistory its
+	// latest health transitions, oldest first
+	HealthReasons map[HealthReason]time.Duration
+	HealthHistory []HealthTransition
+	// DuplicateAllocations is the number of Allocate calls rejected for requesting a device
+	// more than once
+	DuplicateAllocations uint64
+	// SharedUplinks are the physical uplinks of the bridge that back ports of another managed
+	// bridge as well, only one of the bridges gets their traffic
+	SharedUplinks []string
+	// LinkWatchDegraded is set when link updates are polled because the netlink subscription
+	// isn't permitted, health changes are noticed later
+	LinkWatchDegraded bool
 }
 
-func (c *controlledDevice) Start() {
+// healthAccountingDevice is a plugin that accounts for the health reasons of its bridge.
+type healthAccountingDevice interface {
+	HealthReasonDurations() map[HealthReason]time.Duration
+	HealthHistory() []HealthTransition
+}
+
+// Start runs the device plugin until Stop is called or ctx is cancelled, restarting it with backoff.
+func (c *controlledDevice) Start(ctx context.Context) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if c.started {
 		return
 	}
 
-	stop := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
+	exited := make(chan struct{})
 
 	logger := log.DefaultLogger()
 	dev := c.devicePlugin
-	deviceName := dev.GetDeviceName()
+	deviceName := dev.GetResourceName()
 	logger.Infof("Starting a device plugin for device: %s", deviceName)
-	retries := 0
-
-	backoff := c.backoff
-	if backoff == nil {
-		backoff = defaultBackoffTime
-	}
+	failures := 0
+	// bounces counts kubelet restarts in quick succession, re-registration backs off on them
+	bounces := 0
 
 	go func() {
-		for {
-			err := dev.Start(stop)
-			if err != nil {
+		defer close(exited)
+		// restartReason is why the previous attempt exited
+		restartReason := ""
+		for attempt := 0; ; attempt++ {
+			c.recordAttempt(restartReason)
+			startedAt := c.clock.Now()
+			err := dev.Start(ctx)
+			wait := c.backoff.Duration(failures)
+			if errors.Is(err, ErrKubeletRestarted) {
+				restartReason = restartReasonKubeletRestart
+				failures = 0
+				if c.clock.Now().Sub(startedAt) < kubeletBounceWindow {
+					bounces++
+				} else {
+					bounces = 0
+				}
+				wait = c.backoff.Duration(bounces)
+				if waitForKubelet(ctx, c.devicePlugin.GetKubeletSocket()) == nil {
+					if bounces == 0 {
+						logger.Infof("Kubelet is back, re-registering %s device plugin", deviceName)
+						continue
+					}
+					logger.Warningf("Kubelet restarted again within %v, re-registering %s device plugin in %v", kubeletBounceWindow, deviceName, wait)
+				}
+			} else if errors.Is(err, ErrUnsupportedVersion) {
+				c.recordFailure(err)
+				logger.Errorf("Not restarting %s device plugin, it can't register with this kubelet", deviceName)
+				return
+			} else if err != nil {
+				restartReason = restartReasonError
+				c.recordError(err)
 				logger.Reason(err).Errorf("Error starting %s device plugin", deviceName)
-				retries = int(math.Min(float64(retries+1), float64(len(backoff)-1)))
+				failures++
 			} else {
-				retries = 0
+				restartReason = restartReasonExited
+				failures = 0
 			}
 
 			select {
-			case <-stop:
+			case <-ctx.Done():
 				// Ok we don't want to re-register
 				return
-			case <-time.After(backoff[retries]):
+			case <-c.clock.After(wait):
 				// Wait a little and re-register
 				continue
 			}
 		}
 	}()
 
-	c.stopChan = stop
+	c.cancel = cancel
+	c.exited = exited
 	c.started = true
+
+	c.statusLock.Lock()
+	c.startedAt = c.clock.Now()
+	c.statusLock.Unlock()
 }
 
+// Stop stops the device plugin and waits until it has shut down, so its socket is
+// released before another plugin for the same bridge is started.
 func (c *controlledDevice) Stop() {
+	c.StopWithTimeout(deviceStopTimeout)
+}
+
+// StopWithTimeout stops the device plugin and waits at most timeout for it to shut down.
+func (c *controlledDevice) StopWithTimeout(timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if !c.started {
 		return
 	}
-	close(c.stopChan)
+	c.cancel()
 
-	c.stopChan = nil
+	select {
+	case <-c.exited:
+	case <-c.clock.After(timeout):
+		log.DefaultLogger().Warningf("device plugin %s didn't shut down within %v", c.devicePlugin.GetResourceName(), timeout)
+	}
+
+	c.cancel = nil
+	c.exited = nil
 	c.started = false
 }
 
+// waitForKubelet waits until kubelet serves its registration socket again.
+func waitForKubelet(ctx context.Context, kubeletSocket string) error {
+	return waitForGRPCServer(ctx, kubeletSocket, kubeletRestartTimeout)
+}
+
+// recordAttempt records a start of the plugin, restartReason is empty for the first one.
+func (c *controlledDevice) recordAttempt(restartReason string) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.lastAttempt = c.clock.Now()
+	if restartReason != "" {
+		c.restarts++
+		pluginRestartsMetric.Inc(c.devicePlugin.GetDeviceName(), restartReason)
+	}
+}
+
+func (c *controlledDevice) recordError(err error) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.lastError = err
+}
+
+// recordFailure records that the plugin stopped for good.
+func (c *controlledDevice) recordFailure(err error) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.lastError = err
+	c.failed = true
+}
+
+func (c *controlledDevice) status() DeviceStatus {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	status := DeviceStatus{
+		BridgeName:   c.devicePlugin.GetDeviceName(),
+		ResourceName: c.devicePlugin.GetResourceName(),
+		Initialized:  c.devicePlugin.GetInitialized(),
+		StartedSince: c.startedAt,
+		Restarts:     c.restarts,
+		LastAttempt:  c.lastAttempt,
+		Failed:       c.failed,
+	}
+	status.HealthyDevices, status.TotalDevices = c.devicePlugin.HealthSummary()
+	status.Healthy = c.devicePlugin.Healthy()
+	status.SocketPath = c.devicePlugin.GetSocketPath()
+	if c.lastError != nil {
+		status.LastError = c.lastError.Error()
+	}
+	if accounting, ok := c.devicePlugin.(healthAccountingDevice); ok {
+		status.HealthReasons = accounting.HealthReasonDurations()
+		status.HealthHistory = accounting.HealthHistory()
+	}
+	if allocations, ok := c.devicePlugin.(interface{ DuplicateAllocations() uint64 }); ok {
+		status.DuplicateAllocations = allocations.DuplicateAllocations()
+	}
+	return status
+}
+
 func (c *controlledDevice) GetName() string {
 	return c.devicePlugin.GetDeviceName()
 }
 
-func GetBridgeDevicePlugins(maxDevices int) ([]Device, error) {
+// BridgeVariant is a named sub-resource of a bridge with its own device count,
+// e.g. the "trunk" variant of br0 is advertised as bridge.network.kubevirt.io/br0-trunk.
+type BridgeVariant struct {
+	Name       string
+	MaxDevices int
+}
+
+// NewBridgeDevicePlugins creates the plugin for the bridge resource and one plugin per variant of the bridge.
+// Device counts are clamped to the port limit of the bridge.
+func NewBridgeDevicePlugins(bridgeName string, maxDevices int, variants []BridgeVariant, opts ...PluginOption) ([]Device, error) {
+	dev, err := NewBridgeDevicePlugin(bridgeName, clampMaxDevices(bridgeName, maxDevices), opts...)
+	if err != nil {
+		return nil, err
+	}
+	ret := []Device{dev}
+	for _, variant := range variants {
+		variantOpts := append(append([]PluginOption{}, opts...), WithVariant(variant.Name))
+		dev, err := NewBridgeDevicePlugin(bridgeName, clampMaxDevices(bridgeName, variant.MaxDevices), variantOpts...)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, dev)
+	}
+	return ret, nil
+}
+
+// newLinkDevicePlugins creates the plugins of an exposed link, bonds get the bond configuration,
+// VLAN sub-interfaces are marked as such and VLAN-filtering bridges get a plugin per trunk VLAN
+// when enabled.
+func newLinkDevicePlugins(link netlink.Link, maxDevices int, variants []BridgeVariant, filter *BridgeFilter, opts []PluginOption) ([]Device, error) {
+	name := link.Attrs().Name
+	maxDevices, opts = filter.settings(name).apply(maxDevices, opts)
+	if isVLAN(link) {
+		return NewBridgeDevicePlugins(name, maxDevices, variants, append(append([]PluginOption{}, opts...), WithVLAN())...)
+	}
+	if !isBond(link) || filter == nil || filter.Bonds == nil {
+		devs, err := NewBridgeDevicePlugins(name, maxDevices, variants, opts...)
+		if err != nil || filter == nil || filter.BridgeVLANs == nil {
+			return devs, err
+		}
+		vlanDevs, err := newBridgeVLANPlugins(link, filter.BridgeVLANs, opts)
+		if err != nil {
+			// The bridge itself is still exposed, the VLANs are picked up by the next resync
+			log.DefaultLogger().Reason(err).Warningf("could not read the VLANs of bridge %s", name)
+			return devs, nil
+		}
+		return append(devs, vlanDevs...), nil
+	}
+	bondOpts := append(append([]PluginOption{}, opts...), WithResourceNamespace(BondNamespace))
+	if filter.Bonds.MinActiveSlaves > 0 {
+		bondOpts = append(bondOpts, WithMinUpPorts(filter.Bonds.MinActiveSlaves))
+	}
+	dev, err := NewBridgeDevicePlugin(name, filter.Bonds.MaxDevices, bondOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return []Device{dev}, nil
+}
+
+// GetListedBridgeDevicePlugins creates plugins for exactly the bridges of the filter's bridge list,
+// without discovering the node's links. Bridges that don't exist yet are exposed with all devices
+// unhealthy until they are created.
+func GetListedBridgeDevicePlugins(maxDevices int, variants map[string][]BridgeVariant, filter *BridgeFilter, opts ...PluginOption) ([]Device, error) {
+	names := make([]string, 0, len(filter.Bridges))
+	for name := range filter.Bridges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := make([]Device, 0, len(names))
+	for _, name := range names {
+		devs, err := newListedDevicePlugins(name, maxDevices, variants[name], filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, devs...)
+	}
+	return ret, nil
+}
+
+// newListedDevicePlugins creates the plugins of a listed bridge, whether or not it exists.
+func newListedDevicePlugins(name string, maxDevices int, variants []BridgeVariant, filter *BridgeFilter, opts []PluginOption) ([]Device, error) {
+	link, err := linkSourceOf(opts).LinkByName(name)
+	if err == nil {
+		return newLinkDevicePlugins(link, maxDevices, variants, filter, opts)
+	}
+	if !isLinkNotFound(err) {
+		return nil, fmt.Errorf("could not look up bridge %q: %v", name, err)
+	}
+	log.DefaultLogger().Infof("bridge %s doesn't exist yet, exposing it as unhealthy until it is created", name)
+	maxDevices, opts = filter.settings(name).apply(maxDevices, opts)
+	return NewBridgeDevicePlugins(name, maxDevices, variants, opts...)
+}
+
+// GetBridgeDevicePlugins creates plugins for the bridges on the node. When ctx expires the
+// discovery is truncated and the plugins created so far are returned.
+func GetBridgeDevicePlugins(ctx context.Context, maxDevices int, variants map[string][]BridgeVariant, filter *BridgeFilter, opts ...PluginOption) ([]Device, error) {
+	logger := log.DefaultLogger()
 	ret := make([]Device, 0)
-	links, err := netlink.LinkList()
+	lister := linkSourceOf(opts)
+	links, err := listLinks(ctx, lister)
 	if err != nil {
+		if ctx.Err() != nil {
+			discoveryTruncationsMetric.Inc()
+			logger.Reason(err).Warning("Listing links did not finish in time, no bridges were discovered")
+			return ret, nil
+		}
 		return nil, err
 	}
-	for _, link := range links {
-		if bridge, ok := link.(*netlink.Bridge); ok {
-			ret = append(ret, NewBridgeDevicePlugin(bridge.Name, maxDevices))
+	for i, link := range links {
+		if ctx.Err() != nil {
+			discoveryTruncationsMetric.Inc()
+			logger.Warningf("Bridge discovery truncated after %d of %d links, continuing with %d plugins", i, len(links), len(ret))
+			break
+		}
+		if filter.isBridge(link) {
+			name := link.Attrs().Name
+			if !filter.MatchesLink(link, lister) || filter.enslaved(link) || filter.missingUplink(link, links, lister) {
+				continue
+			}
+			devs, err := newLinkDevicePlugins(link, maxDevices, variants[name], filter, opts)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, devs...)
 		}
 	}
 	return ret, nil
 }
 
+// DiscoveryTruncations returns the number of discovery passes that hit their deadline.
+func DiscoveryTruncations() uint64 {
+	return uint64(discoveryTruncationsMetric.Value())
+}
+
+// BridgeDeviceControllerInterface is the controller as seen by the command and admin handlers.
+type BridgeDeviceControllerInterface interface {
+	Run(ctx context.Context) error
+	RefreshDevices() error
+}
+
+var _ BridgeDeviceControllerInterface = &BridgeDeviceController{}
+
 type BridgeDeviceController struct {
-	permanentPlugins    map[string]Device
-	startedPlugins      map[string]controlledDevice
+	// permanentPlugins are the plugins found at startup, Run moves them to startedPlugins
+	permanentPlugins map[string]Device
+	// startedPlugins is the single registry of running plugins, both permanent and discovered ones
+	startedPlugins      map[string]*controlledDevice
 	startedPluginsMutex sync.Mutex
-	newPlugins	    chan Device
-	maxDevices	    int
-	backoff             []time.Duration
-	stop                chan struct{}
+	newPlugins          chan Device
+	// manuallyStopped are bridges stopped through StopDeviceByName, guarded by startedPluginsMutex
+	manuallyStopped map[string]bool
+	// stopping are the plugins removed from startedPlugins that are still shutting down, keyed by
+	// resource name, guarded by startedPluginsMutex
+	stopping       map[string]chan struct{}
+	removedBridges chan string
+	// removedPlugins are single plugins to stop, e.g. of VLANs removed from a bridge's trunk
+	removedPlugins chan string
+	maxDevices     int
+	backoff        Backoff
+	// ctx is the context of Run, plugins are started with contexts derived from it
+	ctx context.Context
+	// scanErrors carries the scanner's terminal error to Run
+	scanErrors    chan error
+	pluginOptions []PluginOption
+	variants      map[string][]BridgeVariant
+	loopMonitor   *loopMonitor
+	// keepRegistrationOnShutdown skips deregistration when the controller stops, for fast restarts
+	keepRegistrationOnShutdown bool
+	// linkMasters tracks the master of every link seen by the scanner, to notice enslavement changes
+	linkMasters map[int]int
+	// bridgeNames tracks bridge names by ifindex in the scanner, to notice renames
+	bridgeNames       map[int]string
+	sharedUplinks     map[string][]string
+	sharedUplinksLock sync.Mutex
+	// discoveryTimeout bounds a single pass over the node's links
+	discoveryTimeout time.Duration
+	// resyncPeriod is the interval of full bridge resyncs, 0 disables them
+	resyncPeriod time.Duration
+	// drainGracePeriod is how long kubelet gets to observe drained devices before the plugins stop
+	drainGracePeriod time.Duration
+	// maxConcurrentStarts bounds the plugins setting up their socket and registering at once, 0 is unbounded
+	maxConcurrentStarts int
+	// dynamicDiscovery starts plugins for bridges created after startup, otherwise only the permanent plugins run
+	dynamicDiscovery bool
+	// bridgeFilter selects the bridges that are exposed, it can be replaced while running
+	bridgeFilter atomic.Pointer[BridgeFilter]
+	// refreshOnRun is set when the filter was replaced before Run, guarded by startedPluginsMutex
+	refreshOnRun bool
+	// subscribed is set while the scanner follows link updates
+	subscribed atomic.Bool
+	// pluginsStarted is closed once Run started the permanent plugins
+	pluginsStarted chan struct{}
+	// links is where bridges are discovered and followed
+	links LinkSource
+	// clock times the restart backoff of the plugins and the resync
+	clock Clock
 }
 
 func NewBridgeDeviceController(
 	permanentPlugins []Device,
 	maxDevices int,
+	opts ...ControllerOption,
 ) *BridgeDeviceController {
 
 	permanentPluginsMap := make(map[string]Device, len(permanentPlugins))
 	for i := range permanentPlugins {
-		permanentPluginsMap[permanentPlugins[i].GetDeviceName()] = permanentPlugins[i]
+		key := permanentPlugins[i].GetResourceName()
+		if _, exists := permanentPluginsMap[key]; exists {
+			log.DefaultLogger().Warningf("ignoring duplicate permanent device plugin %s", key)
+			continue
+		}
+		permanentPluginsMap[key] = permanentPlugins[i]
 	}
 
 	controller := &BridgeDeviceController{
-		permanentPlugins: permanentPluginsMap,
-		startedPlugins:   map[string]controlledDevice{},
-		newPlugins:	  make(chan Device),
-		backoff:          defaultBackoffTime,
-		maxDevices: maxDevices,
+		permanentPlugins:    permanentPluginsMap,
+		startedPlugins:      map[string]*controlledDevice{},
+		newPlugins:          make(chan Device),
+		removedBridges:      make(chan string),
+		removedPlugins:      make(chan string),
+		scanErrors:          make(chan error, 1),
+		pluginsStarted:      make(chan struct{}),
+		manuallyStopped:     map[string]bool{},
+		stopping:            map[string]chan struct{}{},
+		backoff:             DefaultBackoff,
+		linkMasters:         map[int]int{},
+		bridgeNames:         map[int]string{},
+		sharedUplinks:       map[string][]string{},
+		discoveryTimeout:    DefaultDiscoveryTimeout,
+		resyncPeriod:        DefaultResyncPeriod,
+		dynamicDiscovery:    true,
+		maxConcurrentStarts: DefaultMaxConcurrentStarts,
+		drainGracePeriod:    DefaultDrainGracePeriod,
+		maxDevices:          maxDevices,
+		loopMonitor:         newLoopMonitor("controller", DefaultLoopStallThreshold),
+		links:               defaultLinkSource,
+		clock:               defaultClock,
+	}
+
+	for _, opt := range opts {
+		opt(controller)
+	}
+	if controller.links != defaultLinkSource {
+		controller.pluginOptions = append(append([]PluginOption{}, controller.pluginOptions...), WithLinkSource(controller.links))
+	}
+	if controller.clock != defaultClock {
+		controller.pluginOptions = append(append([]PluginOption{}, controller.pluginOptions...), WithClock(controller.clock))
 	}
 
 	return controller
 }
 
-func (c *BridgeDeviceController) startDevice(resourceName string, dev Device) {
-	c.stopDevice(resourceName)
-	controlledDev := controlledDevice{
+// startDevice starts the plugin unless a plugin for the same resource is already running,
+// so a bridge seen both at startup and by the scanner isn't bounced. It must be called with
+// startedPluginsMutex held, the mutex is released while a previous plugin of the resource
+// shuts down.
+func (c *BridgeDeviceController) startDevice(resourceName string, dev Device) bool {
+	// A plugin of the resource that is still shutting down holds the socket, Status and
+	// the other calls are answered meanwhile
+	for {
+		stopped, stopping := c.stopping[resourceName]
+		if !stopping {
+			break
+		}
+		c.startedPluginsMutex.Unlock()
+		<-stopped
+		c.startedPluginsMutex.Lock()
+	}
+	if existing, exists := c.startedPlugins[resourceName]; exists {
+		if bridge := existing.devicePlugin.GetDeviceName(); bridge != dev.GetDeviceName() {
+			log.DefaultLogger().Warningf("bridges %s and %s are both exposed as %s, only %s is served",
+				bridge, dev.GetDeviceName(), resourceName, bridge)
+		}
+		return false
+	}
+	controlledDev := &controlledDevice{
 		devicePlugin: dev,
 		backoff:      c.backoff,
+		clock:        c.clock,
 	}
-	controlledDev.Start()
+	controlledDev.Start(c.ctx)
 	c.startedPlugins[resourceName] = controlledDev
-	
+	recordStatusMetrics(controlledDev.status())
+	return true
 }
 
-func (c *BridgeDeviceController) stopDevice(resourceName string) {
+// stoppingDevice is a plugin removed from the started plugins that is yet to be stopped.
+type stoppingDevice struct {
+	resourceName string
+	dev          *controlledDevice
+	stopped      chan struct{}
+}
+
+// removeDevice removes the plugin from the started plugins, stopDevices stops it once
+// startedPluginsMutex is released. It must be called with startedPluginsMutex held.
+func (c *BridgeDeviceController) removeDevice(resourceName string) *stoppingDevice {
 	dev, exists := c.startedPlugins[resourceName]
-	if exists {
-		dev.Stop()
-		delete(c.startedPlugins, resourceName)
+	if !exists {
+		return nil
 	}
+	delete(c.startedPlugins, resourceName)
+	stopping := &stoppingDevice{resourceName: resourceName, dev: dev, stopped: make(chan struct{})}
+	c.stopping[resourceName] = stopping.stopped
+	return stopping
 }
 
-func (c *BridgeDeviceController) Run(stop chan struct{}) error {
+// stopDevices stops the plugins returned by removeDevice. It must be called without
+// startedPluginsMutex held, so Status and the other calls don't wait for plugins to shut down.
+func (c *BridgeDeviceController) stopDevices(devs []*stoppingDevice) {
+	for _, stopping := range devs {
+		stopping.dev.Stop()
+		// The health check reports until the plugin stopped, a new plugin of the resource
+		// only starts afterwards
+		deletePluginMetrics(stopping.dev.devicePlugin.GetDeviceName(), stopping.resourceName)
+		close(stopping.stopped)
+		c.startedPluginsMutex.Lock()
+		if c.stopping[stopping.resourceName] == stopping.stopped {
+			delete(c.stopping, stopping.resourceName)
+		}
+		c.startedPluginsMutex.Unlock()
+	}
+}
+
+// Run starts the device plugins and keeps them in sync with the node's bridges until ctx is cancelled.
+func (c *BridgeDeviceController) Run(ctx context.Context) error {
 	logger := log.DefaultLogger()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Plugins outlive ctx until they are drained and stopped on shutdown
+	pluginCtx, cancelPlugins := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelPlugins()
+	pluginCtx = withStartLimiter(pluginCtx, c.maxConcurrentStarts)
+	c.startedPluginsMutex.Lock()
+	c.ctx = pluginCtx
+	c.startedPluginsMutex.Unlock()
 
 	// start the permanent DevicePlugins
 	c.startPermanentPlugins()
+	close(c.pluginsStarted)
+	c.startedPluginsMutex.Lock()
+	refresh := c.refreshOnRun
+	c.refreshOnRun = false
+	c.startedPluginsMutex.Unlock()
+	if refresh {
+		if err := c.RefreshDevices(); err != nil {
+			logger.Reason(err).Error("Could not apply the bridge filter set before the controller started")
+		}
+	}
 
 	// Scan for new devices and adds them as they become available
-	go c.ScanForNewDevices(stop)
+	if c.dynamicDiscovery {
+		go c.ScanForNewDevices(ctx)
+	}
 
+	heartbeat := c.clock.NewTicker(loopHeartbeatInterval)
+	defer heartbeat.Stop()
+	defer c.loopMonitor.Reset()
+
+	newPlugins := c.newPlugins
 	for {
+		c.loopMonitor.Beat()
 		select {
-		case device := <-c.newPlugins:
+		case <-heartbeat.C():
+		case device, ok := <-newPlugins:
+			if !ok {
+				// The scanner is gone, stop selecting on the closed channel
+				newPlugins = nil
+				continue
+			}
 			c.startNewPlugin(device)
+		case bridgeName := <-c.removedBridges:
+			c.stopBridgePlugins(bridgeName)
+		case key := <-c.removedPlugins:
+			c.stopPlugin(key)
+		case err := <-c.scanErrors:
+			logger.Reason(err).Critical("Scanning for bridges failed, shutting down device plugin controller")
+			c.shutdown()
+			return err
 		// keep running until stop
-		case <-stop:
+		case <-ctx.Done():
 			logger.Info("Shutting down device plugin controller")
-			c.stopAllPlugins()
+			c.shutdown()
 			return nil
 		}
 	}
@@ -167,41 +658,227 @@ func (c *BridgeDeviceController) Run(stop chan struct{}) error {
 func (c *BridgeDeviceController) startPermanentPlugins() {
 	c.startedPluginsMutex.Lock()
 	defer c.startedPluginsMutex.Unlock()
-	for name, dev := range c.permanentPlugins {
-		c.startDevice(name, dev)
+	// Sorted, so the start order is deterministic
+	names := make([]string, 0, len(c.permanentPlugins))
+	for name := range c.permanentPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.startDevice(name, c.permanentPlugins[name])
 	}
+	c.permanentPlugins = nil
+}
+
+// shutdown drains the plugins, unless their registration is kept for a fast restart, and stops them.
+func (c *BridgeDeviceController) shutdown() {
+	if !c.keepRegistrationOnShutdown && c.drainGracePeriod > 0 {
+		c.drainAllPlugins()
+	}
+	c.stopAllPlugins()
+}
+
+// drainAllPlugins reports every device as unhealthy and gives kubelet the drain grace period
+// to stop scheduling pods against them before the plugins go away.
+func (c *BridgeDeviceController) drainAllPlugins() {
+	c.startedPluginsMutex.Lock()
+	for _, dev := range c.startedPlugins {
+		dev.devicePlugin.Drain()
+	}
+	c.startedPluginsMutex.Unlock()
+
+	log.DefaultLogger().Infof("Draining device plugins, waiting %v before stopping them", c.drainGracePeriod)
+	<-c.clock.After(c.drainGracePeriod)
 }
 
 func (c *BridgeDeviceController) stopAllPlugins() {
 	c.startedPluginsMutex.Lock()
-	defer c.startedPluginsMutex.Unlock()
-	for name := range c.startedPlugins {
-		c.stopDevice(name)
+	var removed []*stoppingDevice
+	for name, dev := range c.startedPlugins {
+		if c.keepRegistrationOnShutdown {
+			dev.devicePlugin.KeepRegistration()
+		}
+		removed = append(removed, c.removeDevice(name))
 	}
+	c.startedPluginsMutex.Unlock()
+	c.stopDevices(removed)
 }
 
 func (c *BridgeDeviceController) startNewPlugin(device Device) {
 	c.startedPluginsMutex.Lock()
 	defer c.startedPluginsMutex.Unlock()
-	c.startDevice(device.GetDeviceName(), device)
+	// Attribute changes also emit RTM_NEWLINK, the running plugin tracks them itself
+	c.startDevice(device.GetResourceName(), device)
+}
+
+// stopBridgePlugins stops and deregisters every plugin backed by the bridge, including its variants.
+// A recreated bridge is picked up by the scanner.
+func (c *BridgeDeviceController) stopBridgePlugins(bridgeName string) {
+	c.startedPluginsMutex.Lock()
+	var removed []*stoppingDevice
+	for name, dev := range c.startedPlugins {
+		if dev.devicePlugin.GetDeviceName() == bridgeName {
+			log.DefaultLogger().Infof("bridge %s was deleted, stopping device plugin %s", bridgeName, name)
+			removed = append(removed, c.removeDevice(name))
+		}
+	}
+	c.startedPluginsMutex.Unlock()
+	c.stopDevices(removed)
+}
+
+// stopPlugin stops and deregisters a single plugin.
+func (c *BridgeDeviceController) stopPlugin(key string) {
+	c.startedPluginsMutex.Lock()
+	removed := c.removeDevice(key)
+	c.startedPluginsMutex.Unlock()
+	if removed != nil {
+		log.DefaultLogger().Infof("stopping device plugin %s", key)
+		c.stopDevices([]*stoppingDevice{removed})
+	}
 }
 
-func (c *BridgeDeviceController) ScanForNewDevices(stop chan struct{}) {
+// RunWithStop runs the controller until stop is closed.
+//
+// Deprecated: use Run with a context.
+func (c *BridgeDeviceController) RunWithStop(stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return c.Run(ctx)
+}
+
+// ScanForNewDevices follows link updates and hands plugins for new bridges to the controller until ctx is cancelled.
+func (c *BridgeDeviceController) ScanForNewDevices(ctx context.Context) {
 	defer close(c.newPlugins)
+	defer c.subscribed.Store(false)
 	logger := log.DefaultLogger()
-	updates := make(chan netlink.LinkUpdate) 
-	if err := netlink.LinkSubscribe(updates, stop); err != nil {
-		logger.Reason(err).Criticalf("Could not subscribe to link updates, stopping device plugin.")
-		close(stop)
+	stop := ctx.Done()
+	netnsGeneration := currentNetnsGeneration()
+	updates, cancelSub, err := c.subscribeCancelable(ctx)
+	if err != nil {
+		c.scanFailed(ctx, err)
+		return
+	}
+	defer func() { cancelSub() }()
+	c.refreshSharedUplinks()
+	c.recordBridgeNames()
+	// Bridges created or removed between the startup discovery and the subscription only show
+	// up in a listing, later changes arrive as updates. Bridges seen twice are left alone.
+	if !c.resync(stop) {
 		return
 	}
 
+	var resync <-chan time.Time
+	if c.resyncPeriod > 0 {
+		ticker := c.clock.NewTicker(c.resyncPeriod)
+		defer ticker.Stop()
+		resync = ticker.C()
+	}
+	var netnsCheck <-chan time.Time
+	netnsGone := false
+	if netnsConfigured() {
+		ticker := c.clock.NewTicker(linkPollInterval)
+		defer ticker.Stop()
+		netnsCheck = ticker.C()
+	}
+
 	for {
 		select {
-		case update := <-updates:
-			link := update.Link
-			if bridge, ok := link.(*netlink.Bridge); ok && update.Header.Type == unix.RTM_NEWLINK {
-				c.newPlugins <- NewBridgeDevicePlugin(bridge.Name, c.maxDevices)
+		case update, ok := <-updates:
+			if !ok {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Warning("Link update subscription was closed, resubscribing")
+				if !c.resubscribe(ctx, &updates, &cancelSub) {
+					return
+				}
+				// Updates may have been missed in between
+				if !c.resync(stop) {
+					return
+				}
+				continue
+			}
+			recordLinkEvent(update)
+			if c.trackEnslavement(update) && c.bridgeFilter.Load().requiresUplink() {
+				// A port was attached or detached, bridges may have gained or lost their uplink
+				if !c.recheckUplinks(stop) {
+					return
+				}
+			}
+			if update.Family == unix.AF_BRIDGE && c.bridgeFilter.Load().bridgeVLANs() != nil {
+				// The VLANs of a bridge port changed, or a port was added to or removed from a bridge
+				if bridgeName, known := c.bridgeNames[update.Attrs().MasterIndex]; known {
+					if !c.syncBridgeVLANs(bridgeName, stop) {
+						return
+					}
+				}
+			}
+			if !c.bridgeFilter.Load().isBridge(update.Link) {
+				continue
+			}
+			bridge := update.Link.Attrs()
+			switch update.Header.Type {
+			case unix.RTM_NEWLINK:
+				if previous, known := c.bridgeNames[bridge.Index]; known && previous != bridge.Name {
+					logger.Infof("bridge %s was renamed to %s", previous, bridge.Name)
+					if !c.removeBridge(previous, stop) {
+						return
+					}
+				}
+				c.bridgeNames[bridge.Index] = bridge.Name
+				if c.managedBridges()[bridge.Name] {
+					if c.bridgeFilter.Load().enslaved(update.Link) {
+						logger.Infof("bridge %s was enslaved to another interface", bridge.Name)
+						if !c.removeBridge(bridge.Name, stop) {
+							return
+						}
+					}
+					continue
+				}
+				if !c.addBridge(update.Link, stop) {
+					return
+				}
+			case unix.RTM_DELLINK:
+				delete(c.bridgeNames, bridge.Index)
+				if c.bridgeFilter.Load().listed(bridge.Name) {
+					// The plugins report the missing bridge until it is created again
+					continue
+				}
+				if !c.removeBridge(bridge.Name, stop) {
+					return
+				}
+			}
+		case <-resync:
+			if !c.resync(stop) {
+				return
+			}
+		case <-netnsCheck:
+			err := checkNetns(netnsGeneration)
+			if err != nil && !errors.Is(err, ErrNetnsChanged) {
+				if !netnsGone {
+					logger.Reason(err).Warning("Could not check the network namespace")
+				}
+				netnsGone = true
+				continue
+			}
+			netnsGone = false
+			if err != nil {
+				logger.Info("Network namespace was replaced, resubscribing to link updates")
+				netnsGeneration = currentNetnsGeneration()
+				if !c.resubscribe(ctx, &updates, &cancelSub) {
+					return
+				}
+				c.linkMasters = map[int]int{}
+				if !c.resync(stop) {
+					return
+				}
 			}
 		case <-stop:
 			logger.Info("Stop scanning for new devices due to stop signal")
@@ -209,3 +886,618 @@ func (c *BridgeDeviceController) ScanForNewDevices(stop chan struct{}) {
 		}
 	}
 }
+
+// subscribe subscribes to link updates, retrying with backoff. It gives up after
+// maxSubscribeAttempts failed attempts or when ctx is done.
+func (c *BridgeDeviceController) subscribe(ctx context.Context) (chan netlink.LinkUpdate, error) {
+	for attempt := 1; ; attempt++ {
+		updates := make(chan netlink.LinkUpdate, linkUpdateBuffer)
+		err := c.links.Subscribe(updates, ctx.Done())
+		if err == nil {
+			return updates, nil
+		}
+		if attempt >= maxSubscribeAttempts {
+			return nil, fmt.Errorf("could not subscribe to link updates after %d attempts: %v", attempt, err)
+		}
+
+		delay := c.backoff.Duration(attempt - 1)
+		log.DefaultLogger().Reason(err).Warningf("Could not subscribe to link updates, retrying in %v", delay)
+		select {
+		case <-c.clock.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// subscribeCancelable subscribes to link updates with its own context, so the subscription
+// can be replaced, e.g. when the network namespace is.
+func (c *BridgeDeviceController) subscribeCancelable(ctx context.Context) (chan netlink.LinkUpdate, context.CancelFunc, error) {
+	subCtx, cancel := context.WithCancel(ctx)
+	updates, err := c.subscribe(subCtx)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	c.subscribed.Store(true)
+	return updates, cancel, nil
+}
+
+// resubscribe replaces the subscription, it returns false when the scanner has to stop.
+func (c *BridgeDeviceController) resubscribe(ctx context.Context, updates *chan netlink.LinkUpdate, cancel *context.CancelFunc) bool {
+	c.subscribed.Store(false)
+	(*cancel)()
+	newUpdates, newCancel, err := c.subscribeCancelable(ctx)
+	if err != nil {
+		c.scanFailed(ctx, err)
+		return false
+	}
+	*updates, *cancel = newUpdates, newCancel
+	return true
+}
+
+// scanFailed hands a terminal scanner error to Run, unless the controller is shutting down anyway.
+func (c *BridgeDeviceController) scanFailed(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	select {
+	case c.scanErrors <- err:
+	default:
+	}
+}
+
+// addBridge hands plugins for the bridge to the controller loop, it returns false when stopped.
+func (c *BridgeDeviceController) addBridge(link netlink.Link, stop <-chan struct{}) bool {
+	bridgeName := link.Attrs().Name
+	if c.isManuallyStopped(bridgeName) {
+		log.DefaultLogger().V(4).Infof("not starting manually stopped bridge %s", bridgeName)
+		return true
+	}
+	filter := c.bridgeFilter.Load()
+	if !filter.MatchesLink(link, c.links) {
+		log.DefaultLogger().V(4).Infof("not starting filtered out bridge %s", bridgeName)
+		return true
+	}
+	if filter.enslaved(link) || filter.missingUplink(link, nil, c.links) {
+		return true
+	}
+	devs, err := newLinkDevicePlugins(link, c.maxDevices, c.variants[bridgeName], filter, c.pluginOptions)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Errorf("Could not create device plugin for bridge %s", bridgeName)
+		return true
+	}
+	for _, dev := range devs {
+		select {
+		case c.newPlugins <- dev:
+		case <-stop:
+			return false
+		}
+	}
+	return true
+}
+
+// removeBridge asks the controller loop to stop the bridge's plugins, it returns false when stopped.
+func (c *BridgeDeviceController) removeBridge(bridgeName string, stop <-chan struct{}) bool {
+	select {
+	case c.removedBridges <- bridgeName:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// resync recovers from missed link updates by diffing the bridges on the node against the
+// started plugins. Running plugins are left alone. It returns false when stopped.
+func (c *BridgeDeviceController) resync(stop <-chan struct{}) bool {
+	logger := log.DefaultLogger()
+	ctx, cancel := context.WithTimeout(context.Background(), c.discoveryTimeout)
+	defer cancel()
+	links, err := listLinks(ctx, c.links)
+	if err != nil {
+		logger.Reason(err).Error("Could not list links to resync bridges")
+		return true
+	}
+
+	present := map[string]bool{}
+	bridges := map[string]netlink.Link{}
+	c.bridgeNames = map[int]string{}
+	filter := c.bridgeFilter.Load()
+	for _, link := range links {
+		if filter.isBridge(link) {
+			bridge := link.Attrs()
+			present[bridge.Name] = filter.MatchesLink(link, c.links) && !filter.enslaved(link) && !filter.missingUplink(link, links, c.links)
+			bridges[bridge.Name] = link
+			c.bridgeNames[bridge.Index] = bridge.Name
+		}
+	}
+	managed := c.managedBridges()
+
+	for name, matches := range present {
+		if matches && !managed[name] {
+			logger.Infof("resync found unmanaged bridge %s", name)
+			if !c.addBridge(bridges[name], stop) {
+				return false
+			}
+		}
+	}
+	for name := range managed {
+		if !present[name] && !filter.listed(name) {
+			logger.Infof("resync found bridge %s is gone or filtered out", name)
+			if !c.removeBridge(name, stop) {
+				return false
+			}
+		} else if filter.bridgeVLANs() != nil {
+			if !c.syncBridgeVLANs(name, stop) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// syncBridgeVLANs starts plugins for VLANs added to the trunk of a managed bridge and stops
+// the plugins of removed ones, it returns false when stopped.
+func (c *BridgeDeviceController) syncBridgeVLANs(bridgeName string, stop <-chan struct{}) bool {
+	filter := c.bridgeFilter.Load()
+	if filter.bridgeVLANs() == nil || c.isManuallyStopped(bridgeName) || !c.managedBridges()[bridgeName] {
+		return true
+	}
+	link, err := c.links.LinkByName(bridgeName)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Warningf("could not look up bridge %s to sync its VLANs", bridgeName)
+		return true
+	}
+	// The VLANs have their own device count
+	_, opts := filter.settings(bridgeName).apply(0, c.pluginOptions)
+	devs, err := newBridgeVLANPlugins(link, filter.bridgeVLANs(), opts)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Warningf("could not read the VLANs of bridge %s", bridgeName)
+		return true
+	}
+
+	wanted := make(map[string]bool, len(devs))
+	for _, dev := range devs {
+		wanted[dev.GetResourceName()] = true
+		select {
+		case c.newPlugins <- dev:
+		case <-stop:
+			return false
+		}
+	}
+	for _, key := range c.bridgeVLANPlugins(bridgeName) {
+		if wanted[key] {
+			continue
+		}
+		log.DefaultLogger().Infof("VLAN plugin %s is no longer trunked on bridge %s", key, bridgeName)
+		select {
+		case c.removedPlugins <- key:
+		case <-stop:
+			return false
+		}
+	}
+	return true
+}
+
+// bridgeVLANPlugins returns the keys of the started VLAN plugins of the bridge.
+func (c *BridgeDeviceController) bridgeVLANPlugins(bridgeName string) []string {
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+	var ret []string
+	for key, dev := range c.startedPlugins {
+		if dev.devicePlugin.GetDeviceName() == bridgeName && bridgeVLANOf(dev.devicePlugin) != 0 {
+			ret = append(ret, key)
+		}
+	}
+	return ret
+}
+
+// recordBridgeNames remembers the name of every bridge by ifindex, so renames can be detected.
+func (c *BridgeDeviceController) recordBridgeNames() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.discoveryTimeout)
+	defer cancel()
+	links, err := listLinks(ctx, c.links)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Error("Could not list links to record bridge names")
+		return
+	}
+	filter := c.bridgeFilter.Load()
+	for _, link := range links {
+		if filter.isBridge(link) {
+			c.bridgeNames[link.Attrs().Index] = link.Attrs().Name
+		}
+	}
+}
+
+// trackEnslavement refreshes the shared uplink detection when the master of a link changes,
+// it returns whether it changed.
+func (c *BridgeDeviceController) trackEnslavement(update netlink.LinkUpdate) bool {
+	index := update.Attrs().Index
+	master := update.Attrs().MasterIndex
+	previous, known := c.linkMasters[index]
+	if update.Header.Type == unix.RTM_DELLINK {
+		master = 0
+		delete(c.linkMasters, index)
+	} else {
+		c.linkMasters[index] = master
+	}
+
+	if previous == master && (known || master == 0) {
+		return false
+	}
+	c.refreshSharedUplinks()
+	return true
+}
+
+// recheckUplinks starts the plugins of bridges that got a physical uplink and stops the plugins
+// of bridges that lost theirs, it returns false when stopped.
+func (c *BridgeDeviceController) recheckUplinks(stop <-chan struct{}) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.discoveryTimeout)
+	defer cancel()
+	links, err := listLinks(ctx, c.links)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Error("Could not list links to check the uplinks of bridges")
+		return true
+	}
+	filter := c.bridgeFilter.Load()
+	managed := c.managedBridges()
+	for _, link := range links {
+		name := link.Attrs().Name
+		if !filter.isBridge(link) || !filter.MatchesLink(link, c.links) || filter.enslaved(link) {
+			continue
+		}
+		missing := filter.missingUplink(link, links, c.links)
+		switch {
+		case missing && managed[name]:
+			log.DefaultLogger().Infof("bridge %s lost its physical uplink", name)
+			if !c.removeBridge(name, stop) {
+				return false
+			}
+		case !missing && !managed[name]:
+			if !c.addBridge(link, stop) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *BridgeDeviceController) refreshSharedUplinks() {
+	logger := log.DefaultLogger()
+	ctx, cancel := context.WithTimeout(context.Background(), c.discoveryTimeout)
+	defer cancel()
+	links, err := listLinks(ctx, c.links)
+	if err != nil {
+		logger.Reason(err).Error("Could not list links to detect shared uplinks")
+		return
+	}
+	shared := findSharedUplinks(links, c.managedBridges())
+
+	c.sharedUplinksLock.Lock()
+	previous := c.sharedUplinks
+	c.sharedUplinks = shared
+	recordSharedUplinkMetrics(previous, shared)
+	c.sharedUplinksLock.Unlock()
+
+	for uplink, bridges := range shared {
+		if !slices.Equal(previous[uplink], bridges) {
+			logger.Warningf("uplink %s is shared by bridges %s, only one of them will get its traffic", uplink, strings.Join(bridges, ", "))
+		}
+	}
+	for uplink := range previous {
+		if _, exists := shared[uplink]; !exists {
+			logger.Infof("uplink %s is no longer shared between bridges", uplink)
+		}
+	}
+}
+
+func (c *BridgeDeviceController) managedBridges() map[string]bool {
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+	bridges := make(map[string]bool, len(c.startedPlugins))
+	for _, dev := range c.startedPlugins {
+		bridges[dev.devicePlugin.GetDeviceName()] = true
+	}
+	return bridges
+}
+
+// SharedUplinks returns the physical uplinks backing more than one managed bridge, mapped to those bridges.
+func (c *BridgeDeviceController) SharedUplinks() map[string][]string {
+	c.sharedUplinksLock.Lock()
+	defer c.sharedUplinksLock.Unlock()
+	ret := make(map[string][]string, len(c.sharedUplinks))
+	for uplink, bridges := range c.sharedUplinks {
+		ret[uplink] = append([]string{}, bridges...)
+	}
+	return ret
+}
+
+// RefreshDevices reconciles the started plugins with the bridges currently on the node, without
+// waiting for link updates. Plugins of bridges that are gone are stopped and plugins for new
+// bridges are started, bridges stopped through StopDeviceByName are left alone.
+// It returns the aggregate of all failures.
+func (c *BridgeDeviceController) RefreshDevices() error {
+	logger := log.DefaultLogger()
+	ctx, cancel := context.WithTimeout(context.Background(), c.discoveryTimeout)
+	defer cancel()
+	links, err := listLinks(ctx, c.links)
+	if err != nil {
+		return fmt.Errorf("could not list links: %v", err)
+	}
+	present := map[string]netlink.Link{}
+	filter := c.bridgeFilter.Load()
+	for _, link := range links {
+		if filter.isBridge(link) && filter.MatchesLink(link, c.links) && !filter.enslaved(link) && !filter.missingUplink(link, links, c.links) {
+			present[link.Attrs().Name] = link
+		}
+	}
+
+	// Plugins are stopped once the lock is released, the bridges they are removed for aren't
+	// started again by this refresh
+	var removed []*stoppingDevice
+	c.startedPluginsMutex.Lock()
+	defer func() {
+		c.startedPluginsMutex.Unlock()
+		c.stopDevices(removed)
+	}()
+	if c.ctx == nil {
+		return fmt.Errorf("the controller is not running")
+	}
+
+	for name, dev := range c.startedPlugins {
+		if bridgeName := dev.devicePlugin.GetDeviceName(); present[bridgeName] == nil && !filter.listed(bridgeName) {
+			logger.Infof("refresh found bridge %s is gone or filtered out, stopping device plugin %s", bridgeName, name)
+			removed = append(removed, c.removeDevice(name))
+		}
+	}
+	bridgeNames := make([]string, 0, len(present))
+	for bridgeName := range present {
+		bridgeNames = append(bridgeNames, bridgeName)
+	}
+	// Listed bridges are exposed before they exist
+	for bridgeName := range filter.listedBridges() {
+		if present[bridgeName] == nil {
+			bridgeNames = append(bridgeNames, bridgeName)
+		}
+	}
+	sort.Strings(bridgeNames)
+
+	var errs []error
+	wanted := map[string]bool{}
+	for _, bridgeName := range bridgeNames {
+		if c.manuallyStopped[bridgeName] {
+			continue
+		}
+		var devs []Device
+		if link := present[bridgeName]; link != nil {
+			devs, err = newLinkDevicePlugins(link, c.maxDevices, c.variants[bridgeName], filter, c.pluginOptions)
+		} else {
+			maxDevices, opts := filter.settings(bridgeName).apply(c.maxDevices, c.pluginOptions)
+			devs, err = NewBridgeDevicePlugins(bridgeName, maxDevices, c.variants[bridgeName], opts...)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not create device plugin for bridge %s: %v", bridgeName, err))
+			continue
+		}
+		for _, dev := range devs {
+			key := dev.GetResourceName()
+			wanted[key] = true
+			if c.startDevice(key, dev) {
+				logger.Infof("refresh found unmanaged bridge %s, started device plugin %s", bridgeName, key)
+			}
+		}
+	}
+	// VLANs no longer trunked on a bridge that is still present
+	for name, dev := range c.startedPlugins {
+		if bridgeVLANOf(dev.devicePlugin) != 0 && !wanted[name] && !c.manuallyStopped[dev.devicePlugin.GetDeviceName()] {
+			logger.Infof("refresh found VLAN plugin %s is no longer trunked, stopping it", name)
+			removed = append(removed, c.removeDevice(name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetBridgeFilter replaces the bridge filter, plugins of bridges that no longer match are
+// stopped and deregistered, newly matching bridges are started and bridges whose settings
+// changed are restarted with the new ones.
+// A filter set before Run is applied when Run starts.
+func (c *BridgeDeviceController) SetBridgeFilter(filter *BridgeFilter) error {
+	previous := c.bridgeFilter.Swap(filter)
+
+	c.startedPluginsMutex.Lock()
+	if c.ctx == nil {
+		c.refreshOnRun = true
+		c.startedPluginsMutex.Unlock()
+		return nil
+	}
+	var removed []*stoppingDevice
+	for key, dev := range c.startedPlugins {
+		bridgeName := dev.devicePlugin.GetDeviceName()
+		if previous.settings(bridgeName) != filter.settings(bridgeName) {
+			log.DefaultLogger().Infof("settings of bridge %s changed, restarting device plugin %s", bridgeName, key)
+			removed = append(removed, c.removeDevice(key))
+		}
+	}
+	c.startedPluginsMutex.Unlock()
+	c.stopDevices(removed)
+	return c.RefreshDevices()
+}
+
+// StopDeviceByName stops and deregisters the plugins of the named bridge, including its variants.
+// The bridge stays stopped, regardless of link updates, until StartDeviceByName is called for it.
+func (c *BridgeDeviceController) StopDeviceByName(name string) error {
+	c.startedPluginsMutex.Lock()
+	var removed []*stoppingDevice
+	for key, dev := range c.startedPlugins {
+		if dev.devicePlugin.GetDeviceName() == name {
+			removed = append(removed, c.removeDevice(key))
+		}
+	}
+	if len(removed) == 0 {
+		c.startedPluginsMutex.Unlock()
+		return fmt.Errorf("%w: no device plugin is running for bridge %q", ErrUnknownDevice, name)
+	}
+	// Marked before the plugins are stopped, so link updates don't start them again meanwhile
+	c.manuallyStopped[name] = true
+	c.startedPluginsMutex.Unlock()
+	c.stopDevices(removed)
+	log.DefaultLogger().Infof("device plugins for bridge %s were stopped on request", name)
+	return nil
+}
+
+// StartDeviceByName starts the plugins of the named bridge, which must exist on the node,
+// and lets link updates manage it again. Plugins that are already running are left alone.
+func (c *BridgeDeviceController) StartDeviceByName(name string) error {
+	filter := c.bridgeFilter.Load()
+	if filter.listed(name) {
+		devs, err := newListedDevicePlugins(name, c.maxDevices, c.variants[name], filter, c.pluginOptions)
+		if err != nil {
+			return err
+		}
+		return c.startRequested(name, devs)
+	}
+
+	link, err := c.links.LinkByName(name)
+	if err != nil {
+		if isLinkNotFound(err) {
+			return fmt.Errorf("%w: bridge %q does not exist", ErrUnknownDevice, name)
+		}
+		return fmt.Errorf("could not look up bridge %q: %v", name, err)
+	}
+	if !filter.isBridge(link) {
+		return fmt.Errorf("%w: %q is not a bridge", ErrUnknownDevice, name)
+	}
+	if !filter.MatchesLink(link, c.links) {
+		return fmt.Errorf("bridge %q is excluded by the bridge filter", name)
+	}
+	if filter.enslaved(link) {
+		return fmt.Errorf("bridge %q is enslaved to another interface", name)
+	}
+	if filter.missingUplink(link, nil, c.links) {
+		return fmt.Errorf("bridge %q has no physical uplink", name)
+	}
+
+	devs, err := newLinkDevicePlugins(link, c.maxDevices, c.variants[name], filter, c.pluginOptions)
+	if err != nil {
+		return err
+	}
+	return c.startRequested(name, devs)
+}
+
+// startRequested starts the plugins of a bridge started through StartDeviceByName.
+func (c *BridgeDeviceController) startRequested(name string, devs []Device) error {
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+	if c.ctx == nil {
+		return fmt.Errorf("the controller is not running")
+	}
+	delete(c.manuallyStopped, name)
+	for _, dev := range devs {
+		c.startDevice(dev.GetResourceName(), dev)
+	}
+	log.DefaultLogger().Infof("device plugins for bridge %s were started on request", name)
+	return nil
+}
+
+func (c *BridgeDeviceController) isManuallyStopped(bridgeName string) bool {
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+	return c.manuallyStopped[bridgeName]
+}
+
+// Status returns a snapshot of the status of every started plugin, ordered by resource name.
+// It doesn't wait for the plugins, so it can be called at any time.
+func (c *BridgeDeviceController) Status() []DeviceStatus {
+	sharedUplinks := map[string][]string{}
+	for uplink, bridges := range c.SharedUplinks() {
+		for _, bridge := range bridges {
+			sharedUplinks[bridge] = append(sharedUplinks[bridge], uplink)
+		}
+	}
+
+	degraded := LinkWatchDegraded()
+
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+	ret := make([]DeviceStatus, 0, len(c.startedPlugins))
+	for _, dev := range c.startedPlugins {
+		status := dev.status()
+		status.SharedUplinks = sharedUplinks[status.BridgeName]
+		sort.Strings(status.SharedUplinks)
+		status.LinkWatchDegraded = degraded
+		ret = append(ret, status)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ResourceName < ret[j].ResourceName
+	})
+	return ret
+}
+
+// PluginsStarted is closed once Run has started the plugins found at startup. They may not
+// be registered yet.
+func (c *BridgeDeviceController) PluginsStarted() <-chan struct{} {
+	return c.pluginsStarted
+}
+
+// Initialized reports whether Run has started the plugins and every started plugin is
+// registered with kubelet. It goes false again while a plugin re-registers.
+func (c *BridgeDeviceController) Initialized() bool {
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+	if c.permanentPlugins != nil {
+		return false
+	}
+	for _, dev := range c.startedPlugins {
+		if !dev.devicePlugin.GetInitialized() {
+			return false
+		}
+	}
+	return true
+}
+
+// FailedPlugins returns the resource names of the started plugins that stopped for good, sorted.
+func (c *BridgeDeviceController) FailedPlugins() []string {
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+	var ret []string
+	for name, dev := range c.startedPlugins {
+		if dev.status().Failed {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Subscribed reports whether the scanner follows link updates. Without dynamic discovery
+// there is nothing to follow and it is always true.
+func (c *BridgeDeviceController) Subscribed() bool {
+	return !c.dynamicDiscovery || c.subscribed.Load()
+}
+
+// LinkWatchDegraded reports whether link updates are polled because the netlink subscription
+// isn't permitted.
+func (c *BridgeDeviceController) LinkWatchDegraded() bool {
+	return LinkWatchDegraded()
+}
+
+// LoopLatency returns the iteration gap statistics of the controller event loop.
+func (c *BridgeDeviceController) LoopLatency() LoopLatencyStats {
+	return c.loopMonitor.Stats()
+}
+
+// Stalled reports whether the controller event loop or any started plugin's health check loop stopped iterating.
+func (c *BridgeDeviceController) Stalled() bool {
+	if c.loopMonitor.Stalled() {
+		return true
+	}
+
+	c.startedPluginsMutex.Lock()
+	defer c.startedPluginsMutex.Unlock()
+	for _, dev := range c.startedPlugins {
+		if dev.devicePlugin.Stalled() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,625 @@
+package plugin_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/metrics"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin/pluginfakes"
+	"github.com/vishvananda/netlink"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func resourceName(bridge string) string {
+	return plugin.DeviceNamespace + "/" + bridge
+}
+
+func TestControllerEnslavedPortWithoutFilter(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	runController(t, h, []plugin.Device{newPlugin(t, h, "br0", 3)})
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+
+	// Without a bridge filter, ports joining a bridge must not trip over the missing filter
+	h.Links.AddDevice("eth0")
+	h.Links.SetMaster("eth0", "br0")
+	// Updates are handled in order, so the scanner got past the port once br1 registers
+	h.Links.AddBridge("br1")
+	waitForRegistration(ctx, t, h, resourceName("br1"))
+}
+
+func TestControllerBridgePortVLANsWithoutFilter(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	h.Links.AddDevice("eth0")
+	h.Links.SetMaster("eth0", "br0")
+	runController(t, h, []plugin.Device{newPlugin(t, h, "br0", 3)})
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+
+	// Without a bridge filter, bridge VLAN updates of a port must not trip over the missing filter
+	h.Links.SetBridgeVLANs("eth0", 1, 100, 200)
+	h.Links.AddBridge("br1")
+	waitForRegistration(ctx, t, h, resourceName("br1"))
+}
+
+func TestControllerReconcilesChangesBeforeSubscribing(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br-gone")
+	// The startup discovery saw br-gone only
+	c := runControllerLater(t, h, []plugin.Device{newPlugin(t, h, "br-gone", 3)})
+	// Changes between the discovery and the subscription send no update the scanner could see
+	h.Links.RemoveLink("br-gone")
+	h.Links.AddBridge("br-new")
+	c.run()
+
+	waitForRegistration(ctx, t, h, resourceName("br-new"))
+	eventually(ctx, t, "br-gone's plugin wasn't stopped", func() bool {
+		for _, status := range c.Status() {
+			if status.BridgeName == "br-gone" {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestControllerKeysPluginsByResourceName(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	// Same device name, different resource namespaces
+	c := runController(t, h, []plugin.Device{
+		newPlugin(t, h, "br0", 3),
+		newPlugin(t, h, "br0", 3, plugin.WithResourceNamespace("storage.example.com")),
+	})
+
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+	waitForRegistration(ctx, t, h, "storage.example.com/br0")
+	var got []string
+	for _, status := range c.Status() {
+		got = append(got, status.ResourceName)
+	}
+	want := []string{resourceName("br0"), "storage.example.com/br0"}
+	if !slices.Equal(got, want) {
+		t.Errorf("the controller runs %v, want %v", got, want)
+	}
+}
+
+func TestControllerAdvertisesBridgeVariants(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	runController(t, h, nil, plugin.WithBridgeVariants(map[string][]plugin.BridgeVariant{
+		"br0": {{Name: "trunk", MaxDevices: 2}},
+	}))
+
+	h.Links.AddBridge("br0")
+	h.Links.AddBridge("br1")
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+	waitForRegistration(ctx, t, h, resourceName("br0-trunk"))
+	waitForRegistration(ctx, t, h, resourceName("br1"))
+
+	devices, err := watch(ctx, t, h, resourceName("br0-trunk")).WaitFor(ctx, pluginfakes.AllHealth(pluginapi.Healthy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Errorf("the variant advertises %d devices, expected 2", len(devices))
+	}
+	if h.Kubelet.Registrations(resourceName("br1-trunk")) != 0 {
+		t.Error("a bridge without variants registered a variant")
+	}
+}
+
+func TestControllerDetectsSharedUplinks(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	h.Links.AddBridge("br1")
+	eth0 := h.Links.AddDevice("eth0")
+	h.Links.SetMaster("eth0", "br0")
+	c := runController(t, h, nil)
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+	waitForRegistration(ctx, t, h, resourceName("br1"))
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name, attrs.ParentIndex = "eth0.100", eth0
+	h.Links.AddLink(&netlink.Vlan{LinkAttrs: attrs, VlanId: 100})
+	h.Links.SetMaster("eth0.100", "br1")
+	eventually(ctx, t, "eth0 isn't reported as shared", func() bool {
+		return slices.Equal(c.SharedUplinks()["eth0"], []string{"br0", "br1"})
+	})
+	for _, status := range c.Status() {
+		if !slices.Equal(status.SharedUplinks, []string{"eth0"}) {
+			t.Errorf("bridge %s has shared uplinks %v, expected eth0", status.BridgeName, status.SharedUplinks)
+		}
+		if metricValue(t, `bridge_marker_shared_uplink{uplink="eth0",bridge="`+status.BridgeName+`"}`) != 1 {
+			t.Errorf("eth0 isn't exported as shared by %s", status.BridgeName)
+		}
+	}
+
+	h.Links.RemoveLink("eth0.100")
+	eventually(ctx, t, "eth0 is still reported as shared", func() bool {
+		return len(c.SharedUplinks()) == 0
+	})
+	for _, status := range c.Status() {
+		if len(status.SharedUplinks) != 0 {
+			t.Errorf("bridge %s still has shared uplinks %v", status.BridgeName, status.SharedUplinks)
+		}
+	}
+	if metricValue(t, `bridge_marker_shared_uplink{uplink="eth0",bridge="br0"}`) != 0 {
+		t.Error("eth0 is still exported as shared")
+	}
+}
+
+func TestControllerFiltersAltNames(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	filter, err := plugin.NewBridgeFilter("", "^infra-", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter.MatchPolicy = plugin.FilterMatchAny
+	h.Links.AddBridge("br0")
+	h.Links.SetAltNames("br0", "infra-br0")
+	h.Links.AddBridge("br1")
+	runController(t, h, nil, plugin.WithBridgeFilter(filter))
+	waitForRegistration(ctx, t, h, resourceName("br1"))
+	if h.Kubelet.Registrations(resourceName("br0")) != 0 {
+		t.Error("a bridge excluded by its alternative name registered")
+	}
+
+	// Dropping the alternative name exposes the bridge, under its kernel name
+	h.Links.SetAltNames("br0")
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+}
+
+func TestControllerAppliesBridgeHealthSettings(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	filter, err := plugin.NewBridgeFilter("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter.Settings = map[string]plugin.BridgeSettings{
+		"br-storage": {MinUpPorts: 1},
+		"br-mgmt":    {HealthMode: plugin.HealthModeExists},
+	}
+	h.Links.AddBridge("br-storage")
+	h.Links.AddBridge("br-mgmt")
+	h.Links.SetUp("br-mgmt", false)
+	runController(t, h, nil, plugin.WithBridgeFilter(filter))
+
+	storage := watch(ctx, t, h, resourceName("br-storage"))
+	waitForHealth(ctx, t, storage, pluginapi.Unhealthy)
+	mgmt := watch(ctx, t, h, resourceName("br-mgmt"))
+	waitForHealth(ctx, t, mgmt, pluginapi.Healthy)
+
+	h.Links.AddDevice("eth0")
+	h.Links.SetMaster("eth0", "br-storage")
+	waitForHealth(ctx, t, storage, pluginapi.Healthy)
+}
+
+func TestControllerDoesNotRestartPermanentPlugins(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	// The same bridge twice at startup, only one of them runs
+	permanent := []plugin.Device{newPlugin(t, h, "br0", 3), newPlugin(t, h, "br0", 3)}
+	c := runControllerLater(t, h, permanent)
+	c.run()
+	// The bridge changes right around startup, so the scanner sees it as well
+	h.Links.SetOperState("br0", netlink.OperLowerLayerDown)
+	h.Links.SetOperState("br0", netlink.OperUp)
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+
+	// Updates are handled in order, so the scanner got past br0 once br1 registers
+	h.Links.AddBridge("br1")
+	waitForRegistration(ctx, t, h, resourceName("br1"))
+	if registrations := h.Kubelet.Registrations(resourceName("br0")); registrations != 1 {
+		t.Errorf("br0 registered %d times, expected once", registrations)
+	}
+	if plugins := c.Status(); len(plugins) != 2 {
+		t.Errorf("%d plugins are running, expected br0 and br1", len(plugins))
+	}
+}
+
+func TestControllerExposesListedBridgesOnly(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	filter, err := plugin.NewBridgeFilter("", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.SetBridges([]string{"br-storage", "br-vm"}); err != nil {
+		t.Fatal(err)
+	}
+	h.Links.AddBridge("br0")
+	h.Links.AddBridge("br-vm")
+	// Like the command, create the plugins of the listed bridges without discovering the links
+	permanent, err := plugin.GetListedBridgeDevicePlugins(3, nil, filter, h.PluginOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runController(t, h, permanent, plugin.WithBridgeFilter(filter), plugin.WithDynamicDiscovery(false))
+
+	// The missing bridge is registered right away, without capacity
+	storage := watch(ctx, t, h, resourceName("br-storage"))
+	waitForHealth(ctx, t, storage, pluginapi.Unhealthy)
+	waitForHealth(ctx, t, watch(ctx, t, h, resourceName("br-vm")), pluginapi.Healthy)
+
+	h.Links.AddBridge("br-storage")
+	waitForHealth(ctx, t, storage, pluginapi.Healthy)
+	// Deleting a listed bridge takes its capacity away, the resource stays
+	h.Links.RemoveLink("br-storage")
+	waitForHealth(ctx, t, storage, pluginapi.Unhealthy)
+	h.Links.AddBridge("br-storage")
+	waitForHealth(ctx, t, storage, pluginapi.Healthy)
+
+	if registrations := h.Kubelet.Registrations(resourceName("br-storage")); registrations != 1 {
+		t.Errorf("br-storage registered %d times, expected once", registrations)
+	}
+	if h.Kubelet.Registrations(resourceName("br0")) != 0 {
+		t.Error("a bridge that isn't listed registered")
+	}
+}
+
+func TestControllerRestartBackoffFollowsClock(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	clock := pluginfakes.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	// The socket directory is a file, so every start of the plugin fails before it serves
+	socketDir := filepath.Join(t.TempDir(), "device-plugins")
+	if err := os.WriteFile(socketDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.Links.AddBridge("br0")
+	c := runControllerLater(t, h, nil, plugin.WithControllerClock(clock), plugin.WithResyncPeriod(0),
+		plugin.WithBackoff(plugin.Backoff{Steps: []time.Duration{time.Second, 4 * time.Second}}),
+		plugin.WithPluginOptions(plugin.WithDevicePluginDir(socketDir)))
+	c.run()
+	restarts := func() int {
+		status := c.Status()
+		if len(status) == 0 {
+			return -1
+		}
+		return status[0].Restarts
+	}
+
+	for i, wait := range []time.Duration{time.Second, 4 * time.Second, 4 * time.Second} {
+		if err := clock.WaitForTimers(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		clock.Step(wait - time.Millisecond)
+		if clock.Timers() == 0 || restarts() != i {
+			t.Fatalf("restart %d happened before the %v backoff", i+1, wait)
+		}
+		clock.Step(time.Millisecond)
+		eventually(ctx, t, fmt.Sprintf("no restart %d after the %v backoff", i+1, wait), func() bool {
+			return restarts() == i+1
+		})
+	}
+}
+
+func TestControllerDrainWaitsForClock(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	clock := pluginfakes.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h.Links.AddBridge("br0")
+	opts := append(h.ControllerOptions(), plugin.WithControllerClock(clock), plugin.WithResyncPeriod(0),
+		plugin.WithDrainGracePeriod(30*time.Second))
+	c := plugin.NewBridgeDeviceController(nil, 3, opts...)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.Run(runCtx) }()
+
+	stream := watch(ctx, t, h, resourceName("br0"))
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+	cancel()
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	clock.Step(30*time.Second - time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("the controller stopped the plugins before the drain grace period passed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	clock.Step(time.Millisecond)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("the controller failed: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("the controller didn't stop after the drain grace period")
+	}
+}
+
+func TestControllerCountsRestarts(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	socketDir := filepath.Join(t.TempDir(), "device-plugins")
+	if err := os.WriteFile(socketDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.Links.AddBridge("br-crashloop")
+	runController(t, h, nil, plugin.WithBackoff(plugin.Backoff{Steps: []time.Duration{10 * time.Millisecond}}),
+		plugin.WithPluginOptions(plugin.WithDevicePluginDir(socketDir)))
+
+	eventually(ctx, t, "the restarts of a failing plugin weren't counted", func() bool {
+		return metricValue(t, `bridge_marker_plugin_restarts_total{bridge="br-crashloop",reason="error"}`) >= 2
+	})
+}
+
+// TestControllerCountsLinkEvents doesn't run in parallel, so no other test moves the counters.
+func TestControllerCountsLinkEvents(t *testing.T) {
+	h := newHarness(t)
+	ctx := testContext(t)
+	runController(t, h, nil)
+	// Without bridges the scanner is the only subscriber, links added before it subscribes
+	// are found by listing them
+	eventually(ctx, t, "the scanner didn't subscribe to link updates", func() bool { return h.Links.Subscribers() > 0 })
+	counted := func(eventType string) func() float64 {
+		before := metricValue(t, `bridge_marker_netlink_events_total{type="`+eventType+`"}`)
+		return func() float64 {
+			return metricValue(t, `bridge_marker_netlink_events_total{type="`+eventType+`"}`) - before
+		}
+	}
+
+	created := counted("new")
+	h.Links.AddBridge("br0")
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+	eventually(ctx, t, "the new bridge wasn't counted", func() bool { return created() == 1 })
+
+	changed, deleted := counted("update"), counted("del")
+	h.Links.SetOperState("br0", netlink.OperDown)
+	eventually(ctx, t, "the bridge change wasn't counted", func() bool { return changed() == 1 })
+	h.Links.RemoveLink("br0")
+	eventually(ctx, t, "the deleted bridge wasn't counted", func() bool { return deleted() == 1 })
+}
+
+func TestControllerExposesBridgesCreatedAfterStartup(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	// Like the command on a node without bridges, startup discovery finds nothing
+	devs, err := plugin.GetBridgeDevicePlugins(ctx, 3, nil, nil, h.PluginOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 0 {
+		t.Fatalf("discovered %d plugins on a node without bridges", len(devs))
+	}
+	runController(t, h, devs)
+
+	h.Links.AddBridge("br0")
+	waitForHealth(ctx, t, watch(ctx, t, h, resourceName("br0")), pluginapi.Healthy)
+}
+
+func TestControllerStopDoesNotBlockStatus(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	clock := pluginfakes.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h.Links.AddBridge("br0")
+	h.Links.AddBridge("br1")
+	// Without a ListAndWatch stream the plugins wait for the fake clock to deregister
+	c := runController(t, h, nil, plugin.WithPluginOptions(plugin.WithClock(clock)))
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+	waitForRegistration(ctx, t, h, resourceName("br1"))
+	eventually(ctx, t, "the plugins didn't start", func() bool {
+		status := c.Status()
+		return len(status) == 2 && status[0].Initialized && status[1].Initialized
+	})
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.StopDeviceByName("br0") }()
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	// br0 is shutting down until the clock moves, the controller answers meanwhile
+	answered := make(chan []plugin.DeviceStatus, 1)
+	go func() {
+		if err := c.RefreshDevices(); err != nil {
+			t.Errorf("could not refresh while br0 stops: %v", err)
+		}
+		answered <- c.Status()
+	}()
+	select {
+	case status := <-answered:
+		if len(status) != 1 || status[0].BridgeName != "br1" {
+			t.Errorf("got plugins %+v while br0 stops, expected br1 only", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the controller waited for br0 to stop")
+	}
+	clock.Step(plugin.DefaultDeregistrationTimeout)
+	if err := <-stopped; err != nil {
+		t.Errorf("could not stop br0: %v", err)
+	}
+
+	go func() { stopped <- c.StopDeviceByName("br1") }()
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	clock.Step(plugin.DefaultDeregistrationTimeout)
+	if err := <-stopped; err != nil {
+		t.Errorf("could not stop br1: %v", err)
+	}
+}
+
+func TestControllerStartDoesNotBlockStatus(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	clock := pluginfakes.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h.Links.AddBridge("br0")
+	// Without a ListAndWatch stream the plugin waits for the fake clock to deregister
+	c := runController(t, h, nil, plugin.WithPluginOptions(plugin.WithClock(clock)))
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+	eventually(ctx, t, "the plugin didn't start", func() bool {
+		status := c.Status()
+		return len(status) == 1 && status[0].Initialized
+	})
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.StopDeviceByName("br0") }()
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Starting br0 again waits for the old plugin to release the socket, the controller
+	// answers meanwhile
+	started := make(chan error, 1)
+	go func() { started <- c.StartDeviceByName("br0") }()
+	// The start gets to wait at some point, the controller keeps answering throughout
+	for i := 0; i < 20; i++ {
+		answered := make(chan []plugin.DeviceStatus, 1)
+		go func() { answered <- c.Status() }()
+		select {
+		case status := <-answered:
+			if len(status) != 0 {
+				t.Fatalf("got plugins %+v while br0 stops, expected none", status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the controller waited for br0 to stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-started:
+		t.Fatalf("br0 started again before the old plugin stopped: %v", err)
+	default:
+	}
+
+	clock.Step(plugin.DefaultDeregistrationTimeout)
+	if err := <-stopped; err != nil {
+		t.Errorf("could not stop br0: %v", err)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("could not start br0 again: %v", err)
+	}
+	if _, err := h.Kubelet.WaitForRegistrations(ctx, resourceName("br0"), 2); err != nil {
+		t.Fatalf("br0 didn't register again: %v", err)
+	}
+
+	go func() { stopped <- c.StopDeviceByName("br0") }()
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	clock.Step(plugin.DefaultDeregistrationTimeout)
+	if err := <-stopped; err != nil {
+		t.Errorf("could not stop br0: %v", err)
+	}
+}
+
+func TestControllerReportsHealthReasons(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	c := runController(t, h, nil)
+	waitForHealth(ctx, t, watch(ctx, t, h, resourceName("br0")), pluginapi.Healthy)
+
+	h.Links.SetUp("br0", false)
+	eventually(ctx, t, "the transitions aren't in the status", func() bool {
+		status := c.Status()
+		if len(status) != 1 {
+			return false
+		}
+		var reasons []plugin.HealthReason
+		for _, transition := range status[0].HealthHistory {
+			reasons = append(reasons, transition.Reason)
+		}
+		return slices.Equal(reasons, []plugin.HealthReason{plugin.HealthReasonUp, plugin.HealthReasonDown})
+	})
+	status := c.Status()[0]
+	if _, up := status.HealthReasons[plugin.HealthReasonUp]; !up {
+		t.Errorf("the status has no time up: %v", status.HealthReasons)
+	}
+	if _, down := status.HealthReasons[plugin.HealthReasonDown]; !down {
+		t.Errorf("the status has no time down: %v", status.HealthReasons)
+	}
+}
+
+func TestControllerReportsDuplicateAllocations(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br-dup")
+	c := runController(t, h, nil)
+	// The bridge is the test's own, so it doesn't add to the duplicates counted for br0
+	client := dial(ctx, t, h, resourceName("br-dup"))
+
+	if _, err := client.AllocateDevices(ctx, "br-dup0", "br-dup0"); err == nil {
+		t.Fatal("allocating a device twice succeeded")
+	}
+	if status := c.Status(); len(status) != 1 || status[0].DuplicateAllocations != 1 {
+		t.Errorf("got status %+v, expected a duplicate allocation of br-dup", status)
+	}
+}
+
+func TestControllerExportsBridgeUpPerResource(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	// The bridge is the test's own, so no other test sets its series
+	h.Links.AddBridge("br-modes")
+	storage := "storage.example.com/br-modes"
+	c := runController(t, h, []plugin.Device{
+		newPlugin(t, h, "br-modes", 3),
+		newPlugin(t, h, "br-modes", 3, plugin.WithResourceNamespace("storage.example.com"), plugin.WithHealthMode(plugin.HealthModeExists)),
+	})
+	operUp := watch(ctx, t, h, resourceName("br-modes"))
+	exists := watch(ctx, t, h, storage)
+	waitForHealth(ctx, t, operUp, pluginapi.Healthy)
+	waitForHealth(ctx, t, exists, pluginapi.Healthy)
+
+	// The plugins judge the bridge by their own health modes, neither overwrites the other
+	h.Links.SetUp("br-modes", false)
+	waitForHealth(ctx, t, operUp, pluginapi.Unhealthy)
+	sample := func(resource string) string {
+		return `bridge_marker_bridge_up{bridge="br-modes",resource="` + resource + `"}`
+	}
+	eventually(ctx, t, "the bridge isn't exported down for the default health mode", func() bool {
+		return metricValue(t, sample(resourceName("br-modes"))) == 0
+	})
+	if up := metricValue(t, sample(storage)); up != 1 {
+		t.Errorf("the bridge is exported as %v for the exists health mode, expected 1", up)
+	}
+
+	if err := c.StopDeviceByName("br-modes"); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Default.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), `bridge_marker_bridge_up{bridge="br-modes"`) {
+		t.Error("the stopped plugins are still exported")
+	}
+}
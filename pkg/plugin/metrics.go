@@ -0,0 +1,120 @@
+package plugin
+
+import (
+	"github.com/Acedus/bridge-marker-dp/pkg/metrics"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	bridgeUpMetric = metrics.Default.NewGaugeVec("bridge_marker_bridge_up",
+		"Whether the bridge is up, as seen by the health check of the plugin with its health mode.", "bridge", "resource")
+	pluginRegisteredMetric = metrics.Default.NewGaugeVec("bridge_marker_plugin_registered",
+		"Whether the device plugin is registered with kubelet.", "bridge", "resource")
+	devicesTotalMetric = metrics.Default.NewGaugeVec("bridge_marker_devices_total",
+		"The number of devices the plugin advertises.", "bridge", "resource")
+	devicesHealthyMetric = metrics.Default.NewGaugeVec("bridge_marker_devices_healthy",
+		"The number of devices the plugin advertises as healthy.", "bridge", "resource")
+	pluginRestartsMetric = metrics.Default.NewCounterVec("bridge_marker_plugin_restarts_total",
+		"The number of times the controller started a plugin again, by the reason it exited.", "bridge", "reason")
+	registrationFailuresMetric = metrics.Default.NewCounterVec("bridge_marker_registration_failures_total",
+		"The number of failed registrations with kubelet.", "bridge")
+	netlinkEventsMetric = metrics.Default.NewCounterVec("bridge_marker_netlink_events_total",
+		"The number of link updates seen by the bridge discovery.", "type")
+	duplicateAllocationsMetric = metrics.Default.NewCounterVec("bridge_marker_duplicate_allocations_total",
+		"The number of Allocate calls rejected for requesting a device more than once, a sign of a corrupted kubelet checkpoint.", "bridge", "resource")
+	discoveryTruncationsMetric = metrics.Default.NewCounterVec("bridge_marker_discovery_truncations_total",
+		"The number of bridge discovery passes cut short by their deadline.")
+	sharedUplinkMetric = metrics.Default.NewGaugeVec("bridge_marker_shared_uplink",
+		"Set for each managed bridge with a port on a physical uplink that another managed bridge uses as well.", "uplink", "bridge")
+	linkWatchDegradedMetric = metrics.Default.NewGaugeVec("bridge_marker_link_watch_degraded",
+		"Set for each netlink operation that isn't permitted and was replaced by a fallback, e.g. link updates by polling.", "operation")
+	loopLatencyMetric = metrics.Default.NewGaugeVec("bridge_marker_loop_latency_seconds",
+		"Percentiles of the recent gaps between iterations of an event loop, the controller's or a plugin's health check.", "loop", "quantile")
+	loopLatencyMaxMetric = metrics.Default.NewGaugeVec("bridge_marker_loop_latency_max_seconds",
+		"The longest gap between iterations of an event loop.", "loop")
+	healthReasonSecondsMetric = metrics.Default.NewCounterVec("bridge_marker_health_reason_seconds_total",
+		"The time the plugin's bridge spent in each health reason.", "bridge", "resource", "reason")
+)
+
+// Reasons of plugin restarts
+const (
+	restartReasonError          = "error"
+	restartReasonKubeletRestart = "kubelet-restart"
+	restartReasonExited         = "exited"
+)
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// recordDeviceMetrics records the device counts as currently advertised to kubelet.
+func (dpi *BridgeDevicePlugin) recordDeviceMetrics() {
+	healthy, total := dpi.deviceHealth.counts()
+	devicesTotalMetric.Set(float64(total), dpi.deviceName, dpi.resourceName)
+	devicesHealthyMetric.Set(float64(healthy), dpi.deviceName, dpi.resourceName)
+}
+
+// recordHealthReasonMetrics adds the time spent in each health reason since the last call.
+func (dpi *BridgeDevicePlugin) recordHealthReasonMetrics() {
+	for reason, duration := range dpi.healthAccounting.unexported(dpi.clock.Now()) {
+		healthReasonSecondsMetric.Add(duration.Seconds(), dpi.deviceName, dpi.resourceName, string(reason))
+	}
+}
+
+// recordLinkEvent counts a link update by whether it created, deleted or changed a link.
+func recordLinkEvent(update netlink.LinkUpdate) {
+	eventType := "update"
+	switch {
+	case update.Family == unix.AF_BRIDGE:
+		// Ports joining or leaving a bridge, the links themselves stay
+	case update.Header.Type == unix.RTM_DELLINK:
+		eventType = "del"
+	case update.Change == linkCreatedChange:
+		eventType = "new"
+	}
+	netlinkEventsMetric.Inc(eventType)
+}
+
+// recordStatusMetrics records the metrics of a plugin started by the controller.
+func recordStatusMetrics(status DeviceStatus) {
+	pluginRegisteredMetric.Set(boolMetric(status.Initialized), status.BridgeName, status.ResourceName)
+	devicesTotalMetric.Set(float64(status.TotalDevices), status.BridgeName, status.ResourceName)
+	devicesHealthyMetric.Set(float64(status.HealthyDevices), status.BridgeName, status.ResourceName)
+}
+
+// deletePluginMetrics removes the metrics of a stopped plugin.
+func deletePluginMetrics(bridgeName, resourceName string) {
+	pluginRegisteredMetric.Delete(bridgeName, resourceName)
+	devicesTotalMetric.Delete(bridgeName, resourceName)
+	devicesHealthyMetric.Delete(bridgeName, resourceName)
+	bridgeUpMetric.Delete(bridgeName, resourceName)
+}
+
+// recordSharedUplinkMetrics replaces the shared uplinks previously recorded with the current ones.
+func recordSharedUplinkMetrics(previous, shared map[string][]string) {
+	for uplink := range previous {
+		sharedUplinkMetric.DeleteMatching("uplink", uplink)
+	}
+	for uplink, bridges := range shared {
+		for _, bridge := range bridges {
+			sharedUplinkMetric.Set(1, uplink, bridge)
+		}
+	}
+}
+
+// recordLoopLatencyMetrics records the iteration gap statistics of an event loop.
+func recordLoopLatencyMetrics(loop string, stats LoopLatencyStats) {
+	loopLatencyMetric.Set(stats.P50.Seconds(), loop, "0.5")
+	loopLatencyMetric.Set(stats.P99.Seconds(), loop, "0.99")
+	loopLatencyMaxMetric.Set(stats.Max.Seconds(), loop)
+}
+
+// deleteLoopLatencyMetrics removes the metrics of an event loop that exited.
+func deleteLoopLatencyMetrics(loop string) {
+	loopLatencyMetric.DeleteMatching("loop", loop)
+	loopLatencyMaxMetric.Delete(loop)
+}
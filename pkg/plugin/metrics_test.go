@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestRecordLinkEvent(t *testing.T) {
+	created := newLinkUpdate(testBridge(1, "br0"), unix.RTM_NEWLINK)
+	created.Change = linkCreatedChange
+	changed := newLinkUpdate(testBridge(1, "br0"), unix.RTM_NEWLINK)
+	changed.Change = unix.IFF_UP
+	deleted := newLinkUpdate(testBridge(1, "br0"), unix.RTM_DELLINK)
+	portLeft := newLinkUpdate(testBridge(2, "eth0"), unix.RTM_DELLINK)
+	portLeft.Family = unix.AF_BRIDGE
+
+	tests := []struct {
+		name      string
+		update    netlink.LinkUpdate
+		eventType string
+	}{
+		{name: "created link", update: created, eventType: "new"},
+		{name: "changed link", update: changed, eventType: "update"},
+		{name: "deleted link", update: deleted, eventType: "del"},
+		{name: "port leaving a bridge", update: portLeft, eventType: "update"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := netlinkEventsMetric.Value(tt.eventType)
+			recordLinkEvent(tt.update)
+			if counted := netlinkEventsMetric.Value(tt.eventType) - before; counted != 1 {
+				t.Errorf("counted %v %s events, expected 1", counted, tt.eventType)
+			}
+		})
+	}
+}
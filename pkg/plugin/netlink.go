@@ -0,0 +1,414 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"kubevirt.io/client-go/log"
+)
+
+const (
+	// DefaultLinkPollInterval is how often links are listed when they are polled.
+	DefaultLinkPollInterval = 2 * time.Second
+
+	// OperationLinkSubscribe is the netlink link update subscription.
+	OperationLinkSubscribe = "LinkSubscribe"
+
+	// linkUpdateBuffer buffers link updates, so the subscription keeps draining the netlink
+	// socket during bursts of interface churn instead of overflowing it.
+	linkUpdateBuffer = 256
+
+	// NetnsRunDir is where named network namespaces are bind-mounted, as by ip netns add.
+	NetnsRunDir = "/var/run/netns"
+)
+
+// LinkWatchMode is how the scanner and the health checks follow link changes.
+type LinkWatchMode string
+
+const (
+	// LinkWatchSubscribe subscribes to netlink link updates and fails if that isn't possible.
+	LinkWatchSubscribe LinkWatchMode = "subscribe"
+	// LinkWatchPoll lists the links periodically and synthesizes updates for the changed ones.
+	LinkWatchPoll LinkWatchMode = "poll"
+	// LinkWatchAuto subscribes, falling back to polling when the subscription can't be set up.
+	LinkWatchAuto LinkWatchMode = "auto"
+)
+
+// ParseLinkWatchMode validates the name of a link watch mode.
+func ParseLinkWatchMode(name string) (LinkWatchMode, error) {
+	switch mode := LinkWatchMode(name); mode {
+	case LinkWatchSubscribe, LinkWatchPoll, LinkWatchAuto:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown health check mode %q, expected one of %s, %s or %s", name, LinkWatchSubscribe, LinkWatchPoll, LinkWatchAuto)
+}
+
+// The link watch mode is set once at startup by SetLinkWatchMode, before any plugin is started.
+var (
+	linkWatchMode    = LinkWatchAuto
+	linkPollInterval = DefaultLinkPollInterval
+)
+
+// SetLinkWatchMode sets how link changes are followed and how often links are polled.
+func SetLinkWatchMode(mode LinkWatchMode, pollInterval time.Duration) error {
+	if pollInterval <= 0 {
+		return fmt.Errorf("the link poll interval must be positive, got %v", pollInterval)
+	}
+	linkWatchMode, linkPollInterval = mode, pollInterval
+	return nil
+}
+
+var (
+	degradedOperations     = map[string]error{}
+	degradedOperationsLock sync.Mutex
+
+	linkSubscriptionOverflows atomic.Uint64
+)
+
+// LinkSubscriptionOverflows returns how often a link update subscription lost updates
+// because the netlink socket buffer overflowed.
+func LinkSubscriptionOverflows() uint64 {
+	return linkSubscriptionOverflows.Load()
+}
+
+// ErrNetnsChanged is returned by the health check when the monitored network namespace was
+// replaced, the plugin is restarted in the new namespace.
+var ErrNetnsChanged = errors.New("network namespace changed")
+
+// The links are monitored in the network namespace set by SetNetworkNamespace, the process's own
+// namespace by default. netnsGeneration counts the replacements of the namespace.
+var (
+	netnsLock       sync.RWMutex
+	netnsPath       string
+	netnsHandle     = netns.None()
+	linkNetlink     = &netlink.Handle{}
+	netnsGeneration uint64
+)
+
+// SetNetworkNamespace monitors the links of the given network namespace, a path to a netns file
+// or the name of one in NetnsRunDir. It must be called before discovery starts.
+func SetNetworkNamespace(nameOrPath string) error {
+	path := nameOrPath
+	if !filepath.IsAbs(path) && filepath.Base(path) == path {
+		path = filepath.Join(NetnsRunDir, nameOrPath)
+	}
+	ns, handle, err := openNetns(path)
+	if err != nil {
+		return err
+	}
+	netnsLock.Lock()
+	defer netnsLock.Unlock()
+	netnsPath, netnsHandle, linkNetlink = path, ns, handle
+	return nil
+}
+
+func openNetns(path string) (netns.NsHandle, *netlink.Handle, error) {
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return netns.None(), nil, fmt.Errorf("could not open network namespace %s: %v", path, err)
+	}
+	handle, err := netlink.NewHandleAt(ns, unix.NETLINK_ROUTE)
+	if err != nil {
+		ns.Close()
+		return netns.None(), nil, fmt.Errorf("could not open a netlink socket in network namespace %s: %v", path, err)
+	}
+	return ns, handle, nil
+}
+
+// ErrLinkNotFound may be wrapped by LinkLister implementations other than netlink for missing
+// links, netlink itself returns a netlink.LinkNotFoundError.
+var ErrLinkNotFound = errors.New("link not found")
+
+// isLinkNotFound reports whether a link lookup failed because the link doesn't exist.
+func isLinkNotFound(err error) bool {
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return true
+	}
+	return errors.Is(err, ErrLinkNotFound)
+}
+
+// LinkLister looks links up.
+type LinkLister interface {
+	LinkList() ([]netlink.Link, error)
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	BridgeVlanList() (map[int32][]*nl.BridgeVlanInfo, error)
+}
+
+// LinkWatcher delivers link updates until stop is closed, it closes updates when the
+// subscription fails and updates were lost.
+type LinkWatcher interface {
+	Subscribe(updates chan<- netlink.LinkUpdate, stop <-chan struct{}) error
+}
+
+// LinkSource is where the plugins and the controller get links and link updates from, the
+// default is the netlink of the monitored network namespace.
+type LinkSource interface {
+	LinkLister
+	LinkWatcher
+}
+
+// netlinkSource is the netlink of the monitored network namespace, following the link watch mode.
+type netlinkSource struct{}
+
+// defaultLinkSource shares one netlink subscription between the controller and all plugins.
+var defaultLinkSource LinkSource = NewLinkMonitor(netlinkSource{})
+
+func (netlinkSource) LinkList() ([]netlink.Link, error) {
+	return linkHandle().LinkList()
+}
+
+func (netlinkSource) LinkByName(name string) (netlink.Link, error) {
+	return linkHandle().LinkByName(name)
+}
+
+func (netlinkSource) LinkByIndex(index int) (netlink.Link, error) {
+	return linkHandle().LinkByIndex(index)
+}
+
+func (netlinkSource) BridgeVlanList() (map[int32][]*nl.BridgeVlanInfo, error) {
+	return linkHandle().BridgeVlanList()
+}
+
+func (s netlinkSource) Subscribe(updates chan<- netlink.LinkUpdate, stop <-chan struct{}) error {
+	return subscribeLinks(s, updates, stop)
+}
+
+// linkHandle is the netlink handle of the monitored network namespace.
+func linkHandle() *netlink.Handle {
+	netnsLock.RLock()
+	defer netnsLock.RUnlock()
+	return linkNetlink
+}
+
+// netnsConfigured reports whether a network namespace was set with SetNetworkNamespace.
+func netnsConfigured() bool {
+	netnsLock.RLock()
+	defer netnsLock.RUnlock()
+	return netnsPath != ""
+}
+
+// currentNetnsGeneration is the generation of the monitored network namespace, it changes when
+// the namespace is replaced.
+func currentNetnsGeneration() uint64 {
+	netnsLock.RLock()
+	defer netnsLock.RUnlock()
+	return netnsGeneration
+}
+
+// checkNetns fails when the monitored network namespace is gone, or was replaced since the given
+// generation. The first caller to notice a replacement switches to the new namespace.
+func checkNetns(generation uint64) error {
+	netnsLock.Lock()
+	defer netnsLock.Unlock()
+	if netnsPath == "" {
+		return nil
+	}
+	if generation != netnsGeneration {
+		return ErrNetnsChanged
+	}
+	current, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		return fmt.Errorf("network namespace %s is gone: %v", netnsPath, err)
+	}
+	defer current.Close()
+	if current.Equal(netnsHandle) {
+		return nil
+	}
+
+	ns, handle, err := openNetns(netnsPath)
+	if err != nil {
+		return err
+	}
+	log.DefaultLogger().Warningf("network namespace %s was replaced, restarting the device plugins in the new one", netnsPath)
+	// Users of the old handle may still hold it and fail on the old namespace, so it isn't
+	// deleted, which would silently move them to the process's namespace
+	netnsHandle.Close()
+	netnsHandle, linkNetlink = ns, handle
+	netnsGeneration++
+	return ErrNetnsChanged
+}
+
+// markDegraded records that an operation failed, e.g. it was refused by a seccomp or LSM profile,
+// and a fallback is used instead. The warning is only logged the first time the operation degrades.
+func markDegraded(operation string, err error, fallback string) {
+	degradedOperationsLock.Lock()
+	defer degradedOperationsLock.Unlock()
+	if _, exists := degradedOperations[operation]; !exists {
+		log.DefaultLogger().Reason(err).Warningf("netlink %s is not available, falling back to %s", operation, fallback)
+	}
+	degradedOperations[operation] = err
+	linkWatchDegradedMetric.Set(1, operation)
+}
+
+// LinkWatchDegraded reports whether link updates are polled because the netlink subscription
+// isn't permitted.
+func LinkWatchDegraded() bool {
+	degradedOperationsLock.Lock()
+	defer degradedOperationsLock.Unlock()
+	_, degraded := degradedOperations[OperationLinkSubscribe]
+	return degraded
+}
+
+// DegradedOperations returns the netlink operations that aren't available and the error they failed with.
+func DegradedOperations() map[string]error {
+	degradedOperationsLock.Lock()
+	defer degradedOperationsLock.Unlock()
+	ret := make(map[string]error, len(degradedOperations))
+	for operation, err := range degradedOperations {
+		ret[operation] = err
+	}
+	return ret
+}
+
+// listLinks lists the links, giving up when ctx is done. A LinkList call can't be
+// interrupted, so on cancellation it is left to finish in the background.
+func listLinks(ctx context.Context, lister LinkLister) ([]netlink.Link, error) {
+	type result struct {
+		links []netlink.Link
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		links, err := lister.LinkList()
+		done <- result{links, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.links, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// subscribeLinks delivers link updates until stop is closed or the subscription fails, in
+// which case updates is closed and the caller has to resubscribe and resync, as updates
+// were lost. In poll mode, or in auto mode when the subscription can't be set up, the link
+// list is polled instead and updates are synthesized for changed links.
+func subscribeLinks(lister LinkLister, updates chan<- netlink.LinkUpdate, stop <-chan struct{}) error {
+	if linkWatchMode == LinkWatchPoll {
+		go pollLinks(lister, defaultClock, updates, stop)
+		return nil
+	}
+	netnsLock.RLock()
+	ns := netnsHandle
+	err := netlink.LinkSubscribeWithOptions(updates, stop, netlink.LinkSubscribeOptions{
+		Namespace: &ns,
+		ErrorCallback: func(err error) {
+			subscriptionFailed(err, stop)
+		},
+	})
+	netnsLock.RUnlock()
+	if err == nil || linkWatchMode == LinkWatchSubscribe {
+		return err
+	}
+
+	markDegraded(OperationLinkSubscribe, err, "polling")
+	go pollLinks(lister, defaultClock, updates, stop)
+	return nil
+}
+
+func subscriptionFailed(err error, stop <-chan struct{}) {
+	if IsChanClosed(stop) {
+		// Closing the socket on stop fails the pending receive
+		return
+	}
+	if errors.Is(err, unix.ENOBUFS) {
+		overflows := linkSubscriptionOverflows.Add(1)
+		log.DefaultLogger().Warningf("netlink socket buffer overflowed and link updates were lost (%d overflows so far), resyncing", overflows)
+		return
+	}
+	log.DefaultLogger().Reason(err).Warning("link update subscription failed")
+}
+
+func pollLinks(lister LinkLister, clock Clock, updates chan<- netlink.LinkUpdate, stop <-chan struct{}) {
+	logger := log.DefaultLogger()
+	known := map[int]netlink.Link{}
+	ticker := clock.NewTicker(linkPollInterval)
+	defer ticker.Stop()
+
+	for {
+		links, err := lister.LinkList()
+		if err != nil {
+			logger.Reason(err).Error("Failed polling links")
+		} else {
+			for _, update := range diffLinks(known, links) {
+				select {
+				case updates <- update:
+				case <-stop:
+					return
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// diffLinks updates known to the given links and returns the updates describing the changes.
+func diffLinks(known map[int]netlink.Link, links []netlink.Link) []netlink.LinkUpdate {
+	var ret []netlink.LinkUpdate
+	seen := make(map[int]bool, len(links))
+	for _, link := range links {
+		attrs := link.Attrs()
+		seen[attrs.Index] = true
+		old, exists := known[attrs.Index]
+		if exists && !linkChanged(old.Attrs(), attrs) {
+			continue
+		}
+		known[attrs.Index] = link
+		update := newLinkUpdate(link, unix.RTM_NEWLINK)
+		if !exists {
+			update.Change = linkCreatedChange
+		}
+		ret = append(ret, update)
+	}
+
+	// Deterministic order for removed links
+	var removed []int
+	for index := range known {
+		if !seen[index] {
+			removed = append(removed, index)
+		}
+	}
+	sort.Ints(removed)
+	for _, index := range removed {
+		ret = append(ret, newLinkUpdate(known[index], unix.RTM_DELLINK))
+		delete(known, index)
+	}
+	return ret
+}
+
+func linkChanged(old, cur *netlink.LinkAttrs) bool {
+	return old.Name != cur.Name ||
+		old.OperState != cur.OperState ||
+		old.Flags != cur.Flags ||
+		old.MasterIndex != cur.MasterIndex ||
+		old.MTU != cur.MTU
+}
+
+// linkCreatedChange is the change mask of the RTM_NEWLINK the kernel sends when a link is created.
+const linkCreatedChange = 0xffffffff
+
+func newLinkUpdate(link netlink.Link, msgType uint16) netlink.LinkUpdate {
+	update := netlink.LinkUpdate{Link: link}
+	update.Header.Type = msgType
+	update.Index = int32(link.Attrs().Index)
+	return update
+}
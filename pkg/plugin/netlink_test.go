@@ -0,0 +1,269 @@
+package plugin
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/metrics"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func testBridge(index int, name string) netlink.Link {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Index, attrs.Name = index, name
+	attrs.OperState = netlink.OperUp
+	return &netlink.Bridge{LinkAttrs: attrs}
+}
+
+func TestDiffLinks(t *testing.T) {
+	type change struct {
+		name    string
+		msgType uint16
+		created bool
+	}
+	br0, br1 := testBridge(1, "br0"), testBridge(2, "br1")
+	renamed := testBridge(2, "br-renamed")
+	down := testBridge(1, "br0")
+	down.Attrs().OperState = netlink.OperDown
+
+	tests := []struct {
+		name     string
+		known    []netlink.Link
+		links    []netlink.Link
+		expected []change
+	}{
+		{
+			name:     "first listing creates every link",
+			links:    []netlink.Link{br0, br1},
+			expected: []change{{"br0", unix.RTM_NEWLINK, true}, {"br1", unix.RTM_NEWLINK, true}},
+		},
+		{
+			name:  "unchanged links are skipped",
+			known: []netlink.Link{br0, br1},
+			links: []netlink.Link{br0, br1},
+		},
+		{
+			name:     "changed links are updated",
+			known:    []netlink.Link{br0, br1},
+			links:    []netlink.Link{down, renamed},
+			expected: []change{{"br0", unix.RTM_NEWLINK, false}, {"br-renamed", unix.RTM_NEWLINK, false}},
+		},
+		{
+			name:     "missing links are deleted",
+			known:    []netlink.Link{br0, br1},
+			links:    []netlink.Link{},
+			expected: []change{{"br0", unix.RTM_DELLINK, false}, {"br1", unix.RTM_DELLINK, false}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			known := map[int]netlink.Link{}
+			for _, link := range tt.known {
+				known[link.Attrs().Index] = link
+			}
+			updates := diffLinks(known, tt.links)
+			if len(updates) != len(tt.expected) {
+				t.Fatalf("got %d updates, expected %v", len(updates), tt.expected)
+			}
+			for i, update := range updates {
+				got := change{update.Link.Attrs().Name, update.Header.Type, update.Change == linkCreatedChange}
+				if got != tt.expected[i] {
+					t.Errorf("update %d is %v, expected %v", i, got, tt.expected[i])
+				}
+				if int(update.Index) != update.Link.Attrs().Index {
+					t.Errorf("update %d has index %d, expected %d", i, update.Index, update.Link.Attrs().Index)
+				}
+			}
+			if len(known) != len(tt.links) {
+				t.Errorf("%d links are known after the diff, expected %d", len(known), len(tt.links))
+			}
+		})
+	}
+}
+
+// stubLister lists a fixed set of links that tests can replace.
+type stubLister struct {
+	lock  sync.Mutex
+	links []netlink.Link
+}
+
+func (l *stubLister) set(links []netlink.Link) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.links = links
+}
+
+func (l *stubLister) LinkList() ([]netlink.Link, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.links, nil
+}
+
+func (l *stubLister) LinkByName(name string) (netlink.Link, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, link := range l.links {
+		if link.Attrs().Name == name {
+			return link, nil
+		}
+	}
+	return nil, ErrLinkNotFound
+}
+
+func (l *stubLister) LinkByIndex(index int) (netlink.Link, error) {
+	return nil, ErrLinkNotFound
+}
+
+func (l *stubLister) BridgeVlanList() (map[int32][]*nl.BridgeVlanInfo, error) {
+	return nil, nil
+}
+
+// tickClock is the real clock, except for tickers that only tick when the test sends on ticks.
+type tickClock struct {
+	realClock
+	ticks chan time.Time
+}
+
+func (c tickClock) NewTicker(time.Duration) Ticker {
+	return manualTicker(c.ticks)
+}
+
+type manualTicker chan time.Time
+
+func (t manualTicker) C() <-chan time.Time {
+	return t
+}
+
+func (manualTicker) Stop() {}
+
+func TestPollLinksSynthesizesUpdates(t *testing.T) {
+	lister := &stubLister{links: []netlink.Link{testBridge(1, "br0")}}
+	clock := tickClock{ticks: make(chan time.Time)}
+	updates := make(chan netlink.LinkUpdate)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pollLinks(lister, clock, updates, stop)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	receive := func() netlink.LinkUpdate {
+		t.Helper()
+		select {
+		case update := <-updates:
+			return update
+		case <-time.After(10 * time.Second):
+			t.Fatal("no link update was polled")
+			return netlink.LinkUpdate{}
+		}
+	}
+
+	// The links are listed right away, not after the first poll interval
+	if update := receive(); update.Header.Type != unix.RTM_NEWLINK || update.Link.Attrs().Name != "br0" {
+		t.Errorf("got %v of %s, expected the creation of br0", update.Header.Type, update.Link.Attrs().Name)
+	}
+
+	// The deletion is only seen by the next poll, on the clock's tick
+	lister.set(nil)
+	select {
+	case update := <-updates:
+		t.Fatalf("got %v of %s before the next poll", update.Header.Type, update.Link.Attrs().Name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.ticks <- time.Now()
+	if update := receive(); update.Header.Type != unix.RTM_DELLINK || update.Link.Attrs().Name != "br0" {
+		t.Errorf("got %v of %s, expected the deletion of br0", update.Header.Type, update.Link.Attrs().Name)
+	}
+}
+
+func TestParseLinkWatchMode(t *testing.T) {
+	for _, name := range []string{"subscribe", "poll", "auto"} {
+		if mode, err := ParseLinkWatchMode(name); err != nil || string(mode) != name {
+			t.Errorf("%s got %q, %v", name, mode, err)
+		}
+	}
+	if _, err := ParseLinkWatchMode("inotify"); err == nil {
+		t.Error("an unknown mode was accepted")
+	}
+	if err := SetLinkWatchMode(LinkWatchPoll, 0); err == nil {
+		t.Error("a zero poll interval was accepted")
+	}
+}
+
+func TestSubscribeLinksPolls(t *testing.T) {
+	defer func(mode LinkWatchMode, interval time.Duration) {
+		linkWatchMode, linkPollInterval = mode, interval
+	}(linkWatchMode, linkPollInterval)
+	if err := SetLinkWatchMode(LinkWatchPoll, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// The poll mode never touches netlink, the lister is all it needs
+	lister := &stubLister{links: []netlink.Link{testBridge(1, "br0")}}
+	updates := make(chan netlink.LinkUpdate)
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := subscribeLinks(lister, updates, stop); err != nil {
+		t.Fatal(err)
+	}
+	receive := func() netlink.LinkUpdate {
+		t.Helper()
+		select {
+		case update := <-updates:
+			return update
+		case <-time.After(10 * time.Second):
+			t.Fatal("no link update was polled")
+			return netlink.LinkUpdate{}
+		}
+	}
+	if update := receive(); update.Link.Attrs().Name != "br0" {
+		t.Errorf("got an update of %s, expected br0", update.Link.Attrs().Name)
+	}
+	lister.set([]netlink.Link{testBridge(1, "br0"), testBridge(2, "br1")})
+	if update := receive(); update.Header.Type != unix.RTM_NEWLINK || update.Link.Attrs().Name != "br1" {
+		t.Errorf("got %v of %s, expected the creation of br1", update.Header.Type, update.Link.Attrs().Name)
+	}
+}
+
+func TestMarkDegradedReportsLinkWatch(t *testing.T) {
+	// The degraded operations are global, the test leaves them as it found them
+	degradedOperationsLock.Lock()
+	saved := degradedOperations
+	degradedOperations = map[string]error{}
+	degradedOperationsLock.Unlock()
+	t.Cleanup(func() {
+		degradedOperationsLock.Lock()
+		degradedOperations = saved
+		degradedOperationsLock.Unlock()
+		linkWatchDegradedMetric.Delete(OperationLinkSubscribe)
+	})
+	exported := func() bool {
+		var b strings.Builder
+		if err := metrics.Default.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Contains(b.String(), `bridge_marker_link_watch_degraded{operation="LinkSubscribe"} 1`)
+	}
+
+	if LinkWatchDegraded() || exported() {
+		t.Fatal("the link watch is degraded before any operation failed")
+	}
+	markDegraded(OperationLinkSubscribe, unix.EPERM, "polling")
+	if !LinkWatchDegraded() {
+		t.Error("the link watch isn't reported degraded")
+	}
+	if !exported() {
+		t.Error("the degraded link watch isn't exported")
+	}
+	if err := DegradedOperations()[OperationLinkSubscribe]; err != unix.EPERM {
+		t.Errorf("got error %v for the subscription, expected EPERM", err)
+	}
+}
@@ -0,0 +1,375 @@
+package plugin
+
+import (
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// PluginOption configures a BridgeDevicePlugin.
+type PluginOption func(*BridgeDevicePlugin)
+
+// WithLoopStallThreshold sets the health check loop iteration gap that is reported as a stall, 0 disables reporting.
+func WithLoopStallThreshold(threshold time.Duration) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.loopMonitor = newLoopMonitor(dpi.deviceName+" health check", threshold)
+	}
+}
+
+// WithVariant exposes the bridge as the named sub-resource <bridge>-<variant> instead of the bridge resource itself.
+func WithVariant(variant string) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.variant = variant
+	}
+}
+
+// WithResourceName exposes the bridge under the given name instead of its own, variants and
+// VLANs of the bridge are named after it as well.
+func WithResourceName(name string) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.baseName = name
+	}
+}
+
+// WithFastRestart lets the plugin reclaim a socket left behind by a previous run that has no live listener.
+func WithFastRestart() PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.fastRestart = true
+	}
+}
+
+// WithHealthHistorySize sets the number of health transitions the plugin keeps in memory.
+func WithHealthHistorySize(size int) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.healthAccounting = newHealthAccounting(size)
+	}
+}
+
+// WithHealthNotifier sets the notifier informed about health changes of the plugin's devices.
+func WithHealthNotifier(notifier HealthNotifier) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.healthNotifier = notifier
+	}
+}
+
+// WithAllocationEnvs sets environment variables naming the granted bridge and devices in the containers.
+func WithAllocationEnvs() PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.allocationEnvs = true
+	}
+}
+
+// WithAllocationAnnotations annotates allocations with the MTU, MAC address and ifindex of the bridge.
+func WithAllocationAnnotations() PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.allocationAnnotations = true
+	}
+}
+
+// WithHealthDebounce reports a health change only once it was stable for window, the latest state winning.
+// Unless unhealthyToo is set, changes to unhealthy are reported right away, as false-healthy is worse than false-unhealthy.
+func WithHealthDebounce(window time.Duration, unhealthyToo bool) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.healthDebounce = window
+		dpi.debounceUnhealthy = unhealthyToo
+	}
+}
+
+// WithHealthMode sets the criterion for the bridge to be healthy, by default it has to be operationally up.
+func WithHealthMode(mode HealthMode) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.healthMode = mode
+	}
+}
+
+// WithRequireUpPort makes the bridge unhealthy unless at least one of its ports is up, on top of the health mode.
+func WithRequireUpPort() PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.minUpPorts = max(dpi.minUpPorts, 1)
+	}
+}
+
+// WithMinUpPorts makes the link unhealthy unless at least n of its ports, or slaves of a bond, are up.
+func WithMinUpPorts(n int) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.minUpPorts = n
+	}
+}
+
+// WithPortCapacity reports as many of the highest unallocated devices unhealthy as the bridge has
+// ports not accounted for by allocations, so the capacity matches the free port slots.
+func WithPortCapacity() PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.portCapacity = true
+	}
+}
+
+// WithNUMATopology reports the NUMA nodes of the bridge's physical uplinks as device topology,
+// so kubelet's Topology Manager can align the pod with them. It costs sysfs reads on port changes.
+func WithNUMATopology() PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.numaTopology = true
+	}
+}
+
+// WithPreStartCheck makes kubelet call PreStartContainer, which fails the container when the bridge
+// is gone or unhealthy by the configured criteria.
+func WithPreStartCheck() PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.preStartCheck = true
+	}
+}
+
+// WithKeepalive sets the gRPC server keepalive pings and the policy kubelet's pings must follow.
+func WithKeepalive(params keepalive.ServerParameters, policy keepalive.EnforcementPolicy) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.keepalive = params
+		dpi.keepalivePolicy = policy
+	}
+}
+
+// WithMaxConcurrentStreams bounds the concurrent gRPC streams per kubelet connection.
+func WithMaxConcurrentStreams(n uint32) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.maxConcurrentStreams = n
+	}
+}
+
+// WithResourceNamespace advertises the resource under the given domain instead of bridge.network.kubevirt.io.
+func WithResourceNamespace(namespace string) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.resourceNamespace = namespace
+	}
+}
+
+// WithSocketPrefix names plugin sockets <prefix><bridge>.sock instead of kubevirt-<bridge>.sock.
+func WithSocketPrefix(prefix string) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.socketPrefix = prefix
+	}
+}
+
+// WithRegistrationBackoff sets the backoff between registration attempts while kubelet isn't up.
+func WithRegistrationBackoff(backoff Backoff) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.registrationBackoff = backoff
+	}
+}
+
+// WithDeregistrationTimeout sets how long a stopping plugin waits for kubelet to receive the empty device list.
+func WithDeregistrationTimeout(timeout time.Duration) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.deregistrationTimeout = timeout
+	}
+}
+
+// WithGracefulStopTimeout sets how long in-flight RPCs may take before a stopping plugin server closes them.
+func WithGracefulStopTimeout(timeout time.Duration) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.gracefulStopTimeout = timeout
+	}
+}
+
+// WithRegistrationMode sets how the plugin registers with kubelet, legacy by default.
+func WithRegistrationMode(mode RegistrationMode) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.registrationMode = mode
+	}
+}
+
+// WithPluginsRegistryDir serves the plugin watcher registration in dir instead of /var/lib/kubelet/plugins_registry.
+func WithPluginsRegistryDir(dir string) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.pluginsRegistryDir = dir
+	}
+}
+
+// WithDevicePluginDir places the plugin sockets in dir instead of /var/lib/kubelet/device-plugins.
+func WithDevicePluginDir(dir string) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.devicePluginDir = dir
+	}
+}
+
+// WithKubeletSocket registers with the kubelet socket at path instead of kubelet.sock in the device plugin directory.
+func WithKubeletSocket(path string) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.kubeletSocket = path
+	}
+}
+
+// WithSocketMode sets the permissions of the plugin socket, 0600 by default.
+func WithSocketMode(mode os.FileMode) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.socketMode = mode
+	}
+}
+
+// WithSocketOwner changes the owner of the plugin socket, -1 keeps the respective id unchanged.
+func WithSocketOwner(uid, gid int) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.socketUID = uid
+		dpi.socketGID = gid
+	}
+}
+
+// WithUnaryInterceptors adds interceptors to the unary RPCs of the plugin server, after the logging one.
+func WithUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.unaryInterceptors = append(dpi.unaryInterceptors, interceptors...)
+	}
+}
+
+// WithStreamInterceptors adds interceptors to the streaming RPCs of the plugin server, after the logging one.
+func WithStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.streamInterceptors = append(dpi.streamInterceptors, interceptors...)
+	}
+}
+
+// WithServerMetrics records the RPCs of the plugin server, i.e. their count, status codes and
+// latency, in the registry the metrics were created with.
+func WithServerMetrics(m *ServerMetrics) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.serverMetrics = m
+	}
+}
+
+// WithVLAN marks the link as a VLAN sub-interface, its resource name has dots replaced by dashes
+// and its health also follows the carrier of the parent link.
+func WithVLAN() PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.vlan = true
+	}
+}
+
+// WithBridgeVLAN exposes a VLAN of a VLAN-filtering bridge as the resource <bridge>.vlan<vid>,
+// its health follows the bridge.
+func WithBridgeVLAN(vid uint16) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.bridgeVLAN = vid
+	}
+}
+
+// WithLinkSource looks up and follows links through the given source instead of netlink, e.g. a fake in tests.
+func WithLinkSource(links LinkSource) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.links = links
+	}
+}
+
+// WithClock times the health debounce, the registration retries and the shutdown waits with
+// the given clock instead of the real one.
+func WithClock(clock Clock) PluginOption {
+	return func(dpi *BridgeDevicePlugin) {
+		dpi.clock = clock
+	}
+}
+
+// linkSourceOf returns the link source the options set for plugins.
+func linkSourceOf(opts []PluginOption) LinkSource {
+	dpi := &BridgeDevicePlugin{links: defaultLinkSource}
+	for _, opt := range opts {
+		opt(dpi)
+	}
+	return dpi.links
+}
+
+// ControllerOption configures a BridgeDeviceController.
+type ControllerOption func(*BridgeDeviceController)
+
+// WithPluginOptions sets the options used for plugins created by the controller.
+func WithPluginOptions(opts ...PluginOption) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.pluginOptions = append(c.pluginOptions, opts...)
+	}
+}
+
+// WithControllerLoopStallThreshold sets the controller loop iteration gap that is reported as a stall, 0 disables reporting.
+func WithControllerLoopStallThreshold(threshold time.Duration) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.loopMonitor = newLoopMonitor("controller", threshold)
+	}
+}
+
+// WithBridgeVariants sets the named sub-resources the controller exposes for bridges it discovers.
+func WithBridgeVariants(variants map[string][]BridgeVariant) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.variants = variants
+	}
+}
+
+// WithKeepRegistrationOnShutdown makes the controller leave plugin sockets and registrations in place when it is stopped.
+func WithKeepRegistrationOnShutdown() ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.keepRegistrationOnShutdown = true
+	}
+}
+
+// WithDiscoveryTimeout bounds each pass the controller makes over the node's links.
+func WithDiscoveryTimeout(timeout time.Duration) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.discoveryTimeout = timeout
+	}
+}
+
+// WithResyncPeriod sets the interval of full bridge resyncs, 0 disables them.
+func WithResyncPeriod(period time.Duration) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.resyncPeriod = period
+	}
+}
+
+// WithBackoff sets the backoff used to restart failed plugins and to retry the link subscription.
+func WithBackoff(backoff Backoff) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.backoff = backoff
+	}
+}
+
+// WithDynamicDiscovery sets whether plugins are started for bridges created after startup, it is enabled by default.
+// Without it only the permanent plugins the controller was created with are run.
+func WithDynamicDiscovery(enabled bool) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.dynamicDiscovery = enabled
+	}
+}
+
+// WithDrainGracePeriod sets how long devices are reported unhealthy on shutdown before the plugins stop, 0 disables draining.
+func WithDrainGracePeriod(period time.Duration) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.drainGracePeriod = period
+	}
+}
+
+// WithMaxConcurrentStarts bounds how many plugins set up their socket and register with kubelet at once, 0 is unbounded.
+func WithMaxConcurrentStarts(n int) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.maxConcurrentStarts = n
+	}
+}
+
+// WithControllerLinkSource discovers and follows links through the given source instead of
+// netlink, the plugins started by the controller use it as well.
+func WithControllerLinkSource(links LinkSource) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.links = links
+	}
+}
+
+// WithControllerClock times the restart backoff and the resync with the given clock instead of
+// the real one, the plugins started by the controller use it as well.
+func WithControllerClock(clock Clock) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.clock = clock
+	}
+}
+
+// WithBridgeFilter only exposes the bridges matching the filter.
+func WithBridgeFilter(filter *BridgeFilter) ControllerOption {
+	return func(c *BridgeDeviceController) {
+		c.bridgeFilter.Store(filter)
+	}
+}
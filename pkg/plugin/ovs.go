@@ -0,0 +1,19 @@
+package plugin
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// ovsLinkType is the netlink kind of the internal interfaces of Open vSwitch bridges
+	ovsLinkType = "openvswitch"
+	// ovsDatapathName is the interface of the kernel datapath, which is not a bridge
+	ovsDatapathName = "ovs-system"
+)
+
+// isOVSBridge reports whether the link is the internal interface of an Open vSwitch bridge.
+// OVS ports are enslaved to the datapath rather than to their bridge, so ports can't be
+// followed over netlink and port based health and capacity don't apply to OVS bridges.
+func isOVSBridge(link netlink.Link) bool {
+	return link.Type() == ovsLinkType && link.Attrs().Name != ovsDatapathName
+}
@@ -0,0 +1,154 @@
+package pluginfakes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// PluginClient talks to a device plugin like kubelet does.
+type PluginClient struct {
+	conn *grpc.ClientConn
+	pluginapi.DevicePluginClient
+}
+
+// DialPlugin connects to the plugin socket, e.g. the Endpoint of its registration joined with the kubelet's Dir.
+func DialPlugin(socketPath string) (*PluginClient, error) {
+	conn, err := grpc.NewClient("unix://"+socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create a client of %s: %v", socketPath, err)
+	}
+	return &PluginClient{conn: conn, DevicePluginClient: pluginapi.NewDevicePluginClient(conn)}, nil
+}
+
+func (c *PluginClient) Close() error {
+	return c.conn.Close()
+}
+
+// AllocateDevices allocates the devices to a single container, like kubelet admitting a pod.
+func (c *PluginClient) AllocateDevices(ctx context.Context, ids ...string) (*pluginapi.ContainerAllocateResponse, error) {
+	resp, err := c.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.ContainerResponses) != 1 {
+		return nil, fmt.Errorf("expected a response for 1 container, got %d", len(resp.ContainerResponses))
+	}
+	return resp.ContainerResponses[0], nil
+}
+
+// Watch opens ListAndWatch and receives device lists in the background until ctx is done
+// or the plugin ends the stream.
+func (c *PluginClient) Watch(ctx context.Context) (*DeviceStream, error) {
+	stream, err := c.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		return nil, fmt.Errorf("could not open ListAndWatch: %v", err)
+	}
+	s := &DeviceStream{changed: make(chan struct{}), done: make(chan struct{})}
+	go s.receive(stream)
+	return s, nil
+}
+
+// DeviceStream collects the device lists a plugin sends on ListAndWatch.
+type DeviceStream struct {
+	lock  sync.Mutex
+	lists [][]*pluginapi.Device
+	ended bool
+	err   error
+	// changed is closed and replaced on every received list
+	changed chan struct{}
+	done    chan struct{}
+}
+
+func (s *DeviceStream) receive(stream pluginapi.DevicePlugin_ListAndWatchClient) {
+	defer close(s.done)
+	for {
+		resp, err := stream.Recv()
+		s.lock.Lock()
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			s.ended = true
+			close(s.changed)
+			s.lock.Unlock()
+			return
+		}
+		s.lists = append(s.lists, resp.Devices)
+		close(s.changed)
+		s.changed = make(chan struct{})
+		s.lock.Unlock()
+	}
+}
+
+// Lists returns all device lists received so far, oldest first.
+func (s *DeviceStream) Lists() [][]*pluginapi.Device {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([][]*pluginapi.Device{}, s.lists...)
+}
+
+// Done is closed when the stream ended, Err tells why.
+func (s *DeviceStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err is the error the stream ended with, nil while it runs or when the plugin closed it.
+func (s *DeviceStream) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// WaitFor waits until a received list satisfies the condition and returns it. Lists received
+// before the call are checked too, so a condition met by the latest list returns right away.
+func (s *DeviceStream) WaitFor(ctx context.Context, condition func([]*pluginapi.Device) bool) ([]*pluginapi.Device, error) {
+	checked := 0
+	for {
+		s.lock.Lock()
+		lists, changed, ended, err := s.lists[checked:], s.changed, s.ended, s.err
+		checked = len(s.lists)
+		s.lock.Unlock()
+		for _, devices := range lists {
+			if condition(devices) {
+				return devices, nil
+			}
+		}
+		if ended {
+			return nil, fmt.Errorf("the stream ended: %v", err)
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no matching device list: %v", ctx.Err())
+		}
+	}
+}
+
+// AllHealth is a WaitFor condition matching non-empty lists whose devices all have the health.
+func AllHealth(health string) func([]*pluginapi.Device) bool {
+	return func(devices []*pluginapi.Device) bool {
+		if len(devices) == 0 {
+			return false
+		}
+		for _, dev := range devices {
+			if dev.Health != health {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Empty is a WaitFor condition matching the empty list a plugin sends when it deregisters.
+func Empty(devices []*pluginapi.Device) bool {
+	return len(devices) == 0
+}
@@ -0,0 +1,174 @@
+package pluginfakes
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+)
+
+var _ plugin.Clock = &Clock{}
+
+// Clock is a manual plugin.Clock, time only moves when Step is called. Hand it to
+// plugin.WithClock or plugin.WithControllerClock.
+type Clock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*waiter
+	// changed is closed and replaced whenever a waiter is added
+	changed chan struct{}
+}
+
+// waiter is a pending timer or ticker, period is 0 for timers.
+type waiter struct {
+	clock    *Clock
+	deadline time.Time
+	period   time.Duration
+	c        chan time.Time
+}
+
+// NewClock returns a manual clock set to now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now, changed: make(chan struct{})}
+}
+
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *Clock) NewTimer(d time.Duration) plugin.Timer {
+	return c.add(d, 0)
+}
+
+func (c *Clock) NewTicker(d time.Duration) plugin.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return ticker{c.add(d, d)}
+}
+
+func (c *Clock) add(d, period time.Duration) *waiter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	w := &waiter{clock: c, deadline: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+		return w
+	}
+	c.waiters = append(c.waiters, w)
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return w
+}
+
+// Step moves the clock forward and fires the timers and tickers that are due. Like the
+// real ones, a ticker drops ticks its reader didn't keep up with.
+func (c *Clock) Step(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		select {
+		case w.c <- c.now:
+		default:
+		}
+		if w.period > 0 {
+			for !w.deadline.After(c.now) {
+				w.deadline = w.deadline.Add(w.period)
+			}
+			pending = append(pending, w)
+		}
+	}
+	c.waiters = pending
+}
+
+// Waiters returns the number of timers and tickers that didn't fire or stop yet.
+func (c *Clock) Waiters() int {
+	return c.count(true)
+}
+
+// Timers returns the number of timers that didn't fire or stop yet. Unlike Waiters it leaves
+// out the tickers, e.g. of the loop heartbeats, which are pending for as long as a loop runs.
+func (c *Clock) Timers() int {
+	return c.count(false)
+}
+
+// WaitForWaiters blocks until at least n timers and tickers are pending, e.g. until the
+// restart backoff waits, so a following Step isn't lost.
+func (c *Clock) WaitForWaiters(ctx context.Context, n int) error {
+	return c.waitFor(ctx, n, true)
+}
+
+// WaitForTimers blocks until at least n timers are pending, ignoring the tickers.
+func (c *Clock) WaitForTimers(ctx context.Context, n int) error {
+	return c.waitFor(ctx, n, false)
+}
+
+func (c *Clock) waitFor(ctx context.Context, n int, tickers bool) error {
+	for {
+		c.lock.Lock()
+		changed := c.changed
+		c.lock.Unlock()
+		if c.count(tickers) >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Clock) count(tickers bool) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if tickers {
+		return len(c.waiters)
+	}
+	count := 0
+	for _, w := range c.waiters {
+		if w.period == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (w *waiter) C() <-chan time.Time {
+	return w.c
+}
+
+// Stop removes the waiter, it returns false if it already fired or stopped.
+func (w *waiter) Stop() bool {
+	c := w.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, pending := range c.waiters {
+		if pending == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type ticker struct {
+	*waiter
+}
+
+func (t ticker) Stop() {
+	t.waiter.Stop()
+}
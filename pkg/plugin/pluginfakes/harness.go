@@ -0,0 +1,138 @@
+package pluginfakes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/netlinkfake"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+)
+
+// Harness runs device plugins in process against a fake kubelet and fake links, so the
+// whole loop of registration, ListAndWatch, Allocate and kubelet restarts can be driven
+// without a node or privileges.
+type Harness struct {
+	Kubelet *Kubelet
+	Links   *netlinkfake.Links
+	// monitor shares the subscription of Links like the default link source shares netlink's
+	monitor *plugin.LinkMonitor
+
+	lock sync.Mutex
+	runs []*PluginRun
+}
+
+// NewHarness serves a fake kubelet in dir, e.g. a test's temp dir, and starts with no links.
+func NewHarness(dir string) (*Harness, error) {
+	kubelet, err := StartKubelet(dir)
+	if err != nil {
+		return nil, err
+	}
+	links := netlinkfake.New()
+	return &Harness{Kubelet: kubelet, Links: links, monitor: plugin.NewLinkMonitor(links)}, nil
+}
+
+// PluginOptions point a plugin at the fake kubelet and links.
+func (h *Harness) PluginOptions() []plugin.PluginOption {
+	return []plugin.PluginOption{
+		plugin.WithDevicePluginDir(h.Kubelet.Dir()),
+		plugin.WithLinkSource(h.monitor),
+	}
+}
+
+// ControllerOptions point a controller and the plugins it discovers at the fake kubelet and
+// links. Permanent plugins need PluginOptions as well.
+func (h *Harness) ControllerOptions() []plugin.ControllerOption {
+	return []plugin.ControllerOption{
+		plugin.WithPluginOptions(plugin.WithDevicePluginDir(h.Kubelet.Dir())),
+		plugin.WithControllerLinkSource(h.monitor),
+	}
+}
+
+// NewPlugin creates a plugin for the bridge with PluginOptions and the given options.
+func (h *Harness) NewPlugin(bridge string, maxDevices int, opts ...plugin.PluginOption) (*plugin.BridgeDevicePlugin, error) {
+	return plugin.NewBridgeDevicePlugin(bridge, maxDevices, append(h.PluginOptions(), opts...)...)
+}
+
+// PluginRun is a plugin started by the harness.
+type PluginRun struct {
+	cancel   context.CancelFunc
+	done     chan struct{}
+	err      error
+	restarts atomic.Int32
+}
+
+// StartPlugin runs the plugin until ctx is done or Stop is called. Like the controller, it
+// starts the plugin again when it returns because kubelet restarted.
+func (h *Harness) StartPlugin(ctx context.Context, dev plugin.Device) *PluginRun {
+	ctx, cancel := context.WithCancel(ctx)
+	run := &PluginRun{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(run.done)
+		for {
+			err := dev.Start(ctx)
+			if !errors.Is(err, plugin.ErrKubeletRestarted) || ctx.Err() != nil {
+				run.err = err
+				return
+			}
+			run.restarts.Add(1)
+		}
+	}()
+	h.lock.Lock()
+	h.runs = append(h.runs, run)
+	h.lock.Unlock()
+	return run
+}
+
+// Restarts returns how often the plugin was started again after a kubelet restart.
+func (r *PluginRun) Restarts() int {
+	return int(r.restarts.Load())
+}
+
+// Done is closed once the plugin stopped for good.
+func (r *PluginRun) Done() <-chan struct{} {
+	return r.done
+}
+
+// Stop stops the plugin, waits for it and returns the error it stopped with.
+func (r *PluginRun) Stop() error {
+	r.cancel()
+	<-r.done
+	return r.err
+}
+
+// Dial waits until the resource registered and connects to the plugin like kubelet does.
+func (h *Harness) Dial(ctx context.Context, resourceName string) (*PluginClient, error) {
+	req, err := h.Kubelet.WaitForRegistration(ctx, resourceName)
+	if err != nil {
+		return nil, err
+	}
+	return DialPlugin(filepath.Join(h.Kubelet.Dir(), req.Endpoint))
+}
+
+// RestartKubelet restarts the fake kubelet and waits until the resource registered again.
+func (h *Harness) RestartKubelet(ctx context.Context, resourceName string) error {
+	registrations := h.Kubelet.Registrations(resourceName)
+	if err := h.Kubelet.Restart(); err != nil {
+		return fmt.Errorf("could not restart the kubelet: %v", err)
+	}
+	_, err := h.Kubelet.WaitForRegistrations(ctx, resourceName, registrations+1)
+	return err
+}
+
+// Close stops the plugins started by the harness and the kubelet.
+func (h *Harness) Close() error {
+	h.lock.Lock()
+	runs := h.runs
+	h.runs = nil
+	h.lock.Unlock()
+	var errs []error
+	for _, run := range runs {
+		errs = append(errs, run.Stop())
+	}
+	h.Kubelet.Stop()
+	return errors.Join(errs...)
+}
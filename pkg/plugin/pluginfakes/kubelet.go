@@ -0,0 +1,169 @@
+// Package pluginfakes provides a fake kubelet, a device plugin client and a manual clock for
+// tests of the plugins, without a real kubelet, privileges or sleeping.
+package pluginfakes
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Kubelet serves the device plugin Registration service on a unix socket and records the
+// registrations. Point plugins at it with plugin.WithDevicePluginDir(kubelet.Dir()).
+type Kubelet struct {
+	dir      string
+	listener net.Listener
+	server   *grpc.Server
+
+	lock     sync.Mutex
+	requests []*pluginapi.RegisterRequest
+	// registered is closed and replaced on every registration
+	registered chan struct{}
+	// registerErr fails the following registrations
+	registerErr error
+}
+
+// StartKubelet serves kubelet.sock in dir, e.g. a test's temp dir.
+func StartKubelet(dir string) (*Kubelet, error) {
+	k := &Kubelet{
+		dir:        dir,
+		registered: make(chan struct{}),
+	}
+	if err := k.serve(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *Kubelet) serve() error {
+	socketPath := filepath.Join(k.dir, filepath.Base(pluginapi.KubeletSocket))
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %v", socketPath, err)
+	}
+	server := grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(server, k)
+	k.lock.Lock()
+	k.listener, k.server = listener, server
+	k.lock.Unlock()
+	go server.Serve(listener)
+	return nil
+}
+
+// Dir is the device plugin directory the kubelet socket is served in.
+func (k *Kubelet) Dir() string {
+	return k.dir
+}
+
+// SocketPath is the path of the kubelet socket.
+func (k *Kubelet) SocketPath() string {
+	return filepath.Join(k.dir, filepath.Base(pluginapi.KubeletSocket))
+}
+
+// Stop stops serving and removes the socket, like a kubelet going away.
+func (k *Kubelet) Stop() {
+	k.lock.Lock()
+	server := k.server
+	k.lock.Unlock()
+	server.Stop()
+}
+
+// Restart stops the kubelet, removes the plugin sockets in its directory and serves again,
+// like kubelet does when it restarts. Earlier registrations are kept.
+func (k *Kubelet) Restart() error {
+	k.Stop()
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSocket == 0 {
+			continue
+		}
+		if err := os.Remove(filepath.Join(k.dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return k.serve()
+}
+
+// SetRegisterError fails the following registrations with err, nil accepts them again.
+func (k *Kubelet) SetRegisterError(err error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.registerErr = err
+}
+
+// Register records the request, it implements the Registration service.
+func (k *Kubelet) Register(_ context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.registerErr != nil {
+		return nil, k.registerErr
+	}
+	k.requests = append(k.requests, req)
+	close(k.registered)
+	k.registered = make(chan struct{})
+	return &pluginapi.Empty{}, nil
+}
+
+// Requests returns the accepted registrations in the order they were received.
+func (k *Kubelet) Requests() []*pluginapi.RegisterRequest {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return append([]*pluginapi.RegisterRequest{}, k.requests...)
+}
+
+// WaitForRegistration waits until the resource registered, counting registrations before the call.
+func (k *Kubelet) WaitForRegistration(ctx context.Context, resourceName string) (*pluginapi.RegisterRequest, error) {
+	return k.WaitForRegistrations(ctx, resourceName, 1)
+}
+
+// Registrations returns how often the resource registered.
+func (k *Kubelet) Registrations(resourceName string) int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	count := 0
+	for _, req := range k.requests {
+		if req.ResourceName == resourceName {
+			count++
+		}
+	}
+	return count
+}
+
+// WaitForRegistrations waits until the resource registered n times and returns the last
+// registration, e.g. to see a plugin register again after Restart.
+func (k *Kubelet) WaitForRegistrations(ctx context.Context, resourceName string, n int) (*pluginapi.RegisterRequest, error) {
+	for {
+		k.lock.Lock()
+		registered := k.registered
+		var last *pluginapi.RegisterRequest
+		count := 0
+		for _, req := range k.requests {
+			if req.ResourceName == resourceName {
+				last = req
+				count++
+			}
+		}
+		k.lock.Unlock()
+		if count >= n {
+			return last, nil
+		}
+
+		select {
+		case <-registered:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s didn't register %d times: %v", resourceName, n, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"kubevirt.io/client-go/log"
+)
+
+// MaxBridgePorts is the port limit of Linux bridges, BR_MAX_PORTS = 1 << BR_PORT_BITS with BR_PORT_BITS = 10.
+// The kernel exposes it neither in sysfs nor over netlink, so it is a compile-time constant here as well.
+const MaxBridgePorts = 1 << 10
+
+// sysfsNetPath is where sysfs lists the network interfaces.
+var sysfsNetPath = "/sys/class/net"
+
+// bridgePortLimit returns the port limit of the bridge, or false if it has none. Only Linux bridges,
+// which sysfs tells apart by their bridge directory, are limited. When sysfs can't be read the Linux
+// bridge limit is assumed.
+func bridgePortLimit(bridgeName string) (int, bool) {
+	if _, err := os.Stat(filepath.Join(sysfsNetPath, bridgeName)); err != nil {
+		return MaxBridgePorts, true
+	}
+	if _, err := os.Stat(filepath.Join(sysfsNetPath, bridgeName, "bridge")); err != nil {
+		return 0, false
+	}
+	return MaxBridgePorts, true
+}
+
+// clampMaxDevices reduces the requested device count to the port limit of the bridge.
+func clampMaxDevices(bridgeName string, requested int) int {
+	limit, limited := bridgePortLimit(bridgeName)
+	if !limited || requested <= limit {
+		return requested
+	}
+	log.DefaultLogger().Warningf("bridge %s supports at most %d ports, reducing its devices from %d", bridgeName, limit, requested)
+	return limit
+}
+
+// bridgePorts tracks the ports enslaved to the monitored bridge by ifindex and whether they are up.
+type bridgePorts map[int]bool
+
+func (p bridgePorts) upCount() int {
+	count := 0
+	for _, up := range p {
+		if up {
+			count++
+		}
+	}
+	return count
+}
+
+// portUp reports whether the port passes traffic, tun/tap ports report an unknown operational state.
+func portUp(attrs *netlink.LinkAttrs) bool {
+	return attrs.OperState == netlink.OperUp ||
+		(attrs.OperState == netlink.OperUnknown && attrs.Flags&net.FlagUp != 0)
+}
+
+// tracksPorts reports whether the health check has to follow the bridge's ports.
+func (dpi *BridgeDevicePlugin) tracksPorts() bool {
+	return !dpi.ovs && !dpi.vlan && (dpi.minUpPorts > 0 || dpi.portCapacity || dpi.numaTopology)
+}
+
+// portsChanged updates the capacity and health after the tracked ports changed.
+func (dpi *BridgeDevicePlugin) portsChanged() {
+	if dpi.portCapacity {
+		dpi.deviceHealth.setPorts(len(dpi.ports))
+	}
+	if dpi.numaTopology {
+		dpi.updateTopology()
+	}
+	if dpi.minUpPorts > 0 {
+		dpi.observeHealth(dpi.healthReason())
+	}
+}
+
+// updateTopology places the devices on the NUMA nodes of the bridge's physical uplinks.
+func (dpi *BridgeDevicePlugin) updateTopology() {
+	if dpi.linkIndex == 0 {
+		dpi.deviceHealth.setTopology(nil)
+		return
+	}
+	links, err := dpi.links.LinkList()
+	if err != nil {
+		log.DefaultLogger().Reason(err).Errorf("could not list links to find the uplinks of bridge %s", dpi.deviceName)
+		return
+	}
+	dpi.deviceHealth.setTopology(numaTopology(bridgeUplinks(links, dpi.linkIndex)))
+}
+
+// listPorts replaces the tracked ports with the links currently enslaved to the bridge.
+func (dpi *BridgeDevicePlugin) listPorts() error {
+	links, err := dpi.links.LinkList()
+	if err != nil {
+		return err
+	}
+	dpi.ports = bridgePorts{}
+	for _, link := range links {
+		if attrs := link.Attrs(); attrs.MasterIndex == dpi.linkIndex {
+			dpi.ports[attrs.Index] = portUp(attrs)
+		}
+	}
+	return nil
+}
+
+// trackPort follows ports joining, leaving or changing state, it reports whether the ports changed.
+func (dpi *BridgeDevicePlugin) trackPort(update netlink.LinkUpdate) bool {
+	attrs := update.Attrs()
+	wasUp, known := dpi.ports[attrs.Index]
+	if update.Header.Type == unix.RTM_NEWLINK && dpi.linkIndex != 0 && attrs.MasterIndex == dpi.linkIndex {
+		up := portUp(attrs)
+		dpi.ports[attrs.Index] = up
+		return !known || wasUp != up
+	}
+	if known {
+		delete(dpi.ports, attrs.Index)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClampMaxDevices(t *testing.T) {
+	sysfs := t.TempDir()
+	for _, dir := range []string{"br0/bridge", "ovsbr0"} {
+		if err := os.MkdirAll(filepath.Join(sysfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(path string) { sysfsNetPath = path }(sysfsNetPath)
+	sysfsNetPath = sysfs
+
+	tests := []struct {
+		name      string
+		bridge    string
+		requested int
+		expected  int
+	}{
+		{name: "linux bridge within the limit", bridge: "br0", requested: 100, expected: 100},
+		{name: "linux bridge at the limit", bridge: "br0", requested: MaxBridgePorts, expected: MaxBridgePorts},
+		{name: "linux bridge above the limit", bridge: "br0", requested: 5000, expected: MaxBridgePorts},
+		{name: "other bridges are not limited", bridge: "ovsbr0", requested: 5000, expected: 5000},
+		{name: "unreadable sysfs falls back to the linux limit", bridge: "br1", requested: 5000, expected: MaxBridgePorts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clampMaxDevices(tt.bridge, tt.requested); got != tt.expected {
+				t.Errorf("got %d devices, expected %d", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+	"kubevirt.io/client-go/log"
+)
+
+// PluginsRegistryPath is the directory kubelet's plugin watcher discovers plugin sockets in.
+const PluginsRegistryPath = "/var/lib/kubelet/plugins_registry"
+
+// pluginWatcherTimeout is how long the auto mode waits for the plugin watcher before
+// registering through kubelet.sock.
+const pluginWatcherTimeout = 10 * time.Second
+
+// ErrUnsupportedVersion is returned by Start when kubelet doesn't support the device plugin API
+// version of the plugin, registering again can't succeed.
+var ErrUnsupportedVersion = errors.New("device plugin API version not supported by kubelet")
+
+// The messages kubelet rejects a version with, through kubelet.sock and the plugin watcher
+var (
+	kubeletVersionsPattern = regexp.MustCompile(`is not supported by kubelet\. Supported versions are (.*)`)
+	managerVersionPattern  = regexp.MustCompile(`manager version, ([^,]+), is not among plugin supported versions`)
+)
+
+// RegistrationMode is how a device plugin registers with kubelet.
+type RegistrationMode string
+
+const (
+	// RegistrationModeLegacy registers by calling kubelet's Registration service on kubelet.sock.
+	RegistrationModeLegacy RegistrationMode = "legacy"
+	// RegistrationModePluginWatcher serves a Registration service in the plugins registry directory
+	// for kubelet's plugin watcher to find.
+	RegistrationModePluginWatcher RegistrationMode = "pluginwatcher"
+	// RegistrationModeAuto offers the plugin watcher registration and falls back to the legacy one
+	// when kubelet doesn't pick it up.
+	RegistrationModeAuto RegistrationMode = "auto"
+)
+
+// ParseRegistrationMode validates the name of a registration mode.
+func ParseRegistrationMode(name string) (RegistrationMode, error) {
+	switch mode := RegistrationMode(name); mode {
+	case RegistrationModeLegacy, RegistrationModePluginWatcher, RegistrationModeAuto:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown registration mode %q, expected one of %s, %s or %s",
+		name, RegistrationModeLegacy, RegistrationModePluginWatcher, RegistrationModeAuto)
+}
+
+// registrationService is the plugin watcher side of the registration, kubelet asks for the
+// plugin's info and reports whether it registered the plugin.
+type registrationService struct {
+	dpi    *BridgeDevicePlugin
+	status chan error
+}
+
+func (r *registrationService) GetInfo(_ context.Context, _ *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DevicePlugin,
+		Name:              r.dpi.resourceName,
+		Endpoint:          r.dpi.socketPath,
+		SupportedVersions: []string{pluginapi.Version},
+	}, nil
+}
+
+func (r *registrationService) NotifyRegistrationStatus(_ context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	var err error
+	if !status.PluginRegistered {
+		err = errors.New(status.Error)
+	}
+	r.dpi.recordRegistration(r.dpi.registerRequest(), err)
+	select {
+	case r.status <- err:
+	default:
+	}
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
+
+// registerWithKubelet registers the plugin according to the registration mode.
+func (dpi *BridgeDevicePlugin) registerWithKubelet(ctx context.Context, release func(), serveErr <-chan error) error {
+	if dpi.registrationMode == RegistrationModeLegacy {
+		return dpi.registerWithRetry(ctx, release, serveErr)
+	}
+
+	status, err := dpi.serveRegistration()
+	if err != nil {
+		return err
+	}
+	// Registration is up to kubelet from here on
+	release()
+
+	var timeout <-chan time.Time
+	if dpi.registrationMode == RegistrationModeAuto {
+		timer := dpi.clock.NewTimer(pluginWatcherTimeout)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	select {
+	case <-dpi.stop:
+		return nil
+	case err := <-serveErr:
+		return fmt.Errorf("the GRPC server failed while registering: %v", err)
+	case err := <-status:
+		if err != nil {
+			registrationFailuresMetric.Inc(dpi.deviceName)
+			if kubeletVersions, mismatch := versionMismatch(err); mismatch {
+				return dpi.unsupportedVersion(kubeletVersions, err)
+			}
+			return fmt.Errorf("kubelet's plugin watcher failed to register %s: %v", dpi.resourceName, err)
+		}
+		return nil
+	case <-timeout:
+		log.DefaultLogger().Infof("kubelet's plugin watcher didn't pick up %s within %v, registering through %s",
+			dpi.resourceName, pluginWatcherTimeout, dpi.kubeletSocket)
+		dpi.stopRegistration()
+		return dpi.registerWithRetry(ctx, func() {}, serveErr)
+	}
+}
+
+// serveRegistration serves the Registration service on a socket in the plugins registry directory.
+func (dpi *BridgeDevicePlugin) serveRegistration() (<-chan error, error) {
+	socketPath := filepath.Join(dpi.pluginsRegistryDir, filepath.Base(dpi.socketPath))
+	if err := checkSocketDir(dpi.pluginsRegistryDir); err != nil {
+		return nil, err
+	}
+	if err := removeSocket(socketPath); err != nil {
+		return nil, err
+	}
+	sock, err := listenUnix(socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the registration socket: %v", err)
+	}
+
+	service := &registrationService{dpi: dpi, status: make(chan error, 1)}
+	server := grpc.NewServer()
+	registerapi.RegisterRegistrationServer(server, service)
+	go server.Serve(sock)
+
+	dpi.lock.Lock()
+	dpi.registrationServer = server
+	dpi.registrationListener = sock
+	dpi.lock.Unlock()
+	return service.status, nil
+}
+
+// stopRegistration stops the Registration service, its socket is left in place when the
+// registration is kept, so kubelet's plugin watcher doesn't deregister the plugin.
+func (dpi *BridgeDevicePlugin) stopRegistration() {
+	dpi.lock.Lock()
+	server, listener := dpi.registrationServer, dpi.registrationListener
+	dpi.registrationServer, dpi.registrationListener = nil, nil
+	dpi.lock.Unlock()
+	if server == nil {
+		return
+	}
+	if dpi.shouldKeepRegistration() {
+		listener.SetUnlinkOnClose(false)
+	}
+	server.Stop()
+}
+
+// versionMismatch tells a registration kubelet rejected for the API version apart from other
+// failures and returns the versions kubelet supports. The versions kubelet lists decide, so a
+// message that merely looks alike doesn't fail the plugin for good.
+func versionMismatch(err error) (string, bool) {
+	message := err.Error()
+	if match := kubeletVersionsPattern.FindStringSubmatch(message); match != nil {
+		versions := strings.Fields(strings.NewReplacer(`"`, "", "[", "", "]", "").Replace(match[1]))
+		return strings.Join(versions, ", "), !slices.Contains(versions, pluginapi.Version)
+	}
+	if match := managerVersionPattern.FindStringSubmatch(message); match != nil {
+		return match[1], match[1] != pluginapi.Version
+	}
+	return "", false
+}
+
+// unsupportedVersion reports the version mismatch once, the plugin isn't registered again.
+func (dpi *BridgeDevicePlugin) unsupportedVersion(kubeletVersions string, err error) error {
+	log.DefaultLogger().Criticalf("kubelet supports device plugin API versions %s, %s needs %s. "+
+		"Upgrade kubelet or run a bridge-marker built for its API version: %v",
+		kubeletVersions, dpi.resourceName, pluginapi.Version, err)
+	return fmt.Errorf("%w: the plugin needs %s, kubelet supports %s", ErrUnsupportedVersion, pluginapi.Version, kubeletVersions)
+}
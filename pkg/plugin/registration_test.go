@@ -0,0 +1,113 @@
+package plugin_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin/pluginfakes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+func TestPluginRegistersThroughPluginWatcher(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	registry := t.TempDir()
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3,
+		plugin.WithRegistrationMode(plugin.RegistrationModePluginWatcher), plugin.WithPluginsRegistryDir(registry))
+	run := h.StartPlugin(ctx, dev)
+
+	// Like kubelet's plugin watcher, find the socket in the registry and ask for the plugin's info
+	registrationSocket := filepath.Join(registry, filepath.Base(dev.GetSocketPath()))
+	eventually(ctx, t, "no registration socket in the plugins registry", func() bool {
+		_, err := os.Stat(registrationSocket)
+		return err == nil
+	})
+	conn, err := grpc.NewClient("unix://"+registrationSocket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	watcher := registerapi.NewRegistrationClient(conn)
+	info, err := watcher.GetInfo(ctx, &registerapi.InfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != registerapi.DevicePlugin || info.Name != resourceName("br0") || info.Endpoint != dev.GetSocketPath() ||
+		!slices.Contains(info.SupportedVersions, pluginapi.Version) {
+		t.Errorf("got plugin info %v", info)
+	}
+	if _, err := watcher.NotifyRegistrationStatus(ctx, &registerapi.RegistrationStatus{PluginRegistered: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(ctx, t, "the plugin didn't start after the plugin watcher registered it", dev.GetInitialized)
+	if registrations := h.Kubelet.Registrations(resourceName("br0")); registrations != 0 {
+		t.Errorf("the plugin registered %d times through kubelet.sock as well", registrations)
+	}
+	client, err := pluginfakes.DialPlugin(info.Endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	stream, err := client.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopBeforeClients(t, run)
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+}
+
+func TestPluginFallsBackToLegacyRegistration(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	clock := pluginfakes.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3, plugin.WithClock(clock),
+		plugin.WithRegistrationMode(plugin.RegistrationModeAuto), plugin.WithPluginsRegistryDir(t.TempDir()))
+	run := h.StartPlugin(ctx, dev)
+
+	// Nothing watches the plugins registry
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if h.Kubelet.Registrations(resourceName("br0")) != 0 {
+		t.Error("the plugin registered through kubelet.sock without waiting for the plugin watcher")
+	}
+	clock.Step(10 * time.Second)
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+	watch(ctx, t, h, resourceName("br0"))
+	stopBeforeClients(t, run)
+}
+
+func TestPluginCountsRegistrationFailures(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Kubelet.SetRegisterError(errors.New("the device plugin manager isn't ready"))
+	h.Links.AddBridge("br-rejected")
+	h.StartPlugin(ctx, newPlugin(t, h, "br-rejected", 3,
+		plugin.WithRegistrationBackoff(plugin.Backoff{Steps: []time.Duration{10 * time.Millisecond}})))
+
+	sample := `bridge_marker_registration_failures_total{bridge="br-rejected"}`
+	eventually(ctx, t, "the failed registrations weren't counted", func() bool {
+		return metricValue(t, sample) >= 2
+	})
+	h.Kubelet.SetRegisterError(nil)
+	waitForRegistration(ctx, t, h, resourceName("br-rejected"))
+	failures := metricValue(t, sample)
+	watch(ctx, t, h, resourceName("br-rejected"))
+	if metricValue(t, sample) != failures {
+		t.Error("a successful registration was counted as a failure")
+	}
+}
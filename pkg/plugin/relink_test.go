@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// stubSource is a stubLister whose updates are handed to the plugin by the test.
+type stubSource struct {
+	stubLister
+}
+
+func (*stubSource) Subscribe(chan<- netlink.LinkUpdate, <-chan struct{}) error {
+	return nil
+}
+
+func TestHandleLinkUpdateFollowsRecreatedBridge(t *testing.T) {
+	oldBridge, newBridge := testBridge(1, "br0"), testBridge(2, "br0")
+	// step is an update handled while the lister shows links
+	type step struct {
+		links  []netlink.Link
+		update netlink.LinkUpdate
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "deleted, then recreated",
+			steps: []step{
+				{links: nil, update: newLinkUpdate(oldBridge, unix.RTM_DELLINK)},
+				{links: []netlink.Link{newBridge}, update: newLinkUpdate(newBridge, unix.RTM_NEWLINK)},
+			},
+		},
+		{
+			name: "deletion handled once the bridge is recreated",
+			steps: []step{
+				{links: []netlink.Link{newBridge}, update: newLinkUpdate(oldBridge, unix.RTM_DELLINK)},
+				{links: []netlink.Link{newBridge}, update: newLinkUpdate(newBridge, unix.RTM_NEWLINK)},
+			},
+		},
+		{
+			name: "recreated before the deletion is handled",
+			steps: []step{
+				{links: []netlink.Link{newBridge}, update: newLinkUpdate(newBridge, unix.RTM_NEWLINK)},
+				{links: []netlink.Link{newBridge}, update: newLinkUpdate(oldBridge, unix.RTM_DELLINK)},
+			},
+		},
+		{
+			name: "stale update of the deleted bridge",
+			steps: []step{
+				{links: []netlink.Link{newBridge}, update: newLinkUpdate(newBridge, unix.RTM_NEWLINK)},
+				{links: []netlink.Link{newBridge}, update: newLinkUpdate(oldBridge, unix.RTM_NEWLINK)},
+				{links: []netlink.Link{newBridge}, update: newLinkUpdate(oldBridge, unix.RTM_DELLINK)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			links := &stubSource{stubLister{links: []netlink.Link{oldBridge}}}
+			dpi, err := NewBridgeDevicePlugin("br0", 3, WithLinkSource(links), WithDevicePluginDir(t.TempDir()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dpi.checkLink(); err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range tt.steps {
+				links.set(step.links)
+				dpi.handleLinkUpdate(step.update)
+			}
+			if dpi.linkIndex != newBridge.Attrs().Index || dpi.healthReason() != HealthReasonUp {
+				t.Errorf("following ifindex %d with %s, expected %d with %s",
+					dpi.linkIndex, dpi.healthReason(), newBridge.Attrs().Index, HealthReasonUp)
+			}
+		})
+	}
+}
+
+func TestHandleLinkUpdateReportsDeletedBridge(t *testing.T) {
+	links := &stubSource{stubLister{links: []netlink.Link{testBridge(1, "br0")}}}
+	dpi, err := NewBridgeDevicePlugin("br0", 3, WithLinkSource(links), WithDevicePluginDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dpi.checkLink(); err != nil {
+		t.Fatal(err)
+	}
+	links.set(nil)
+	dpi.handleLinkUpdate(newLinkUpdate(testBridge(1, "br0"), unix.RTM_DELLINK))
+	if dpi.linkIndex != 0 || dpi.healthReason() != HealthReasonMissing {
+		t.Errorf("following ifindex %d with %s after the bridge was deleted", dpi.linkIndex, dpi.healthReason())
+	}
+	if healthy, _ := dpi.deviceHealth.counts(); healthy != 0 {
+		t.Errorf("%d devices are healthy without the bridge", healthy)
+	}
+}
@@ -4,17 +4,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	"kubevirt.io/client-go/log"
@@ -23,108 +32,425 @@ import (
 const (
 	DeviceNamespace   = "bridge.network.kubevirt.io"
 	connectionTimeout = 5 * time.Second
+	// staleSocketProbeTimeout bounds the check for a live listener on a leftover socket
+	staleSocketProbeTimeout = 500 * time.Millisecond
+	// registrationLogInterval rate limits the warnings while kubelet doesn't accept the registration
+	registrationLogInterval = time.Minute
+	// DefaultDeregistrationTimeout is how long a stopping plugin waits for the empty device list to be sent
+	DefaultDeregistrationTimeout = 1 * time.Second
+	// DefaultGracefulStopTimeout is how long in-flight RPCs may take when the plugin server stops
+	DefaultGracefulStopTimeout = 5 * time.Second
+	// DefaultSocketMode is the mode of the plugin sockets, only kubelet running as root needs access
+	DefaultSocketMode os.FileMode = 0600
+
+	// DefaultKeepaliveTime is the idle time after which the server pings kubelet
+	DefaultKeepaliveTime = 30 * time.Second
+	// DefaultKeepaliveTimeout is how long the server waits for the ping ack before closing the connection
+	DefaultKeepaliveTimeout = 10 * time.Second
+	// DefaultKeepaliveMinTime is the minimum interval kubelet may ping at
+	DefaultKeepaliveMinTime = 5 * time.Second
+	// DefaultMaxConcurrentStreams bounds the streams per kubelet connection
+	DefaultMaxConcurrentStreams = 16
 )
 
 type Device interface {
-	Start(stop <-chan struct{}) error
+	Start(ctx context.Context) error
 	ListAndWatch(*pluginapi.Empty, pluginapi.DevicePlugin_ListAndWatchServer) error
 	PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error)
 	GetPreferredAllocation(context.Context, *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error)
 	Allocate(context.Context, *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error)
 	GetDeviceName() string
+	// GetResourceName identifies the plugin in the controller, plugins of the same device,
+	// e.g. VLAN variants of a bridge, differ in their resource name.
+	GetResourceName() string
 	GetInitialized() bool
+	// GetSocketPath is the socket the plugin serves, GetKubeletSocket the one it registers with
+	GetSocketPath() string
+	GetKubeletSocket() string
+	// Healthy reports whether the device itself is healthy, HealthSummary counts the healthy devices
+	Healthy() bool
+	HealthSummary() (healthy, total int)
+	// CurrentHealth checks the health of the device right now, without waiting for the health check
+	CurrentHealth() (HealthReason, error)
+	// Stalled reports whether the health check stopped iterating
+	Stalled() bool
+	// Drain reports all devices unhealthy ahead of stopping the plugin
+	Drain()
+	// KeepRegistration makes the next stop leave the socket and registration behind for a restart
+	KeepRegistration()
 }
 
+// ErrKubeletRestarted is returned by Start when kubelet restarted and wiped the plugin's
+// registration, the plugin should be started again right away.
+var ErrKubeletRestarted = errors.New("kubelet restarted")
+
 type BridgeDevicePlugin struct {
-	devs         []*pluginapi.Device
+	devs []*pluginapi.Device
+	// deviceHealth is the health of every device as sent to kubelet
+	deviceHealth *deviceHealthState
+	// devIndex maps device IDs to their number
+	devIndex     map[string]int
 	server       *grpc.Server
 	socketPath   string
-	stop         <-chan struct{}
-	health       chan deviceHealth
-	deviceName   string
+	socketPrefix string
+	// registrationBackoff spaces out registration attempts while kubelet isn't up
+	registrationBackoff   Backoff
+	deregistrationTimeout time.Duration
+	gracefulStopTimeout   time.Duration
+	registrationMode      RegistrationMode
+	// pluginsRegistryDir is where the plugin watcher registration is served
+	pluginsRegistryDir string
+	// unaryInterceptors and streamInterceptors run after the logging interceptors
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+	// serverMetrics records the RPCs, it is nil unless enabled
+	serverMetrics   *ServerMetrics
+	devicePluginDir string
+	socketMode      os.FileMode
+	// socketUID and socketGID are the socket owner, -1 keeps the marker's
+	socketUID     int
+	socketGID     int
+	kubeletSocket string
+	// registrationServer serves the plugin watcher registration, guarded by lock
+	registrationServer   *grpc.Server
+	registrationListener *net.UnixListener
+	// legacySocketPath is where the socket lived with the default prefix, removed on start
+	// so changing the prefix doesn't leave a dead endpoint behind
+	legacySocketPath string
+	stop             <-chan struct{}
+	deviceName       string
+	variant          string
+	// baseName replaces the device name in the resource name when set
+	baseName     string
 	resourceName string
-	done         chan struct{}
-	initialized  bool
-	lock         *sync.Mutex
-	deregistered chan struct{}
+	// resourceNamespace is the domain the resource is advertised under
+	resourceNamespace string
+	done              chan struct{}
+	initialized       bool
+	lock              *sync.Mutex
+	deregistered      chan struct{}
+	// streamErrors carries ListAndWatch send failures that require a restart
+	streamErrors chan error
+	loopMonitor  *loopMonitor
+	listener     *net.UnixListener
+	// healthAccounting tracks the time spent per health reason
+	healthAccounting *healthAccounting
+	healthNotifier   HealthNotifier
+	// lastHealth is the last health reported by the health check, kept across restarts
+	lastHealth           string
+	duplicateAllocations atomic.Uint64
+	lastRegistration     *RegistrationInfo
+	// linkIndex is the ifindex of the monitored bridge, 0 while it doesn't exist
+	linkIndex int
+	// fastRestart reclaims sockets left behind by a previous run of the marker
+	fastRestart bool
+	// healthMode is the criterion for the bridge to be healthy
+	healthMode HealthMode
+	// keepalive, keepalivePolicy and maxConcurrentStreams configure the gRPC server
+	keepalive            keepalive.ServerParameters
+	keepalivePolicy      keepalive.EnforcementPolicy
+	maxConcurrentStreams uint32
+	// preStartCheck re-checks the bridge health before a container with its devices starts
+	preStartCheck bool
+	// numaTopology reports the NUMA nodes of the bridge's physical uplinks as device topology
+	numaTopology bool
+	// portCapacity reduces the advertised capacity by the ports the bridge already has
+	portCapacity bool
+	// minUpPorts makes the bridge unhealthy unless at least as many of its ports, or slaves of a bond, are up
+	minUpPorts int
+	// bridgeReason is the health reason of the bridge link itself and ports are the ports
+	// of the bridge, they are only used by the health check
+	bridgeReason HealthReason
+	ports        bridgePorts
+	// ovs is set when the bridge is an Open vSwitch bridge, whose ports aren't tracked
+	ovs bool
+	// vlan is set for VLAN sub-interfaces, whose health also follows the carrier of
+	// the parent link at parentIndex
+	vlan        bool
+	parentIndex int
+	parentUp    bool
+	// bridgeVLAN is the VLAN of the bridge the plugin exposes, 0 exposes the whole bridge
+	bridgeVLAN uint16
+	// healthDebounce is how long a health change must be stable before it is reported, 0 reports it right away
+	healthDebounce time.Duration
+	// debounceUnhealthy debounces changes to unhealthy as well, not only recoveries
+	debounceUnhealthy bool
+	// pendingReason and debounceTimer hold back a health change, they are only used by the health check
+	pendingReason HealthReason
+	debounceTimer Timer
+	// allocationEnvs tells containers the granted bridge and devices through environment variables
+	allocationEnvs bool
+	// allocationAnnotations annotates allocations with the bridge's MTU, MAC and ifindex
+	allocationAnnotations bool
+	// draining reports all devices unhealthy regardless of the bridge health
+	draining atomic.Bool
+	// keepRegistration leaves the socket and the kubelet registration in place on the next stop
+	keepRegistration bool
+	// links is where the bridge and its ports are looked up and followed
+	links LinkSource
+	// clock times the health debounce, the registration retries and the shutdown waits
+	clock Clock
 }
 
-func NewBridgeDevicePlugin(deviceName string, maxDevices int) *BridgeDevicePlugin {
-	serverSock := SocketPath(deviceName)
+func NewBridgeDevicePlugin(deviceName string, maxDevices int, opts ...PluginOption) (*BridgeDevicePlugin, error) {
 	dpi := &BridgeDevicePlugin{
-		devs:         []*pluginapi.Device{},
-		socketPath:   serverSock,
-		health:       make(chan deviceHealth),
-		deviceName:   deviceName,
-		resourceName: fmt.Sprintf("%s/%s", DeviceNamespace, deviceName),
-		initialized:  false,
-		lock:         &sync.Mutex{},
+		devs:                  []*pluginapi.Device{},
+		devIndex:              map[string]int{},
+		deviceName:            deviceName,
+		initialized:           false,
+		lock:                  &sync.Mutex{},
+		loopMonitor:           newLoopMonitor(deviceName+" health check", DefaultLoopStallThreshold),
+		healthAccounting:      newHealthAccounting(DefaultHealthHistorySize),
+		healthMode:            HealthModeOperUp,
+		resourceNamespace:     DeviceNamespace,
+		socketPrefix:          DefaultSocketPrefix,
+		registrationBackoff:   DefaultBackoff,
+		deregistrationTimeout: DefaultDeregistrationTimeout,
+		gracefulStopTimeout:   DefaultGracefulStopTimeout,
+		registrationMode:      RegistrationModeLegacy,
+		pluginsRegistryDir:    PluginsRegistryPath,
+		devicePluginDir:       DefaultDevicePluginDir,
+		socketMode:            DefaultSocketMode,
+		socketUID:             -1,
+		socketGID:             -1,
+		keepalive: keepalive.ServerParameters{
+			Time:    DefaultKeepaliveTime,
+			Timeout: DefaultKeepaliveTimeout,
+		},
+		keepalivePolicy: keepalive.EnforcementPolicy{
+			MinTime:             DefaultKeepaliveMinTime,
+			PermitWithoutStream: true,
+		},
+		maxConcurrentStreams: DefaultMaxConcurrentStreams,
+		ports:                bridgePorts{},
+		links:                defaultLinkSource,
+		clock:                defaultClock,
 	}
 
+	for _, opt := range opts {
+		opt(dpi)
+	}
+
+	// Variants and VLANs of the same bridge are told apart by suffixes of the base name
+	name := dpi.deviceName
+	if dpi.baseName != "" {
+		name = dpi.baseName
+	}
+	if dpi.vlan {
+		name = vlanResourceName(name)
+	}
+	if dpi.variant != "" {
+		name = fmt.Sprintf("%s-%s", name, dpi.variant)
+	}
+	if dpi.bridgeVLAN != 0 {
+		name = bridgeVLANResourceName(name, dpi.bridgeVLAN)
+	}
+	if err := ValidateResourceNamespace(dpi.resourceNamespace); err != nil {
+		return nil, err
+	}
+	if sanitized, changed := sanitizeResourceName(name); changed {
+		log.DefaultLogger().Warningf("%s is not a valid resource name, exposing bridge %s as %s/%s", name, dpi.deviceName, dpi.resourceNamespace, sanitized)
+		name = sanitized
+	}
+	// Markers with different namespaces on the same node must not share sockets,
+	// the default namespace keeps the plain socket name
+	endpoint := name
+	if dpi.resourceNamespace != DeviceNamespace {
+		endpoint = dpi.resourceNamespace + "-" + name
+	}
+	if err := ValidateSocketPrefix(dpi.socketPrefix); err != nil {
+		return nil, err
+	}
+	dpi.socketPath = prefixedSocketPath(dpi.devicePluginDir, dpi.socketPrefix, endpoint)
+	if err := ValidateSocketPath(dpi.socketPath); err != nil {
+		return nil, err
+	}
+	if dpi.socketPrefix != DefaultSocketPrefix {
+		dpi.legacySocketPath = prefixedSocketPath(dpi.devicePluginDir, DefaultSocketPrefix, endpoint)
+	}
+	// kubelet serves its socket in the device plugin directory unless told otherwise
+	if dpi.kubeletSocket == "" {
+		dpi.kubeletSocket = filepath.Join(dpi.devicePluginDir, filepath.Base(pluginapi.KubeletSocket))
+	}
+	dpi.resourceName = fmt.Sprintf("%s/%s", dpi.resourceNamespace, name)
+	// Variants of a bridge run health checks of their own
+	dpi.loopMonitor.label = dpi.resourceName
+
 	for i := 0; i < maxDevices; i++ {
-		deviceId := dpi.deviceName + strconv.Itoa(i)
+		deviceId := name + strconv.Itoa(i)
 		dpi.devs = append(dpi.devs, &pluginapi.Device{
 			ID:     deviceId,
 			Health: pluginapi.Healthy,
 		})
+		dpi.devIndex[deviceId] = i
 	}
+	dpi.deviceHealth = newDeviceHealthState(dpi.devs)
+	dpi.deviceHealth.portCapacity = dpi.portCapacity
 
-	return dpi
+	return dpi, nil
 }
 
 func (dpi *BridgeDevicePlugin) GetDeviceName() string {
 	return dpi.deviceName
 }
 
-// Start starts the device plugin
-func (dpi *BridgeDevicePlugin) Start(stop <-chan struct{}) (err error) {
+func (dpi *BridgeDevicePlugin) GetResourceName() string {
+	return dpi.resourceName
+}
+
+func (dpi *BridgeDevicePlugin) GetSocketPath() string {
+	return dpi.socketPath
+}
+
+func (dpi *BridgeDevicePlugin) GetKubeletSocket() string {
+	return dpi.kubeletSocket
+}
+
+func (dpi *BridgeDevicePlugin) GetBridgeVLAN() uint16 {
+	return dpi.bridgeVLAN
+}
+
+// Devices returns a copy of the devices as currently advertised to kubelet.
+func (dpi *BridgeDevicePlugin) Devices() []*pluginapi.Device {
+	devs := dpi.deviceHealth.devices()
+	for _, dev := range devs {
+		if dev.Topology != nil {
+			topology := &pluginapi.TopologyInfo{}
+			for _, node := range dev.Topology.Nodes {
+				topology.Nodes = append(topology.Nodes, &pluginapi.NUMANode{ID: node.ID})
+			}
+			dev.Topology = topology
+		}
+	}
+	return devs
+}
+
+// Healthy reports whether the bridge is healthy, regardless of devices held back for capacity.
+func (dpi *BridgeDevicePlugin) Healthy() bool {
+	return dpi.deviceHealth.anyHealthy()
+}
+
+// HealthSummary returns the number of healthy devices and the total number of devices.
+func (dpi *BridgeDevicePlugin) HealthSummary() (healthy, total int) {
+	return dpi.deviceHealth.counts()
+}
+
+// Start starts the device plugin and serves it until ctx is cancelled or the plugin fails
+func (dpi *BridgeDevicePlugin) Start(ctx context.Context) (err error) {
 	logger := log.DefaultLogger()
-	dpi.stop = stop
+	// The plugin's own stop also ends the other goroutine when Serve or healthCheck fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dpi.stop = ctx.Done()
 	dpi.done = make(chan struct{})
 	dpi.deregistered = make(chan struct{})
 
+	if err := checkSocketDir(filepath.Dir(dpi.socketPath)); err != nil {
+		return err
+	}
+	if dpi.fastRestart {
+		err = dpi.checkStaleSocket(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	release, err := acquireStartSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	err = dpi.cleanup()
 	if err != nil {
 		return err
 	}
+	dpi.removeLegacySocket(ctx)
 
-	sock, err := net.Listen("unix", dpi.socketPath)
+	sock, err := listenUnix(dpi.socketPath)
 	if err != nil {
 		return fmt.Errorf("error creating GRPC server socket: %v", err)
 	}
+	dpi.listener = sock
+	if err := dpi.secureSocket(); err != nil {
+		sock.Close()
+		return err
+	}
 
-	dpi.server = grpc.NewServer([]grpc.ServerOption{}...)
-	defer dpi.stopDevicePlugin()
-
+	dpi.server = grpc.NewServer(dpi.serverOptions()...)
 	pluginapi.RegisterDevicePluginServer(dpi.server, dpi)
 
+	var wg sync.WaitGroup
 	errChan := make(chan error, 2)
+	dpi.streamErrors = make(chan error, 1)
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		errChan <- dpi.server.Serve(sock)
 	}()
+	// Wait for Serve and healthCheck to exit, so nothing of this start survives into the next
+	// one, and report all their errors
+	defer func() {
+		cancel()
+		dpi.stopDevicePlugin()
+		wg.Wait()
+		close(errChan)
+		errs := []error{err}
+		for goroutineErr := range errChan {
+			errs = append(errs, goroutineErr)
+		}
+		err = errors.Join(errs...)
+	}()
 
-	err = waitForGRPCServer(dpi.socketPath, connectionTimeout)
+	err = waitForGRPCServer(ctx, dpi.socketPath, connectionTimeout)
 	if err != nil {
 		return fmt.Errorf("error starting the GRPC server: %v", err)
 	}
 
-	err = dpi.register()
+	err = dpi.registerWithKubelet(ctx, release, errChan)
 	if err != nil {
-		return fmt.Errorf("error registering with device plugin manager: %v", err)
+		return fmt.Errorf("error registering with device plugin manager: %w", err)
+	}
+	if IsChanClosed(dpi.stop) {
+		return nil
 	}
 
+	release()
+
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		errChan <- dpi.healthCheck()
 	}()
 
 	dpi.setInitialized(true)
 	logger.Infof("%s device plugin started", dpi.deviceName)
-	err = <-errChan
+	select {
+	case err = <-errChan:
+	case err = <-dpi.streamErrors:
+	}
 
 	return err
 }
 
+// serverOptions detect half-dead kubelet connections, so stale ListAndWatch streams don't linger.
+func (dpi *BridgeDevicePlugin) serverOptions() []grpc.ServerOption {
+	unary := []grpc.UnaryServerInterceptor{dpi.logUnary}
+	stream := []grpc.StreamServerInterceptor{dpi.logStream}
+	if dpi.serverMetrics != nil {
+		unary = append(unary, dpi.serverMetrics.unaryInterceptor(dpi.resourceName))
+		stream = append(stream, dpi.serverMetrics.streamInterceptor(dpi.resourceName))
+	}
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(dpi.keepalive),
+		grpc.KeepaliveEnforcementPolicy(dpi.keepalivePolicy),
+		grpc.MaxConcurrentStreams(dpi.maxConcurrentStreams),
+		grpc.ChainUnaryInterceptor(append(unary, dpi.unaryInterceptors...)...),
+		grpc.ChainStreamInterceptor(append(stream, dpi.streamInterceptors...)...),
+	}
+}
+
 // Stop stops the gRPC server
 func (dpi *BridgeDevicePlugin) stopDevicePlugin() error {
 	defer func() {
@@ -133,53 +459,240 @@ func (dpi *BridgeDevicePlugin) stopDevicePlugin() error {
 		}
 	}()
 
-	// Give the device plugin one second to properly deregister
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-	select {
-	case <-dpi.deregistered:
-	case <-ticker.C:
+	if dpi.shouldKeepRegistration() {
+		// Leave the socket file behind so a restarted marker can take it over
+		dpi.listener.SetUnlinkOnClose(false)
+		dpi.stopServer()
+		dpi.stopRegistration()
+		dpi.setInitialized(false)
+		return nil
 	}
-	dpi.server.Stop()
+
+	// Keep serving until ListAndWatch has sent the empty device list, so the final Send
+	// doesn't race with stopping the server
+	if dpi.GetInitialized() {
+		timer := dpi.clock.NewTimer(dpi.deregistrationTimeout)
+		defer timer.Stop()
+		select {
+		case <-dpi.deregistered:
+			log.DefaultLogger().Infof("%s device plugin deregistered", dpi.deviceName)
+		case <-timer.C():
+			log.DefaultLogger().Warningf("%s device plugin didn't deregister within %v, kubelet may keep stale capacity", dpi.deviceName, dpi.deregistrationTimeout)
+		}
+	}
+	dpi.stopServer()
+	dpi.stopRegistration()
 	dpi.setInitialized(false)
 	return dpi.cleanup()
 }
 
+// stopServer lets in-flight RPCs, e.g. an Allocate for a pod being admitted, finish before the
+// server stops, and falls back to closing them after the graceful stop timeout.
+// ListAndWatch returns once the plugin is stopped, so it doesn't hold the graceful stop up.
+func (dpi *BridgeDevicePlugin) stopServer() {
+	stopped := make(chan struct{})
+	go func() {
+		dpi.server.GracefulStop()
+		close(stopped)
+	}()
+
+	timer := dpi.clock.NewTimer(dpi.gracefulStopTimeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C():
+		log.DefaultLogger().Warningf("%s device plugin server didn't stop gracefully within %v, closing open RPCs", dpi.deviceName, dpi.gracefulStopTimeout)
+		dpi.server.Stop()
+		<-stopped
+	}
+}
+
+// checkStaleSocket makes sure an existing socket at our path isn't served by another process before it is reclaimed.
+func (dpi *BridgeDevicePlugin) checkStaleSocket(ctx context.Context) error {
+	if _, err := os.Stat(dpi.socketPath); err != nil {
+		return nil
+	}
+	if err := waitForGRPCServer(ctx, dpi.socketPath, staleSocketProbeTimeout); err == nil {
+		return fmt.Errorf("socket %s is served by another process, refusing to take it over", dpi.socketPath)
+	}
+	log.DefaultLogger().Infof("reclaiming socket %s left behind by a previous run", dpi.socketPath)
+	return nil
+}
+
+// removeLegacySocket removes the socket left behind under the default prefix, unless it is live,
+// e.g. because it belongs to a KubeVirt device plugin of the same name.
+func (dpi *BridgeDevicePlugin) removeLegacySocket(ctx context.Context) {
+	if dpi.legacySocketPath == "" {
+		return
+	}
+	if _, err := os.Stat(dpi.legacySocketPath); err != nil {
+		return
+	}
+	if err := waitForGRPCServer(ctx, dpi.legacySocketPath, staleSocketProbeTimeout); err == nil {
+		return
+	}
+	log.DefaultLogger().Infof("removing socket %s left behind with the previous socket prefix", dpi.legacySocketPath)
+	if err := removeSocket(dpi.legacySocketPath); err != nil {
+		log.DefaultLogger().Reason(err).Warningf("failed to remove socket %s", dpi.legacySocketPath)
+	}
+}
+
+// KeepRegistration makes the next stop skip deregistration and leave the socket in place,
+// so a quickly restarted marker can re-register without kubelet dropping the resource.
+func (dpi *BridgeDevicePlugin) KeepRegistration() {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	dpi.keepRegistration = true
+}
+
+func (dpi *BridgeDevicePlugin) shouldKeepRegistration() bool {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	return dpi.keepRegistration
+}
+
 // Register registers the device plugin for the given resourceName with Kubelet.
-func (dpi *BridgeDevicePlugin) register() error {
-	conn, err := gRPCConnect(pluginapi.KubeletSocket, connectionTimeout)
+func (dpi *BridgeDevicePlugin) register(ctx context.Context) error {
+	conn, err := gRPCConnect(ctx, dpi.kubeletSocket, connectionTimeout)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
 	client := pluginapi.NewRegistrationClient(conn)
-	reqt := &pluginapi.RegisterRequest{
+	reqt := dpi.registerRequest()
+
+	ctx, cancel := context.WithTimeout(ctx, connectionTimeout)
+	defer cancel()
+	_, err = client.Register(ctx, reqt)
+	dpi.recordRegistration(reqt, err)
+	if err != nil {
+		return fmt.Errorf("register request (version %s, endpoint %s, resource %s) failed: %v",
+			reqt.Version, reqt.Endpoint, reqt.ResourceName, err)
+	}
+	return nil
+}
+
+func (dpi *BridgeDevicePlugin) registerRequest() *pluginapi.RegisterRequest {
+	return &pluginapi.RegisterRequest{
 		Version:      pluginapi.Version,
 		Endpoint:     path.Base(dpi.socketPath),
 		ResourceName: dpi.resourceName,
+		Options:      dpi.devicePluginOptions(),
+	}
+}
+
+// registerWithRetry keeps the server up and retries the registration until it succeeds, the
+// server fails or the plugin is stopped, e.g. while kubelet isn't up yet after a node reboot.
+func (dpi *BridgeDevicePlugin) registerWithRetry(ctx context.Context, release func(), serveErr <-chan error) error {
+	logger := log.DefaultLogger()
+	var lastLogged time.Time
+	for failures := 0; ; failures++ {
+		err := dpi.register(ctx)
+		if err == nil {
+			return nil
+		}
+		registrationFailuresMetric.Inc(dpi.deviceName)
+		// Don't hold back other plugins while kubelet is away
+		release()
+		if kubeletVersions, mismatch := versionMismatch(err); mismatch {
+			return dpi.unsupportedVersion(kubeletVersions, err)
+		}
+		if dpi.clock.Now().Sub(lastLogged) >= registrationLogInterval {
+			logger.Reason(err).Warningf("registering the %s device plugin with kubelet failed, retrying", dpi.deviceName)
+			lastLogged = dpi.clock.Now()
+		}
+
+		select {
+		case <-dpi.stop:
+			return nil
+		case err := <-serveErr:
+			return fmt.Errorf("the GRPC server failed while registering: %v", err)
+		case <-dpi.clock.After(dpi.registrationBackoff.Duration(failures)):
+		}
 	}
+}
+
+// RegistrationInfo is the last registration request sent to kubelet and its outcome.
+type RegistrationInfo struct {
+	Version      string
+	Endpoint     string
+	ResourceName string
+	Options      pluginapi.DevicePluginOptions
+	Time         time.Time
+	Succeeded    bool
+	Error        string
+}
 
-	_, err = client.Register(context.Background(), reqt)
+func (dpi *BridgeDevicePlugin) recordRegistration(reqt *pluginapi.RegisterRequest, err error) {
+	info := RegistrationInfo{
+		Version:      reqt.Version,
+		Endpoint:     reqt.Endpoint,
+		ResourceName: reqt.ResourceName,
+		Time:         dpi.clock.Now(),
+		Succeeded:    err == nil,
+	}
+	if reqt.Options != nil {
+		info.Options = pluginapi.DevicePluginOptions{
+			PreStartRequired:                reqt.Options.PreStartRequired,
+			GetPreferredAllocationAvailable: reqt.Options.GetPreferredAllocationAvailable,
+		}
+	}
 	if err != nil {
-		return err
+		info.Error = err.Error()
 	}
-	return nil
+
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	dpi.lastRegistration = &info
+}
+
+// LastRegistration returns the last registration request sent to kubelet, if any.
+func (dpi *BridgeDevicePlugin) LastRegistration() (RegistrationInfo, bool) {
+	dpi.lock.Lock()
+	defer dpi.lock.Unlock()
+	if dpi.lastRegistration == nil {
+		return RegistrationInfo{}, false
+	}
+	return *dpi.lastRegistration, true
 }
 
 func (dpi *BridgeDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
+	// A broken stream fails the call so kubelet reconnects, rather than never receiving devices
+	// A new stream always gets the full list, later lists are only sent when they differ
+	// Subscribe before taking the list, so no change after it goes unnoticed
+	changed, unsubscribe := dpi.deviceHealth.subscribe()
+	defer unsubscribe()
+	dpi.recordDeviceMetrics()
+	sent := dpi.deviceHealth.devices()
+	if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: sent}); err != nil {
+		return fmt.Errorf("failed to send the %s device list: %v", dpi.resourceName, err)
+	}
 
 	done := false
 	for {
 		select {
-		case devHealth := <-dpi.health:
-			// There's only one shared bridge device
-			// so update each plugin device to reflect overall device health
-			for _, dev := range dpi.devs {
-				dev.Health = devHealth.Health
+		case <-changed:
+			dpi.recordDeviceMetrics()
+			devices := dpi.deviceHealth.devices()
+			if sameDevices(devices, sent) {
+				log.DefaultLogger().V(4).Infof("%s device list is unchanged, not sending it", dpi.resourceName)
+				continue
 			}
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: dpi.devs})
+			sent = devices
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
+				err = fmt.Errorf("failed to send the %s device list update: %v", dpi.resourceName, err)
+				// kubelet would keep stale health, restart the plugin to get a fresh stream
+				select {
+				case dpi.streamErrors <- err:
+				default:
+				}
+				return err
+			}
+		case <-s.Context().Done():
+			// kubelet dropped the stream, e.g. for a newer one, the plugin keeps serving
+			log.DefaultLogger().V(4).Infof("%s ListAndWatch stream ended: %v", dpi.resourceName, s.Context().Err())
+			return s.Context().Err()
 		case <-dpi.stop:
 			done = true
 		case <-dpi.done:
@@ -189,6 +702,11 @@ func (dpi *BridgeDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.Devi
 			break
 		}
 	}
+	if dpi.shouldKeepRegistration() {
+		close(dpi.deregistered)
+		return nil
+	}
+
 	// Send empty list to increase the chance that the kubelet acts fast on stopped device plugins
 	// There exists no explicit way to deregister devices
 	emptyList := []*pluginapi.Device{}
@@ -203,118 +721,556 @@ func (dpi *BridgeDevicePlugin) Allocate(ctx context.Context, r *pluginapi.Alloca
 	log.DefaultLogger().Infof("Bridge Allocate: resourceName: %s", dpi.deviceName)
 	log.DefaultLogger().Infof("Bridge Allocate: request: %v", r.ContainerRequests)
 
-	res := pluginapi.AllocateResponse{}
-	containerResponse := new(pluginapi.ContainerAllocateResponse)
+	if IsChanClosed(dpi.stop) {
+		return nil, status.Errorf(codes.Unavailable, "device plugin for %s is shutting down", dpi.resourceName)
+	}
+
+	if duplicates := duplicateDeviceIDs(r.ContainerRequests); len(duplicates) > 0 {
+		dpi.duplicateAllocations.Add(1)
+		duplicateAllocationsMetric.Inc(dpi.deviceName, dpi.resourceName)
+		log.DefaultLogger().Errorf("Bridge Allocate: %s requested devices %v more than once", dpi.resourceName, duplicates)
+		return nil, status.Errorf(codes.InvalidArgument,
+			"devices %s of %s were requested more than once, kubelet's device checkpoint %s is probably corrupted and should be removed before restarting kubelet",
+			strings.Join(duplicates, ", "), dpi.resourceName, filepath.Join(dpi.devicePluginDir, kubeletCheckpointFile))
+	}
+
+	// kubelet may still hold devices of a previous configuration in its checkpoint
+	if unknown := dpi.unknownDeviceIDs(r.ContainerRequests); len(unknown) > 0 {
+		log.DefaultLogger().Errorf("Bridge Allocate: %s requested devices %v that it doesn't advertise", dpi.resourceName, unknown)
+		return nil, status.Errorf(codes.InvalidArgument, "devices %s are not advertised by %s",
+			strings.Join(unknown, ", "), dpi.resourceName)
+	}
 
-	// No DeviceSpec needed if no device mounts are required
-	res.ContainerResponses = []*pluginapi.ContainerAllocateResponse{containerResponse}
+	// kubelet's view of the health can lag behind, so unhealthy devices are still allocated
+	for _, request := range r.ContainerRequests {
+		if unhealthy := dpi.deviceHealth.unhealthy(request.DevicesIDs); len(unhealthy) > 0 {
+			log.DefaultLogger().Warningf("Bridge Allocate: %s allocates devices %v that are unhealthy", dpi.resourceName, unhealthy)
+		}
+	}
+
+	if dpi.portCapacity {
+		for _, request := range r.ContainerRequests {
+			dpi.deviceHealth.markAllocated(request.DevicesIDs)
+		}
+	}
 
+	var annotations map[string]string
+	if dpi.allocationAnnotations {
+		annotations = dpi.bridgeAnnotations()
+	}
+	// kubelet expects a response for every container request, in the same order. No DeviceSpec
+	// is needed as no device mounts are required.
+	res := pluginapi.AllocateResponse{
+		ContainerResponses: make([]*pluginapi.ContainerAllocateResponse, 0, len(r.ContainerRequests)),
+	}
+	for _, request := range r.ContainerRequests {
+		containerResponse := &pluginapi.ContainerAllocateResponse{
+			Annotations: maps.Clone(annotations),
+		}
+		if dpi.allocationEnvs {
+			containerResponse.Envs = dpi.allocationEnv(request.DevicesIDs)
+		}
+		res.ContainerResponses = append(res.ContainerResponses, containerResponse)
+	}
 	return &res, nil
 }
 
-func (dpi *BridgeDevicePlugin) cleanup() error {
-	if err := os.Remove(dpi.socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return err
+// bridgeAnnotations describes the bridge for CNI plugins and scripts in the pod,
+// it returns nil when the bridge can't be looked up.
+func (dpi *BridgeDevicePlugin) bridgeAnnotations() map[string]string {
+	link, err := dpi.links.LinkByName(dpi.deviceName)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Warningf("Bridge Allocate: could not look up bridge %s, omitting its annotations", dpi.deviceName)
+		return nil
 	}
+	attrs := link.Attrs()
+	return map[string]string{
+		dpi.resourceNamespace + "/mtu":     strconv.Itoa(attrs.MTU),
+		dpi.resourceNamespace + "/mac":     attrs.HardwareAddr.String(),
+		dpi.resourceNamespace + "/ifindex": strconv.Itoa(attrs.Index),
+	}
+}
+
+// allocationEnv tells the container which bridge it was granted, e.g. for bridge.network.kubevirt.io/br-storage:
+//
+//	BRIDGE_NETWORK_KUBEVIRT_IO_BR_STORAGE=br-storage
+//	BRIDGE_NETWORK_KUBEVIRT_IO_BR_STORAGE_DEVICE_IDS=br-storage3,br-storage7
+func (dpi *BridgeDevicePlugin) allocationEnv(deviceIDs []string) map[string]string {
+	name := envVarName(dpi.resourceName)
+	return map[string]string{
+		name:                 dpi.deviceName,
+		name + "_DEVICE_IDS": strings.Join(deviceIDs, ","),
+	}
+}
+
+// envVarName derives a valid environment variable name, characters other than letters,
+// digits and underscores are replaced by underscores.
+func envVarName(name string) string {
+	ret := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	if ret != "" && ret[0] >= '0' && ret[0] <= '9' {
+		ret = "_" + ret
+	}
+	return ret
+}
+
+// duplicateDeviceIDs returns the device IDs that appear more than once within or across container requests.
+func duplicateDeviceIDs(requests []*pluginapi.ContainerAllocateRequest) []string {
+	seen := map[string]bool{}
+	var duplicates []string
+	for _, request := range requests {
+		for _, id := range request.DevicesIDs {
+			if seen[id] && !slices.Contains(duplicates, id) {
+				duplicates = append(duplicates, id)
+			}
+			seen[id] = true
+		}
+	}
+	return duplicates
+}
+
+// unknownDeviceIDs returns the requested device IDs the plugin doesn't advertise.
+func (dpi *BridgeDevicePlugin) unknownDeviceIDs(requests []*pluginapi.ContainerAllocateRequest) []string {
+	var unknown []string
+	for _, request := range requests {
+		for _, id := range request.DevicesIDs {
+			if _, known := dpi.devIndex[id]; !known && !slices.Contains(unknown, id) {
+				unknown = append(unknown, id)
+			}
+		}
+	}
+	return unknown
+}
 
+// DuplicateAllocations returns the number of Allocate calls rejected for requesting a device more than once.
+func (dpi *BridgeDevicePlugin) DuplicateAllocations() uint64 {
+	return dpi.duplicateAllocations.Load()
+}
+
+func (dpi *BridgeDevicePlugin) cleanup() error {
+	// The directory is shared with other plugins, don't remove what isn't a socket
+	return removeSocket(dpi.socketPath)
+}
+
+// secureSocket applies the configured permissions and ownership to the plugin socket.
+func (dpi *BridgeDevicePlugin) secureSocket() error {
+	if err := os.Chmod(dpi.socketPath, dpi.socketMode); err != nil {
+		return fmt.Errorf("failed to set the mode of socket %s to %v: %v", dpi.socketPath, dpi.socketMode, err)
+	}
+	if dpi.socketUID >= 0 || dpi.socketGID >= 0 {
+		if err := os.Chown(dpi.socketPath, dpi.socketUID, dpi.socketGID); err != nil {
+			return fmt.Errorf("failed to change the owner of socket %s to %d:%d: %v", dpi.socketPath, dpi.socketUID, dpi.socketGID, err)
+		}
+	}
 	return nil
 }
 
 func (dpi *BridgeDevicePlugin) GetDevicePluginOptions(_ context.Context, _ *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	options := &pluginapi.DevicePluginOptions{
-		PreStartRequired:                false,
-		GetPreferredAllocationAvailable: false,
+	return dpi.devicePluginOptions(), nil
+}
+
+func (dpi *BridgeDevicePlugin) devicePluginOptions() *pluginapi.DevicePluginOptions {
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                dpi.preStartCheck,
+		GetPreferredAllocationAvailable: true,
 	}
-	return options, nil
 }
 
-func (dpi *BridgeDevicePlugin) PreStartContainer(_ context.Context, _ *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+// PreStartContainer fails the container when the pre-start check is enabled and the bridge
+// is gone or unhealthy, so the pod doesn't start with a dead network.
+func (dpi *BridgeDevicePlugin) PreStartContainer(_ context.Context, r *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
 	res := &pluginapi.PreStartContainerResponse{}
+	if !dpi.preStartCheck {
+		return res, nil
+	}
+
+	reason, err := dpi.currentHealthReason()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not check bridge %s backing %s: %v", dpi.deviceName, dpi.resourceName, err)
+	}
+	if reason != HealthReasonUp {
+		log.DefaultLogger().Warningf("Bridge PreStartContainer: rejecting devices %v, bridge %s is %s", r.DevicesIDs, dpi.deviceName, reason)
+		return nil, status.Errorf(codes.FailedPrecondition, "bridge %s backing %s is unhealthy: %s", dpi.deviceName, dpi.resourceName, reason)
+	}
 	return res, nil
 }
 
-func (dpi *BridgeDevicePlugin) GetPreferredAllocation(ctx context.Context, _ *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+// CurrentHealth evaluates the health of the bridge right away, without a running health check.
+func (dpi *BridgeDevicePlugin) CurrentHealth() (HealthReason, error) {
+	return dpi.currentHealthReason()
+}
+
+// currentHealthReason looks the bridge up instead of relying on the health check state.
+func (dpi *BridgeDevicePlugin) currentHealthReason() (HealthReason, error) {
+	link, err := dpi.links.LinkByName(dpi.deviceName)
+	if err != nil {
+		if isLinkNotFound(err) {
+			return HealthReasonMissing, nil
+		}
+		return "", err
+	}
+	reason := linkHealthReason(link, dpi.healthMode)
+	if reason == HealthReasonUp && dpi.vlan {
+		parent, err := dpi.links.LinkByIndex(link.Attrs().ParentIndex)
+		if err != nil || !portUp(parent.Attrs()) {
+			return HealthReasonNoCarrier, nil
+		}
+	}
+	if reason != HealthReasonUp || dpi.minUpPorts == 0 || isOVSBridge(link) || dpi.vlan {
+		return reason, nil
+	}
+
+	links, err := dpi.links.LinkList()
+	if err != nil {
+		return "", err
+	}
+	up := 0
+	for _, port := range links {
+		if attrs := port.Attrs(); attrs.MasterIndex == link.Attrs().Index && portUp(attrs) {
+			up++
+		}
+	}
+	if up < dpi.minUpPorts {
+		return HealthReasonNoPortUp, nil
+	}
+	return HealthReasonUp, nil
+}
+
+// GetPreferredAllocation prefers the lowest-numbered available devices, always including the
+// devices kubelet requires.
+func (dpi *BridgeDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
 	res := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range r.ContainerRequests {
+		if dpi.portCapacity {
+			// Devices kubelet offers are no longer allocated
+			dpi.deviceHealth.markAvailable(req.AvailableDeviceIDs)
+		}
+		res.ContainerResponses = append(res.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: dpi.preferredDevices(req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize)),
+		})
+	}
 	return res, nil
 }
 
-// TODO: Currently we create a new netlink watcher for every dpi,
-// This is redundant, a proper message queue solution should be examined.
+// preferredDevices returns the must-include devices topped up with the lowest-numbered
+// available ones, up to size devices.
+func (dpi *BridgeDevicePlugin) preferredDevices(available, mustInclude []string, size int) []string {
+	ret := make([]string, 0, size)
+	chosen := map[string]bool{}
+	for _, id := range mustInclude {
+		if len(ret) == size {
+			break
+		}
+		if !chosen[id] {
+			chosen[id] = true
+			ret = append(ret, id)
+		}
+	}
+
+	candidates := make([]string, 0, len(available))
+	for _, id := range available {
+		if _, known := dpi.devIndex[id]; known && !chosen[id] {
+			candidates = append(candidates, id)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return dpi.devIndex[candidates[i]] < dpi.devIndex[candidates[j]]
+	})
+	for _, id := range candidates {
+		if len(ret) == size {
+			break
+		}
+		chosen[id] = true
+		ret = append(ret, id)
+	}
+	return ret
+}
+
+// healthCheck follows the bridge through the shared link subscription and the device plugin
+// directory watcher until the plugin stops or kubelet restarts.
 func (dpi *BridgeDevicePlugin) healthCheck() error {
 	logger := log.DefaultLogger()
-	// Open a netlink handle
-	nlHandle, err := netlink.NewHandle()
-	if err != nil {
-		return fmt.Errorf("failed to create netlink handle: %v", err)
+	// A replaced network namespace restarts the plugin in the new one
+	netnsGeneration := currentNetnsGeneration()
+	if err := checkNetns(netnsGeneration); err != nil {
+		return err
 	}
-	defer nlHandle.Delete()
 
-	// Subscribe to link updates
-	updates := make(chan netlink.LinkUpdate)
-	if err := netlink.LinkSubscribe(updates, dpi.stop); err != nil {
+	// Subscribe to link updates before the initial check, so a change in between arrives as an
+	// update. Updates repeating the checked state are no-ops.
+	updates := make(chan netlink.LinkUpdate, linkUpdateBuffer)
+	if err := dpi.links.Subscribe(updates, dpi.stop); err != nil {
 		return fmt.Errorf("failed to subscribe to link updates: %v", err)
 	}
 
-	// Set up fsnotify for the socket file
-	watcher, err := fsnotify.NewWatcher()
+	// Watch the socket file through the watcher shared by all plugins
+	socketRemoved, err := socketWatcher.watch(dpi.socketPath, fsnotify.Remove)
 	if err != nil {
-		return fmt.Errorf("failed to create fsnotify watcher: %v", err)
+		return fmt.Errorf("failed to watch the device-plugin socket: %v", err)
 	}
-	defer watcher.Close()
-
-	socketDir := filepath.Dir(dpi.socketPath)
-	if err := watcher.Add(socketDir); err != nil {
-		return fmt.Errorf("failed to add socket directory to watcher: %v", err)
+	defer socketRemoved.Close()
+	// A recreated kubelet socket means kubelet restarted, possibly without removing our socket
+	kubeletCreated, err := socketWatcher.watch(dpi.kubeletSocket, fsnotify.Create)
+	if err != nil {
+		return fmt.Errorf("failed to watch the kubelet socket: %v", err)
 	}
+	defer kubeletCreated.Close()
 
-	_, err = os.Stat(dpi.socketPath)
 	if _, err := os.Stat(dpi.socketPath); err != nil {
 		return fmt.Errorf("failed to stat the device-plugin socket: %v", err)
 	}
 
+	defer func() {
+		dpi.healthAccounting.stop(dpi.clock.Now())
+		dpi.recordHealthReasonMetrics()
+	}()
+	defer dpi.stopDebounce()
+
 	// Initial bridge check
-	link, err := netlink.LinkByName(dpi.deviceName)
-	if err != nil {
-		if _, ok := err.(netlink.LinkNotFoundError); ok {
-			logger.Warningf("bridge '%s' is not present, the device plugin can't expose it: %v", dpi.deviceName, err)
-			dpi.health <- deviceHealth{Health: pluginapi.Unhealthy}
-		} else {
-			return fmt.Errorf("could not check the bridge: %v", err)
-		}
-	} else {
-		logger.Infof("bridge '%s' is present.", dpi.deviceName)
-		if link.Attrs().OperState == netlink.OperUp {
-			logger.Infof("monitored bridge %s is up", dpi.deviceName)
-			dpi.health <- deviceHealth{Health: pluginapi.Healthy}
-		} else {
-			logger.Infof("monitored bridge %s is down", dpi.deviceName)
-			dpi.health <- deviceHealth{Health: pluginapi.Unhealthy}
-		}
+	dpi.linkIndex = 0
+	if err := dpi.checkLink(); err != nil {
+		return err
 	}
 
+	heartbeat := dpi.clock.NewTicker(loopHeartbeatInterval)
+	defer heartbeat.Stop()
+	defer dpi.loopMonitor.Reset()
+
 	for {
+		dpi.loopMonitor.Beat()
 		select {
 		case <-dpi.stop:
 			return nil
-		case update := <-updates:
-			if update.Attrs().Name == dpi.deviceName {
-				if update.Link.Attrs().OperState == netlink.OperUp {
-					logger.Infof("monitored bridge %s is up", dpi.deviceName)
-					dpi.health <- deviceHealth{Health: pluginapi.Healthy}
-				} else {
-					logger.Infof("monitored bridge %s is down", dpi.deviceName)
-					dpi.health <- deviceHealth{Health: pluginapi.Unhealthy}
-				}
+		case <-heartbeat.C():
+			if err := checkNetns(netnsGeneration); err != nil {
+				return err
 			}
-		case event := <-watcher.Events:
-			if event.Name == dpi.socketPath && event.Op&fsnotify.Remove == fsnotify.Remove {
-				logger.Infof("device socket file for device %s was removed, kubelet probably restarted.", dpi.deviceName)
-				return nil
+			dpi.recordHealthReasonMetrics()
+		case <-dpi.debounced():
+			dpi.debounceTimer = nil
+			dpi.reportHealth(dpi.pendingReason)
+		case update, ok := <-updates:
+			if !ok {
+				if IsChanClosed(dpi.stop) {
+					return nil
+				}
+				updates = make(chan netlink.LinkUpdate, linkUpdateBuffer)
+				if err := dpi.links.Subscribe(updates, dpi.stop); err != nil {
+					return fmt.Errorf("failed to resubscribe to link updates: %v", err)
+				}
+				// Updates may have been missed in between
+				if err := dpi.checkLink(); err != nil {
+					return err
+				}
+				continue
 			}
-		case err := <-watcher.Errors:
-			logger.Errorf("Error watching socket file: %v", err)
+			dpi.handleLinkUpdate(update)
+		case <-socketRemoved.Events():
+			logger.Infof("device socket file for device %s was removed, kubelet probably restarted.", dpi.deviceName)
+			return ErrKubeletRestarted
+		case <-kubeletCreated.Events():
+			logger.Infof("kubelet socket was recreated, re-registering device %s.", dpi.deviceName)
+			return ErrKubeletRestarted
+		}
+	}
+}
+
+// checkLink looks the bridge up by name and reports its health.
+func (dpi *BridgeDevicePlugin) checkLink() error {
+	logger := log.DefaultLogger()
+	link, err := dpi.links.LinkByName(dpi.deviceName)
+	if err != nil {
+		if isLinkNotFound(err) {
+			logger.Warningf("bridge '%s' is not present, the device plugin can't expose it: %v", dpi.deviceName, err)
+			dpi.linkIndex = 0
+			dpi.observeHealth(dpi.healthReason())
+			return nil
+		}
+		return fmt.Errorf("could not check the bridge: %v", err)
+	}
+	logger.Infof("bridge '%s' is present.", dpi.deviceName)
+	if err := dpi.followLink(link); err != nil {
+		return fmt.Errorf("could not list the bridge ports: %v", err)
+	}
+	return nil
+}
+
+// followLink makes link the monitored bridge and reports its health.
+func (dpi *BridgeDevicePlugin) followLink(link netlink.Link) error {
+	dpi.linkIndex = link.Attrs().Index
+	dpi.ovs = isOVSBridge(link)
+	dpi.bridgeReason = linkHealthReason(link, dpi.healthMode)
+	if dpi.vlan {
+		dpi.trackParent(link)
+	}
+	var err error
+	if dpi.tracksPorts() {
+		dpi.ports = bridgePorts{}
+		err = dpi.listPorts()
+		dpi.portsChanged()
+	}
+	dpi.observeHealth(dpi.healthReason())
+	return err
+}
+
+// relink looks the bridge up by name again once the monitored link is gone or another link
+// took its name. A bridge deleted and recreated gets a new ifindex, and the updates of the old
+// and the new link may be handled in either order, so the lookup decides which link has the
+// name now.
+func (dpi *BridgeDevicePlugin) relink() {
+	logger := log.DefaultLogger()
+	previous := dpi.linkIndex
+	link, err := dpi.links.LinkByName(dpi.deviceName)
+	if err == nil && link.Attrs().Index == previous {
+		return
+	}
+	if err != nil {
+		if !isLinkNotFound(err) {
+			logger.Reason(err).Errorf("could not look up bridge %s again", dpi.deviceName)
+		}
+		if previous == 0 {
+			return
+		}
+		logger.Warningf("bridge '%s' is gone, the device plugin can't expose it", dpi.deviceName)
+		dpi.linkIndex = 0
+		dpi.ports = bridgePorts{}
+		dpi.portsChanged()
+		dpi.observeHealth(dpi.healthReason())
+		return
+	}
+	logger.Infof("bridge '%s' is present with ifindex %d.", dpi.deviceName, link.Attrs().Index)
+	if err := dpi.followLink(link); err != nil {
+		logger.Reason(err).Errorf("could not list the ports of bridge %s", dpi.deviceName)
+	}
+}
+
+// handleLinkUpdate follows the bridge by ifindex, so another interface that later reuses
+// the name isn't mistaken for it. Once the bridge is deleted or renamed, or a link with its
+// name shows up, the link that has the name now is followed instead.
+func (dpi *BridgeDevicePlugin) handleLinkUpdate(update netlink.LinkUpdate) {
+	attrs := update.Attrs()
+	switch {
+	case dpi.linkIndex != 0 && attrs.Index == dpi.linkIndex:
+		if update.Header.Type == unix.RTM_DELLINK || attrs.Name != dpi.deviceName {
+			dpi.relink()
+			return
 		}
+		dpi.bridgeReason = linkHealthReason(update.Link, dpi.healthMode)
+		dpi.observeHealth(dpi.healthReason())
+	case attrs.Name == dpi.deviceName && update.Header.Type == unix.RTM_NEWLINK:
+		dpi.relink()
+	case dpi.vlan && dpi.linkIndex != 0 && attrs.Index == dpi.parentIndex:
+		dpi.parentUp = update.Header.Type == unix.RTM_NEWLINK && portUp(attrs)
+		dpi.observeHealth(dpi.healthReason())
+	case dpi.tracksPorts() && dpi.trackPort(update):
+		dpi.portsChanged()
+	}
+}
+
+// healthReason combines the state of the bridge and, if required, of its ports.
+func (dpi *BridgeDevicePlugin) healthReason() HealthReason {
+	if dpi.linkIndex == 0 {
+		return HealthReasonMissing
+	}
+	if dpi.bridgeReason == HealthReasonUp && dpi.vlan && !dpi.parentUp {
+		return HealthReasonNoCarrier
+	}
+	if dpi.bridgeReason == HealthReasonUp && dpi.tracksPorts() && dpi.ports.upCount() < dpi.minUpPorts {
+		return HealthReasonNoPortUp
+	}
+	return dpi.bridgeReason
+}
+
+// observeHealth reports the health reason, health changes are held back until they
+// were stable for the debounce window. Changes to unhealthy may skip the window.
+func (dpi *BridgeDevicePlugin) observeHealth(reason HealthReason) {
+	health := reason.Health()
+	if dpi.healthDebounce <= 0 || dpi.lastHealth == "" || health == dpi.lastHealth ||
+		(health != pluginapi.Healthy && !dpi.debounceUnhealthy) {
+		dpi.stopDebounce()
+		dpi.reportHealth(reason)
+		return
+	}
+	// The latest reason wins once the window passed
+	dpi.pendingReason = reason
+	if dpi.debounceTimer == nil {
+		log.DefaultLogger().V(4).Infof("debouncing health change of bridge %s to %s", dpi.deviceName, reason)
+		dpi.debounceTimer = dpi.clock.NewTimer(dpi.healthDebounce)
+	}
+}
+
+// debounced fires when a held back health change was stable for the debounce window.
+func (dpi *BridgeDevicePlugin) debounced() <-chan time.Time {
+	if dpi.debounceTimer == nil {
+		return nil
+	}
+	return dpi.debounceTimer.C()
+}
+
+func (dpi *BridgeDevicePlugin) stopDebounce() {
+	if dpi.debounceTimer != nil {
+		dpi.debounceTimer.Stop()
+		dpi.debounceTimer = nil
+	}
+}
+
+// reportHealth records the health reason and forwards the resulting health to ListAndWatch.
+func (dpi *BridgeDevicePlugin) reportHealth(reason HealthReason) {
+	logger := log.DefaultLogger()
+	if reason == HealthReasonUp {
+		logger.Infof("monitored bridge %s is up", dpi.deviceName)
+	} else {
+		logger.Infof("monitored bridge %s is down (%s)", dpi.deviceName, reason)
 	}
+	now := dpi.clock.Now()
+	dpi.healthAccounting.record(reason, now)
+	dpi.recordHealthReasonMetrics()
+
+	health := reason.Health()
+	if dpi.draining.Load() {
+		health = pluginapi.Unhealthy
+	}
+	if dpi.healthNotifier != nil && dpi.lastHealth != "" && dpi.lastHealth != health {
+		dpi.healthNotifier.NotifyHealthChange(HealthChange{
+			Bridge:    dpi.deviceName,
+			Resource:  dpi.resourceName,
+			OldHealth: dpi.lastHealth,
+			NewHealth: health,
+			Reason:    reason,
+			Time:      now,
+		})
+	}
+	dpi.lastHealth = health
+	bridgeUpMetric.Set(boolMetric(reason.Health() == pluginapi.Healthy), dpi.deviceName, dpi.resourceName)
+	// There's only one shared bridge device, so its health applies to all devices
+	dpi.deviceHealth.apply(deviceHealth{Health: health})
+	dpi.recordDeviceMetrics()
+}
+
+// Drain reports all devices as unhealthy from now on, so kubelet stops scheduling pods
+// against them before the plugin is stopped.
+func (dpi *BridgeDevicePlugin) Drain() {
+	dpi.draining.Store(true)
+	dpi.deviceHealth.apply(deviceHealth{Health: pluginapi.Unhealthy})
+	dpi.recordDeviceMetrics()
+}
+
+// HealthReasonDurations returns the time the bridge spent in each health reason.
+func (dpi *BridgeDevicePlugin) HealthReasonDurations() map[HealthReason]time.Duration {
+	return dpi.healthAccounting.durations(dpi.clock.Now())
+}
+
+// HealthHistory returns the latest health transitions of the bridge, oldest first.
+func (dpi *BridgeDevicePlugin) HealthHistory() []HealthTransition {
+	return dpi.healthAccounting.transitions()
 }
 
 func (dpi *BridgeDevicePlugin) GetInitialized() bool {
@@ -323,8 +1279,19 @@ func (dpi *BridgeDevicePlugin) GetInitialized() bool {
 	return dpi.initialized
 }
 
+// LoopLatency returns the iteration gap statistics of the health check loop.
+func (dpi *BridgeDevicePlugin) LoopLatency() LoopLatencyStats {
+	return dpi.loopMonitor.Stats()
+}
+
+// Stalled reports whether the health check loop stopped iterating.
+func (dpi *BridgeDevicePlugin) Stalled() bool {
+	return dpi.loopMonitor.Stalled()
+}
+
 func (dpi *BridgeDevicePlugin) setInitialized(initialized bool) {
 	dpi.lock.Lock()
 	defer dpi.lock.Unlock()
 	dpi.initialized = initialized
+	pluginRegisteredMetric.Set(boolMetric(initialized), dpi.deviceName, dpi.resourceName)
 }
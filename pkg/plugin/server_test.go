@@ -0,0 +1,767 @@
+package plugin_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin/pluginfakes"
+	"github.com/vishvananda/netlink"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestPluginRegistersWithKubelet(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	h.StartPlugin(ctx, newPlugin(t, h, "br0", 3))
+
+	req, err := h.Kubelet.WaitForRegistration(ctx, resourceName("br0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Version != pluginapi.Version {
+		t.Errorf("registered version %s, want %s", req.Version, pluginapi.Version)
+	}
+	if _, err := os.Stat(filepath.Join(h.Kubelet.Dir(), req.Endpoint)); err != nil {
+		t.Errorf("the registered endpoint isn't served: %v", err)
+	}
+	if !req.GetOptions().GetGetPreferredAllocationAvailable() {
+		t.Error("GetPreferredAllocation isn't announced")
+	}
+}
+
+func TestPluginListsItsDevices(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	stream := watchPlugin(ctx, t, h, "br0")
+
+	devices, err := stream.WaitFor(ctx, pluginfakes.AllHealth(pluginapi.Healthy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 3 {
+		t.Errorf("listed %d devices, want 3", len(devices))
+	}
+}
+
+func TestPluginReportsLostCarrier(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	stream := watchPlugin(ctx, t, h, "br0")
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+
+	// Administratively up, but without carrier
+	h.Links.SetOperState("br0", netlink.OperLowerLayerDown)
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+	h.Links.SetOperState("br0", netlink.OperUp)
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+}
+
+func TestPluginDeregistersOnStop(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	run := h.StartPlugin(ctx, newPlugin(t, h, "br0", 3))
+	stream, err := dial(ctx, t, h, resourceName("br0")).Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+
+	if err := run.Stop(); err != nil {
+		t.Fatalf("the plugin failed: %v", err)
+	}
+	if _, err := stream.WaitFor(ctx, pluginfakes.Empty); err != nil {
+		t.Fatalf("the plugin didn't send the empty list: %v", err)
+	}
+}
+
+func TestPluginTimesHealthWithItsClock(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := pluginfakes.NewClock(start)
+	h.Links.AddBridge("br-timed")
+	// The bridge is the test's own, so only earlier runs add to its series
+	upSample := `bridge_marker_health_reason_seconds_total{bridge="br-timed",resource="` + resourceName("br-timed") + `",reason="Up"}`
+	upBefore := metricValue(t, upSample)
+	dev := newPlugin(t, h, "br-timed", 3, plugin.WithClock(clock))
+	run := h.StartPlugin(ctx, dev)
+	stream := watch(ctx, t, h, resourceName("br-timed"))
+	stopBeforeClients(t, run)
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+
+	if info, ok := dev.LastRegistration(); !ok || !info.Time.Equal(start) {
+		t.Errorf("the registration was recorded at %v, expected %v", info.Time, start)
+	}
+
+	clock.Step(time.Minute)
+	h.Links.SetUp("br-timed", false)
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+	clock.Step(time.Second)
+	expected := map[plugin.HealthReason]time.Duration{
+		plugin.HealthReasonUp:   time.Minute,
+		plugin.HealthReasonDown: time.Second,
+	}
+	if durations := dev.HealthReasonDurations(); !reflect.DeepEqual(durations, expected) {
+		t.Errorf("got durations %v, expected %v", durations, expected)
+	}
+	if seconds := metricValue(t, upSample) - upBefore; seconds != 60 {
+		t.Errorf("exported %v seconds up, expected 60", seconds)
+	}
+}
+
+func TestPluginHeartbeatFollowsItsClock(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	clock := pluginfakes.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h.Links.AddBridge("br-heartbeat")
+	upSample := `bridge_marker_health_reason_seconds_total{bridge="br-heartbeat",resource="` + resourceName("br-heartbeat") + `",reason="Up"}`
+	upBefore := metricValue(t, upSample)
+	dev := newPlugin(t, h, "br-heartbeat", 3, plugin.WithClock(clock))
+	run := h.StartPlugin(ctx, dev)
+	stream := watch(ctx, t, h, resourceName("br-heartbeat"))
+	stopBeforeClients(t, run)
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+	eventually(ctx, t, "the health check heartbeat doesn't tick on the plugin's clock", func() bool {
+		return clock.Waiters() > clock.Timers()
+	})
+
+	// Nothing but the heartbeat exports the time spent up while the health doesn't change
+	clock.Step(time.Minute)
+	eventually(ctx, t, "the heartbeat didn't export the minute up", func() bool {
+		return metricValue(t, upSample)-upBefore == 60
+	})
+}
+
+func TestPluginRecordsLastRegistration(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	clock := pluginfakes.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h.Links.AddBridge("br0")
+	h.Kubelet.SetRegisterError(errors.New("registration quota exceeded"))
+	dev := newPlugin(t, h, "br0", 3, plugin.WithClock(clock))
+	if _, ok := dev.LastRegistration(); ok {
+		t.Error("a plugin that never registered has a registration")
+	}
+	run := h.StartPlugin(ctx, dev)
+
+	eventually(ctx, t, "the failed registration wasn't recorded", func() bool {
+		_, ok := dev.LastRegistration()
+		return ok
+	})
+	info, _ := dev.LastRegistration()
+	if info.Succeeded || !strings.Contains(info.Error, "registration quota exceeded") {
+		t.Errorf("the failed registration was recorded as %+v", info)
+	}
+
+	// The retry after the backoff succeeds
+	h.Kubelet.SetRegisterError(nil)
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	clock.Step(time.Minute)
+	req, err := h.Kubelet.WaitForRegistration(ctx, resourceName("br0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	watch(ctx, t, h, resourceName("br0"))
+	stopBeforeClients(t, run)
+	eventually(ctx, t, "the successful registration wasn't recorded", func() bool {
+		info, _ = dev.LastRegistration()
+		return info.Succeeded
+	})
+	if info.Error != "" {
+		t.Errorf("the successful registration was recorded with error %q", info.Error)
+	}
+	if info.Version != req.Version || info.Endpoint != req.Endpoint || info.ResourceName != req.ResourceName {
+		t.Errorf("recorded %+v, kubelet received %v", info, req)
+	}
+	if info.Options.GetPreferredAllocationAvailable != req.GetOptions().GetGetPreferredAllocationAvailable() {
+		t.Errorf("recorded options %+v, kubelet received %v", info.Options, req.GetOptions())
+	}
+	if !info.Time.Equal(clock.Now()) {
+		t.Errorf("the registration was recorded at %v, expected %v", info.Time, clock.Now())
+	}
+}
+
+func TestPluginDebouncesRecoveries(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	clock := pluginfakes.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3, plugin.WithClock(clock), plugin.WithHealthDebounce(3*time.Second, false))
+	run := h.StartPlugin(ctx, dev)
+	stream := watch(ctx, t, h, resourceName("br0"))
+	stopBeforeClients(t, run)
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+	waiters := clock.Timers()
+
+	// Going unhealthy is reported right away, recovering only once stable for the window
+	h.Links.SetUp("br0", false)
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+	h.Links.SetUp("br0", true)
+	if err := clock.WaitForTimers(ctx, waiters+1); err != nil {
+		t.Fatal(err)
+	}
+	clock.Step(2 * time.Second)
+	if dev.Healthy() {
+		t.Fatal("the recovery was reported within the debounce window")
+	}
+	clock.Step(time.Second)
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+}
+
+func TestPluginDebouncesUnhealthyToo(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	clock := pluginfakes.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3, plugin.WithClock(clock), plugin.WithHealthDebounce(3*time.Second, true))
+	run := h.StartPlugin(ctx, dev)
+	stream := watch(ctx, t, h, resourceName("br0"))
+	stopBeforeClients(t, run)
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+	waiters := clock.Timers()
+
+	// A flap back to the reported health cancels the pending change
+	h.Links.SetUp("br0", false)
+	if err := clock.WaitForTimers(ctx, waiters+1); err != nil {
+		t.Fatal(err)
+	}
+	h.Links.SetUp("br0", true)
+	eventually(ctx, t, "the flap back didn't cancel the pending change", func() bool {
+		return clock.Timers() == waiters
+	})
+
+	h.Links.SetUp("br0", false)
+	if err := clock.WaitForTimers(ctx, waiters+1); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.Healthy() {
+		t.Fatal("the change to unhealthy was reported within the debounce window")
+	}
+	clock.Step(3 * time.Second)
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+}
+
+func TestPluginClosesConnectionsThatStopResponding(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3, plugin.WithKeepalive(
+		keepalive.ServerParameters{Time: time.Second, Timeout: time.Second},
+		keepalive.EnforcementPolicy{MinTime: time.Second, PermitWithoutStream: true},
+	))
+	h.StartPlugin(ctx, dev)
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+
+	// A half-dead client, it opens the HTTP/2 connection but never acknowledges anything
+	conn, err := net.Dial("unix", dev.GetSocketPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	preface := "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	emptySettings := []byte{0, 0, 0, 4, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(append([]byte(preface), emptySettings...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server pings after a second and gives up a second later
+	start := time.Now()
+	if err := conn.SetReadDeadline(start.Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("the server didn't close the connection: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("the server closed the connection after %v, before pinging it", elapsed)
+	}
+}
+
+func TestPluginSocketPrefixRemovesOldSocket(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	// The socket of a marker that ran with the default prefix and didn't clean up
+	oldSocket := filepath.Join(h.Kubelet.Dir(), plugin.DefaultSocketPrefix+"br0.sock")
+	listener, err := net.Listen("unix", oldSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	h.StartPlugin(ctx, newPlugin(t, h, "br0", 3, plugin.WithSocketPrefix("marker-")))
+	req, err := h.Kubelet.WaitForRegistration(ctx, resourceName("br0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Endpoint != "marker-br0.sock" {
+		t.Errorf("registered endpoint %s, expected marker-br0.sock", req.Endpoint)
+	}
+	if _, err := os.Stat(oldSocket); !os.IsNotExist(err) {
+		t.Errorf("the socket with the old prefix is left behind: %v", err)
+	}
+}
+
+// brokenStream is a ListAndWatch stream that breaks after sending sends lists.
+type brokenStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	sends int
+}
+
+func (s *brokenStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *brokenStream) Send(*pluginapi.ListAndWatchResponse) error {
+	if s.sends == 0 {
+		return errors.New("transport is closing")
+	}
+	s.sends--
+	return nil
+}
+
+// listAndWatch runs ListAndWatch on the stream and returns its result once it returns.
+func listAndWatch(dev *plugin.BridgeDevicePlugin, stream *brokenStream) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- dev.ListAndWatch(&pluginapi.Empty{}, stream)
+	}()
+	return result
+}
+
+func TestListAndWatchFailsOnBrokenStream(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3)
+
+	select {
+	case err := <-listAndWatch(dev, &brokenStream{ctx: ctx}):
+		if err == nil {
+			t.Error("the failed initial send wasn't reported")
+		}
+	case <-ctx.Done():
+		t.Fatal("ListAndWatch kept a broken stream")
+	}
+}
+
+func TestPluginRestartsWhenUpdateCannotBeSent(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3)
+	// Not started by the harness, which takes the expected failure for a broken plugin
+	started := make(chan error, 1)
+	go func() {
+		started <- dev.Start(ctx)
+	}()
+	waitForRegistration(ctx, t, h, resourceName("br0"))
+
+	// The initial list goes through, the update after the bridge went down doesn't
+	result := listAndWatch(dev, &brokenStream{ctx: ctx, sends: 1})
+	h.Links.SetUp("br0", false)
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("the failed update wasn't reported")
+		}
+	case <-ctx.Done():
+		t.Fatal("ListAndWatch kept a broken stream")
+	}
+	select {
+	case err := <-started:
+		if err == nil || !strings.Contains(err.Error(), "device list update") {
+			t.Errorf("the plugin stopped with %v, expected the failed update", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("the plugin kept running without kubelet receiving its health")
+	}
+}
+
+func TestPluginStopsServingWhenHealthCheckFails(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	h.Links.SubscribeErr = errors.New("netlink socket closed")
+	dev := newPlugin(t, h, "br0", 3)
+
+	err := dev.Start(ctx)
+	if err == nil || !strings.Contains(err.Error(), "netlink socket closed") {
+		t.Fatalf("the plugin stopped with %v, expected the health check failure", err)
+	}
+	// Serve has returned as well, nothing answers on the socket anymore
+	if conn, err := net.Dial("unix", dev.GetSocketPath()); err == nil {
+		conn.Close()
+		t.Error("the plugin is still served after Start returned")
+	}
+}
+
+// blockAllocate holds the responses of Allocate calls until release is closed or their RPC is aborted.
+func blockAllocate(entered chan<- struct{}, release <-chan struct{}) plugin.PluginOption {
+	return plugin.WithUnaryInterceptors(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if strings.HasSuffix(info.FullMethod, "/Allocate") {
+			entered <- struct{}{}
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return resp, err
+	})
+}
+
+func TestPluginStopWaitsForAllocate(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	run := h.StartPlugin(ctx, newPlugin(t, h, "br0", 3, blockAllocate(entered, release)))
+	client := dial(ctx, t, h, resourceName("br0"))
+	stream, err := client.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allocated := make(chan error, 1)
+	go func() {
+		_, err := client.AllocateDevices(ctx, "br00")
+		allocated <- err
+	}()
+	<-entered
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- run.Stop()
+	}()
+
+	// The plugin deregisters while the pod is still being admitted, and keeps serving it
+	if _, err := stream.WaitFor(ctx, pluginfakes.Empty); err != nil {
+		t.Fatalf("the plugin didn't send the empty list: %v", err)
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("the plugin stopped during an Allocate call: %v", err)
+	default:
+	}
+	close(release)
+	if err := <-allocated; err != nil {
+		t.Errorf("the Allocate call in flight failed: %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("the plugin failed: %v", err)
+	}
+}
+
+func TestPluginStopAbortsAllocateAfterTimeout(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	entered := make(chan struct{}, 1)
+	dev := newPlugin(t, h, "br0", 3, blockAllocate(entered, nil), plugin.WithGracefulStopTimeout(100*time.Millisecond))
+	run := h.StartPlugin(ctx, dev)
+	client := dial(ctx, t, h, resourceName("br0"))
+
+	allocated := make(chan error, 1)
+	go func() {
+		_, err := client.AllocateDevices(ctx, "br00")
+		allocated <- err
+	}()
+	<-entered
+	if err := run.Stop(); err != nil {
+		t.Errorf("the plugin failed: %v", err)
+	}
+	if err := <-allocated; err == nil {
+		t.Error("the Allocate call outlived the plugin")
+	}
+}
+
+func TestPluginHealthAccessors(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	var dev plugin.Device = newPlugin(t, h, "br0", 3)
+	h.StartPlugin(ctx, dev)
+	stream := watch(ctx, t, h, resourceName("br0"))
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+	if healthy, total := dev.HealthSummary(); !dev.Healthy() || healthy != 3 || total != 3 {
+		t.Errorf("got %d of %d devices healthy, healthy %v", healthy, total, dev.Healthy())
+	}
+
+	// The accessors are read while the health check changes the health
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				dev.Healthy()
+				dev.HealthSummary()
+			}
+		}
+	}()
+	h.Links.SetUp("br0", false)
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+	if healthy, total := dev.HealthSummary(); dev.Healthy() || healthy != 0 || total != 3 {
+		t.Errorf("got %d of %d devices healthy, healthy %v", healthy, total, dev.Healthy())
+	}
+}
+
+func TestPluginDevicesAreCopies(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 2)
+
+	devices := dev.Devices()
+	devices[0].Health = pluginapi.Unhealthy
+	devices[1].ID = "br07"
+	for i, device := range dev.Devices() {
+		if expected := fmt.Sprintf("br0%d", i); device.ID != expected || device.Health != pluginapi.Healthy {
+			t.Errorf("device %d is %s %s after changing the copy", i, device.ID, device.Health)
+		}
+	}
+}
+
+func TestPluginSocketPermissions(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		opts     []plugin.PluginOption
+		mode     os.FileMode
+		uid, gid int
+		// rootOnly tests need the privileges to chown the socket
+		rootOnly bool
+	}{
+		{name: "default", mode: plugin.DefaultSocketMode, uid: os.Geteuid(), gid: os.Getegid()},
+		{name: "group access", opts: []plugin.PluginOption{plugin.WithSocketMode(0660)}, mode: 0660, uid: os.Geteuid(), gid: os.Getegid()},
+		{name: "owner", opts: []plugin.PluginOption{plugin.WithSocketOwner(107, 108)}, mode: plugin.DefaultSocketMode, uid: 107, gid: 108, rootOnly: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if tt.rootOnly && os.Geteuid() != 0 {
+				t.Skip("chowning the socket needs root")
+			}
+			h := newHarness(t)
+			ctx := testContext(t)
+			h.Links.AddBridge("br0")
+			dev := newPlugin(t, h, "br0", 3, tt.opts...)
+			h.StartPlugin(ctx, dev)
+			waitForRegistration(ctx, t, h, resourceName("br0"))
+
+			info, err := os.Stat(dev.GetSocketPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode().Perm(); mode != tt.mode {
+				t.Errorf("the socket has mode %o, expected %o", mode, tt.mode)
+			}
+			stat := info.Sys().(*syscall.Stat_t)
+			if int(stat.Uid) != tt.uid || int(stat.Gid) != tt.gid {
+				t.Errorf("the socket is owned by %d:%d, expected %d:%d", stat.Uid, stat.Gid, tt.uid, tt.gid)
+			}
+		})
+	}
+}
+
+func TestPluginDoesNotRemoveSymlinkedSocket(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	dev := newPlugin(t, h, "br0", 3)
+	target := filepath.Join(t.TempDir(), "important")
+	if err := os.WriteFile(target, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, dev.GetSocketPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.Start(ctx); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Errorf("the plugin started with %v, expected the symlink to be refused", err)
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Errorf("the symlink target is gone: %v", err)
+	}
+}
+
+func TestPluginRefusesTamperedSocketDir(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	root := t.TempDir()
+	// The device plugin directory is redirected to another one
+	elsewhere := filepath.Join(root, "elsewhere")
+	if err := os.Mkdir(elsewhere, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(root, "device-plugins")
+	if err := os.Symlink(elsewhere, link); err != nil {
+		t.Fatal(err)
+	}
+	dev := newPlugin(t, h, "br0", 3, plugin.WithDevicePluginDir(link))
+
+	if err := dev.Start(ctx); err == nil || !strings.Contains(err.Error(), "is a symlink") {
+		t.Errorf("the plugin started with %v, expected the symlinked directory to be refused", err)
+	}
+	if entries, err := os.ReadDir(elsewhere); err != nil || len(entries) != 0 {
+		t.Errorf("the plugin created %v in the symlink target: %v", entries, err)
+	}
+}
+
+func TestListAndWatchSkipsUnchangedLists(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	stream := watchPlugin(ctx, t, h, "br0")
+	waitForHealth(ctx, t, stream, pluginapi.Healthy)
+
+	// Every flap re-evaluates the health, only the real transitions reach kubelet
+	h.Links.SetUp("br0", false)
+	waitForHealth(ctx, t, stream, pluginapi.Unhealthy)
+	for i := 0; i < 20; i++ {
+		h.Links.SetUp("br0", false)
+		h.Links.SetOperState("br0", netlink.OperDown)
+	}
+	h.Links.SetUp("br0", true)
+	eventually(ctx, t, "the recovery wasn't sent", func() bool { return len(stream.Lists()) >= 3 })
+	var health []string
+	for _, devices := range stream.Lists() {
+		health = append(health, devices[0].Health)
+	}
+	expected := []string{pluginapi.Healthy, pluginapi.Unhealthy, pluginapi.Healthy}
+	if !reflect.DeepEqual(health, expected) {
+		t.Errorf("sent %d lists with health %v, expected %v", len(health), health, expected)
+	}
+}
+
+func TestListAndWatchDropsStreamsKubeletClosed(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	ctx := testContext(t)
+	h.Links.AddBridge("br0")
+	run := h.StartPlugin(ctx, newPlugin(t, h, "br0", 3))
+	stopBeforeClients(t, run)
+
+	// kubelet drops the first stream and opens another one, the plugin keeps running
+	firstCtx, dropFirst := context.WithCancel(ctx)
+	first := watch(firstCtx, t, h, resourceName("br0"))
+	waitForHealth(ctx, t, first, pluginapi.Healthy)
+	dropFirst()
+	<-first.Done()
+	second := watch(ctx, t, h, resourceName("br0"))
+	waitForHealth(ctx, t, second, pluginapi.Healthy)
+
+	// Every transition has to reach the live stream, the dropped one competes for none of them
+	for i, up := range []bool{false, true, false, true} {
+		h.Links.SetUp("br0", up)
+		eventually(ctx, t, "the live stream missed a transition", func() bool { return len(second.Lists()) == i+2 })
+	}
+	if lists := second.Lists(); !pluginfakes.AllHealth(pluginapi.Healthy)(lists[len(lists)-1]) {
+		t.Errorf("the live stream ended up with %v, expected healthy devices", lists[len(lists)-1])
+	}
+	if lists := len(first.Lists()); lists != 1 {
+		t.Errorf("the dropped stream received %d lists, expected 1", lists)
+	}
+	select {
+	case <-run.Done():
+		t.Fatal("the plugin stopped after kubelet dropped a stream")
+	default:
+	}
+	if registrations := h.Kubelet.Registrations(resourceName("br0")); registrations != 1 {
+		t.Errorf("the plugin registered %d times, expected it not to restart", registrations)
+	}
+}
+
+func TestPluginResourceName(t *testing.T) {
+	t.Parallel()
+	h := newHarness(t)
+	tests := []struct {
+		name     string
+		device   string
+		opts     []plugin.PluginOption
+		expected string
+	}{
+		{name: "bridge", device: "br0", expected: "br0"},
+		{name: "renamed", device: "br0", opts: []plugin.PluginOption{plugin.WithResourceName("infra")}, expected: "infra"},
+		{name: "VLAN interface", device: "eth0.100", opts: []plugin.PluginOption{plugin.WithVLAN()}, expected: "eth0-100"},
+		{name: "variant", device: "br0", opts: []plugin.PluginOption{plugin.WithVariant("trunk")}, expected: "br0-trunk"},
+		{name: "bridge VLAN", device: "br0", opts: []plugin.PluginOption{plugin.WithBridgeVLAN(100)}, expected: "br0.vlan100"},
+		{
+			name:     "variant of a VLAN interface",
+			device:   "eth0.100",
+			opts:     []plugin.PluginOption{plugin.WithVLAN(), plugin.WithVariant("trunk")},
+			expected: "eth0-100-trunk",
+		},
+		{
+			name:     "variant of a renamed bridge",
+			device:   "br0",
+			opts:     []plugin.PluginOption{plugin.WithResourceName("infra"), plugin.WithVariant("trunk")},
+			expected: "infra-trunk",
+		},
+		{
+			name:     "VLAN of a renamed bridge",
+			device:   "br0",
+			opts:     []plugin.PluginOption{plugin.WithResourceName("infra"), plugin.WithBridgeVLAN(100)},
+			expected: "infra.vlan100",
+		},
+		{
+			name:     "VLAN of a variant",
+			device:   "br0",
+			opts:     []plugin.PluginOption{plugin.WithVariant("trunk"), plugin.WithBridgeVLAN(100)},
+			expected: "br0-trunk.vlan100",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := newPlugin(t, h, tt.device, 3, tt.opts...)
+			if name := dev.GetResourceName(); name != plugin.DeviceNamespace+"/"+tt.expected {
+				t.Errorf("got resource %s, expected %s/%s", name, plugin.DeviceNamespace, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package plugin
+
+// BridgeSettings are the plugin settings of a bridge that can be changed while the controller
+// runs, zero values keep the defaults.
+type BridgeSettings struct {
+	// MaxDevices is the device count of the bridge resource
+	MaxDevices int
+	// HealthMode is the criterion for the bridge to be healthy
+	HealthMode HealthMode
+	// MinUpPorts is the number of ports that have to be up for the bridge to be healthy
+	MinUpPorts int
+	// ResourceName replaces the bridge name in the resource name
+	ResourceName string
+}
+
+// Merge fills the zero values of the settings from the defaults.
+func (s BridgeSettings) Merge(defaults BridgeSettings) BridgeSettings {
+	if s.MaxDevices == 0 {
+		s.MaxDevices = defaults.MaxDevices
+	}
+	if s.HealthMode == "" {
+		s.HealthMode = defaults.HealthMode
+	}
+	if s.MinUpPorts == 0 {
+		s.MinUpPorts = defaults.MinUpPorts
+	}
+	if s.ResourceName == "" {
+		s.ResourceName = defaults.ResourceName
+	}
+	return s
+}
+
+// apply returns the device count and plugin options of a bridge with these settings.
+func (s BridgeSettings) apply(maxDevices int, opts []PluginOption) (int, []PluginOption) {
+	if s.MaxDevices != 0 {
+		maxDevices = s.MaxDevices
+	}
+	if s.HealthMode == "" && s.MinUpPorts == 0 && s.ResourceName == "" {
+		return maxDevices, opts
+	}
+	opts = append([]PluginOption{}, opts...)
+	if s.HealthMode != "" {
+		opts = append(opts, WithHealthMode(s.HealthMode))
+	}
+	if s.MinUpPorts != 0 {
+		opts = append(opts, WithMinUpPorts(s.MinUpPorts))
+	}
+	if s.ResourceName != "" {
+		opts = append(opts, WithResourceName(s.ResourceName))
+	}
+	return maxDevices, opts
+}
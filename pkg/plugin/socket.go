@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketUmask keeps sockets private to the owner between creating them and applying the
+// configured mode.
+const socketUmask = 0177
+
+// umaskLock serializes the umask changes of listenUnix, the umask is process wide.
+var umaskLock sync.Mutex
+
+// checkSocketDir makes sure sockets are only created and removed in a real directory that
+// nobody but root or the marker itself can change, so a tampered directory can't redirect them.
+func checkSocketDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("socket directory %s is not accessible: %v", dir, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("socket directory %s is a symlink, refusing to follow it", dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 && int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("socket directory %s is owned by uid %d, expected root or uid %d", dir, stat.Uid, os.Geteuid())
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("socket directory %s is writable by group or others (%v)", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// removeSocket removes a leftover socket, anything else at the path is left alone and reported.
+func removeSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to remove %s, it is a symlink", path)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to remove %s, it is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// listenUnix creates the socket with a restrictive umask.
+func listenUnix(path string) (*net.UnixListener, error) {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	previous := unix.Umask(socketUmask)
+	defer unix.Umask(previous)
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return sock.(*net.UnixListener), nil
+}
@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSocketDir(t *testing.T) {
+	tests := []struct {
+		name string
+		// layout creates the layout in the temp dir and returns the socket directory
+		layout   func(t *testing.T, root string) string
+		expected string
+	}{
+		{
+			name: "private directory",
+			layout: func(t *testing.T, root string) string {
+				return mkdir(t, filepath.Join(root, "device-plugins"), 0755)
+			},
+		},
+		{
+			name: "missing directory",
+			layout: func(t *testing.T, root string) string {
+				return filepath.Join(root, "device-plugins")
+			},
+			expected: "is not accessible",
+		},
+		{
+			name: "symlinked directory",
+			layout: func(t *testing.T, root string) string {
+				target := mkdir(t, filepath.Join(root, "elsewhere"), 0755)
+				link := filepath.Join(root, "device-plugins")
+				if err := os.Symlink(target, link); err != nil {
+					t.Fatal(err)
+				}
+				return link
+			},
+			expected: "is a symlink",
+		},
+		{
+			name: "file instead of a directory",
+			layout: func(t *testing.T, root string) string {
+				path := filepath.Join(root, "device-plugins")
+				if err := os.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			expected: "is not a directory",
+		},
+		{
+			name: "world writable directory",
+			layout: func(t *testing.T, root string) string {
+				return mkdir(t, filepath.Join(root, "device-plugins"), 0777)
+			},
+			expected: "is writable by group or others",
+		},
+		{
+			name: "group writable directory",
+			layout: func(t *testing.T, root string) string {
+				return mkdir(t, filepath.Join(root, "device-plugins"), 0775)
+			},
+			expected: "is writable by group or others",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSocketDir(tt.layout(t, t.TempDir()))
+			if tt.expected == "" {
+				if err != nil {
+					t.Errorf("got error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("got error %v, expected %q", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRemoveSocket(t *testing.T) {
+	tests := []struct {
+		name string
+		// layout creates what is at the socket path
+		layout   func(t *testing.T, path string)
+		expected string
+		removed  bool
+	}{
+		{
+			name:    "nothing at the path",
+			layout:  func(t *testing.T, path string) {},
+			removed: true,
+		},
+		{
+			name: "leftover socket",
+			layout: func(t *testing.T, path string) {
+				sock, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sock.(*net.UnixListener).SetUnlinkOnClose(false)
+				sock.Close()
+			},
+			removed: true,
+		},
+		{
+			name: "symlink",
+			layout: func(t *testing.T, path string) {
+				if err := os.Symlink("/etc/passwd", path); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expected: "it is a symlink",
+		},
+		{
+			name: "regular file",
+			layout: func(t *testing.T, path string) {
+				if err := os.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expected: "it is not a socket",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "br0.sock")
+			tt.layout(t, path)
+			err := removeSocket(path)
+			if tt.expected != "" && (err == nil || !strings.Contains(err.Error(), tt.expected)) {
+				t.Errorf("got error %v, expected %q", err, tt.expected)
+			}
+			if tt.expected == "" && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if _, err := os.Lstat(path); os.IsNotExist(err) != tt.removed {
+				t.Errorf("the path was removed: %v, expected %v", os.IsNotExist(err), tt.removed)
+			}
+		})
+	}
+}
+
+func TestListenUnixCreatesPrivateSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "br0.sock")
+	sock, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("the socket was created with mode %v, expected 0600", perm)
+	}
+}
+
+func mkdir(t *testing.T, path string, perm os.FileMode) string {
+	t.Helper()
+	if err := os.Mkdir(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	// Mkdir applies the umask
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// maxLinkStackDepth bounds the walk from a bridge port down to its physical device.
+const maxLinkStackDepth = 8
+
+// findSharedUplinks returns the physical devices that back ports of more than one of the given bridges,
+// mapped to the sorted names of those bridges. Ports stacked on a physical device (e.g. VLAN
+// sub-interfaces) are resolved to the device underneath.
+func findSharedUplinks(links []netlink.Link, bridges map[string]bool) map[string][]string {
+	byIndex := make(map[int]netlink.Link, len(links))
+	for _, link := range links {
+		byIndex[link.Attrs().Index] = link
+	}
+
+	uplinkBridges := map[string]map[string]bool{}
+	for _, link := range links {
+		master, exists := byIndex[link.Attrs().MasterIndex]
+		if !exists || !bridges[master.Attrs().Name] {
+			continue
+		}
+		uplink := physicalDevice(link, byIndex)
+		if uplink == nil {
+			continue
+		}
+		name := uplink.Attrs().Name
+		if uplinkBridges[name] == nil {
+			uplinkBridges[name] = map[string]bool{}
+		}
+		uplinkBridges[name][master.Attrs().Name] = true
+	}
+
+	shared := map[string][]string{}
+	for uplink, names := range uplinkBridges {
+		if len(names) < 2 {
+			continue
+		}
+		for name := range names {
+			shared[uplink] = append(shared[uplink], name)
+		}
+		sort.Strings(shared[uplink])
+	}
+	return shared
+}
+
+// physicalDevice follows the parent links of a stacked device down to the physical device, if any.
+func physicalDevice(link netlink.Link, byIndex map[int]netlink.Link) netlink.Link {
+	for i := 0; i < maxLinkStackDepth && link != nil; i++ {
+		if _, ok := link.(*netlink.Device); ok {
+			return link
+		}
+		link = byIndex[link.Attrs().ParentIndex]
+	}
+	return nil
+}
+
+// hasPhysicalUplink reports whether a port of the bridge with the given ifindex is, or is stacked
+// on, a physical device or a bond with a physical slave. Virtual ports like veth and tap devices
+// don't count.
+func hasPhysicalUplink(links []netlink.Link, bridgeIndex int) bool {
+	byIndex := make(map[int]netlink.Link, len(links))
+	for _, link := range links {
+		byIndex[link.Attrs().Index] = link
+	}
+	isPhysicalBond := func(bond netlink.Link) bool {
+		for _, link := range links {
+			if link.Attrs().MasterIndex == bond.Attrs().Index && physicalDevice(link, byIndex) != nil {
+				return true
+			}
+		}
+		return false
+	}
+	for _, port := range links {
+		if port.Attrs().MasterIndex != bridgeIndex {
+			continue
+		}
+		for link, i := port, 0; i < maxLinkStackDepth && link != nil; i++ {
+			if _, ok := link.(*netlink.Device); ok {
+				return true
+			}
+			if isBond(link) && isPhysicalBond(link) {
+				return true
+			}
+			link = byIndex[link.Attrs().ParentIndex]
+		}
+	}
+	return false
+}
+
+// bridgeUplinks returns the physical devices backing ports of the bridge with the given ifindex.
+func bridgeUplinks(links []netlink.Link, bridgeIndex int) []netlink.Link {
+	byIndex := make(map[int]netlink.Link, len(links))
+	for _, link := range links {
+		byIndex[link.Attrs().Index] = link
+	}
+	var uplinks []netlink.Link
+	for _, link := range links {
+		if link.Attrs().MasterIndex != bridgeIndex {
+			continue
+		}
+		if uplink := physicalDevice(link, byIndex); uplink != nil {
+			uplinks = append(uplinks, uplink)
+		}
+	}
+	return uplinks
+}
+
+// numaTopology returns the NUMA nodes of the uplinks as read from sysfs, nil when none is known,
+// e.g. for bridges with virtual ports only.
+func numaTopology(uplinks []netlink.Link) *pluginapi.TopologyInfo {
+	nodes := map[int64]bool{}
+	for _, uplink := range uplinks {
+		raw, err := os.ReadFile(filepath.Join(sysfsNetPath, uplink.Attrs().Name, "device", "numa_node"))
+		if err != nil {
+			continue
+		}
+		// -1 is reported when the platform has no NUMA information
+		node, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+		if err != nil || node < 0 {
+			continue
+		}
+		nodes[node] = true
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	topology := &pluginapi.TopologyInfo{}
+	for node := range nodes {
+		topology.Nodes = append(topology.Nodes, &pluginapi.NUMANode{ID: node})
+	}
+	sort.Slice(topology.Nodes, func(i, j int) bool {
+		return topology.Nodes[i].ID < topology.Nodes[j].ID
+	})
+	return topology
+}
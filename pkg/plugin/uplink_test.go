@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// testLink returns a link with the given index, name, master and parent ifindexes.
+func testLink(link netlink.Link, index int, name string, master, parent int) netlink.Link {
+	attrs := link.Attrs()
+	attrs.Index, attrs.Name, attrs.MasterIndex, attrs.ParentIndex = index, name, master, parent
+	return link
+}
+
+func TestFindSharedUplinks(t *testing.T) {
+	br0 := testLink(&netlink.Bridge{}, 1, "br0", 0, 0)
+	br1 := testLink(&netlink.Bridge{}, 2, "br1", 0, 0)
+	br2 := testLink(&netlink.Bridge{}, 3, "br2", 0, 0)
+	eth0 := func(master int) netlink.Link { return testLink(&netlink.Device{}, 10, "eth0", master, 0) }
+	eth1 := testLink(&netlink.Device{}, 11, "eth1", 2, 0)
+	vlan := func(master int) netlink.Link { return testLink(&netlink.Vlan{}, 20, "eth0.100", master, 10) }
+	veth := func(index, master int) netlink.Link { return testLink(&netlink.Veth{}, index, "veth", master, 0) }
+
+	tests := []struct {
+		name     string
+		links    []netlink.Link
+		bridges  map[string]bool
+		expected map[string][]string
+	}{
+		{
+			name:     "separate uplinks",
+			links:    []netlink.Link{br0, br1, eth0(1), eth1},
+			bridges:  map[string]bool{"br0": true, "br1": true},
+			expected: map[string][]string{},
+		},
+		{
+			name:     "vlan on the uplink of another bridge",
+			links:    []netlink.Link{br0, br1, br2, eth0(1), vlan(2)},
+			bridges:  map[string]bool{"br0": true, "br1": true},
+			expected: map[string][]string{"eth0": {"br0", "br1"}},
+		},
+		{
+			name:     "unmanaged bridges don't count",
+			links:    []netlink.Link{br0, br1, eth0(1), vlan(2)},
+			bridges:  map[string]bool{"br0": true},
+			expected: map[string][]string{},
+		},
+		{
+			name:     "virtual ports have no uplink",
+			links:    []netlink.Link{br0, br1, veth(30, 1), veth(31, 2)},
+			bridges:  map[string]bool{"br0": true, "br1": true},
+			expected: map[string][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shared := findSharedUplinks(tt.links, tt.bridges)
+			if !reflect.DeepEqual(shared, tt.expected) {
+				t.Errorf("got %v, expected %v", shared, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package plugin
+
+import (
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"kubevirt.io/client-go/log"
+)
+
+func isVLAN(link netlink.Link) bool {
+	_, ok := link.(*netlink.Vlan)
+	return ok
+}
+
+// vlanResourceName turns a VLAN sub-interface name like eth0.100 into eth0-100. A bridge with
+// that name would get the same resource, the controller serves the first one and warns.
+func vlanResourceName(name string) string {
+	return strings.ReplaceAll(name, ".", "-")
+}
+
+// trackParent follows the carrier of the parent of a VLAN sub-interface, a VLAN is only
+// healthy while its parent passes traffic.
+func (dpi *BridgeDevicePlugin) trackParent(link netlink.Link) {
+	dpi.parentIndex = link.Attrs().ParentIndex
+	parent, err := dpi.links.LinkByIndex(dpi.parentIndex)
+	if err != nil {
+		log.DefaultLogger().Reason(err).Warningf("could not look up the parent of VLAN %s", dpi.deviceName)
+		dpi.parentUp = false
+		return
+	}
+	dpi.parentUp = portUp(parent.Attrs())
+}
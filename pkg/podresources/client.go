@@ -0,0 +1,93 @@
+// Package podresources reads device allocations from the kubelet PodResources API.
+package podresources
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	// DefaultSocket is the PodResources socket of a kubelet with the default root directory.
+	DefaultSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+	// maxMessageSize matches kubelet's own limit, nodes with many pods exceed the gRPC default.
+	maxMessageSize = 16 * 1024 * 1024
+)
+
+// Allocation is the set of devices of one resource allocated to a container.
+type Allocation struct {
+	Namespace    string   `json:"namespace"`
+	Pod          string   `json:"pod"`
+	Container    string   `json:"container"`
+	ResourceName string   `json:"resourceName"`
+	DeviceIDs    []string `json:"deviceIDs"`
+}
+
+// Client lists allocations through the kubelet PodResources socket.
+type Client struct {
+	conn   *grpc.ClientConn
+	lister podresourcesapi.PodResourcesListerClient
+}
+
+// NewClient creates a client of the PodResources socket, the connection is established lazily.
+func NewClient(socketPath string) (*Client, error) {
+	conn, err := grpc.NewClient("unix://"+socketPath,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMessageSize)))
+	if err != nil {
+		return nil, fmt.Errorf("could not create a client of %s: %v", socketPath, err)
+	}
+	return &Client{conn: conn, lister: podresourcesapi.NewPodResourcesListerClient(conn)}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// List returns the allocations of the resources under the resource namespace, e.g.
+// bridge.network.kubevirt.io, ordered by pod, container and resource.
+func (c *Client) List(ctx context.Context, resourceNamespace string) ([]Allocation, error) {
+	resp, err := c.lister.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list pod resources: %v", err)
+	}
+
+	prefix := resourceNamespace + "/"
+	var ret []Allocation
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, devices := range container.GetDevices() {
+				if !strings.HasPrefix(devices.GetResourceName(), prefix) || len(devices.GetDeviceIds()) == 0 {
+					continue
+				}
+				ret = append(ret, Allocation{
+					Namespace:    pod.GetNamespace(),
+					Pod:          pod.GetName(),
+					Container:    container.GetName(),
+					ResourceName: devices.GetResourceName(),
+					DeviceIDs:    append([]string{}, devices.GetDeviceIds()...),
+				})
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Pod != b.Pod {
+			return a.Pod < b.Pod
+		}
+		if a.Container != b.Container {
+			return a.Container < b.Container
+		}
+		return a.ResourceName < b.ResourceName
+	})
+	return ret, nil
+}
@@ -0,0 +1,123 @@
+package podresources
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Acedus/bridge-marker-dp/pkg/metrics"
+	"github.com/Acedus/bridge-marker-dp/pkg/plugin"
+	"kubevirt.io/client-go/log"
+)
+
+var devicesAllocatedMetric = metrics.Default.NewGaugeVec("bridge_marker_devices_allocated",
+	"The number of devices of the bridge allocated to containers, as listed by the kubelet PodResources API.", "bridge")
+
+// Poller counts the allocated devices of every bridge through the PodResources API and exports
+// them as the bridge_marker_devices_allocated metric.
+type Poller struct {
+	client   *Client
+	prefix   string
+	interval time.Duration
+	// status returns the plugins of the controller, it maps resources to their bridge
+	status func() []plugin.DeviceStatus
+
+	// reported are the bridges the metric was set for
+	reported map[string]bool
+}
+
+// NewPoller creates a poller of the PodResources socket, status is usually the Status method of
+// the controller.
+func NewPoller(socketPath, resourceNamespace string, interval time.Duration, status func() []plugin.DeviceStatus) (*Poller, error) {
+	client, err := NewClient(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Poller{
+		client:   client,
+		prefix:   resourceNamespace + "/",
+		interval: interval,
+		status:   status,
+		reported: map[string]bool{},
+	}, nil
+}
+
+// Run counts the allocations every interval until ctx is done. Failures, e.g. a missing socket,
+// are logged and clear the metric, they don't affect the plugins.
+func (p *Poller) Run(ctx context.Context) {
+	logger := log.DefaultLogger()
+	defer p.client.Close()
+	defer p.clear()
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	failing := false
+
+	for {
+		err := p.poll(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err != nil && !failing:
+			logger.Reason(err).Warningf("could not count the allocated bridge devices, retrying every %v", p.interval)
+		case err != nil:
+			logger.Reason(err).V(4).Info("could not count the allocated bridge devices")
+		case failing:
+			logger.Info("counting the allocated bridge devices recovered")
+		}
+		failing = err != nil
+		if err != nil {
+			p.clear()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Poller) poll(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+	allocations, err := p.client.List(ctx, strings.TrimSuffix(p.prefix, "/"))
+	if err != nil {
+		return err
+	}
+
+	// Served bridges are reported even without allocations
+	bridges := map[string]string{}
+	counts := map[string]int{}
+	for _, status := range p.status() {
+		bridges[status.ResourceName] = status.BridgeName
+		counts[status.BridgeName] = 0
+	}
+	for _, allocation := range allocations {
+		bridge, ok := bridges[allocation.ResourceName]
+		if !ok {
+			// The plugin is gone while pods still hold its devices
+			bridge = strings.TrimPrefix(allocation.ResourceName, p.prefix)
+		}
+		counts[bridge] += len(allocation.DeviceIDs)
+	}
+
+	for bridge := range p.reported {
+		if _, ok := counts[bridge]; !ok {
+			devicesAllocatedMetric.Delete(bridge)
+			delete(p.reported, bridge)
+		}
+	}
+	for bridge, count := range counts {
+		devicesAllocatedMetric.Set(float64(count), bridge)
+		p.reported[bridge] = true
+	}
+	return nil
+}
+
+func (p *Poller) clear() {
+	for bridge := range p.reported {
+		devicesAllocatedMetric.Delete(bridge)
+	}
+	p.reported = map[string]bool{}
+}